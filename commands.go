@@ -0,0 +1,994 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"github.com/besrabasant/k10ls/internal"
+)
+
+// commands maps subcommand names to their implementation. Running k10ls
+// without a subcommand starts the configured forwards.
+var commands = map[string]func(args []string) error{
+	"add":         addCommand,
+	"api":         apiCommand,
+	"completion":  completionCommand,
+	"contexts":    contextsCommand,
+	"crashes":     crashesCommand,
+	"forward":     forwardCommand,
+	"up":          upCommand,
+	"down":        downCommand,
+	"restart":     restartCommand,
+	"reload":      reloadCommand,
+	"replay":      replayCommand,
+	"run":         runCommand,
+	"schema":      schemaCommand,
+	"plan":        planCommand,
+	"pick":        pickCommand,
+	"ports":       portsCommand,
+	"logs":        logsCommand,
+	"downtime":    downtimeCommand,
+	"env":         envCommand,
+	"gc":          gcCommand,
+	"gateway":     gatewayCommand,
+	"list":        listCommand,
+	"self-update": selfUpdateCommand,
+	"selftest":    selftestCommand,
+	"status":      statusCommand,
+	"stop":        stopCommand,
+	"trust":       trustCommand,
+	"validate":    validateCommand,
+	"version":     versionCommand,
+}
+
+// controlSocketPath returns the control socket configured in configFile,
+// falling back to the default path.
+func controlSocketPath(configFile string) string {
+	// The config piped to a running instance can't be read again.
+	if configFile == internal.StdinConfig {
+		return internal.DefaultControlSocket()
+	}
+	if config, err := internal.ReadConfig(configFile); err == nil && config.ControlSocket != "" {
+		return config.ControlSocket
+	}
+	return internal.DefaultControlSocket()
+}
+
+// portsCommand prints the local ports bound by the running instance.
+func portsCommand(args []string) error {
+	fs := flag.NewFlagSet("ports", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	_ = fs.Parse(args)
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "ports"})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	for _, p := range resp.Ports {
+		state := ""
+		if p.Offset != 0 {
+			state += fmt.Sprintf("\t(offset %+d)", p.Offset)
+		}
+		if !p.Ready {
+			state += "\t(connecting)"
+		}
+		fmt.Fprintf(w, "%s\t→ %s/%s/%s:%s%s\n", p.Local, p.Context, p.Namespace, p.Entry, p.Port, state)
+	}
+	return w.Flush()
+}
+
+// envCommand prints shell commands setting environment variables that
+// point at the ready forwards of the running instance, or spawns a
+// subshell with them set.
+func envCommand(args []string) error {
+	fs := flag.NewFlagSet("env", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	shell := fs.String("shell", "bash", "Shell to print the variables for: bash, fish or powershell")
+	subshell := fs.Bool("subshell", false, "Spawn a subshell with the variables set instead of printing them")
+	_ = fs.Parse(args)
+
+	// Checked before asking the instance, so a typo doesn't wait on it.
+	name, err := internal.ShellCommand(*shell)
+	if err != nil {
+		return err
+	}
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "ports"})
+	if err != nil {
+		return err
+	}
+	env := internal.PortEnv(resp.Ports)
+
+	if !*subshell {
+		script, err := internal.ShellEnv(*shell, env)
+		if err != nil {
+			return err
+		}
+		fmt.Print(script)
+		switch *shell {
+		case "fish":
+			fmt.Println("# To configure your shell, run: k10ls env --shell fish | source")
+		case "powershell":
+			fmt.Println("# To configure your shell, run: k10ls env --shell powershell | Invoke-Expression")
+		default:
+			fmt.Println("# To configure your shell, run: eval \"$(k10ls env)\"")
+		}
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Starting %s with %d forward variables set, exit to leave\n", name, len(env))
+	cmd := exec.Command(name)
+	cmd.Env = append(append(os.Environ(), env...), "K10LS_SUBSHELL=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
+
+// contextsCommand probes the API server of every configured context in
+// parallel and reports which ones are reachable.
+func contextsCommand(args []string) error {
+	fs := flag.NewFlagSet("contexts", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for each API server")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	probes := internal.ProbeContexts(context.Background(), config, *timeout)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTEXT\tSERVER\tVERSION\tLATENCY\tAUTH\tSTATUS")
+	failed := 0
+	for _, p := range probes {
+		status := "ok"
+		if p.Error != "" {
+			status = p.Error
+		}
+		if !p.OK() {
+			failed++
+		}
+		latency := "-"
+		if p.Latency > 0 {
+			latency = p.Latency.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", p.Context, p.Server, p.Version, latency, p.Auth, status)
+	}
+	_ = w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d contexts are not usable", failed, len(probes))
+	}
+	return nil
+}
+
+// validateCommand checks the config file without connecting to any
+// cluster, printing every problem with its location. It exits with status
+// 1 if there are any errors; lint warnings alone don't fail it.
+func validateCommand(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	lint := fs.Bool("lint", false, "Also warn about entries that are likely mistakes")
+	_ = fs.Parse(args)
+
+	problems := internal.CheckConfig(*configFile, *env, *lint)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if internal.HasErrors(problems) {
+		os.Exit(1)
+	}
+	if len(problems) > 0 {
+		return nil
+	}
+	name := *configFile
+	if name == internal.StdinConfig {
+		name = "stdin"
+	}
+	fmt.Printf("%s: no problems found\n", name)
+	return nil
+}
+
+// listCommand prints every configured forward and whether the running
+// instance has it connected.
+func listCommand(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	filters := addEntryFilters(fs, "list")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	filters.apply(config)
+	forwards, err := config.Forwards()
+	if err != nil {
+		return err
+	}
+
+	// Without a running instance every forward is listed as stopped.
+	var running map[string][]internal.PortStatus
+	if resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "ports"}); err == nil {
+		running = map[string][]internal.PortStatus{}
+		for _, p := range resp.Ports {
+			running[p.ID] = append(running[p.ID], p)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCONTEXT\tNAMESPACE\tRESOURCE\tPORTS\tADDRESS\tSTATUS")
+	for _, f := range forwards {
+		ports := make([]string, len(f.Ports))
+		for i, p := range f.Ports {
+			ports[i] = p.Source + ":" + p.Target
+			if p.Address != "" {
+				// Like the address:port:port of docker run -p.
+				ports[i] = net.JoinHostPort(p.Address, ports[i])
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.ID, f.Context, f.Namespace, f.Resource,
+			strings.Join(ports, ","), f.Address, forwardState(running, f.ID))
+		delete(running, f.ID)
+	}
+
+	// Whatever is left was found by forward_all_services.
+	ids := make([]string, 0, len(running))
+	for id := range running {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		var address string
+		ports := make([]string, len(running[id]))
+		for i, p := range running[id] {
+			host, port, _ := net.SplitHostPort(p.Local)
+			address, ports[i] = host, port+":"+p.Port
+		}
+		first := running[id][0]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s (discovered)\n", id, first.Context, first.Namespace, first.Entry,
+			strings.Join(ports, ","), address, forwardState(running, id))
+	}
+	return w.Flush()
+}
+
+// forwardState describes the state of the forward with the given ID from
+// the ports of the running instance, nil if none is running.
+func forwardState(running map[string][]internal.PortStatus, id string) string {
+	if running == nil {
+		return "stopped"
+	}
+	ports, ok := running[id]
+	if !ok {
+		return "inactive"
+	}
+	for _, p := range ports {
+		if p.Ready {
+			return "connected"
+		}
+	}
+	return "connecting"
+}
+
+// statusCommand prints the state and counters of every forward of the
+// running instance.
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	selector := fs.String("l", "", "Only show forwards whose labels match this selector, e.g. team=payments")
+	format := fs.String("format", internal.StatusFormatTable, "Output format: table, or starship or tmux for a one-line summary")
+	_ = fs.Parse(args)
+
+	switch *format {
+	case internal.StatusFormatTable:
+	case internal.StatusFormatStarship, internal.StatusFormatTmux:
+		return statusLine(*configFile, *selector, *format)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "status"})
+	if err != nil {
+		return err
+	}
+	forwards := resp.Forwards
+	if *selector != "" {
+		if forwards, err = internal.FilterForwards(forwards, *selector); err != nil {
+			return err
+		}
+	}
+	return internal.WriteStatus(os.Stdout, forwards)
+}
+
+// statusLine prints the one-line status summary for prompts and status
+// bars, or nothing if k10ls isn't running.
+func statusLine(configFile, selector, format string) error {
+	var config *internal.Config
+	if configFile != internal.StdinConfig {
+		config, _ = internal.ReadConfig(configFile)
+	}
+	forwards, err := statusLineForwards(config)
+	if err != nil {
+		return nil
+	}
+	if selector != "" {
+		if forwards, err = internal.FilterForwards(forwards, selector); err != nil {
+			return err
+		}
+	}
+	fmt.Println(internal.StatusLine(forwards, format))
+	return nil
+}
+
+// statusLineForwards returns the forwards of the running instance from the
+// metrics snapshot if config writes one, which is cheaper than asking the
+// instance over its control socket.
+func statusLineForwards(config *internal.Config) ([]internal.ForwardMetrics, error) {
+	if config != nil && config.MetricsSnapshot != nil {
+		if forwards, err := internal.ReadSnapshot(config.MetricsSnapshot); err == nil {
+			return forwards, nil
+		}
+	}
+	socket := internal.DefaultControlSocket()
+	if config != nil && config.ControlSocket != "" {
+		socket = config.ControlSocket
+	}
+	resp, err := internal.SendControl(socket, internal.ControlRequest{Command: "status"})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Forwards, nil
+}
+
+// logsCommand prints the recent diagnostics of the entries of the running
+// instance, optionally limited to the given entries.
+func logsCommand(args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	_ = fs.Parse(args)
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "logs"})
+	if err != nil {
+		return err
+	}
+	for _, l := range resp.Logs {
+		if !matchesEntry(l.ID, l.Entry, fs.Args()) {
+			continue
+		}
+		for _, line := range l.Lines {
+			fmt.Printf("%s %s\n", l.Entry, line)
+		}
+	}
+	return nil
+}
+
+// downtimeCommand prints how long the forwards of the running instance were
+// down while reconnecting, optionally limited to the given entries.
+func downtimeCommand(args []string) error {
+	fs := flag.NewFlagSet("downtime", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	_ = fs.Parse(args)
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "downtime"})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tOUTAGES\tTOTAL\tLONGEST\tHISTOGRAM")
+	for _, d := range resp.Downtime {
+		if !matchesEntry(d.ID, d.Entry, fs.Args()) {
+			continue
+		}
+		buckets := make([]string, len(d.Buckets))
+		for i, n := range d.Buckets {
+			bound := "≤" + d.BucketBounds[i]
+			if d.BucketBounds[i] == "+Inf" {
+				bound = "all"
+			}
+			buckets[i] = fmt.Sprintf("%s:%d", bound, n)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", d.Entry, d.Outages, seconds(d.Total), seconds(d.Longest), strings.Join(buckets, " "))
+	}
+	return w.Flush()
+}
+
+// seconds formats s seconds as a duration rounded to milliseconds.
+func seconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+// matchesEntry reports whether the entry with the given ID and key matches
+// one of refs, given as ID, kind/name or context/namespace/kind/name. No
+// refs match every entry.
+func matchesEntry(id, key string, refs []string) bool {
+	if len(refs) == 0 {
+		return true
+	}
+	for _, ref := range refs {
+		if ref == id || key == ref || strings.HasSuffix(key, "/"+ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// addCommand adds an entry to the config file, optionally from a built-in
+// template.
+func addCommand(args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	contextName := fs.String("context", "", "Context to add the entry to (default: the only context)")
+	template := fs.String("template", "", "Entry template: "+strings.Join(internal.TemplateNames(), ", "))
+	namespace := fs.String("namespace", "", "Namespace of the entry (default: the context's)")
+	portFlag := fs.String("ports", "", "Comma separated local:remote ports, overriding the template's")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls add [flags] svc/<name>|pod/<name>|label/<selector>|deploy/<name>|sts/<name>|rs/<name>|remote/<host>")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	n := internal.NewEntry{Resource: fs.Arg(0), Template: *template, Namespace: *namespace}
+	if *portFlag != "" {
+		for _, p := range strings.Split(*portFlag, ",") {
+			local, remote, ok := strings.Cut(strings.TrimSpace(p), ":")
+			if !ok {
+				local, remote = p, p
+			}
+			n.Ports = append(n.Ports, internal.PortMap{Source: local, Target: remote})
+		}
+	}
+
+	data, err := os.ReadFile(*configFile)
+	if err != nil {
+		return err
+	}
+	if internal.IsJSONConfig(*configFile, data) {
+		return fmt.Errorf("k10ls add only edits TOML config files")
+	}
+	updated, err := internal.AddEntry(data, *contextName, n)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(*configFile)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*configFile, updated, info.Mode().Perm()); err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to %s\n", n.Resource, *configFile)
+	return nil
+}
+
+// forwardCommand runs a single forward given on the command line, without
+// a config file, until interrupted.
+func forwardCommand(args []string) error {
+	fs := flag.NewFlagSet("forward", flag.ExitOnError)
+	kubeConfig := fs.String("kubeconfig", defaultKubeConfig(), "Path to the kubeconfig")
+	contextName := fs.String("context", "", "Kubeconfig context to forward from (default: the current context)")
+	namespace := fs.String("namespace", "", "Namespace of the resource (default: the kubeconfig context's, or \"default\")")
+	fs.StringVar(namespace, "n", "", "Shorthand for -namespace")
+	address := fs.String("address", "127.0.0.1", "Local address to listen on")
+	template := fs.String("template", "", "Entry template: "+strings.Join(internal.TemplateNames(), ", "))
+	record := fs.String("record", "", "Record every log line, including debug ones, to this file for bug reports")
+	chaos := fs.String("chaos", "", "Drop tunnels and fail API requests at random, e.g. drop=2,api_error=0.1")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls forward [flags] svc/<name>|pod/<name>|label/<selector>|deploy/<name>|sts/<name>|rs/<name>|remote/<host> [local:]remote...")
+		printDefaults(fs)
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 || fs.NArg() == 1 && *template == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := recordSession(*record); err != nil {
+		return err
+	}
+	if err := enableChaos(*chaos); err != nil {
+		return err
+	}
+
+	n := internal.NewEntry{Resource: fs.Arg(0), Template: *template, Namespace: *namespace}
+	for _, p := range fs.Args()[1:] {
+		local, remote, ok := strings.Cut(p, ":")
+		if !ok {
+			local, remote = p, p
+		}
+		n.Ports = append(n.Ports, internal.PortMap{Source: local, Target: remote})
+	}
+	config, err := internal.AdHocConfig(*kubeConfig, *contextName, *address, n)
+	if err != nil {
+		return fmt.Errorf("Invalid forward: %v", err)
+	}
+	return runAdHoc(config)
+}
+
+// runAdHoc runs the forwards of config, made by internal.AdHocConfig, until
+// interrupted.
+func runAdHoc(config *internal.Config) error {
+	internal.SetLogColors(config)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	manager := internal.NewManager()
+	if _, err := manager.Apply(config); err != nil {
+		return err
+	}
+	manager.Run(ctx)
+	return nil
+}
+
+// pickCommand lets the user pick a service or pod of the cluster and its
+// ports interactively, then forwards it like forwardCommand, optionally
+// adding it to the config file first.
+func pickCommand(args []string) error {
+	fs := flag.NewFlagSet("pick", flag.ExitOnError)
+	kubeConfig := fs.String("kubeconfig", defaultKubeConfig(), "Path to the kubeconfig")
+	contextName := fs.String("context", "", "Kubeconfig context to pick from (default: the current context)")
+	namespace := fs.String("namespace", "", "Namespace to pick from (default: the kubeconfig context's, or \"default\")")
+	fs.StringVar(namespace, "n", "", "Shorthand for -namespace")
+	address := fs.String("address", "127.0.0.1", "Local address to listen on")
+	save := fs.Bool("save", false, "Add the picked entry to the config file before forwarding")
+	configFile := fs.String("config", "config.toml", "Path to the config file -save adds the entry to")
+	_ = fs.Parse(args)
+
+	if *namespace == "" {
+		*namespace = internal.AdHocNamespace(*kubeConfig, *contextName)
+	}
+	candidates, err := internal.PickCandidates(*kubeConfig, *contextName, *namespace)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no services or running pods in namespace %s", *namespace)
+	}
+	items := make([]string, len(candidates))
+	for i, c := range candidates {
+		items[i] = c.String()
+	}
+	in := bufio.NewReader(os.Stdin)
+	i, err := internal.Pick(in, os.Stderr, "Forward", items)
+	if err != nil {
+		return err
+	}
+	picked := candidates[i]
+
+	n := internal.NewEntry{Resource: picked.Resource, Namespace: *namespace, Ports: picked.Ports}
+	fmt.Fprintf(os.Stderr, "Ports of %s as local:remote [%s]: ", picked.Resource, internal.FormatPorts(picked.Ports, " "))
+	line, _ := in.ReadString('\n')
+	if fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }); len(fields) > 0 {
+		n.Ports = nil
+		for _, p := range fields {
+			local, remote, ok := strings.Cut(p, ":")
+			if !ok {
+				local, remote = p, p
+			}
+			n.Ports = append(n.Ports, internal.PortMap{Source: local, Target: remote})
+		}
+	}
+
+	config, err := internal.AdHocConfig(*kubeConfig, *contextName, *address, n)
+	if err != nil {
+		return fmt.Errorf("Invalid forward: %v", err)
+	}
+	if *save {
+		if err := savePicked(*configFile, *kubeConfig, *contextName, n); err != nil {
+			return err
+		}
+	}
+	command := "k10ls forward"
+	if *contextName != "" {
+		command += " --context " + *contextName
+	}
+	fmt.Fprintf(os.Stderr, "Forwarding, like %s -n %s %s %s\n", command, *namespace, n.Resource, internal.FormatPorts(n.Ports, " "))
+	return runAdHoc(config)
+}
+
+// savePicked adds the entry n picked from the kubeconfig context
+// kubeContext, or the current one if empty, to the config file at path,
+// creating it if needed.
+func savePicked(path, kubeConfig, kubeContext string, n internal.NewEntry) error {
+	if kubeContext == "" {
+		var err error
+		if kubeContext, err = internal.CurrentKubeContext(kubeConfig); err != nil {
+			return err
+		}
+	}
+	data, err := os.ReadFile(path)
+	mode := os.FileMode(0o644)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case internal.IsJSONConfig(path, data):
+		return fmt.Errorf("-save only edits TOML config files")
+	default:
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+	updated, err := internal.AddKubeContextEntry(data, kubeContext, n)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, updated, mode); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Added %s to %s\n", n.Resource, path)
+	return nil
+}
+
+// gatewayCommand prints the Service manifest exposing the forwards in
+// gateway mode.
+func gatewayCommand(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	apply := fs.Bool("apply", false, "Apply the manifest using the in-cluster service account")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	if *apply {
+		return internal.ApplyGatewayService(context.Background(), config)
+	}
+	manifest, err := internal.GatewayManifest(config)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(manifest)
+	return err
+}
+
+// gcCommand removes helper pods left behind by k10ls processes that didn't
+// shut down cleanly.
+func gcCommand(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	all := fs.Bool("all", false, "Remove every helper pod, including those of running k10ls processes and other hosts")
+	dryRun := fs.Bool("dry-run", false, "Only list the helper pods that would be removed")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	helpers, err := internal.CollectGarbage(ctx, config, *all, *dryRun)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTEXT\tNAMESPACE\tPOD\tCOMPONENT\tOWNER\tAGE\tACTION")
+	failed := 0
+	for _, h := range helpers {
+		action := "kept (owner running)"
+		switch {
+		case h.Error != "":
+			action = "failed: " + h.Error
+			failed++
+		case h.Deleted:
+			action = "deleted"
+		case *dryRun && (*all || h.Leaked):
+			action = "would delete"
+		case h.OtherHost:
+			action = "kept (other host)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", h.Context, h.Namespace, h.Name, h.Component, h.Owner,
+			time.Since(h.Created).Round(time.Second), action)
+	}
+	_ = w.Flush()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d helper pods", failed)
+	}
+	return nil
+}
+
+// crashesCommand lists the crash reports written by k10ls, or files or
+// uploads one of them.
+func crashesCommand(args []string) error {
+	fs := flag.NewFlagSet("crashes", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	issue := fs.Bool("issue", false, "Print a URL filing the report as a GitHub issue")
+	upload := fs.String("upload", "", "Upload the report as JSON to this URL")
+	_ = fs.Parse(args)
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	reports, err := internal.ReadCrashReports(config.CrashDir())
+	if err != nil {
+		return err
+	}
+
+	if !*issue && *upload == "" {
+		if len(reports) == 0 {
+			fmt.Println("No crash reports in", config.CrashDir())
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tWHERE\tPANIC\tFILE")
+		for _, r := range reports {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Time.Local().Format(time.DateTime), r.Where, r.Panic, r.Path)
+		}
+		return w.Flush()
+	}
+
+	// Act on the report given as argument, or the latest one.
+	if len(reports) == 0 {
+		return fmt.Errorf("no crash reports in %s", config.CrashDir())
+	}
+	report := reports[0]
+	if fs.NArg() > 0 {
+		found := false
+		for _, r := range reports {
+			if r.Path == fs.Arg(0) || filepath.Base(r.Path) == fs.Arg(0) {
+				report, found = r, true
+			}
+		}
+		if !found {
+			return fmt.Errorf("no crash report %s in %s", fs.Arg(0), config.CrashDir())
+		}
+	}
+	if *upload != "" {
+		if err := internal.UploadCrashReport(*upload, report); err != nil {
+			return err
+		}
+		fmt.Printf("Uploaded %s to %s\n", report.Path, *upload)
+	}
+	if *issue {
+		fmt.Println(report.IssueURL())
+	}
+	return nil
+}
+
+// selftestCommand checks that port-forwarding works end to end against a
+// cluster.
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	var opts internal.SelfTestOptions
+	fs.StringVar(&opts.Context, "context", "", "Kubeconfig context to test (default: current context)")
+	fs.StringVar(&opts.KubeConfigPath, "kubeconfig", defaultKubeConfig(), "Path to the kubeconfig")
+	fs.StringVar(&opts.Namespace, "namespace", "default", "Namespace to run the echo pod in")
+	fs.StringVar(&opts.Pod, "pod", "", "Existing echo pod to use instead of creating one")
+	fs.StringVar(&opts.Port, "port", "", "Port of the existing echo pod")
+	fs.StringVar(&opts.Image, "image", "alpine/socat", "Image of the echo pod")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := internal.SelfTest(ctx, opts, os.Stdout); err != nil {
+		return fmt.Errorf("selftest failed: %v", err)
+	}
+	fmt.Println("selftest passed")
+	return nil
+}
+
+// replayCommand sends the requests of a HAR recording to another target,
+// or prints a session recorded with -record.
+func replayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls replay -har file -target url [flags]")
+		fmt.Fprintln(fs.Output(), "       k10ls replay [-level level] session.jsonl")
+		fs.PrintDefaults()
+	}
+	har := fs.String("har", "", "HAR file to replay, e.g. one written by record_har")
+	target := fs.String("target", "", "Base URL to send the requests to, e.g. http://localhost:8081")
+	filter := fs.String("filter", "", "Only replay requests whose URL contains this string")
+	level := fs.String("level", "debug", "Only print session events at or above this level")
+	_ = fs.Parse(args)
+
+	if *har == "" && fs.NArg() == 1 {
+		return internal.ReplaySession(fs.Arg(0), *level, os.Stdout)
+	}
+	if *har == "" || *target == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	err := internal.ReplayHAR(*har, *target, *filter, w)
+	_ = w.Flush()
+	return err
+}
+
+// apiCommand serves dashboards and plugins: it prints the endpoints of the
+// running instance as JSON, opens one of them in the browser or prints a
+// k9s plugin definition doing so.
+func apiCommand(args []string) error {
+	fs := flag.NewFlagSet("api", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls api endpoints|open|k9s-plugin [flags] [kind/name...]")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	kubeContext := fs.String("kube-context", "", "Only include forwards of this kubeconfig or k10ls context")
+	namespace := fs.String("namespace", "", "Only include forwards in this namespace")
+	shortCut := fs.String("shortcut", "Shift-K", "Key of the k9s plugin")
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	_ = fs.Parse(args[1:])
+
+	switch args[0] {
+	case "endpoints", "open":
+	case "k9s-plugin":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		config, err := filepath.Abs(*configFile)
+		if err != nil {
+			return err
+		}
+		fmt.Print(internal.K9sPlugins(exe, []string{"-config", config}, *shortCut))
+		return nil
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "endpoints"})
+	if err != nil {
+		return err
+	}
+	list := internal.EndpointList{APIVersion: internal.APIVersion, Endpoints: []internal.APIEndpoint{}}
+	for _, ep := range resp.Endpoints {
+		if ep.Matches(*kubeContext, *namespace, fs.Args()) {
+			list.Endpoints = append(list.Endpoints, ep)
+		}
+	}
+
+	if args[0] == "endpoints" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(list)
+	}
+	var url string
+	for _, ep := range list.Endpoints {
+		if ep.URL != "" && (url == "" || ep.Ready) {
+			url = ep.URL
+			if ep.Ready {
+				break
+			}
+		}
+	}
+	if url == "" {
+		return fmt.Errorf("no running HTTP forward matches %s", strings.Join(fs.Args(), " "))
+	}
+	return internal.OpenURL(url)
+}
+
+// trustCommand installs the local CA of TLS forwards into the trust
+// stores of this machine, or removes it.
+func trustCommand(args []string) error {
+	fs := flag.NewFlagSet("trust", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls trust install|uninstall")
+	}
+	_ = fs.Parse(args)
+
+	switch fs.Arg(0) {
+	case "install":
+		return internal.TrustInstall()
+	case "uninstall":
+		return internal.TrustUninstall()
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+// schemaCommand prints the JSON Schema of the config format.
+func schemaCommand(args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	_ = fs.Parse(args)
+
+	data, err := json.MarshalIndent(internal.ConfigSchema(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// versionCommand prints the version of this binary.
+func versionCommand(args []string) error {
+	fmt.Println(version)
+	return nil
+}
+
+// selfUpdateCommand replaces this binary with the latest GitHub release.
+func selfUpdateCommand(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", false, "Only check whether a newer release is available")
+	allowDowngrade := fs.Bool("allow-downgrade", false, "Install the latest release even if it is older than this binary")
+	_ = fs.Parse(args)
+
+	result, err := internal.SelfUpdate(context.Background(), version, internal.UpdateOptions{CheckOnly: *check, AllowDowngrade: *allowDowngrade})
+	if err != nil {
+		return err
+	}
+	switch {
+	case result.Updated:
+		fmt.Printf("Updated k10ls %s → %s\n", result.Current, result.Latest)
+	case !result.Newer:
+		fmt.Printf("k10ls %s is up to date (latest release: %s)\n", result.Current, result.Latest)
+	default:
+		fmt.Printf("k10ls %s is available (current: %s)\n", result.Latest, result.Current)
+	}
+	return nil
+}
+
+// planCommand prints what reloading the running instance would change.
+func planCommand(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	exitCode := fs.Bool("detailed-exitcode", false, "Exit with status 2 when there are changes")
+	_ = fs.Parse(args)
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "plan"})
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.Diff)
+	if *exitCode && !resp.Diff.Empty() {
+		os.Exit(2)
+	}
+	return nil
+}
+
+// reloadCommand tells the running instance to reload its configuration and
+// prints what changed.
+func reloadCommand(args []string) error {
+	fs := flag.NewFlagSet("reload", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	_ = fs.Parse(args)
+
+	resp, err := internal.SendControl(controlSocketPath(*configFile), internal.ControlRequest{Command: "reload"})
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.Diff)
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/besrabasant/k10ls/internal"
+)
+
+func init() {
+	// Registered here, as it lists the commands itself.
+	commands["__complete"] = completeCommand
+}
+
+// completionCommand prints the shell completion script for bash, zsh or
+// fish.
+func completionCommand(args []string) error {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: k10ls completion bash|zsh|fish")
+		os.Exit(2)
+	}
+	script, err := internal.CompletionScript(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completeCommand prints the candidates for the last of args, the words
+// typed after k10ls, one per line, for the completion scripts. Anything
+// failing, like an unreachable cluster, just leaves no candidates.
+func completeCommand(args []string) error {
+	for _, candidate := range complete(args) {
+		fmt.Println(candidate)
+	}
+	return nil
+}
+
+// resourceKinds are the kinds of resources k10ls forward takes, completed
+// before their names.
+var resourceKinds = []string{"svc/", "pod/", "deploy/", "sts/", "rs/", "label/", "remote/"}
+
+// complete returns the candidates for the last of args: commands, the
+// values of -context, -namespace, -only, -exclude and -template, and the
+// resource of k10ls forward.
+func complete(args []string) []string {
+	if len(args) == 0 {
+		return nil
+	}
+	cur, words := args[len(args)-1], args[:len(args)-1]
+	if len(words) == 0 && !strings.HasPrefix(cur, "-") {
+		var names []string
+		for name := range commands {
+			if !strings.HasPrefix(name, "__") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return matching(names, cur)
+	}
+
+	command := ""
+	if len(words) > 0 {
+		if _, ok := commands[words[0]]; ok {
+			command, words = words[0], words[1:]
+		}
+	}
+
+	// The flags given before, and the positional arguments. bash passes
+	// -flag=value as three words.
+	flags := map[string]string{}
+	var positional []string
+	for i := 0; i < len(words); i++ {
+		name, ok := flagName(words[i])
+		if !ok {
+			positional = append(positional, words[i])
+			continue
+		}
+		if name, value, ok := strings.Cut(name, "="); ok {
+			flags[name] = value
+			continue
+		}
+		if i+1 < len(words) && words[i+1] == "=" {
+			i++
+		}
+		// Only k10ls forward has positional arguments, and all of its
+		// flags take a value.
+		if i+1 < len(words) && !strings.HasPrefix(words[i+1], "-") {
+			i++
+			flags[name] = words[i]
+		}
+	}
+
+	if name, ok := flagName(cur); ok {
+		if name, value, ok := strings.Cut(name, "="); ok {
+			prefix := strings.TrimSuffix(cur, value)
+			var candidates []string
+			for _, c := range completeFlag(command, name, value, flags) {
+				candidates = append(candidates, prefix+c)
+			}
+			return candidates
+		}
+		return nil
+	}
+	if len(words) > 0 {
+		prev := words[len(words)-1]
+		if prev == "=" && len(words) > 1 {
+			prev = words[len(words)-2]
+		}
+		if name, ok := flagName(prev); ok && !strings.Contains(name, "=") {
+			return completeFlag(command, name, cur, flags)
+		}
+	}
+	if command == "forward" && len(positional) == 0 {
+		return completeResource(flags, cur)
+	}
+	return nil
+}
+
+// flagName returns the name of the flag word sets, with its value if
+// given as -flag=value, and whether it is a flag at all.
+func flagName(word string) (string, bool) {
+	if len(word) < 2 || word[0] != '-' || word == "--" {
+		return "", false
+	}
+	return strings.TrimLeft(word, "-"), true
+}
+
+// completeFlag returns the candidates for the value of the flag name of
+// command. k10ls forward and pick take kubeconfig contexts, the other
+// commands those of the config file.
+func completeFlag(command, name, value string, flags map[string]string) []string {
+	switch name {
+	case "context":
+		if command == "forward" || command == "pick" {
+			names, _ := internal.KubeContextNames(completionKubeConfig(flags))
+			return matching(names, value)
+		}
+		if config := completionConfig(flags); config != nil {
+			return matchingList(config.ContextNames(), value)
+		}
+	case "n", "namespace":
+		if command == "forward" || command == "pick" {
+			names, _ := internal.CompleteNamespaces(completionKubeConfig(flags), flags["context"])
+			return matching(names, value)
+		}
+	case "only", "exclude":
+		if config := completionConfig(flags); config != nil {
+			return matchingList(config.TagNames(), value)
+		}
+	case "template":
+		return matching(internal.TemplateNames(), value)
+	}
+	return nil
+}
+
+// completeResource returns the candidates for the resource of k10ls
+// forward: the kinds, then the resources of that kind in the cluster.
+func completeResource(flags map[string]string, cur string) []string {
+	kind, _, ok := strings.Cut(cur, "/")
+	if !ok {
+		return matching(resourceKinds, cur)
+	}
+	namespace := flags["namespace"]
+	if namespace == "" {
+		namespace = flags["n"]
+	}
+	names, _ := internal.CompleteResources(completionKubeConfig(flags), flags["context"], namespace, kind)
+	return matching(names, cur)
+}
+
+// completionKubeConfig returns the kubeconfig given with -kubeconfig, or
+// the default one.
+func completionKubeConfig(flags map[string]string) string {
+	if path := flags["kubeconfig"]; path != "" {
+		return path
+	}
+	return defaultKubeConfig()
+}
+
+// completionConfig reads the config file given with -config, or
+// config.toml, or returns nil if it can't.
+func completionConfig(flags map[string]string) *internal.Config {
+	path := flags["config"]
+	if path == "" {
+		path = "config.toml"
+	}
+	if path == internal.StdinConfig {
+		return nil
+	}
+	config, err := internal.ReadConfig(path)
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+// matching returns the candidates starting with prefix.
+func matching(candidates []string, prefix string) []string {
+	var out []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// matchingList is matching for the last value of a comma separated list.
+func matchingList(candidates []string, list string) []string {
+	done, last := "", list
+	if i := strings.LastIndex(list, ","); i >= 0 {
+		done, last = list[:i+1], list[i+1:]
+	}
+	var out []string
+	for _, c := range matching(candidates, last) {
+		out = append(out, done+c)
+	}
+	return out
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// InheritSystemdListeners adopts the sockets passed by systemd socket
+// activation (LISTEN_FDS) so entries binding the same address and port
+// serve on them instead of opening their own. It returns the number of
+// adopted sockets.
+func InheritSystemdListeners() (int, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return 0, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return i, fmt.Errorf("failed to adopt systemd socket %s: %v", name, err)
+		}
+		if _, ok := l.(*net.TCPListener); !ok {
+			l.Close()
+			return i, fmt.Errorf("systemd socket %s is not a TCP stream socket", name)
+		}
+
+		key := l.Addr().String()
+		inherited[key] = l
+		logrus.Infof("Adopted systemd socket %s (%s)", name, key)
+	}
+	return count, nil
+}
+
+// claimInherited returns and removes the inherited listener for
+// address:port. Wildcard addresses match any inherited wildcard listener on
+// the same port, since systemd binds "[::]" for a bare ListenStream port.
+// The caller must hold listenersMu.
+func claimInherited(address, port string) (string, net.Listener, bool) {
+	key := net.JoinHostPort(address, port)
+	if l, ok := inherited[key]; ok {
+		delete(inherited, key)
+		return key, l, true
+	}
+
+	if ip := net.ParseIP(address); ip == nil || !ip.IsUnspecified() {
+		return "", nil, false
+	}
+	for k, l := range inherited {
+		host, p, err := net.SplitHostPort(k)
+		if err != nil || p != port {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+			delete(inherited, k)
+			return k, l, true
+		}
+	}
+	return "", nil, false
+}
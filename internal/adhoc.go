@@ -0,0 +1,57 @@
+package internal
+
+import "strings"
+
+// AdHocConfig returns a config forwarding just n, like `k10ls forward`: from
+// the context kubeContext of the kubeconfig at kubeConfig, or its current
+// context if kubeContext is empty, listening on address.
+func AdHocConfig(kubeConfig, kubeContext, address string, n NewEntry) (*Config, error) {
+	kind, name, ok := strings.Cut(n.Resource, "/")
+	if !ok || name == "" {
+		return nil, invalidResource(n.Resource)
+	}
+	opts, err := n.options()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := Context{Name: kubeContext, UseCurrentContext: kubeContext == "", Address: address}
+	switch kind {
+	case kindService, "service":
+		ctx.Svc = []Service{{Name: name, EntryOptions: opts}}
+	case kindPod:
+		ctx.Pods = []Pod{{Name: name, EntryOptions: opts}}
+	case kindLabel:
+		ctx.LabelSelectors = []Selector{{Label: name, EntryOptions: opts}}
+	case kindRemote:
+		ctx.Remotes = []Remote{{Host: name, EntryOptions: opts}}
+	default:
+		workload, ok := workloadKind(kind)
+		if !ok {
+			return nil, invalidResource(n.Resource)
+		}
+		w := []Workload{{Name: name, EntryOptions: opts}}
+		switch workload {
+		case kindDeployment:
+			ctx.Deployments = w
+		case kindStatefulSet:
+			ctx.StatefulSets = w
+		case kindReplicaSet:
+			ctx.ReplicaSets = w
+		}
+	}
+
+	config := &Config{GlobalKubeConfig: kubeConfig, Contexts: []Context{ctx}}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// AdHocNamespace returns the namespace ad-hoc forwards from the kubeconfig
+// context kubeContext, or the current context if empty, use without one
+// given: that of the kubeconfig context, or "default".
+func AdHocNamespace(kubeConfig, kubeContext string) string {
+	ctx := &Context{Name: kubeContext, UseCurrentContext: kubeContext == ""}
+	return ctx.namespace(&Config{GlobalKubeConfig: kubeConfig})
+}
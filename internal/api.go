@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// APIVersion is the version of the JSON documents printed by k10ls api.
+// Within a version fields are only ever added, never renamed or removed,
+// so dashboards and plugins can rely on them.
+const APIVersion = "k10ls.io/v1"
+
+// APIEndpoint is a local port of a running forward, as listed by k10ls api
+// endpoints.
+type APIEndpoint struct {
+	ID      string `json:"id"`
+	Context string `json:"context"`
+	// KubeContext is the kubeconfig context of the forward, empty if it
+	// follows the current context of the kubeconfig.
+	KubeContext string `json:"kube_context,omitempty"`
+	Namespace   string `json:"namespace"`
+	Kind        string `json:"kind"`
+	Name        string `json:"name"`
+	Pod         string `json:"pod"`
+	Port        string `json:"port"`
+	Protocol    string `json:"protocol,omitempty"`
+	// Address is where local clients connect to, URL the address to open
+	// in a browser for HTTP forwards.
+	Address string            `json:"address"`
+	URL     string            `json:"url,omitempty"`
+	Ready   bool              `json:"ready"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// EndpointList is the document printed by k10ls api endpoints.
+type EndpointList struct {
+	APIVersion string        `json:"api_version"`
+	Endpoints  []APIEndpoint `json:"endpoints"`
+}
+
+// apiEndpoints returns the local ports of every running forward, sorted by
+// address.
+func apiEndpoints() []APIEndpoint {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	eps := []APIEndpoint{}
+	for f := range forwards {
+		f.mu.Lock()
+		for i, l := range f.listeners {
+			ep := APIEndpoint{
+				ID:          f.entry.ID,
+				Context:     f.entry.Context,
+				KubeContext: f.entry.KubeContext,
+				Namespace:   f.entry.Namespace,
+				Kind:        f.entry.Kind,
+				Name:        f.entry.Name,
+				Pod:         f.podName,
+				Port:        f.entry.Ports[i].Target,
+				Protocol:    f.entry.Protocol,
+				Address:     scrapeAddress(f.entry.Network, l.Addr()),
+				Ready:       f.tun != nil,
+				Labels:      f.entry.Labels,
+			}
+			ep.URL = localURL(f.entry, ep.Address)
+			eps = append(eps, ep)
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Address < eps[j].Address })
+	return eps
+}
+
+// localURL returns the URL to open in a browser for the local address addr
+// of e, empty unless e forwards HTTP or terminates TLS.
+func localURL(e entry, addr string) string {
+	switch {
+	case e.TLS && e.Protocol != protocolPostgres:
+		return "https://" + addr
+	case e.Protocol == protocolHTTP:
+		return "http://" + addr
+	}
+	return ""
+}
+
+// Matches reports whether ep belongs to the kubeconfig or k10ls context
+// kubeContext, the namespace and one of the resources, each given as
+// kind/name like svc/web or pod/web-0. A pod matches the endpoints
+// forwarding to it whatever their kind. Empty filters match everything,
+// and endpoints following the current context of the kubeconfig match any
+// context.
+func (ep APIEndpoint) Matches(kubeContext, namespace string, resources []string) bool {
+	if kubeContext != "" && ep.KubeContext != "" && ep.KubeContext != kubeContext && ep.Context != kubeContext {
+		return false
+	}
+	if namespace != "" && ep.Namespace != namespace {
+		return false
+	}
+	if len(resources) == 0 {
+		return true
+	}
+	for _, r := range resources {
+		if r == ep.Kind+"/"+ep.Name || (ep.Pod != "" && r == kindPod+"/"+ep.Pod) {
+			return true
+		}
+	}
+	return false
+}
+
+// k9sScopes maps the k9s views a plugin is offered in to the kind of
+// resource they list.
+var k9sScopes = []struct{ scope, kind string }{
+	{"pods", kindPod},
+	{"services", kindService},
+	{"deployments", kindDeployment},
+	{"statefulsets", kindStatefulSet},
+	{"replicasets", kindReplicaSet},
+}
+
+// K9sPlugins returns a k9s plugins.yaml offering shortCut in the views of
+// pods, services and workloads to open the forward of the selected
+// resource, by running exe api open with the given extra arguments.
+func K9sPlugins(exe string, args []string, shortCut string) string {
+	var b strings.Builder
+	b.WriteString("# k9s plugins opening k10ls forwards, generated by k10ls api k9s-plugin.\n")
+	b.WriteString("# Merge into $XDG_CONFIG_HOME/k9s/plugins.yaml.\n")
+	b.WriteString("plugins:\n")
+	for _, s := range k9sScopes {
+		fmt.Fprintf(&b, "  k10ls-open-%s:\n", s.kind)
+		fmt.Fprintf(&b, "    shortCut: %s\n", shortCut)
+		fmt.Fprintf(&b, "    description: Open k10ls forward\n")
+		fmt.Fprintf(&b, "    scopes:\n      - %s\n", s.scope)
+		fmt.Fprintf(&b, "    command: %s\n", yamlQuote(exe))
+		fmt.Fprintf(&b, "    background: true\n")
+		fmt.Fprintf(&b, "    args:\n")
+		pluginArgs := append([]string{"api", "open"}, args...)
+		pluginArgs = append(pluginArgs, "-kube-context", "$CONTEXT", "-namespace", "$NAMESPACE", s.kind+"/$NAME")
+		for _, arg := range pluginArgs {
+			fmt.Fprintf(&b, "      - %s\n", yamlQuote(arg))
+		}
+	}
+	return b.String()
+}
+
+// yamlQuote quotes s as a YAML double-quoted scalar, which supports every
+// escape sequence of Go string literals.
+func yamlQuote(s string) string {
+	return fmt.Sprintf("%q", s)
+}
+
+// OpenURL opens url in the default browser.
+func OpenURL(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to open %s: %v", url, err)
+	}
+	return cmd.Process.Release()
+}
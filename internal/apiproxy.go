@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/rest"
+)
+
+// podProxyConnection is a tunnel connection for networks whose proxies or
+// firewalls refuse both WebSocket and SPDY upgrades. Instead of streams on
+// an upgraded connection, it parses the HTTP requests written to each data
+// stream and sends them to the proxy subresource of the pod, like kubectl
+// proxy does, as plain authenticated requests to the API server. It only
+// carries HTTP/1.x traffic.
+type podProxyConnection struct {
+	client *http.Client
+	// pod is the URL of the pod, the base of its proxy subresource.
+	pod *url.URL
+
+	closeOnce sync.Once
+	closed    chan bool
+
+	mu           sync.Mutex
+	errorStreams map[string]*podProxyErrorStream
+	dataStreams  map[*podProxyStream]bool
+}
+
+// podProxyTunnel returns a connection to the pod of the portforward URL
+// target through its proxy subresource, once the API server answered a
+// request for the pod.
+func podProxyTunnel(ctx context.Context, target *url.URL, cfg *rest.Config) (httpstream.Connection, error) {
+	client, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	pod := *target
+	pod.Path = strings.TrimSuffix(pod.Path, "/portforward")
+	pod.RawPath = ""
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pod.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", pod.Path, resp.Status)
+	}
+
+	return &podProxyConnection{
+		client:       client,
+		pod:          &pod,
+		closed:       make(chan bool),
+		errorStreams: map[string]*podProxyErrorStream{},
+		dataStreams:  map[*podProxyStream]bool{},
+	}, nil
+}
+
+// CreateStream returns a new stream. The data stream of a request starts
+// serving the HTTP requests written to it, reporting failures on the error
+// stream of the same request.
+func (c *podProxyConnection) CreateStream(headers http.Header) (httpstream.Stream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return nil, fmt.Errorf("connection closed")
+	default:
+	}
+
+	requestID := headers.Get(corev1.PortForwardRequestIDHeader)
+	if headers.Get(corev1.StreamType) == corev1.StreamTypeError {
+		s := &podProxyErrorStream{headers: headers, done: make(chan struct{})}
+		c.errorStreams[requestID] = s
+		return s, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &podProxyStream{headers: headers, cancel: cancel}
+	s.requestReader, s.requestWriter = io.Pipe()
+	s.responseReader, s.responseWriter = io.Pipe()
+	c.dataStreams[s] = true
+	go c.serve(ctx, s, headers.Get(corev1.PortHeader), c.errorStreams[requestID])
+	return s, nil
+}
+
+// serve forwards the HTTP requests written to s to port of the pod until
+// the client closes s or a request fails.
+func (c *podProxyConnection) serve(ctx context.Context, s *podProxyStream, port string, errorStream *podProxyErrorStream) {
+	var message string
+	defer func() {
+		s.cancel()
+		s.responseWriter.Close()
+		if errorStream != nil {
+			errorStream.finish(message)
+		}
+	}()
+
+	r := bufio.NewReader(s.requestReader)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				message = fmt.Sprintf("reading request: %v", err)
+			}
+			return
+		}
+		resp, err := c.roundTrip(ctx, req, port)
+		if err != nil {
+			if ctx.Err() == nil {
+				message = err.Error()
+			}
+			return
+		}
+		err = resp.Write(s.responseWriter)
+		resp.Body.Close()
+		// Drain what the pod didn't read of the request body before reading
+		// the next request.
+		_, _ = io.Copy(io.Discard, req.Body)
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// roundTrip sends the request in, read from a local client, to port of the
+// pod and returns the response to write back to the client.
+func (c *podProxyConnection) roundTrip(ctx context.Context, in *http.Request, port string) (*http.Response, error) {
+	target, err := url.Parse(c.pod.String() + ":" + port + "/proxy" + in.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+	out, err := http.NewRequestWithContext(ctx, in.Method, target.String(), in.Body)
+	if err != nil {
+		return nil, err
+	}
+	out.ContentLength = in.ContentLength
+	out.Header = in.Header.Clone()
+	for h := range hopHeaders {
+		out.Header.Del(h)
+	}
+	// The credentials of the context authenticate the request against the
+	// API server, which doesn't pass them on to the pod.
+	out.Header.Del("Authorization")
+
+	resp, err := c.client.Do(out)
+	if err != nil {
+		return nil, err
+	}
+	// The API server may answer over HTTP/2, the local client expects the
+	// protocol it spoke.
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = in.Proto, in.ProtoMajor, in.ProtoMinor
+	for h := range hopHeaders {
+		resp.Header.Del(h)
+	}
+	resp.TransferEncoding = nil
+	if resp.ContentLength < 0 && resp.ProtoAtLeast(1, 1) {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	// HTTP/1.0 clients read bodies of unknown length until the connection
+	// closes.
+	resp.Close = in.Close || (resp.ContentLength < 0 && !resp.ProtoAtLeast(1, 1))
+	return resp, nil
+}
+
+// Close stops every request in flight and closes the connection.
+func (c *podProxyConnection) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		close(c.closed)
+		streams := c.dataStreams
+		c.dataStreams = nil
+		for _, s := range c.errorStreams {
+			s.finish("")
+		}
+		c.errorStreams = nil
+		c.mu.Unlock()
+		for s := range streams {
+			_ = s.Reset()
+		}
+		c.client.CloseIdleConnections()
+	})
+	return nil
+}
+
+// CloseChan is closed once the connection was closed.
+func (c *podProxyConnection) CloseChan() <-chan bool {
+	return c.closed
+}
+
+// SetIdleTimeout does nothing: requests are sent over the pooled HTTP
+// connections of the client.
+func (c *podProxyConnection) SetIdleTimeout(time.Duration) {}
+
+// RemoveStreams forgets streams once they are done with.
+func (c *podProxyConnection) RemoveStreams(streams ...httpstream.Stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range streams {
+		switch s := s.(type) {
+		case *podProxyStream:
+			delete(c.dataStreams, s)
+		case *podProxyErrorStream:
+			delete(c.errorStreams, s.headers.Get(corev1.PortForwardRequestIDHeader))
+		}
+	}
+}
+
+// podProxyStream is a data stream of a podProxyConnection: the client
+// writes requests and reads responses.
+type podProxyStream struct {
+	headers        http.Header
+	cancel         context.CancelFunc
+	requestReader  *io.PipeReader
+	requestWriter  *io.PipeWriter
+	responseReader *io.PipeReader
+	responseWriter *io.PipeWriter
+}
+
+func (s *podProxyStream) Read(p []byte) (int, error) {
+	return s.responseReader.Read(p)
+}
+
+func (s *podProxyStream) Write(p []byte) (int, error) {
+	return s.requestWriter.Write(p)
+}
+
+// Close tells the stream no more requests follow; responses can still be
+// read.
+func (s *podProxyStream) Close() error {
+	return s.requestWriter.Close()
+}
+
+// Reset stops the request in flight and closes both directions.
+func (s *podProxyStream) Reset() error {
+	s.cancel()
+	s.requestWriter.Close()
+	s.responseReader.Close()
+	return nil
+}
+
+func (s *podProxyStream) Headers() http.Header { return s.headers }
+
+func (s *podProxyStream) Identifier() uint32 { return 0 }
+
+// podProxyErrorStream is an error stream of a podProxyConnection. Reading it
+// blocks until the data stream of the request is done and then returns the
+// error of the request, if any.
+type podProxyErrorStream struct {
+	headers http.Header
+	once    sync.Once
+	done    chan struct{}
+	message string
+}
+
+// finish ends the stream with message.
+func (s *podProxyErrorStream) finish(message string) {
+	s.once.Do(func() {
+		s.message = message
+		close(s.done)
+	})
+}
+
+func (s *podProxyErrorStream) Read(p []byte) (int, error) {
+	<-s.done
+	if s.message == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, s.message)
+	s.message = s.message[n:]
+	return n, nil
+}
+
+func (s *podProxyErrorStream) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("error streams are read-only")
+}
+
+// Close does nothing, the client never writes to the error stream.
+func (s *podProxyErrorStream) Close() error { return nil }
+
+func (s *podProxyErrorStream) Reset() error {
+	s.finish("")
+	return nil
+}
+
+func (s *podProxyErrorStream) Headers() http.Header { return s.headers }
+
+func (s *podProxyErrorStream) Identifier() uint32 { return 0 }
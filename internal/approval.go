@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// productionTag is the tag of the entries that need approval, set on the
+// entry itself or on its context.
+const productionTag = "production"
+
+// Defaults of approval settings.
+const (
+	defaultApprovalDuration = time.Hour
+	defaultApprovalTimeout  = 10 * time.Minute
+)
+
+// Approval requires an external hook to approve the entries of a context
+// tagged production before they are forwarded. Access expires after
+// Duration.
+type Approval struct {
+	Exec     string        `toml:"exec,omitempty"`
+	Webhook  string        `toml:"webhook,omitempty"`
+	Duration time.Duration `toml:"duration,omitempty"`
+	Timeout  time.Duration `toml:"timeout,omitempty"`
+}
+
+// approvalRequest is the body posted to approval webhooks.
+type approvalRequest struct {
+	ID        string  `json:"id"`
+	Entry     string  `json:"entry"`
+	Context   string  `json:"context"`
+	Namespace string  `json:"namespace"`
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name"`
+	Duration  float64 `json:"duration_seconds"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// entryApproval returns the approval settings of the entry of ctx with
+// opts, nil unless it is tagged production.
+func entryApproval(ctx *Context, opts EntryOptions) *Approval {
+	if !slices.Contains(ctx.Tags, productionTag) && !slices.Contains(opts.Tags, productionTag) {
+		return nil
+	}
+	return ctx.Approval
+}
+
+// validate checks that exactly one hook is configured.
+func (a *Approval) validate() error {
+	if (a.Exec == "") == (a.Webhook == "") {
+		return fmt.Errorf("approval: set exactly one of exec or webhook")
+	}
+	if a.Duration < 0 || a.Timeout < 0 {
+		return fmt.Errorf("approval: duration and timeout must be positive")
+	}
+	return nil
+}
+
+// duration returns how long an approval is valid.
+func (a *Approval) duration() time.Duration {
+	if a.Duration <= 0 {
+		return defaultApprovalDuration
+	}
+	return a.Duration
+}
+
+// requestApproval asks the approval hook of e for access, returning when
+// it expires. A hook that fails, or doesn't answer within its timeout,
+// denies access.
+func requestApproval(ctx context.Context, e entry) (time.Time, error) {
+	a := e.Approval
+	timeout := a.Timeout
+	if timeout <= 0 {
+		timeout = defaultApprovalTimeout
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	e.log().Infof("Requesting approval to forward %s for %s", e.describe(), a.duration())
+	var err error
+	if a.Exec != "" {
+		err = approveExec(reqCtx, e, a)
+	} else {
+		err = approveWebhook(reqCtx, e, a)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("approval denied: %v", err)
+	}
+
+	expires := time.Now().Add(a.duration())
+	e.log().Infof("Approved to forward %s until %s", e.describe(), expires.Format(time.RFC3339))
+	return expires, nil
+}
+
+// approveExec runs the approval command, which approves by exiting 0.
+func approveExec(ctx context.Context, e entry, a *Approval) error {
+	cmd := hookCommand(ctx, e, a.Exec)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("K10LS_DURATION=%d", int(a.duration().Seconds())))
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		e.log().Infof("Approval hook output: %s", Redact(string(out)))
+	}
+	return err
+}
+
+// approveWebhook posts the request to the approval webhook, which approves
+// by answering with a 2xx status.
+func approveWebhook(ctx context.Context, e entry, a *Approval) error {
+	body, err := json.Marshal(approvalRequest{
+		ID:        e.ID,
+		Entry:     e.Key,
+		Context:   e.KubeContext,
+		Namespace: e.Namespace,
+		Kind:      e.Kind,
+		Name:      e.Name,
+		Duration:  a.duration().Seconds(),
+		Labels:    e.Labels,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AuditRecord describes a single local connection proxied through a
+// forward. One record is appended to the audit log when it closes.
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Client        string    `json:"client"`
+	Local         string    `json:"local"`
+	Context       string    `json:"context"`
+	Namespace     string    `json:"namespace"`
+	ID            string    `json:"id"`
+	Entry         string    `json:"entry"`
+	Pod           string    `json:"pod"`
+	Port          string    `json:"port"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Duration      float64   `json:"duration_seconds"`
+	Error         string    `json:"error,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditPath string
+)
+
+// OpenAuditLog enables the connection audit log, appending to path, or
+// disables it if path is empty. A log open at another path is closed; one
+// open at path already is kept.
+func OpenAuditLog(path string) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if path == auditPath {
+		return nil
+	}
+
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+			return fmt.Errorf("failed to open audit log %s: %v", path, err)
+		}
+	}
+	if auditFile != nil {
+		auditFile.Close()
+	}
+	auditFile, auditPath = f, path
+	return nil
+}
+
+// writeAudit appends rec to the audit log if one is open.
+func writeAudit(rec AuditRecord) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if auditFile == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	_, _ = auditFile.Write(append(b, '\n'))
+}
+
+// countingConn counts the bytes read from and written to a connection,
+// adding them to the traffic of its forward as well.
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	written atomic.Int64
+	stats   *forwardStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	if c.stats != nil {
+		c.stats.bytesSent.Add(int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(int64(n))
+	if c.stats != nil {
+		c.stats.bytesReceived.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// backend is an additional tunnel of a load-balanced forward, to another
+// pod than the main tunnel.
+type backend struct {
+	pod string
+	tun *tunnel
+}
+
+// backendPods returns the pods a load-balanced forward may open tunnels to,
+// ranked like pickPod does.
+func backendPods(ctx context.Context, core coreClient, informer *podInformer, e entry) ([]corev1.Pod, error) {
+	var selectors []string
+	switch e.Kind {
+	case kindService:
+		svc, err := core.getService(ctx, e.Namespace, e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service %s: %w", e.Name, err)
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return nil, fmt.Errorf("%w: %s", errNoSelector, e.Name)
+		}
+		selectors = []string{labels.Set(svc.Spec.Selector).String()}
+	case kindLabel:
+		selectors = []string{e.Name}
+	case kindDeployment, kindStatefulSet, kindReplicaSet:
+		var err error
+		if selectors, err = workloadSelectors(ctx, core, e); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	tiers := topologyTiers(ctx, core, e)
+	for _, selector := range selectors {
+		pods, err := listPods(ctx, core, informer, e, selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods for %s: %w", e.describe(), err)
+		}
+		if ranked := rankPods(pods, e, tiers); len(ranked) > 0 {
+			return ranked, nil
+		}
+	}
+	return nil, nil
+}
+
+// balance keeps tunnels to up to load_balance - 1 pods besides the pod of
+// the main tunnel open until runCtx is cancelled, so waitTunnel can spread
+// new connections across them. Pods are added as they become ready and
+// dropped once they are gone or their tunnel breaks.
+func (f *forward) balance(runCtx context.Context, pods *podInformer) {
+	for runCtx.Err() == nil {
+		f.addBackends(runCtx, pods)
+		sleepContext(runCtx, f.entry.Reconnect.delay())
+	}
+}
+
+// addBackends opens tunnels to pods not forwarded to yet until the forward
+// spreads over load_balance pods or no other ready pod is left.
+func (f *forward) addBackends(runCtx context.Context, pods *podInformer) {
+	missing, used := f.backendSlots()
+	if missing <= 0 {
+		return
+	}
+	core, cfg := f.kube.getCore()
+	candidates, err := backendPods(runCtx, core, pods, f.entry)
+	if err != nil {
+		f.entry.log().Debugf("failed to list pods to balance over: %v", err)
+		return
+	}
+	for _, pod := range candidates {
+		if missing == 0 || runCtx.Err() != nil {
+			return
+		}
+		if used[pod.Name] || f.recentlyFailed(pod.Name) {
+			continue
+		}
+		if !f.kube.acquireStream(runCtx) {
+			return
+		}
+		tun, err := f.kube.dialTunnel(runCtx, core, cfg, f.entry, pod.Name)
+		if err != nil {
+			f.kube.releaseStream()
+			f.podFailed(pod.Name)
+			f.entry.log().Debugf("failed to open tunnel to pod %s to balance over: %v", pod.Name, err)
+			continue
+		}
+		b := &backend{pod: pod.Name, tun: tun}
+		f.mu.Lock()
+		f.backends = append(f.backends, b)
+		f.mu.Unlock()
+		f.entry.log().Infof("Balancing connections over pod %s via %s", pod.Name, tun.transport)
+		go f.keepBackend(runCtx, core, pods, b, pod.UID)
+		missing--
+	}
+}
+
+// keepBackend drops b once its tunnel breaks, its pod is gone, the main
+// tunnel moves to its pod or runCtx is cancelled.
+func (f *forward) keepBackend(runCtx context.Context, core coreClient, pods *podInformer, b *backend, uid types.UID) {
+	gone, stopWatching := watchPod(core, pods, f.entry.Namespace, b.pod, uid)
+	select {
+	case <-runCtx.Done():
+	case <-b.tun.Done():
+	case <-gone:
+	}
+	stopWatching()
+
+	f.mu.Lock()
+	for i, other := range f.backends {
+		if other == b {
+			f.backends = append(f.backends[:i], f.backends[i+1:]...)
+			break
+		}
+	}
+	f.mu.Unlock()
+	b.tun.Close()
+	f.kube.releaseStream()
+}
+
+// backendSlots returns how many more pods the forward should balance over
+// and the pods it already forwards to or keeps on standby. A backend to the
+// pod the main tunnel moved to is closed, to be replaced by one to another
+// pod.
+func (f *forward) backendSlots() (int, map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	used := map[string]bool{f.podName: true}
+	for _, s := range f.standbys {
+		used[s.pod] = true
+	}
+	missing := f.entry.LoadBalance - 1
+	for _, b := range f.backends {
+		if b.pod == f.podName {
+			b.tun.Close()
+			continue
+		}
+		used[b.pod] = true
+		missing--
+	}
+	return missing, used
+}
+
+// recentlyFailed reports whether the pod named name failed within
+// failoverWindow.
+func (f *forward) recentlyFailed(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.failedPods[name]
+	return ok && time.Since(t) <= failoverWindow
+}
+
+// nextTunnel returns the tunnel a new connection goes through: tun, the
+// main tunnel, or for load-balanced forwards each of the tunnels in turn.
+// f.mu must be held.
+func (f *forward) nextTunnel(tun *tunnel) *tunnel {
+	if len(f.backends) == 0 {
+		return tun
+	}
+	i := f.nextBackend % (len(f.backends) + 1)
+	f.nextBackend++
+	if i == 0 {
+		return tun
+	}
+	return f.backends[i-1].tun
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/rest"
+)
+
+// Chaos injects failures to check that reconnecting, failing over and
+// alerting work as configured: it drops tunnels and fails API requests at
+// random. It is enabled with the hidden -chaos flag.
+type Chaos struct {
+	// DropRate is how many times a minute each tunnel is dropped on
+	// average.
+	DropRate float64
+	// APIErrorRate is the share of API requests and tunnel dials that fail.
+	APIErrorRate float64
+	// Seed seeds the random failures, so that a run can be repeated.
+	Seed int64
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+// chaos is the failure injection enabled by EnableChaos, if any.
+var chaos *Chaos
+
+// ParseChaos parses the failure injection settings of the -chaos flag, a
+// comma separated list of drop=<tunnels dropped per minute>,
+// api_error=<share of failing API requests> and seed=<number>, like
+// "drop=2,api_error=0.1".
+func ParseChaos(spec string) (*Chaos, error) {
+	c := &Chaos{Seed: time.Now().UnixNano()}
+	for _, setting := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid chaos setting %q, want key=value", setting)
+		}
+		var err error
+		switch key {
+		case "drop":
+			c.DropRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && c.DropRate < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "api_error":
+			c.APIErrorRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (c.APIErrorRate < 0 || c.APIErrorRate > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		case "seed":
+			c.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos setting %q, want drop, api_error or seed", key)
+		}
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) {
+			err = fmt.Errorf("%q is not a number", value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos setting %s: %v", key, err)
+		}
+	}
+	return c, nil
+}
+
+// EnableChaos injects the failures of c into the forwards started after.
+func EnableChaos(c *Chaos) {
+	c.rand = rand.New(rand.NewSource(c.Seed))
+	chaos = c
+	logrus.Warnf("Chaos mode: dropping each tunnel %g times a minute and failing %g%% of API requests on average (seed %d)", c.DropRate, c.APIErrorRate*100, c.Seed)
+}
+
+// failAPI reports whether to fail the next API request.
+func (c *Chaos) failAPI() bool {
+	if c == nil || c.APIErrorRate == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rand.Float64() < c.APIErrorRate
+}
+
+// dropLater closes tun of e after a random delay, unless it is closed
+// before.
+func (c *Chaos) dropLater(tun *tunnel, e entry, podName string) {
+	if c == nil || c.DropRate == 0 {
+		return
+	}
+	c.mu.Lock()
+	delay := time.Duration(c.rand.ExpFloat64() / c.DropRate * float64(time.Minute))
+	c.mu.Unlock()
+
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-tun.Done():
+		case <-timer.C:
+			e.log().Warnf("Chaos: dropping tunnel to pod %s", podName)
+			tun.Close()
+		}
+	}()
+}
+
+// wrapConfig returns a copy of cfg whose API requests fail at the rate of
+// c, with the response of an unavailable API server.
+func (c *Chaos) wrapConfig(cfg *rest.Config) *rest.Config {
+	if c == nil || c.APIErrorRate == 0 {
+		return cfg
+	}
+	cfg = rest.CopyConfig(cfg)
+	wrap := cfg.WrapTransport
+	cfg.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return &chaosRoundTripper{rt: rt, chaos: c}
+	}
+	return cfg
+}
+
+// chaosStatus is the body of the responses of failed API requests, a
+// Kubernetes Status like the API server sends.
+const chaosStatus = `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"chaos: simulated API error","reason":"ServiceUnavailable","code":503}`
+
+type chaosRoundTripper struct {
+	rt    http.RoundTripper
+	chaos *Chaos
+}
+
+func (c *chaosRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.chaos.failAPI() {
+		return c.rt.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return &http.Response{
+		Status:        "503 Service Unavailable",
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(chaosStatus)),
+		ContentLength: int64(len(chaosStatus)),
+		Request:       req,
+	}, nil
+}
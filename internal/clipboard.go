@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// copyURL copies the local URL of f, or the local address for forwards
+// that aren't HTTP, to the clipboard.
+func (f *forward) copyURL() {
+	f.mu.Lock()
+	if len(f.listeners) == 0 {
+		f.mu.Unlock()
+		return
+	}
+	addr := scrapeAddress(f.entry.Network, f.listeners[0].Addr())
+	f.mu.Unlock()
+
+	text := localURL(f.entry, addr)
+	if text == "" {
+		text = addr
+	}
+	if err := copyToClipboard(text); err != nil {
+		f.entry.log().Warnf("failed to copy %s to the clipboard: %v", text, err)
+		return
+	}
+	f.entry.log().Infof("Copied %s to the clipboard", text)
+}
+
+// copyToClipboard replaces the content of the system clipboard with text.
+func copyToClipboard(text string) error {
+	name, args, err := clipboardCommand()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(text)
+	// xclip and wl-copy keep serving the clipboard in the background, so
+	// their output isn't captured, which would wait for them to exit.
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// clipboardCommand returns the command writing its input to the clipboard:
+// pbcopy on macOS, clip on Windows and wl-copy, xclip or xsel elsewhere.
+func clipboardCommand() (string, []string, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return "pbcopy", nil, nil
+	case "windows":
+		return "clip", nil, nil
+	}
+	var candidates [][]string
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		candidates = append(candidates, []string{"wl-copy"})
+	}
+	candidates = append(candidates,
+		[]string{"xclip", "-selection", "clipboard"},
+		[]string{"xsel", "--clipboard", "--input"},
+	)
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err == nil {
+			return c[0], c[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("no clipboard tool found, install wl-copy, xclip or xsel")
+}
@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// completionTimeout bounds the API requests of shell completion, so that an
+// unreachable cluster doesn't hang the shell.
+const completionTimeout = 3 * time.Second
+
+// Completion scripts for `k10ls completion`. They pass the words typed so
+// far to `k10ls __complete`, which prints the candidates for the last one,
+// one per line, and fall back to file names when there are none.
+var completionScripts = map[string]string{
+	shellBash: `_k10ls() {
+    local IFS=$'\n'
+    COMPREPLY=($(k10ls __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+    if [[ ${#COMPREPLY[@]} -eq 0 ]]; then
+        COMPREPLY=($(compgen -f -- "${COMP_WORDS[COMP_CWORD]}"))
+    elif [[ ${#COMPREPLY[@]} -eq 1 && ${COMPREPLY[0]} == */ ]]; then
+        compopt -o nospace
+    fi
+}
+complete -F _k10ls k10ls
+`,
+	"zsh": `#compdef k10ls
+_k10ls() {
+    local -a candidates
+    local c
+    candidates=("${(@f)$(k10ls __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    candidates=(${candidates:#})
+    if (( ${#candidates} == 0 )); then
+        _files
+        return
+    fi
+    for c in $candidates; do
+        if [[ $c == */ ]]; then
+            compadd -Q -S '' -- $c
+        else
+            compadd -Q -- $c
+        fi
+    done
+}
+compdef _k10ls k10ls
+`,
+	shellFish: `function __k10ls_complete
+    set -l args (commandline -opc)
+    set -e args[1]
+    set -l candidates (k10ls __complete $args (commandline -ct) 2>/dev/null)
+    if test (count $candidates) -eq 0
+        __fish_complete_path (commandline -ct)
+        return
+    end
+    printf '%s\n' $candidates
+end
+complete -c k10ls -f -a '(__k10ls_complete)'
+`,
+}
+
+// CompletionScript returns the completion script for shell: bash, zsh or
+// fish.
+func CompletionScript(shell string) (string, error) {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return "", fmt.Errorf("unsupported shell %q (expected bash, zsh or fish)", shell)
+	}
+	return script, nil
+}
+
+// CurrentKubeContext returns the current context of the kubeconfig at
+// kubeConfig.
+func CurrentKubeContext(kubeConfig string) (string, error) {
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(kubeConfig), &clientcmd.ConfigOverrides{}).RawConfig()
+	if err != nil {
+		return "", err
+	}
+	if raw.CurrentContext == "" {
+		return "", fmt.Errorf("no current context in %s", kubeConfig)
+	}
+	return raw.CurrentContext, nil
+}
+
+// KubeContextNames returns the names of the contexts of the kubeconfig at
+// kubeConfig, sorted.
+func KubeContextNames(kubeConfig string) ([]string, error) {
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(kubeConfig), &clientcmd.ConfigOverrides{}).RawConfig()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(raw.Contexts))
+	for name := range raw.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// listingClient returns a client for the kubeconfig context kubeContext,
+// or the current context if empty, whose requests give up after timeout.
+func listingClient(kubeConfig, kubeContext string, timeout time.Duration) (*kubernetes.Clientset, error) {
+	cfg, err := loadRESTConfig(kubeContext, "", kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Timeout = timeout
+	clientset, _, err := newClientset(cfg)
+	return clientset, err
+}
+
+// CompleteNamespaces returns the names of the namespaces of the kubeconfig
+// context kubeContext, or the current context if empty.
+func CompleteNamespaces(kubeConfig, kubeContext string) ([]string, error) {
+	clientset, err := listingClient(kubeConfig, kubeContext, completionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	list, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, ns := range list.Items {
+		names = append(names, ns.Name)
+	}
+	return names, nil
+}
+
+// CompleteResources returns the services, pods or workloads, as kind says,
+// of namespace in the kubeconfig context kubeContext, or the current
+// context if empty, as "<kind>/<name>". Without a namespace, that of the
+// kubeconfig context is used, like for entries.
+func CompleteResources(kubeConfig, kubeContext, namespace, kind string) ([]string, error) {
+	if namespace == "" {
+		namespace = AdHocNamespace(kubeConfig, kubeContext)
+	}
+	clientset, err := listingClient(kubeConfig, kubeContext, completionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+
+	var names []string
+	opts := metav1.ListOptions{}
+	switch kind {
+	case kindService, "service":
+		list, err := clientset.CoreV1().Services(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range list.Items {
+			names = append(names, kind+"/"+s.Name)
+		}
+	case kindPod:
+		list, err := clientset.CoreV1().Pods(namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range list.Items {
+			names = append(names, kind+"/"+p.Name)
+		}
+	default:
+		workload, ok := workloadKind(kind)
+		if !ok {
+			return nil, nil
+		}
+		apps := clientset.AppsV1()
+		switch workload {
+		case kindDeployment:
+			list, err := apps.Deployments(namespace).List(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range list.Items {
+				names = append(names, kind+"/"+d.Name)
+			}
+		case kindStatefulSet:
+			list, err := apps.StatefulSets(namespace).List(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range list.Items {
+				names = append(names, kind+"/"+s.Name)
+			}
+		case kindReplicaSet:
+			list, err := apps.ReplicaSets(namespace).List(ctx, opts)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range list.Items {
+				names = append(names, kind+"/"+r.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// TagNames returns the tags of the contexts and entries of c, sorted.
+func (c *Config) TagNames() []string {
+	var tags []string
+	for i := range c.Contexts {
+		tags = append(tags, c.Contexts[i].Tags...)
+		for _, ce := range checkedEntries(&c.Contexts[i]) {
+			tags = append(tags, ce.opts.Tags...)
+		}
+	}
+	sort.Strings(tags)
+	return slices.Compact(tags)
+}
+
+// ContextNames returns the names the -context filter matches contexts of c
+// by, their alias or their name in the kubeconfig, sorted.
+func (c *Config) ContextNames() []string {
+	var names []string
+	for i := range c.Contexts {
+		names = append(names, c.Contexts[i].displayName())
+		if c.Contexts[i].Name != "" {
+			names = append(names, c.Contexts[i].Name)
+		}
+	}
+	sort.Strings(names)
+	return slices.Compact(names)
+}
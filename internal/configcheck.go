@@ -0,0 +1,506 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Problem is a problem CheckConfig found in a config file, at Location if
+// it could be pinned down. A Warning is a lint finding rather than an error.
+type Problem struct {
+	File string
+	Location
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	message := p.Message
+	if p.Warning {
+		message = "warning: " + message
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.File, message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Column, message)
+}
+
+// CheckConfig checks the config file at path and the files it includes
+// without connecting to any cluster. It reports syntax errors, unknown
+// keys, entries missing their name or ports, malformed port numbers,
+// invalid entry options and duplicate entries with their line and column
+// in TOML files, and then the problems Validate finds in the whole config
+// with the environment overlay env applied, if any. Problems of an entry
+// Validate finds are reported at the entry unless it has errors already.
+// With lint it also warns
+// about entries that work but are likely mistakes, see lintEntry.
+func CheckConfig(path, env string, lint bool) []Problem {
+	c := &configChecker{seen: map[string]bool{}, ids: map[string]string{}, entries: map[string]checkedLocation{},
+		lint: lint, targets: map[string]string{}}
+	c.checkFile(path, true)
+	if c.failed {
+		return c.problems
+	}
+
+	merged, err := ReadConfig(path)
+	if err != nil {
+		// Reading the config fails for some of the problems reported
+		// already.
+		if len(c.problems) == 0 {
+			c.add(path, Location{}, err.Error())
+		}
+		return c.problems
+	}
+	for _, f := range c.files {
+		c.checkEntries(f, merged)
+	}
+
+	if env != "" {
+		if err := merged.ApplyEnv(env); err != nil {
+			c.add(path, Location{}, err.Error())
+			return c.problems
+		}
+	}
+	if err := merged.ApplyGateway(); err != nil {
+		c.add(path, Location{}, err.Error())
+		return c.problems
+	}
+	for _, p := range merged.validate() {
+		if c.reported(p.message) {
+			continue
+		}
+		key := entryKey(p.context, p.resource)
+		if at, ok := c.entries[key]; ok && p.resource != "" {
+			if !at.failed {
+				c.add(at.file, at.loc, p.message)
+			}
+			continue
+		}
+		c.add(path, Location{}, p.message)
+	}
+	return c.problems
+}
+
+// reported reports whether a problem with message was reported already.
+func (c *configChecker) reported(message string) bool {
+	for _, p := range c.problems {
+		if p.Message == message {
+			return true
+		}
+	}
+	return false
+}
+
+// HasErrors reports whether problems has other problems than warnings.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if !p.Warning {
+			return true
+		}
+	}
+	return false
+}
+
+// checkedFile is a config file read by a configChecker. loc is nil for JSON
+// files.
+type checkedFile struct {
+	path   string
+	config *Config
+	loc    *tomlLocator
+}
+
+// configChecker collects the problems of a config file and the files it
+// includes.
+type configChecker struct {
+	problems []Problem
+	// failed is set once a file couldn't be read or decoded.
+	failed bool
+	files  []checkedFile
+	seen   map[string]bool
+	// ids maps the IDs of the entries checked so far to where they are
+	// defined.
+	ids map[string]string
+
+	// lint enables the warnings of lintEntry. targets maps the pod ports
+	// forwarded to so far to the entry forwarding them.
+	lint    bool
+	targets map[string]string
+
+	// entries maps the entries checked so far, by entryKey, to where they
+	// are defined.
+	entries map[string]checkedLocation
+}
+
+// checkedLocation is where an entry is defined and whether errors were
+// reported for it already.
+type checkedLocation struct {
+	file   string
+	loc    Location
+	failed bool
+}
+
+// entryKey identifies the entry resource of the context named context.
+func entryKey(context, resource string) string {
+	return context + "\x00" + resource
+}
+
+func (c *configChecker) add(path string, loc Location, message string) {
+	c.addProblem(Problem{File: path, Location: loc, Message: message})
+}
+
+func (c *configChecker) addProblem(p Problem) {
+	if p.File == StdinConfig {
+		p.File = "stdin"
+	}
+	c.problems = append(c.problems, p)
+}
+
+// checkFile decodes the config file at path, reporting syntax errors and
+// unknown keys, and then checks the files it includes.
+func (c *configChecker) checkFile(path string, main bool) {
+	if abs, err := filepath.Abs(path); err == nil && path != StdinConfig {
+		if c.seen[abs] {
+			return
+		}
+		c.seen[abs] = true
+	}
+	data, err := readConfigData(path)
+	if err != nil {
+		c.add(path, Location{}, err.Error())
+		c.failed = true
+		return
+	}
+
+	f := checkedFile{path: path}
+	var md toml.MetaData
+	if IsJSONConfig(path, data) {
+		if f.config, md, err = decodeConfig(path, data); err != nil {
+			c.add(path, Location{}, err.Error())
+			c.failed = true
+			return
+		}
+		for _, key := range md.Undecoded() {
+			c.add(path, Location{}, fmt.Sprintf("unknown key %q", key.String()))
+		}
+	} else {
+		f.loc = locateTOML(string(data))
+		if f.config, md, err = decodeConfig(path, data); err != nil {
+			loc, message := f.loc.decodeError(err)
+			c.add(path, loc, message)
+			c.failed = true
+			return
+		}
+		for _, key := range f.loc.unknownKeys(reflect.TypeOf(Config{})) {
+			loc, _ := f.loc.locate(key)
+			c.add(path, loc, unknownKeyMessage(key))
+		}
+	}
+	if !main {
+		for _, key := range md.Keys() {
+			if len(key) == 1 && !includableKeys[key[0]] {
+				loc, _ := f.locate(key[0])
+				c.add(path, loc, fmt.Sprintf("%s can only be set in the main config file", key[0]))
+			}
+		}
+	}
+	if err := f.config.expandEnv(); err != nil {
+		c.add(path, Location{}, err.Error())
+		c.failed = true
+		return
+	}
+	c.files = append(c.files, f)
+
+	dir := "."
+	if path != StdinConfig {
+		dir = filepath.Dir(path)
+	}
+	paths, err := includePaths(dir, f.config.Include)
+	if err != nil {
+		loc, _ := f.locate("include")
+		c.add(path, loc, err.Error())
+		c.failed = true
+		return
+	}
+	for _, included := range paths {
+		c.checkFile(included, false)
+	}
+}
+
+// locate returns where path is defined in f, if f is a TOML file.
+func (f checkedFile) locate(path string) (Location, bool) {
+	if f.loc == nil {
+		return Location{}, false
+	}
+	return f.loc.locate(path)
+}
+
+// locateKey returns where key of the table at path is defined in f,
+// falling back to where the table is.
+func (f checkedFile) locateKey(path, key string) Location {
+	if loc, ok := f.locate(joinPath(path, key)); ok {
+		return loc
+	}
+	loc, _ := f.locate(path)
+	return loc
+}
+
+// checkEntries checks the entries of every context of f. merged is the
+// whole config, which provides the port sets and defaults of the entries.
+func (c *configChecker) checkEntries(f checkedFile, merged *Config) {
+	for i := range f.config.Contexts {
+		ctx := f.config.Contexts[i]
+		ctxPath := fmt.Sprintf("context[%d]", i)
+		prefix := "context " + ctx.displayName() + ": "
+
+		base := ctx
+		base.Svc, base.Pods, base.LabelSelectors = nil, nil, nil
+		base.Deployments, base.StatefulSets, base.ReplicaSets, base.Remotes = nil, nil, nil, nil
+		_, baseErr := base.entries(merged)
+		if baseErr != nil {
+			loc, _ := f.locate(ctxPath)
+			c.add(f.path, loc, prefix+baseErr.Error())
+		}
+
+		for _, ce := range checkedEntries(&ctx) {
+			path := fmt.Sprintf("%s.%s[%d]", ctxPath, ce.section, ce.index)
+			at := func(key string) Location { return f.locateKey(path, key) }
+			if ce.name == "" {
+				c.add(f.path, at(""), fmt.Sprintf("%s%s entry has no %s", prefix, ce.section, ce.nameKey))
+				continue
+			}
+			ref := ce.kind + "/" + ce.name
+			key := entryKey(ctx.displayName(), ref)
+			if _, ok := c.entries[key]; !ok {
+				c.entries[key] = checkedLocation{file: f.path, loc: at("")}
+			}
+			fail := func(loc Location, message string) {
+				c.add(f.path, loc, message)
+				at := c.entries[key]
+				at.failed = true
+				c.entries[key] = at
+			}
+			valid := true
+			for k, p := range ce.opts.Ports {
+				port := fmt.Sprintf("ports[%d]", k)
+				if p.Target == "" {
+					fail(at(port), fmt.Sprintf("%s%s: %s: target is required", prefix, ref, port))
+					valid = false
+				} else if _, err := parsePort(p.Target, false); err != nil {
+					fail(at(port+".target"), fmt.Sprintf("%s%s: target port: %v", prefix, ref, err))
+					valid = false
+				}
+				if _, err := parsePort(p.Source, true); err != nil {
+					fail(at(port+".source"), fmt.Sprintf("%s%s: source port: %v", prefix, ref, err))
+					valid = false
+				}
+			}
+			if len(ce.opts.Ports) == 0 && ce.opts.PortSet == "" {
+				fail(at(""), fmt.Sprintf("%s%s: no ports configured", prefix, ref))
+				valid = false
+			}
+			if !valid || baseErr != nil {
+				continue
+			}
+
+			single := base
+			ce.set(&single)
+			entries, err := single.entries(merged)
+			if err != nil {
+				message := strings.TrimPrefix(err.Error(), ref+": ")
+				fail(at(mentionedKey(message, func(key string) bool {
+					_, ok := f.locate(joinPath(path, key))
+					return ok
+				})), prefix+err.Error())
+				continue
+			}
+			for _, e := range entries {
+				where := f.path
+				if loc, ok := f.locate(path); ok {
+					where = fmt.Sprintf("%s:%d", f.path, loc.Line)
+				}
+				if other, dup := c.ids[forwardID(e)]; dup {
+					fail(at(""), fmt.Sprintf("%s%s duplicates the entry at %s", prefix, ref, other))
+					continue
+				}
+				c.ids[forwardID(e)] = where
+				if c.lint {
+					c.lintEntry(f, &ctx, ce, path, e, where, merged)
+				}
+			}
+		}
+	}
+}
+
+// checkedEntry is an entry of a context checked by checkEntries: the index
+// of the entry in the section of the context holding it, the key naming it
+// and set, which makes it the only entry of a context.
+type checkedEntry struct {
+	section string
+	index   int
+	kind    string
+	name    string
+	nameKey string
+	opts    EntryOptions
+	set     func(ctx *Context)
+}
+
+// checkedEntries lists the entries of ctx.
+func checkedEntries(ctx *Context) []checkedEntry {
+	var out []checkedEntry
+	for i, s := range ctx.Svc {
+		out = append(out, checkedEntry{"svc", i, kindService, s.Name, "name", s.EntryOptions, func(c *Context) { c.Svc = []Service{s} }})
+	}
+	for i, p := range ctx.Pods {
+		out = append(out, checkedEntry{"pods", i, kindPod, p.Name, "name", p.EntryOptions, func(c *Context) { c.Pods = []Pod{p} }})
+	}
+	for i, s := range ctx.LabelSelectors {
+		out = append(out, checkedEntry{"label-selectors", i, kindLabel, s.Label, "label", s.EntryOptions, func(c *Context) { c.LabelSelectors = []Selector{s} }})
+	}
+	for i, w := range ctx.Deployments {
+		out = append(out, checkedEntry{"deploy", i, kindDeployment, w.Name, "name", w.EntryOptions, func(c *Context) { c.Deployments = []Workload{w} }})
+	}
+	for i, w := range ctx.StatefulSets {
+		out = append(out, checkedEntry{"sts", i, kindStatefulSet, w.Name, "name", w.EntryOptions, func(c *Context) { c.StatefulSets = []Workload{w} }})
+	}
+	for i, w := range ctx.ReplicaSets {
+		out = append(out, checkedEntry{"rs", i, kindReplicaSet, w.Name, "name", w.EntryOptions, func(c *Context) { c.ReplicaSets = []Workload{w} }})
+	}
+	for i, r := range ctx.Remotes {
+		out = append(out, checkedEntry{"remote", i, kindRemote, r.Host, "host", r.EntryOptions, func(c *Context) { c.Remotes = []Remote{r} }})
+	}
+	return out
+}
+
+// mentionedKey returns the first word of message that is a key defined
+// according to defined, or "" if there is none.
+func mentionedKey(message string, defined func(key string) bool) string {
+	for _, word := range strings.FieldsFunc(message, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r == '_' || r == '-')
+	}) {
+		if defined(word) {
+			return word
+		}
+	}
+	return ""
+}
+
+// tomlDecodeError matches the errors of the TOML decoder for values of the
+// wrong type, which carry the line and the last key decoded.
+var tomlDecodeError = regexp.MustCompile(`^toml: line (\d+) \(last key "([^"]*)"\): (.*)$`)
+
+// tomlParseErrorPrefix matches the position prefix of TOML syntax errors.
+var tomlParseErrorPrefix = regexp.MustCompile(`^toml: line \d+( \(last key "[^"]*"\))?: `)
+
+// decodeError returns the location and message of an error decoding the
+// document.
+func (l *tomlLocator) decodeError(err error) (Location, string) {
+	var parseErr toml.ParseError
+	if errors.As(err, &parseErr) && parseErr.Position.Line > 0 {
+		loc := l.location(parseErr.Position.Start)
+		if loc.Line != parseErr.Position.Line {
+			loc = Location{Line: parseErr.Position.Line, Column: 1}
+		}
+		return loc, tomlParseErrorPrefix.ReplaceAllString(err.Error(), "")
+	}
+	if m := tomlDecodeError.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		key := m[2][strings.LastIndex(m[2], ".")+1:]
+		return l.lineKey(line, key), fmt.Sprintf("%s: %s", m[2], m[3])
+	}
+	return Location{}, err.Error()
+}
+
+// unknownKeys returns the paths of the keys and tables of the document the
+// type t has no field for, leaving out those below another unknown key.
+func (l *tomlLocator) unknownKeys(t reflect.Type) []string {
+	var unknown []string
+	for _, path := range l.order {
+		below := false
+		for _, u := range unknown {
+			if strings.HasPrefix(path, u+".") || strings.HasPrefix(path, u+"[") {
+				below = true
+			}
+		}
+		if !below && !knownPath(t, path) {
+			unknown = append(unknown, path)
+		}
+	}
+	return unknown
+}
+
+// knownPath reports whether decoding into t uses the key at path. Keys
+// below maps are arbitrary and values of the wrong type are left to the
+// decoder.
+func knownPath(t reflect.Type, path string) bool {
+	for _, seg := range strings.Split(path, ".") {
+		name, index, _ := strings.Cut(seg, "[")
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			field, ok := tomlField(t, name)
+			if !ok {
+				return false
+			}
+			t = field.Type
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return true
+		}
+		for index != "" {
+			for t.Kind() == reflect.Ptr {
+				t = t.Elem()
+			}
+			if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+				return true
+			}
+			t = t.Elem()
+			_, index, _ = strings.Cut(index, "[")
+		}
+	}
+	return true
+}
+
+// tomlField returns the field of the struct type t the TOML key name is
+// decoded into, looking into embedded structs like the decoder does.
+func tomlField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			if field, ok := tomlField(f.Type, name); ok {
+				return field, true
+			}
+			continue
+		}
+		if tag == name || tag == "" && strings.EqualFold(f.Name, name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// unknownKeyMessage describes the unknown key at path.
+func unknownKeyMessage(path string) string {
+	path = arrayIndex.ReplaceAllString(path, "")
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return fmt.Sprintf("unknown key %q", path)
+	}
+	return fmt.Sprintf("unknown key %q in %s", path[i+1:], path[:i])
+}
+
+// arrayIndex matches the array indices of locator paths.
+var arrayIndex = regexp.MustCompile(`\[\d+\]`)
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+// StdinConfig is the config path that reads the config from stdin.
+const StdinConfig = "-"
+
+// stdinConfig holds the config read from stdin, which can only be read
+// once but is decoded again on every reload.
+var stdinConfig struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+// ReadConfig decodes the config file at path, or the config piped to stdin
+// if path is "-", merges the files it includes and expands the environment
+// variables referenced by its values. Files ending in .json and input
+// starting with { are JSON with the same keys as the TOML format; anything
+// else is TOML.
+func ReadConfig(path string) (*Config, error) {
+	data, err := readConfigData(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, _, err := decodeConfig(path, data)
+	if err != nil {
+		return nil, err
+	}
+	dir := "."
+	if path != StdinConfig {
+		dir = filepath.Dir(path)
+	}
+	seen := map[string]bool{}
+	if abs, err := filepath.Abs(path); err == nil && path != StdinConfig {
+		seen[abs] = true
+	}
+	if err := config.mergeIncludes(dir, config.Include, seen); err != nil {
+		return nil, err
+	}
+	if err := config.expandEnv(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readConfigData returns the content of the config file at path, or of the
+// config piped to stdin if path is "-".
+func readConfigData(path string) ([]byte, error) {
+	if path != StdinConfig {
+		return os.ReadFile(path)
+	}
+	stdinConfig.once.Do(func() {
+		stdinConfig.data, stdinConfig.err = io.ReadAll(os.Stdin)
+	})
+	return stdinConfig.data, stdinConfig.err
+}
+
+// decodeConfig decodes the TOML or JSON config data read from path.
+func decodeConfig(path string, data []byte) (*Config, toml.MetaData, error) {
+	var config Config
+	if IsJSONConfig(path, data) {
+		md, err := decodeJSONConfig(data, &config)
+		if err != nil {
+			return nil, md, fmt.Errorf("json: %v", err)
+		}
+		return &config, md, nil
+	}
+	md, err := toml.Decode(string(data), &config)
+	if err != nil {
+		return nil, md, err
+	}
+	return &config, md, nil
+}
+
+// includableKeys are the top-level keys included files may set.
+var includableKeys = map[string]bool{"context": true, "portsets": true, "env": true, "include": true}
+
+// mergeIncludes merges the config files matching the include patterns into
+// c, in the order of includePaths. Relative patterns are relative to dir,
+// the directory of the including file. seen holds the files merged so far,
+// which aren't merged twice.
+func (c *Config) mergeIncludes(dir string, patterns []string, seen map[string]bool) error {
+	paths, err := includePaths(dir, patterns)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			continue
+		}
+		seen[abs] = true
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		included, md, err := decodeConfig(path, data)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, key := range md.Keys() {
+			if len(key) == 1 && !includableKeys[key[0]] {
+				return fmt.Errorf("%s: %s can only be set in the main config file", path, key[0])
+			}
+		}
+		if err := c.merge(included); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := c.mergeIncludes(filepath.Dir(path), included.Include, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includePaths returns the files matching the include patterns, in order
+// and each pattern's matches sorted by name. Relative patterns are relative
+// to dir. A pattern without wildcards must match an existing file.
+func includePaths(dir string, patterns []string) ([]string, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		pattern = expandHome(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %v", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("include %q: no such file", pattern)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// merge adds the contexts, port sets and environment overlays of other to
+// c. The entries of a context c already has are added to it, keeping its
+// settings.
+func (c *Config) merge(other *Config) error {
+	for name, set := range other.PortSets {
+		if _, ok := c.PortSets[name]; ok {
+			return fmt.Errorf("portset %q is already defined", name)
+		}
+		if c.PortSets == nil {
+			c.PortSets = map[string]PortSet{}
+		}
+		c.PortSets[name] = set
+	}
+	for name, env := range other.Envs {
+		if _, ok := c.Envs[name]; ok {
+			return fmt.Errorf("env %q is already defined", name)
+		}
+		if c.Envs == nil {
+			c.Envs = map[string]EnvOverlay{}
+		}
+		c.Envs[name] = env
+	}
+	for _, ctx := range other.Contexts {
+		existing := -1
+		for i := range c.Contexts {
+			if c.Contexts[i].displayName() == ctx.displayName() {
+				existing = i
+				break
+			}
+		}
+		if existing < 0 {
+			c.Contexts = append(c.Contexts, ctx)
+			continue
+		}
+		dst := &c.Contexts[existing]
+		dst.Svc = append(dst.Svc, ctx.Svc...)
+		dst.Pods = append(dst.Pods, ctx.Pods...)
+		dst.LabelSelectors = append(dst.LabelSelectors, ctx.LabelSelectors...)
+		dst.Deployments = append(dst.Deployments, ctx.Deployments...)
+		dst.StatefulSets = append(dst.StatefulSets, ctx.StatefulSets...)
+		dst.ReplicaSets = append(dst.ReplicaSets, ctx.ReplicaSets...)
+		dst.Remotes = append(dst.Remotes, ctx.Remotes...)
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~ in path with the home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// IsJSONConfig reports whether the config at path with the given content
+// is JSON rather than TOML.
+func IsJSONConfig(path string, data []byte) bool {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return true
+	}
+	return path == StdinConfig && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+// decodeJSONConfig decodes a JSON config into config. The JSON is
+// converted to TOML first, so both formats share the keys, durations
+// given as strings like "30s" and the validation of the TOML decoder.
+func decodeJSONConfig(data []byte, config *Config) (toml.MetaData, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return toml.MetaData{}, err
+	}
+	if dec.More() {
+		return toml.MetaData{}, fmt.Errorf("unexpected data after the top-level object")
+	}
+	// The schema editors check the config against, see ConfigSchema.
+	delete(doc, "$schema")
+
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(dropNulls(doc)); err != nil {
+		return toml.MetaData{}, err
+	}
+	md, err := toml.Decode(buf.String(), config)
+	if err != nil {
+		// Line numbers refer to the converted TOML, not to the JSON.
+		return md, errors.New(tomlErrorPosition.ReplaceAllString(err.Error(), "key $1: "))
+	}
+	return md, nil
+}
+
+// tomlErrorPosition matches the position prefix of TOML decoding errors.
+var tomlErrorPosition = regexp.MustCompile(`^toml: line \d+ \(last key ("[^"]*")\): `)
+
+// dropNulls removes null values, which TOML has no equivalent for and
+// which mean the same as leaving a key out.
+func dropNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if value == nil {
+				delete(v, key)
+			} else {
+				v[key] = dropNulls(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = dropNulls(value)
+		}
+	}
+	return v
+}
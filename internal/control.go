@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ControlRequest is a single command sent to a running k10ls instance over
+// its control socket.
+type ControlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// ControlResponse is the reply to a ControlRequest.
+type ControlResponse struct {
+	Error string       `json:"error,omitempty"`
+	Ports []PortStatus `json:"ports,omitempty"`
+	Info  *DaemonInfo  `json:"info,omitempty"`
+	Diff  *ConfigDiff  `json:"diff,omitempty"`
+	Logs  []EntryLog   `json:"logs,omitempty"`
+
+	Downtime []EntryDowntime  `json:"downtime,omitempty"`
+	Forwards []ForwardMetrics `json:"forwards,omitempty"`
+	// Endpoints lists the local ports of every forward for k10ls api.
+	Endpoints []APIEndpoint `json:"endpoints,omitempty"`
+	// Entries lists the keys of the entries a command acted on.
+	Entries []string `json:"entries,omitempty"`
+}
+
+// DaemonInfo describes a running k10ls instance and how it was started.
+type DaemonInfo struct {
+	PID     int       `json:"pid"`
+	Version string    `json:"version"`
+	Args    []string  `json:"args"`
+	Dir     string    `json:"dir"`
+	Config  string    `json:"config"`
+	Started time.Time `json:"started"`
+}
+
+// ControlServer listens on a unix socket for commands from other k10ls
+// processes.
+type ControlServer struct {
+	path     string
+	listener *net.UnixListener
+
+	// Info is reported to clients asking what is running.
+	Info DaemonInfo
+
+	// OnHandOff is called after the local listeners have been handed over
+	// to another process.
+	OnHandOff func()
+
+	// OnReload re-reads the configuration and applies it.
+	OnReload func() (*ConfigDiff, error)
+
+	// OnPlan re-reads the configuration and reports what applying it
+	// would change.
+	OnPlan func() (*ConfigDiff, error)
+
+	// OnShutdown is called when a client asks the instance to stop.
+	OnShutdown func()
+
+	// OnStatus reports the state of every forward.
+	OnStatus func() []ForwardMetrics
+
+	// OnRestart and OnStop restart or stop the forwards of the entries
+	// given as arguments, returning their keys.
+	OnRestart func(refs []string) ([]string, error)
+	OnStop    func(refs []string) ([]string, error)
+}
+
+// DefaultControlSocket returns the control socket path used when none is
+// configured.
+func DefaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "k10ls.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("k10ls-%d.sock", os.Getuid()))
+}
+
+// ListenControl binds the control socket at path, removing a stale socket
+// file left behind by a process that is no longer running.
+func ListenControl(path string) (*ControlServer, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another k10ls instance is listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+		}
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %v", path, err)
+	}
+	return &ControlServer{path: path, listener: l}, nil
+}
+
+// Serve accepts control connections until the server is closed or ctx is
+// cancelled.
+func (s *ControlServer) Serve(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		s.Close()
+	}()
+
+	for {
+		conn, err := s.listener.AcceptUnix()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logrus.Errorf("control socket accept failed: %v", err)
+			}
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// Close stops accepting control connections and removes the socket file.
+func (s *ControlServer) Close() error {
+	return s.listener.Close()
+}
+
+func (s *ControlServer) handle(conn *net.UnixConn) {
+	defer conn.Close()
+	defer recoverPanic("control connection")
+
+	var req ControlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		logrus.Debugf("invalid control request: %v", err)
+		return
+	}
+
+	var err error
+	switch req.Command {
+	case "takeover":
+		err = s.handOff(conn)
+	case "ports":
+		err = json.NewEncoder(conn).Encode(ControlResponse{Ports: boundPorts()})
+	case "endpoints":
+		err = json.NewEncoder(conn).Encode(ControlResponse{Endpoints: apiEndpoints()})
+	case "logs":
+		err = json.NewEncoder(conn).Encode(ControlResponse{Logs: entryLogs()})
+	case "downtime":
+		err = json.NewEncoder(conn).Encode(ControlResponse{Downtime: entryDowntime()})
+	case "info":
+		info := s.Info
+		err = json.NewEncoder(conn).Encode(ControlResponse{Info: &info})
+	case "reload", "plan":
+		handler := s.OnReload
+		if req.Command == "plan" {
+			handler = s.OnPlan
+		}
+		if handler == nil {
+			err = fmt.Errorf("%s is not supported", req.Command)
+			break
+		}
+		var diff *ConfigDiff
+		if diff, err = handler(); err == nil {
+			err = json.NewEncoder(conn).Encode(ControlResponse{Diff: diff})
+		}
+	case "status":
+		if s.OnStatus == nil {
+			err = fmt.Errorf("status is not supported")
+			break
+		}
+		err = json.NewEncoder(conn).Encode(ControlResponse{Forwards: s.OnStatus()})
+	case "restart", "stop":
+		handler := s.OnRestart
+		if req.Command == "stop" {
+			handler = s.OnStop
+		}
+		if handler == nil {
+			err = fmt.Errorf("%s is not supported", req.Command)
+			break
+		}
+		var keys []string
+		if keys, err = handler(req.Args); err == nil {
+			err = json.NewEncoder(conn).Encode(ControlResponse{Entries: keys})
+		}
+	case "shutdown":
+		if s.OnShutdown == nil {
+			err = fmt.Errorf("shutdown is not supported")
+			break
+		}
+		err = json.NewEncoder(conn).Encode(ControlResponse{})
+		go s.OnShutdown()
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+	if err != nil {
+		logrus.Errorf("control command %s failed: %v", req.Command, err)
+		_ = json.NewEncoder(conn).Encode(ControlResponse{Error: Redact(err.Error())})
+	}
+}
+
+// SendControl sends req to the k10ls instance listening on the control
+// socket at path and returns its response.
+func SendControl(path string, req ControlRequest) (*ControlResponse, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("k10ls is not running (control socket %s): %v", path, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp ControlResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid response from k10ls: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
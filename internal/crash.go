@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// issuesURL is where bugs are filed.
+const issuesURL = "https://github.com/besrabasant/k10ls/issues/new"
+
+// maxIssueStack bounds the stack included in an issue URL, which browsers
+// and GitHub limit in length.
+const maxIssueStack = 4000
+
+// CrashReports configures where crash reports are written and where they
+// are uploaded to, if anywhere.
+type CrashReports struct {
+	Dir       string `toml:"dir,omitempty"`
+	UploadURL string `toml:"upload_url,omitempty"`
+}
+
+// validate checks the upload URL of the crash reports.
+func (c *CrashReports) validate() error {
+	if c.UploadURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.UploadURL)
+	if err != nil {
+		return fmt.Errorf("crash_reports: upload_url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("crash_reports: upload_url must be an http or https URL")
+	}
+	return nil
+}
+
+// CrashReport describes a panic recovered by k10ls.
+type CrashReport struct {
+	Time  time.Time `json:"time"`
+	Where string    `json:"where"`
+	Panic string    `json:"panic"`
+	Stack string    `json:"stack"`
+
+	Version     string `json:"version"`
+	GoVersion   string `json:"go_version"`
+	ClientGo    string `json:"client_go"`
+	Platform    string `json:"platform"`
+	Fingerprint string `json:"config_fingerprint"`
+
+	// Path is the file the report was read from.
+	Path string `json:"-"`
+}
+
+// crashSettings holds the crash report settings of the current config.
+var crashSettings struct {
+	sync.Mutex
+	dir, uploadURL       string
+	version, fingerprint string
+}
+
+// CrashDir returns the directory crash reports are written to.
+func (c *Config) CrashDir() string {
+	if c.CrashReports != nil && c.CrashReports.Dir != "" {
+		return c.CrashReports.Dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "k10ls", "crashes")
+}
+
+// ConfigureCrashReports records the settings and fingerprint of config and
+// the k10ls version for the crash reports written from now on.
+func ConfigureCrashReports(config *Config, version string) {
+	data, _ := json.Marshal(config)
+	sum := sha256.Sum256(data)
+
+	crashSettings.Lock()
+	defer crashSettings.Unlock()
+	crashSettings.dir = config.CrashDir()
+	crashSettings.uploadURL = ""
+	if config.CrashReports != nil {
+		crashSettings.uploadURL = config.CrashReports.UploadURL
+	}
+	crashSettings.version = version
+	crashSettings.fingerprint = hex.EncodeToString(sum[:6])
+}
+
+// recoverPanic recovers a panic of the calling goroutine, reporting it as
+// having happened in where. It must be deferred directly.
+func recoverPanic(where string) {
+	if r := recover(); r != nil {
+		logrus.Error(reportPanic(where, r))
+	}
+}
+
+// reportPanic writes a crash report for the panic r recovered in where,
+// uploads it if configured and returns a message describing it. It must be
+// called from the deferred function that recovered r so the stack still
+// shows where the panic happened.
+func reportPanic(where string, r any) string {
+	crashSettings.Lock()
+	dir, uploadURL := crashSettings.dir, crashSettings.uploadURL
+	report := CrashReport{
+		Time:        time.Now().UTC(),
+		Where:       where,
+		Panic:       Redact(fmt.Sprint(r)),
+		Stack:       string(debug.Stack()),
+		Version:     crashSettings.version,
+		GoVersion:   runtime.Version(),
+		ClientGo:    moduleVersion("k8s.io/client-go"),
+		Platform:    runtime.GOOS + "/" + runtime.GOARCH,
+		Fingerprint: crashSettings.fingerprint,
+	}
+	crashSettings.Unlock()
+
+	msg := fmt.Sprintf("panic in %s: %s", where, report.Panic)
+	if dir == "" {
+		return msg
+	}
+	path, err := writeCrashReport(dir, report)
+	if err != nil {
+		return fmt.Sprintf("%s (failed to write crash report: %v)", msg, err)
+	}
+	if uploadURL != "" {
+		go uploadCrashReport(uploadURL, report)
+	}
+	return fmt.Sprintf("%s (crash report written to %s)", msg, path)
+}
+
+// moduleVersion returns the version of the dependency path the binary was
+// built with.
+func moduleVersion(path string) string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path {
+			return dep.Version
+		}
+	}
+	return "unknown"
+}
+
+// writeCrashReport writes report to a new file in dir and returns its path.
+func writeCrashReport(dir string, report CrashReport) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("crash-%s-%d.json", report.Time.Format("20060102T150405.000000000Z"), os.Getpid()))
+	return path, os.WriteFile(path, append(data, '\n'), 0o600)
+}
+
+// uploadCrashReport uploads report in the background, logging the result.
+func uploadCrashReport(uploadURL string, report CrashReport) {
+	if err := UploadCrashReport(uploadURL, report); err != nil {
+		logrus.Errorf("failed to upload crash report: %v", err)
+		return
+	}
+	logrus.Infof("Crash report uploaded to %s", uploadURL)
+}
+
+// UploadCrashReport posts report as JSON to uploadURL.
+func UploadCrashReport(uploadURL string, report CrashReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("upload to %s failed: %s", uploadURL, resp.Status)
+	}
+	return nil
+}
+
+// ReadCrashReports returns the crash reports in dir, newest first.
+func ReadCrashReports(dir string) ([]CrashReport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "crash-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var reports []CrashReport
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var report CrashReport
+		if err := json.Unmarshal(data, &report); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		report.Path = path
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Time.After(reports[j].Time)
+	})
+	return reports, nil
+}
+
+// IssueURL returns the URL of a new GitHub issue prefilled with r.
+func (r CrashReport) IssueURL() string {
+	stack := r.Stack
+	if len(stack) > maxIssueStack {
+		stack = stack[:maxIssueStack] + "\n..."
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "k10ls panicked in %s.\n\n", r.Where)
+	fmt.Fprintf(&body, "- Version: %s\n- Go: %s\n- client-go: %s\n- Platform: %s\n- Config fingerprint: %s\n\n", r.Version, r.GoVersion, r.ClientGo, r.Platform, r.Fingerprint)
+	fmt.Fprintf(&body, "```\npanic: %s\n\n%s```\n", r.Panic, stack)
+
+	q := url.Values{}
+	q.Set("title", "Panic in "+r.Where+": "+r.Panic)
+	q.Set("body", body.String())
+	return issuesURL + "?" + q.Encode()
+}
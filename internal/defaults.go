@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// defaultReconnectDelay is the pause between reconnect attempts when no
+// reconnect policy is configured.
+const defaultReconnectDelay = 2 * time.Second
+
+// defaultMaxReconnectDelay caps the pause between reconnect attempts of a
+// policy with a multiplier but no max_delay.
+const defaultMaxReconnectDelay = time.Minute
+
+// Defaults holds values inherited by every entry of a file or context that
+// doesn't set them itself.
+type Defaults struct {
+	Namespace     string           `toml:"namespace,omitempty"`
+	Address       string           `toml:"address,omitempty"`
+	AddressFamily string           `toml:"address_family,omitempty"`
+	PortOffset    int              `toml:"port_offset,omitempty"`
+	Reconnect     *ReconnectPolicy `toml:"reconnect,omitempty"`
+	PortRemap     string           `toml:"port_remap,omitempty"`
+
+	TopologyPreference []map[string]string `toml:"topology_preference,omitempty"`
+}
+
+// ReconnectPolicy controls how a forward reconnects after its tunnel drops.
+// The pause after the first failed attempt is Delay; every further
+// consecutive failure multiplies it by Multiplier, up to MaxDelay. Jitter
+// randomizes each pause by up to that fraction in either direction, so
+// forwards failing together don't retry in lockstep. After MaxRetries
+// consecutive failures the forward gives up; zero retries forever.
+type ReconnectPolicy struct {
+	Delay      time.Duration `toml:"delay,omitempty"`
+	Multiplier float64       `toml:"multiplier,omitempty"`
+	MaxDelay   time.Duration `toml:"max_delay,omitempty"`
+	Jitter     float64       `toml:"jitter,omitempty"`
+	MaxRetries int           `toml:"max_retries,omitempty"`
+}
+
+// validate checks the settings of the policy.
+func (p *ReconnectPolicy) validate() error {
+	switch {
+	case p == nil:
+		return nil
+	case p.Delay < 0 || p.MaxDelay < 0:
+		return fmt.Errorf("reconnect: delay and max_delay must not be negative")
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return fmt.Errorf("reconnect: multiplier must be at least 1")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return fmt.Errorf("reconnect: jitter must be between 0 and 1")
+	case p.MaxRetries < 0:
+		return fmt.Errorf("reconnect: max_retries must not be negative")
+	}
+	return nil
+}
+
+// merge returns p with every unset field taken from parent.
+func (p *ReconnectPolicy) merge(parent *ReconnectPolicy) *ReconnectPolicy {
+	if p == nil {
+		return parent
+	}
+	if parent == nil {
+		return p
+	}
+	out := *parent
+	if p.Delay != 0 {
+		out.Delay = p.Delay
+	}
+	if p.Multiplier != 0 {
+		out.Multiplier = p.Multiplier
+	}
+	if p.MaxDelay != 0 {
+		out.MaxDelay = p.MaxDelay
+	}
+	if p.Jitter != 0 {
+		out.Jitter = p.Jitter
+	}
+	if p.MaxRetries != 0 {
+		out.MaxRetries = p.MaxRetries
+	}
+	return &out
+}
+
+// delay returns the pause before the first reconnect attempt.
+func (p *ReconnectPolicy) delay() time.Duration {
+	if p == nil || p.Delay <= 0 {
+		return defaultReconnectDelay
+	}
+	return p.Delay
+}
+
+// backoff returns the pause after the given number of consecutive failed
+// attempts, counting from one.
+func (p *ReconnectPolicy) backoff(failures int) time.Duration {
+	d := p.delay()
+	if p != nil && p.Multiplier > 1 && failures > 1 {
+		max := p.MaxDelay
+		if max <= 0 {
+			max = defaultMaxReconnectDelay
+		}
+		scaled := float64(d) * math.Pow(p.Multiplier, float64(failures-1))
+		if scaled > float64(max) {
+			scaled = float64(max)
+		}
+		d = time.Duration(scaled)
+	}
+	if p != nil && p.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 + p.Jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// maxRetries returns the consecutive failed attempts after which a forward
+// gives up, zero meaning never.
+func (p *ReconnectPolicy) maxRetries() int {
+	if p == nil {
+		return 0
+	}
+	return p.MaxRetries
+}
+
+// merge returns d with every unset field taken from parent.
+func (d *Defaults) merge(parent *Defaults) Defaults {
+	var out Defaults
+	if parent != nil {
+		out = *parent
+	}
+	if d == nil {
+		return out
+	}
+	if d.Namespace != "" {
+		out.Namespace = d.Namespace
+	}
+	if d.Address != "" {
+		out.Address = d.Address
+	}
+	if d.AddressFamily != "" {
+		out.AddressFamily = d.AddressFamily
+	}
+	if d.PortOffset != 0 {
+		out.PortOffset = d.PortOffset
+	}
+	out.Reconnect = d.Reconnect.merge(out.Reconnect)
+	if d.PortRemap != "" {
+		out.PortRemap = d.PortRemap
+	}
+	if d.TopologyPreference != nil {
+		out.TopologyPreference = d.TopologyPreference
+	}
+	return out
+}
+
+// network returns the listen network for an address family.
+func familyNetwork(family string) (string, error) {
+	switch family {
+	case "", "any":
+		return "tcp", nil
+	case "ipv4":
+		return "tcp4", nil
+	case "ipv6":
+		return "tcp6", nil
+	default:
+		return "", fmt.Errorf("invalid address family %q (expected ipv4, ipv6 or any)", family)
+	}
+}
+
+// offsetPorts shifts the local port of every mapping by offset. Mappings
+// without an explicit local port keep being assigned a random one.
+func offsetPorts(ports []PortMap, offset int) ([]PortMap, error) {
+	if offset == 0 {
+		return ports, nil
+	}
+	out := make([]PortMap, len(ports))
+	for i, p := range ports {
+		out[i] = p
+		if p.Source == "" || p.Source == "0" {
+			continue
+		}
+		n, err := strconv.Atoi(p.Source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source port %q: %v", p.Source, err)
+		}
+		if n+offset < 1 || n+offset > 65535 {
+			return nil, fmt.Errorf("source port %d with offset %d is out of range", n, offset)
+		}
+		out[i].Source = strconv.Itoa(n + offset)
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// diagnosticsSize is the number of messages kept per entry.
+var diagnosticsSize = 50
+
+// EntryLog holds the most recent diagnostics of one entry.
+type EntryLog struct {
+	ID    string   `json:"id"`
+	Entry string   `json:"entry"`
+	Lines []string `json:"lines"`
+}
+
+// The diagnostics registry keeps the last messages reported by every entry,
+// keyed by entry key, including the errors the API server sends back on a
+// tunnel's error stream (e.g. "unable to listen on port").
+var (
+	diagnosticsMu sync.Mutex
+	diagnostics   = map[string]*EntryLog{}
+)
+
+// recordDiagnostic appends msg to the diagnostics of e, dropping the oldest
+// message once the buffer is full.
+func recordDiagnostic(e entry, msg string) {
+	diagnosticsMu.Lock()
+	defer diagnosticsMu.Unlock()
+
+	l, ok := diagnostics[e.Key]
+	if !ok {
+		l = &EntryLog{ID: e.ID, Entry: e.Key}
+		diagnostics[e.Key] = l
+	}
+	l.Lines = append(l.Lines, fmt.Sprintf("%s %s", time.Now().Format(time.RFC3339), Redact(msg)))
+	if len(l.Lines) > diagnosticsSize {
+		l.Lines = l.Lines[len(l.Lines)-diagnosticsSize:]
+	}
+}
+
+// forgetDiagnostics drops the diagnostics of entry key.
+func forgetDiagnostics(key string) {
+	diagnosticsMu.Lock()
+	defer diagnosticsMu.Unlock()
+	delete(diagnostics, key)
+}
+
+// entryLogs returns the diagnostics of every entry, sorted by entry key.
+func entryLogs() []EntryLog {
+	diagnosticsMu.Lock()
+	defer diagnosticsMu.Unlock()
+
+	logs := make([]EntryLog, 0, len(diagnostics))
+	for _, l := range diagnostics {
+		logs = append(logs, EntryLog{ID: l.ID, Entry: l.Entry, Lines: append([]string{}, l.Lines...)})
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Entry < logs[j].Entry })
+	return logs
+}
+
+// failed logs a failure of f tagged with its entry and records it in the
+// entry's diagnostics.
+func (f *forward) failed(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	f.entry.log().Errorf("port-forward failed for %s: %s", f.entry.describe(), msg)
+	recordDiagnostic(f.entry, msg)
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// discoveryResync is how often discovered services are listed again even
+// without watch events, e.g. to resolve named target ports once pods exist.
+const discoveryResync = time.Minute
+
+// discoveryDebounce batches bursts of service events into one update.
+const discoveryDebounce = time.Second
+
+// selectsService reports whether the include and exclude patterns of ctx
+// select the service name.
+func (ctx *Context) selectsService(name string) bool {
+	if len(ctx.Include) > 0 {
+		matched := false
+		for _, p := range ctx.Include {
+			if ok, _ := path.Match(p, name); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for _, p := range ctx.Exclude {
+		if ok, _ := path.Match(p, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// discover keeps the services of the namespace of ctx forwarded until
+// discCtx is cancelled, reporting every change of the set to the manager.
+func (m *Manager) discover(discCtx context.Context, gen int, ctx *Context, config *Config, d desiredEntry) {
+	defer recoverPanic("service discovery of context " + ctx.displayName())
+	var kube *kubeClient
+	for kube == nil {
+		m.mu.Lock()
+		if discCtx.Err() != nil {
+			m.mu.Unlock()
+			return
+		}
+		var b *clientBuild
+		kube, b = m.client(d)
+		m.mu.Unlock()
+		if kube != nil {
+			break
+		}
+		select {
+		case <-discCtx.Done():
+			return
+		case <-b.done:
+		}
+		if b.err != nil {
+			contextLog(ctx).Errorf("Failed to load KubeClient for context %s: %v", ctx.displayName(), b.err)
+			sleepContext(discCtx, discoveryResync)
+		}
+	}
+	namespace := ctx.namespace(config)
+
+	for discCtx.Err() == nil {
+		core, _ := kube.getCore()
+		svcs, err := core.listServices(discCtx, namespace, metav1.ListOptions{})
+		if err != nil {
+			contextLog(ctx).Errorf("Failed to discover services in %s/%s: %v", ctx.displayName(), namespace, err)
+			sleepContext(discCtx, discoveryResync)
+			continue
+		}
+		m.setDiscovered(gen, ctx, config, d.clientSig, m.discoveredServices(discCtx, core, ctx, config, svcs.Items))
+
+		w, err := core.watchServices(discCtx, namespace, metav1.ListOptions{ResourceVersion: svcs.ResourceVersion})
+		if err != nil {
+			logrus.Debugf("failed to watch services in %s: %v", namespace, err)
+			sleepContext(discCtx, discoveryResync)
+			continue
+		}
+		resync := time.NewTimer(discoveryResync)
+	events:
+		for {
+			select {
+			case <-discCtx.Done():
+				break events
+			case <-resync.C:
+				break events
+			case _, ok := <-w.ResultChan():
+				if !ok {
+					break events
+				}
+				// Let a burst of events settle before listing again.
+				sleepContext(discCtx, discoveryDebounce)
+				break events
+			}
+		}
+		resync.Stop()
+		w.Stop()
+	}
+}
+
+// discoveredServices turns the selected services into service entries with
+// local ports assigned, skipping services configured explicitly.
+func (m *Manager) discoveredServices(ctx context.Context, core coreClient, c *Context, config *Config, svcs []corev1.Service) []Service {
+	sort.Slice(svcs, func(i, j int) bool { return svcs[i].Name < svcs[j].Name })
+
+	explicit := map[string]bool{}
+	for _, s := range c.Svc {
+		explicit[s.Name] = true
+	}
+
+	var out []Service
+	for _, svc := range svcs {
+		if explicit[svc.Name] || len(svc.Spec.Selector) == 0 || !c.selectsService(svc.Name) {
+			continue
+		}
+		var ports []PortMap
+		for _, p := range svc.Spec.Ports {
+			if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			target, err := targetPort(ctx, core, svc, p)
+			if err != nil {
+				logrus.Debugf("skipping port %s of service %s: %v", p.Name, svc.Name, err)
+				continue
+			}
+			ports = append(ports, PortMap{
+				Source: strconv.Itoa(m.assignPort(c, config, svc.Namespace, svc.Name, p.Port)),
+				Target: strconv.Itoa(target),
+			})
+		}
+		if len(ports) == 0 {
+			continue
+		}
+		out = append(out, Service{Name: svc.Name, EntryOptions: EntryOptions{Ports: ports}})
+	}
+	return out
+}
+
+// targetPort returns the container port behind service port p, resolving
+// named target ports through the pods of the service.
+func targetPort(ctx context.Context, core coreClient, svc corev1.Service, p corev1.ServicePort) (int, error) {
+	switch {
+	case p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal != 0:
+		return int(p.TargetPort.IntVal), nil
+	case p.TargetPort.Type == intstr.Int:
+		return int(p.Port), nil
+	}
+
+	selector := labels.Set(svc.Spec.Selector).String()
+	pods, err := core.listPods(ctx, svc.Namespace, metav1.ListOptions{LabelSelector: selector, Limit: 1})
+	if err != nil {
+		return 0, err
+	}
+	for _, pod := range pods.Items {
+		for _, c := range pod.Spec.Containers {
+			for _, cp := range c.Ports {
+				if cp.Name == p.TargetPort.StrVal {
+					return int(cp.ContainerPort), nil
+				}
+			}
+		}
+	}
+	return 0, fmt.Errorf("named port %q not found", p.TargetPort.StrVal)
+}
+
+// Discovered ports are assigned local ports in
+// [discoveryPortBase, discoveryPortBase+discoveryPortRange).
+const (
+	discoveryPortBase  = 20000
+	discoveryPortRange = 10000
+)
+
+// assignPort returns the local port of a discovered service port, before
+// the port offset of c is applied. The port is derived from a hash of
+// namespace/service/port, so a service lands on the same local port on
+// every machine; collisions move on to the next free port in the range.
+// Ports keep their assignment for as long as the manager runs.
+func (m *Manager) assignPort(c *Context, config *Config, namespace, name string, port int32) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	offset := c.portOffset(config)
+	key := fmt.Sprintf("%s/%s/%s:%d", c.Name, namespace, name, port)
+	if local, ok := m.assigned[key]; ok {
+		return local - offset
+	}
+
+	used := map[int]bool{}
+	for _, d := range m.static {
+		for _, pm := range d.entry.Ports {
+			if n, err := strconv.Atoi(pm.Source); err == nil {
+				used[n] = true
+			}
+		}
+	}
+	for _, local := range m.assigned {
+		used[local] = true
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s/%d", namespace, name, port)
+	slot := int(h.Sum32() % discoveryPortRange)
+	for i := 0; i < discoveryPortRange; i++ {
+		local := discoveryPortBase + (slot+i)%discoveryPortRange + offset
+		if !used[local] {
+			m.assigned[key] = local
+			return local - offset
+		}
+	}
+	// Every port of the range is taken; fall back to the service port.
+	return int(port)
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// downtimeBuckets are the upper bounds of the downtime histogram buckets.
+var downtimeBuckets = []time.Duration{
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+}
+
+// EntryDowntime summarises how long the tunnel of one entry was down while
+// it was re-established.
+type EntryDowntime struct {
+	ID      string  `json:"id"`
+	Entry   string  `json:"entry"`
+	Outages int     `json:"outages"`
+	Total   float64 `json:"total_seconds"`
+	Longest float64 `json:"longest_seconds"`
+	// Buckets counts outages by duration, cumulatively like Prometheus
+	// histograms: Buckets[i] is the number of outages no longer than
+	// BucketBounds[i]. The last bucket counts every outage.
+	Buckets      []int    `json:"buckets"`
+	BucketBounds []string `json:"bucket_bounds"`
+}
+
+// The downtime registry keeps the reconnect statistics of every entry, keyed
+// by entry key.
+var (
+	downtimeMu sync.Mutex
+	downtime   = map[string]*EntryDowntime{}
+)
+
+// recordDowntime adds an outage of length d to the statistics of e.
+func recordDowntime(e entry, d time.Duration) {
+	downtimeMu.Lock()
+	defer downtimeMu.Unlock()
+
+	s, ok := downtime[e.Key]
+	if !ok {
+		s = &EntryDowntime{ID: e.ID, Entry: e.Key, Buckets: make([]int, len(downtimeBuckets)+1)}
+		for _, b := range downtimeBuckets {
+			s.BucketBounds = append(s.BucketBounds, b.String())
+		}
+		s.BucketBounds = append(s.BucketBounds, "+Inf")
+		downtime[e.Key] = s
+	}
+	s.Outages++
+	s.Total += d.Seconds()
+	if d.Seconds() > s.Longest {
+		s.Longest = d.Seconds()
+	}
+	for i, b := range downtimeBuckets {
+		if d <= b {
+			s.Buckets[i]++
+		}
+	}
+	s.Buckets[len(downtimeBuckets)]++
+}
+
+// forgetDowntime drops the statistics of entry key.
+func forgetDowntime(key string) {
+	downtimeMu.Lock()
+	defer downtimeMu.Unlock()
+	delete(downtime, key)
+}
+
+// entryDowntime returns the statistics of every entry that had an outage,
+// sorted by entry key.
+func entryDowntime() []EntryDowntime {
+	downtimeMu.Lock()
+	defer downtimeMu.Unlock()
+
+	stats := make([]EntryDowntime, 0, len(downtime))
+	for _, s := range downtime {
+		c := *s
+		c.Buckets = append([]int{}, s.Buckets...)
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Entry < stats[j].Entry })
+	return stats
+}
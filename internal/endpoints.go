@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the endpoints file.
+const (
+	endpointsEnv   = "env"
+	endpointsJSON  = "json"
+	endpointsHosts = "hosts"
+)
+
+// EndpointsFile configures a file listing the local addresses of every
+// ready forward, rewritten whenever that set changes. Forwards that are
+// down are left out, or listed with DownAddress in place of their local
+// IP if set.
+type EndpointsFile struct {
+	Path          string `toml:"path"`
+	Format        string `toml:"format,omitempty"`
+	SignalPIDFile string `toml:"signal_pid_file,omitempty"`
+	Signal        string `toml:"signal,omitempty"`
+	DownAddress   string `toml:"down_address,omitempty"`
+}
+
+// endpoint is one local port of a ready forward.
+type endpoint struct {
+	ID        string `json:"id"`
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Pod       string `json:"pod"`
+	Port      string `json:"port"`
+	Address   string `json:"address"`
+}
+
+var (
+	endpointsMu   sync.Mutex
+	endpointsConf *EndpointsFile
+	endpointsLast []byte
+)
+
+// validate checks the format and signal of the endpoints file.
+func (c *EndpointsFile) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("endpoints_file: path is required")
+	}
+	switch c.Format {
+	case "", endpointsEnv, endpointsJSON, endpointsHosts:
+	default:
+		return fmt.Errorf("endpoints_file: unknown format %q (expected env, json or hosts)", c.Format)
+	}
+	if c.SignalPIDFile != "" {
+		if _, err := parseSignal(c.Signal); err != nil {
+			return fmt.Errorf("endpoints_file: %v", err)
+		}
+	}
+	if c.DownAddress != "" && net.ParseIP(c.DownAddress) == nil {
+		return fmt.Errorf("endpoints_file: down_address %q is not an IP address", c.DownAddress)
+	}
+	return nil
+}
+
+// EnableEndpointsFile keeps the endpoints file described by c up to date
+// as forwards become ready or go away, or stops updating it if c is nil.
+// Enabling the same settings again only writes the file if it is outdated.
+func EnableEndpointsFile(c *EndpointsFile) error {
+	endpointsMu.Lock()
+	if !reflect.DeepEqual(c, endpointsConf) {
+		endpointsConf = c
+		endpointsLast = nil
+	}
+	endpointsMu.Unlock()
+	return writeEndpoints()
+}
+
+// updateEndpoints regenerates the endpoints file, logging failures.
+func updateEndpoints() {
+	if err := writeEndpoints(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+}
+
+// writeEndpoints rewrites the endpoints file if one is enabled and its
+// content changed, then signals the configured process.
+func writeEndpoints() error {
+	endpointsMu.Lock()
+	defer endpointsMu.Unlock()
+	c := endpointsConf
+	if c == nil {
+		return nil
+	}
+
+	data, err := formatEndpoints(c.Format, readyEndpoints(c.DownAddress))
+	if err != nil {
+		return err
+	}
+	if endpointsLast != nil && bytes.Equal(data, endpointsLast) {
+		return nil
+	}
+	if err := writeFileAtomic(c.Path, data); err != nil {
+		return err
+	}
+	endpointsLast = data
+
+	if c.SignalPIDFile != "" {
+		if err := signalPIDFile(c.SignalPIDFile, c.Signal); err != nil {
+			return fmt.Errorf("endpoints_file: %v", err)
+		}
+	}
+	return nil
+}
+
+// readyEndpoints returns the local ports of every forward whose tunnel is
+// established, sorted by address. If downAddress is set, forwards that are
+// down are included with downAddress as their IP.
+func readyEndpoints(downAddress string) []endpoint {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	var eps []endpoint
+	for f := range forwards {
+		f.mu.Lock()
+		if f.tun != nil || downAddress != "" {
+			for i, l := range f.listeners {
+				addr := scrapeAddress(f.entry.Network, l.Addr())
+				if f.tun == nil {
+					_, port, _ := net.SplitHostPort(addr)
+					addr = net.JoinHostPort(downAddress, port)
+				}
+				eps = append(eps, endpoint{
+					ID:        f.entry.ID,
+					Context:   f.entry.Context,
+					Namespace: f.entry.Namespace,
+					Kind:      f.entry.Kind,
+					Name:      f.entry.Name,
+					Pod:       f.podName,
+					Port:      f.entry.Ports[i].Target,
+					Address:   addr,
+				})
+			}
+		}
+		f.mu.Unlock()
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Address < eps[j].Address })
+	return eps
+}
+
+// formatEndpoints renders eps in the given format.
+func formatEndpoints(format string, eps []endpoint) ([]byte, error) {
+	var b bytes.Buffer
+	switch format {
+	case "", endpointsEnv:
+		// K10LS_<NAMESPACE>_<NAME>_<PORT>=host:port
+		for _, ep := range eps {
+			fmt.Fprintf(&b, "%s=%s\n", envName("K10LS", ep.Namespace, ep.Name, ep.Port), ep.Address)
+		}
+	case endpointsJSON:
+		if eps == nil {
+			eps = []endpoint{}
+		}
+		data, err := json.MarshalIndent(eps, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		b.Write(append(data, '\n'))
+	case endpointsHosts:
+		// Only services have a name that resolves in the cluster. A hosts
+		// file can't carry ports, so each service is listed once per IP.
+		seen := map[string]bool{}
+		for _, ep := range eps {
+			host, _, _ := net.SplitHostPort(ep.Address)
+			key := host + " " + ep.Namespace + "/" + ep.Name
+			if ep.Kind != kindService || seen[key] {
+				continue
+			}
+			seen[key] = true
+			fmt.Fprintf(&b, "%s\t%s.%s.svc.cluster.local %s.%s.svc %s.%s\n", host,
+				ep.Name, ep.Namespace, ep.Name, ep.Namespace, ep.Name, ep.Namespace)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// envName joins parts into an upper case environment variable name,
+// replacing characters that aren't allowed with underscores.
+func envName(parts ...string) string {
+	name := strings.ToUpper(strings.Join(parts, "_"))
+	return strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writeFileAtomic replaces path with data, so readers never see a partly
+// written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".k10ls-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// signalPIDFile sends the named signal to the process whose PID is stored
+// in pidFile.
+func signalPIDFile(pidFile, name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", pidFile, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("invalid PID in %s: %v", pidFile, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(sig); err != nil {
+		return fmt.Errorf("failed to signal process %d: %v", pid, err)
+	}
+	return nil
+}
@@ -0,0 +1,468 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry kinds, as used in resource references like "svc/mqtt".
+const (
+	kindService     = "svc"
+	kindPod         = "pod"
+	kindLabel       = "label"
+	kindDeployment  = "deploy"
+	kindStatefulSet = "sts"
+	kindReplicaSet  = "rs"
+	kindRemote      = "remote"
+)
+
+// Protocols an entry can be marked with. Plain TCP is the default.
+const (
+	protocolTCP      = "tcp"
+	protocolHTTP     = "http"
+	protocolRedis    = "redis"
+	protocolPostgres = "postgres"
+)
+
+// entry is a single configured forward (service, pod or label selector)
+// with the namespace, address and other defaults of its context applied.
+type entry struct {
+	// Key identifies the entry within the configuration, see
+	// desiredEntries. ID is its stable ID, see forwardID.
+	Key string
+	ID  string
+
+	// Context is the display name of the context, KubeContext its name in
+	// the kubeconfig, empty if the kubeconfig's current context is used.
+	Context       string
+	KubeContext   string
+	Namespace     string
+	Kind          string
+	Name          string
+	Ports         []PortMap
+	PortOffset    int
+	Address       string
+	Network       string
+	Protocol      string
+	RewriteURLs   bool
+	ReadOnly      bool
+	Retries       int
+	TLS           bool
+	Mirror        string
+	RecordHAR     string
+	DependsOn     []string
+	ZeroPodsHook  string
+	ScaleFromZero string
+	IdleTimeout   time.Duration
+	MinAge        time.Duration
+	MaxRestarts   *int
+	Node          string
+	NodeSelector  map[string]string
+	Reconnect     *ReconnectPolicy
+	PortRemap     string
+	Approval      *Approval
+
+	// Labels are free-form annotations passed on to metrics, hooks and
+	// other consumers, see entryLabels.
+	Labels map[string]string
+
+	// RelayImage is the image of the relay pod of remote entries, see
+	// relayImage.
+	RelayImage string
+
+	// LoadBalance is the number of pods new connections are spread across,
+	// see balance.
+	LoadBalance int
+	// Standby is the number of tunnels kept open to other pods to fail
+	// over to, see keepStandby.
+	Standby int
+	// TopologyPreference lists node labels, like the zone and then the
+	// region, in order of preference; pods on nodes matching earlier ones
+	// are picked first, see topologyTiers.
+	TopologyPreference []map[string]string
+
+	// MaxConnections and Bandwidth (in bytes per second) throttle the
+	// local connections, overall and per client IP, see throttle.
+	MaxConnections          int
+	Bandwidth               int64
+	MaxConnectionsPerClient int
+	BandwidthPerClient      int64
+	LogConnections          bool
+	// CopyURL copies the local URL to the clipboard once the forward is
+	// ready, see copyURL.
+	CopyURL bool
+
+	// DialTimeout and TLSHandshakeTimeout bound opening a tunnel, see
+	// dialDeadlines.
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Keepalive is how often idle tunnels are kept alive, see keepalive.
+	Keepalive time.Duration
+	// TunnelProtocol is the tunnel_protocol of the context.
+	TunnelProtocol string
+	// HealthProbe checks the tunnel through the forwarded ports, if set.
+	HealthProbe *HealthProbe
+}
+
+// Resource returns the entry as a kind/name reference, e.g. "svc/mqtt".
+func (e entry) Resource() string {
+	return e.Kind + "/" + e.Name
+}
+
+// portAddress returns the local address the port p of e listens on.
+func (e entry) portAddress(p PortMap) string {
+	if p.Address != "" {
+		return p.Address
+	}
+	return e.Address
+}
+
+// forwardID returns the stable ID of e: a short hash of its context,
+// namespace, kind, name and ports. Unlike the entry key it doesn't depend
+// on the order of the configuration, so it survives restarts and edits of
+// unrelated entries, and external automation can key on it.
+func forwardID(e entry) string {
+	ports := make([]string, len(e.Ports))
+	for i, p := range e.Ports {
+		ports[i] = p.Source + ":" + p.Target
+	}
+	sort.Strings(ports)
+	sum := sha256.Sum256([]byte(strings.Join([]string{e.Context, e.Namespace, e.Kind, e.Name, strings.Join(ports, ",")}, "\x00")))
+	return hex.EncodeToString(sum[:6])
+}
+
+// keepalive returns how often the idle tunnels of e are kept alive.
+func (e entry) keepalive() time.Duration {
+	if e.Keepalive == 0 {
+		return defaultKeepalive
+	}
+	return e.Keepalive
+}
+
+// describe returns a human readable description used in log messages.
+func (e entry) describe() string {
+	switch e.Kind {
+	case kindService:
+		return "service " + e.Name
+	case kindLabel:
+		return "label selector " + e.Name
+	case kindDeployment:
+		return "deployment " + e.Name
+	case kindStatefulSet:
+		return "statefulset " + e.Name
+	case kindReplicaSet:
+		return "replicaset " + e.Name
+	case kindRemote:
+		return "remote host " + e.Name
+	default:
+		return "pod " + e.Name
+	}
+}
+
+// namespace returns the namespace of entries of ctx that don't set one:
+// that of the context, the defaults or, like for kubectl, the kubeconfig
+// context, and "default" without any.
+func (ctx *Context) namespace(config *Config) string {
+	defaults := ctx.Defaults.merge(config.Defaults)
+	switch {
+	case ctx.Namespace != "":
+		return ctx.Namespace
+	case defaults.Namespace != "":
+		return defaults.Namespace
+	}
+	// Kubeconfigs kept in a secret store are only fetched by the forwards.
+	if ctx.KubeConfigVault == "" && ctx.KubeConfigSecret == "" {
+		if ns := kubeConfigNamespace(ctx.kubeContext(), ctx.KubeConfigPath, config.GlobalKubeConfig); ns != "" {
+			return ns
+		}
+	}
+	return "default"
+}
+
+// portOffset returns the offset added to the local ports of ctx.
+func (ctx *Context) portOffset(config *Config) int {
+	if ctx.PortOffset != 0 {
+		return ctx.PortOffset
+	}
+	return ctx.Defaults.merge(config.Defaults).PortOffset
+}
+
+// entries flattens the services, pods, label selectors, workloads and remote
+// hosts of ctx into entries, resolving their namespace, bind address and the defaults
+// inherited from the context and the file.
+func (ctx *Context) entries(config *Config) ([]entry, error) {
+	entries, invalid, err := ctx.collectEntries(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 {
+		return nil, invalid[0].err
+	}
+	return entries, nil
+}
+
+// invalidEntry is an entry skipped by collectEntries: its kind/name and why
+// it is invalid.
+type invalidEntry struct {
+	resource string
+	err      error
+}
+
+// collectEntries is entries, skipping invalid entries instead of failing.
+// It returns the valid entries and the invalid ones, or only why the
+// context itself is invalid.
+func (ctx *Context) collectEntries(config *Config) ([]entry, []invalidEntry, error) {
+	defaults := ctx.Defaults.merge(config.Defaults)
+
+	ctxNamespace := ""
+	namespace := func(ns string) string {
+		if ns != "" {
+			return ns
+		}
+		// Resolved once, as it may read the kubeconfig.
+		if ctxNamespace == "" {
+			ctxNamespace = ctx.namespace(config)
+		}
+		return ctxNamespace
+	}
+	globalAddr := defaults.Address
+	if globalAddr == "" {
+		globalAddr = config.DefaultAddress
+	}
+	offset := ctx.portOffset(config)
+	network, err := familyNetwork(defaults.AddressFamily)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch defaults.PortRemap {
+	case "", portRemapOff, portRemapNext, portRemapRandom:
+	default:
+		return nil, nil, fmt.Errorf("invalid port_remap %q (expected off, next or random)", defaults.PortRemap)
+	}
+	if err := defaults.Reconnect.validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := validateTags(ctx.Tags); err != nil {
+		return nil, nil, err
+	}
+
+	var entries []entry
+	var invalid []invalidEntry
+	add := func(kind, name string, opts EntryOptions) error {
+		ports := opts.Ports
+		if opts.PortSet != "" {
+			set, ok := config.PortSets[opts.PortSet]
+			if !ok {
+				return fmt.Errorf("%s/%s: unknown portset %q", kind, name, opts.PortSet)
+			}
+			ports = append(append([]PortMap{}, set.Ports...), ports...)
+		}
+		ports, err := offsetPorts(ports, offset)
+		if err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		if kind == kindRemote {
+			// Checked after expanding the portset, which may add ports.
+			for _, p := range ports {
+				if _, err := strconv.Atoi(p.Target); err != nil {
+					return fmt.Errorf("%s/%s: remote ports must be numbers, got %q", kind, name, p.Target)
+				}
+			}
+		}
+		switch opts.Protocol {
+		case "", protocolTCP, protocolHTTP, protocolRedis, protocolPostgres:
+		default:
+			return fmt.Errorf("%s/%s: unknown protocol %q (expected tcp, http, redis or postgres)", kind, name, opts.Protocol)
+		}
+		if opts.ScaleFromZero != "" {
+			if _, _, err := parseScaleTarget(opts.ScaleFromZero); err != nil {
+				return fmt.Errorf("%s/%s: %v", kind, name, err)
+			}
+		}
+		if (opts.Node != "" || len(opts.NodeSelector) > 0) && (kind == kindPod || kind == kindRemote) {
+			return fmt.Errorf("%s/%s: node pinning only applies to services, label selectors and workloads", kind, name)
+		}
+		topology := opts.TopologyPreference
+		if kind == kindPod || kind == kindRemote {
+			if topology != nil {
+				return fmt.Errorf("%s/%s: topology_preference only applies to services, label selectors and workloads", kind, name)
+			}
+		} else if topology == nil {
+			topology = defaults.TopologyPreference
+		}
+		for _, selector := range topology {
+			if len(selector) == 0 {
+				return fmt.Errorf("%s/%s: topology_preference: empty node labels", kind, name)
+			}
+		}
+		if ctx.TunnelProtocol == tunnelPodProxy && opts.Protocol != protocolHTTP {
+			return fmt.Errorf("%s/%s: tunnel_protocol = \"proxy\" requires protocol = \"http\"", kind, name)
+		}
+		if opts.RewriteURLs && opts.Protocol != protocolHTTP {
+			return fmt.Errorf("%s/%s: rewrite_urls requires protocol = \"http\"", kind, name)
+		}
+		if opts.ReadOnly && (opts.Protocol == "" || opts.Protocol == protocolTCP) {
+			return fmt.Errorf("%s/%s: read_only requires protocol = \"http\", \"redis\" or \"postgres\"", kind, name)
+		}
+		if opts.RecordHAR != "" && opts.Protocol != protocolHTTP {
+			return fmt.Errorf("%s/%s: record_har requires protocol = \"http\"", kind, name)
+		}
+		if opts.Retries < 0 {
+			return fmt.Errorf("%s/%s: retries must not be negative", kind, name)
+		}
+		if opts.Retries > 0 && opts.Protocol != protocolHTTP {
+			return fmt.Errorf("%s/%s: retries requires protocol = \"http\"", kind, name)
+		}
+		if opts.TLS && opts.Protocol == protocolPostgres {
+			return fmt.Errorf("%s/%s: tls can't be combined with protocol = \"postgres\", which negotiates TLS itself", kind, name)
+		}
+		if opts.DialTimeout < 0 || opts.TLSHandshakeTimeout < 0 {
+			return fmt.Errorf("%s/%s: dial_timeout and tls_handshake_timeout must not be negative", kind, name)
+		}
+		if opts.Keepalive < 0 {
+			return fmt.Errorf("%s/%s: keepalive must not be negative", kind, name)
+		}
+		if err := opts.HealthProbe.validate(); err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		if err := validateLabels(opts.Labels); err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		if err := validateTags(opts.Tags); err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		if err := opts.Reconnect.validate(); err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		if opts.LoadBalance < 0 {
+			return fmt.Errorf("%s/%s: load_balance must not be negative", kind, name)
+		}
+		if opts.LoadBalance > 1 && (kind == kindPod || kind == kindRemote) {
+			return fmt.Errorf("%s/%s: load_balance needs a service, label selector or workload to pick pods from", kind, name)
+		}
+		if opts.Standby < 0 {
+			return fmt.Errorf("%s/%s: standby must not be negative", kind, name)
+		}
+		if opts.Standby > 0 && (kind == kindPod || kind == kindRemote) {
+			return fmt.Errorf("%s/%s: standby needs a service, label selector or workload to pick pods from", kind, name)
+		}
+		if opts.MaxConnections < 0 || opts.MaxConnectionsPerClient < 0 {
+			return fmt.Errorf("%s/%s: max_connections and max_connections_per_client must not be negative", kind, name)
+		}
+		var bandwidth, clientBandwidth int64
+		if opts.Bandwidth != "" {
+			if bandwidth, err = parseBandwidth(opts.Bandwidth); err != nil {
+				return fmt.Errorf("%s/%s: %v", kind, name, err)
+			}
+		}
+		if opts.BandwidthPerClient != "" {
+			if clientBandwidth, err = parseBandwidth(opts.BandwidthPerClient); err != nil {
+				return fmt.Errorf("%s/%s: bandwidth_per_client: %v", kind, name, err)
+			}
+		}
+		if opts.Mirror != "" {
+			if _, _, err := parseMirrorTarget(opts.Mirror); err != nil {
+				return fmt.Errorf("%s/%s: %v", kind, name, err)
+			}
+			if opts.ReadOnly {
+				return fmt.Errorf("%s/%s: mirror can't be combined with read_only, the mirror would receive blocked writes", kind, name)
+			}
+		}
+		entries = append(entries, entry{
+			Context:       ctx.displayName(),
+			KubeContext:   ctx.kubeContext(),
+			Namespace:     namespace(opts.Namespace),
+			Kind:          kind,
+			Name:          name,
+			Ports:         ports,
+			PortOffset:    offset,
+			Address:       computeAddress(opts.Address, ctx.Address, globalAddr),
+			Network:       network,
+			Protocol:      opts.Protocol,
+			RewriteURLs:   opts.RewriteURLs,
+			ReadOnly:      opts.ReadOnly,
+			Retries:       opts.Retries,
+			TLS:           opts.TLS,
+			Mirror:        opts.Mirror,
+			RecordHAR:     opts.RecordHAR,
+			DependsOn:     opts.DependsOn,
+			ZeroPodsHook:  opts.ZeroPodsHook,
+			ScaleFromZero: opts.ScaleFromZero,
+			IdleTimeout:   opts.IdleTimeout,
+			MinAge:        opts.MinAge,
+			MaxRestarts:   opts.MaxRestarts,
+			Node:          opts.Node,
+			NodeSelector:  opts.NodeSelector,
+			Reconnect:     opts.Reconnect.merge(defaults.Reconnect),
+			PortRemap:     defaults.PortRemap,
+			Approval:      entryApproval(ctx, opts),
+			Labels:        opts.Labels,
+			LoadBalance:   opts.LoadBalance,
+			Standby:       opts.Standby,
+
+			TopologyPreference: topology,
+
+			MaxConnections:          opts.MaxConnections,
+			Bandwidth:               bandwidth,
+			MaxConnectionsPerClient: opts.MaxConnectionsPerClient,
+			BandwidthPerClient:      clientBandwidth,
+			LogConnections:          opts.LogConnections,
+			CopyURL:                 opts.CopyURL,
+
+			DialTimeout:         opts.DialTimeout,
+			TLSHandshakeTimeout: opts.TLSHandshakeTimeout,
+			Keepalive:           opts.Keepalive,
+			HealthProbe:         opts.HealthProbe,
+			TunnelProtocol:      ctx.TunnelProtocol,
+		})
+		return nil
+	}
+
+	for _, svc := range ctx.Svc {
+		if err := add(kindService, svc.Name, svc.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindService + "/" + svc.Name, err})
+		}
+	}
+	for _, pod := range ctx.Pods {
+		if err := add(kindPod, pod.Name, pod.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindPod + "/" + pod.Name, err})
+		}
+	}
+	for _, sel := range ctx.LabelSelectors {
+		if err := add(kindLabel, sel.Label, sel.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindLabel + "/" + sel.Label, err})
+		}
+	}
+	for _, w := range ctx.Deployments {
+		if err := add(kindDeployment, w.Name, w.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindDeployment + "/" + w.Name, err})
+		}
+	}
+	for _, w := range ctx.StatefulSets {
+		if err := add(kindStatefulSet, w.Name, w.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindStatefulSet + "/" + w.Name, err})
+		}
+	}
+	for _, w := range ctx.ReplicaSets {
+		if err := add(kindReplicaSet, w.Name, w.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindReplicaSet + "/" + w.Name, err})
+		}
+	}
+	for _, r := range ctx.Remotes {
+		if err := validateRemoteHost(r.Host); err != nil {
+			invalid = append(invalid, invalidEntry{kindRemote + "/" + r.Host, fmt.Errorf("%s/%s: %v", kindRemote, r.Host, err)})
+			continue
+		}
+		if err := add(kindRemote, r.Host, r.EntryOptions); err != nil {
+			invalid = append(invalid, invalidEntry{kindRemote + "/" + r.Host, err})
+			continue
+		}
+		entries[len(entries)-1].RelayImage = r.Image
+	}
+	return entries, invalid, nil
+}
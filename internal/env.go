@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EnvOverlay overrides parts of the configuration for one environment,
+// selected at startup with --env.
+type EnvOverlay struct {
+	GlobalKubeConfig string                    `toml:"global_kubeconfig,omitempty"`
+	DefaultAddress   string                    `toml:"default_address,omitempty"`
+	Defaults         *Defaults                 `toml:"defaults,omitempty"`
+	Namespaces       map[string]string         `toml:"namespaces,omitempty"`
+	Contexts         map[string]ContextOverlay `toml:"contexts,omitempty"`
+}
+
+// ContextOverlay overrides the settings of the context it is keyed by, its
+// name or alias.
+type ContextOverlay struct {
+	Name           string    `toml:"name,omitempty"`
+	Alias          string    `toml:"alias,omitempty"`
+	Namespace      string    `toml:"namespace,omitempty"`
+	Address        string    `toml:"address,omitempty"`
+	KubeConfigPath string    `toml:"kubeconfig,omitempty"`
+	PortOffset     int       `toml:"port_offset,omitempty"`
+	Defaults       *Defaults `toml:"defaults,omitempty"`
+}
+
+// ApplyEnv applies the overlay of environment name to c.
+func (c *Config) ApplyEnv(name string) error {
+	env, ok := c.Envs[name]
+	if !ok {
+		names := make([]string, 0, len(c.Envs))
+		for n := range c.Envs {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown environment %q (available: %s)", name, strings.Join(names, ", "))
+	}
+
+	if env.GlobalKubeConfig != "" {
+		c.GlobalKubeConfig = env.GlobalKubeConfig
+	}
+	if env.DefaultAddress != "" {
+		c.DefaultAddress = env.DefaultAddress
+	}
+	if env.Defaults != nil {
+		defaults := env.Defaults.merge(c.Defaults)
+		c.Defaults = &defaults
+	}
+
+	seen := map[string]bool{}
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		key := ctx.Name
+		if _, ok := env.Contexts[key]; !ok && ctx.Alias != "" {
+			key = ctx.Alias
+		}
+		if o, ok := env.Contexts[key]; ok {
+			seen[key] = true
+			if o.Name != "" {
+				ctx.Name = o.Name
+			}
+			if o.Alias != "" {
+				ctx.Alias = o.Alias
+			}
+			if o.Namespace != "" {
+				ctx.Namespace = o.Namespace
+			}
+			if o.Address != "" {
+				ctx.Address = o.Address
+			}
+			if o.KubeConfigPath != "" {
+				ctx.KubeConfigPath = o.KubeConfigPath
+			}
+			if o.PortOffset != 0 {
+				ctx.PortOffset = o.PortOffset
+			}
+			if o.Defaults != nil {
+				defaults := o.Defaults.merge(ctx.Defaults)
+				ctx.Defaults = &defaults
+			}
+		}
+		ctx.mapNamespaces(env.Namespaces)
+	}
+	for n := range env.Contexts {
+		if !seen[n] {
+			return fmt.Errorf("environment %q overrides unknown context %q", name, n)
+		}
+	}
+	return nil
+}
+
+// mapNamespaces renames every namespace of ctx and its entries found in m.
+func (ctx *Context) mapNamespaces(m map[string]string) {
+	if len(m) == 0 {
+		return
+	}
+	rename := func(ns *string) {
+		if to, ok := m[*ns]; ok && *ns != "" {
+			*ns = to
+		}
+	}
+
+	rename(&ctx.Namespace)
+	if ctx.Defaults != nil {
+		rename(&ctx.Defaults.Namespace)
+	}
+	for i := range ctx.Svc {
+		rename(&ctx.Svc[i].Namespace)
+	}
+	for i := range ctx.Pods {
+		rename(&ctx.Pods[i].Namespace)
+	}
+	for i := range ctx.LabelSelectors {
+		rename(&ctx.LabelSelectors[i].Namespace)
+	}
+	for _, workloads := range [][]Workload{ctx.Deployments, ctx.StatefulSets, ctx.ReplicaSets} {
+		for i := range workloads {
+			rename(&workloads[i].Namespace)
+		}
+	}
+	for i := range ctx.Remotes {
+		rename(&ctx.Remotes[i].Namespace)
+	}
+}
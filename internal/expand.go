@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envReference matches ${VAR} and ${VAR:-default} in config values.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvValue replaces the environment variable references in s with
+// their values. An unset or empty variable takes the default after :-, and
+// is an error without one.
+func expandEnvValue(s string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envReference.FindStringSubmatch(ref)
+		if value := os.Getenv(m[1]); value != "" {
+			return value
+		}
+		if m[2] != "" {
+			return m[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return ref
+	})
+	return expanded, err
+}
+
+// expandEnv expands the environment variable references in the kubeconfig
+// paths, namespaces, addresses and ports of c. Other values, like hooks
+// run by a shell, are left alone.
+func (c *Config) expandEnv() error {
+	for _, f := range []*string{&c.GlobalKubeConfig, &c.DefaultAddress, &c.MetricsAddress} {
+		if err := expandField(f); err != nil {
+			return err
+		}
+	}
+	if err := c.Defaults.expandEnv(); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	for name, set := range c.PortSets {
+		if err := expandPorts(set.Ports); err != nil {
+			return fmt.Errorf("portset %s: %v", name, err)
+		}
+	}
+	for name, env := range c.Envs {
+		if err := env.expandEnv(); err != nil {
+			return fmt.Errorf("env %s: %v", name, err)
+		}
+		c.Envs[name] = env
+	}
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		if err := ctx.expandEnv(); err != nil {
+			return fmt.Errorf("context %s: %v", ctx.displayName(), err)
+		}
+	}
+	return nil
+}
+
+func (ctx *Context) expandEnv() error {
+	for _, f := range []*string{&ctx.KubeConfigPath, &ctx.Namespace, &ctx.Address} {
+		if err := expandField(f); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Defaults.expandEnv(); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	expand := func(kind, name string, o *EntryOptions) error {
+		if err := o.expandEnv(); err != nil {
+			return fmt.Errorf("%s/%s: %v", kind, name, err)
+		}
+		return nil
+	}
+	for i := range ctx.Svc {
+		if err := expand(kindService, ctx.Svc[i].Name, &ctx.Svc[i].EntryOptions); err != nil {
+			return err
+		}
+	}
+	for i := range ctx.Pods {
+		if err := expand(kindPod, ctx.Pods[i].Name, &ctx.Pods[i].EntryOptions); err != nil {
+			return err
+		}
+	}
+	for i := range ctx.LabelSelectors {
+		if err := expand(kindLabel, ctx.LabelSelectors[i].Label, &ctx.LabelSelectors[i].EntryOptions); err != nil {
+			return err
+		}
+	}
+	for _, w := range []struct {
+		kind      string
+		workloads []Workload
+	}{{kindDeployment, ctx.Deployments}, {kindStatefulSet, ctx.StatefulSets}, {kindReplicaSet, ctx.ReplicaSets}} {
+		for i := range w.workloads {
+			if err := expand(w.kind, w.workloads[i].Name, &w.workloads[i].EntryOptions); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range ctx.Remotes {
+		if err := expand(kindRemote, ctx.Remotes[i].Host, &ctx.Remotes[i].EntryOptions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *EntryOptions) expandEnv() error {
+	for _, f := range []*string{&o.Namespace, &o.Address} {
+		if err := expandField(f); err != nil {
+			return err
+		}
+	}
+	if err := expandPorts(o.Ports); err != nil {
+		return fmt.Errorf("ports: %v", err)
+	}
+	return nil
+}
+
+func (d *Defaults) expandEnv() error {
+	if d == nil {
+		return nil
+	}
+	for _, f := range []*string{&d.Namespace, &d.Address} {
+		if err := expandField(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (env *EnvOverlay) expandEnv() error {
+	for _, f := range []*string{&env.GlobalKubeConfig, &env.DefaultAddress} {
+		if err := expandField(f); err != nil {
+			return err
+		}
+	}
+	if err := env.Defaults.expandEnv(); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	for from, to := range env.Namespaces {
+		expanded, err := expandEnvValue(to)
+		if err != nil {
+			return fmt.Errorf("namespaces: %v", err)
+		}
+		env.Namespaces[from] = expanded
+	}
+	for name, o := range env.Contexts {
+		for _, f := range []*string{&o.Namespace, &o.Address, &o.KubeConfigPath} {
+			if err := expandField(f); err != nil {
+				return fmt.Errorf("contexts %s: %v", name, err)
+			}
+		}
+		if err := o.Defaults.expandEnv(); err != nil {
+			return fmt.Errorf("contexts %s: defaults: %v", name, err)
+		}
+		env.Contexts[name] = o
+	}
+	return nil
+}
+
+func expandPorts(ports []PortMap) error {
+	for i := range ports {
+		for _, f := range []*string{&ports[i].Source, &ports[i].Target, &ports[i].Address} {
+			if err := expandField(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func expandField(f *string) error {
+	expanded, err := expandEnvValue(*f)
+	if err != nil {
+		return err
+	}
+	*f = expanded
+	return nil
+}
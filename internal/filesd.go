@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileSDGroup is a target group in Prometheus file_sd format.
+type fileSDGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+var (
+	fileSDMu   sync.Mutex
+	fileSDPath string
+)
+
+// EnableFileSD writes the local addresses of every HTTP forward to path in
+// Prometheus file_sd format, keeping it up to date as forwards come and go.
+// An empty path stops updating the file.
+func EnableFileSD(path string) error {
+	fileSDMu.Lock()
+	fileSDPath = path
+	fileSDMu.Unlock()
+	return writeFileSD()
+}
+
+// writeFileSD regenerates the file_sd file if one is enabled.
+func writeFileSD() error {
+	fileSDMu.Lock()
+	defer fileSDMu.Unlock()
+	if fileSDPath == "" {
+		return nil
+	}
+
+	groups := fileSDTargets()
+	if groups == nil {
+		groups = []fileSDGroup{}
+	}
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Prometheus may read the file at any time, so replace it atomically.
+	return writeFileAtomic(fileSDPath, append(data, '\n'))
+}
+
+// updateFileSD regenerates the file_sd file, logging failures.
+func updateFileSD() {
+	if err := writeFileSD(); err != nil {
+		logrus.Errorf("%v", err)
+	}
+}
+
+// fileSDTargets returns one target group per running HTTP forward.
+func fileSDTargets() []fileSDGroup {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	var groups []fileSDGroup
+	for f := range forwards {
+		if f.entry.Protocol != protocolHTTP {
+			continue
+		}
+		f.mu.Lock()
+		g := fileSDGroup{
+			Labels: map[string]string{
+				"id":        f.entry.ID,
+				"context":   f.entry.Context,
+				"namespace": f.entry.Namespace,
+				"pod":       f.podName,
+				"entry":     f.entry.Resource(),
+			},
+		}
+		if f.entry.Kind == kindService {
+			g.Labels["service"] = f.entry.Name
+		}
+		for name, value := range f.entry.Labels {
+			g.Labels[name] = value
+		}
+		for _, l := range f.listeners {
+			g.Targets = append(g.Targets, scrapeAddress(f.entry.Network, l.Addr()))
+		}
+		f.mu.Unlock()
+		sort.Strings(g.Targets)
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Targets[0] < groups[j].Targets[0]
+	})
+	return groups
+}
+
+// scrapeAddress returns the address Prometheus on this host should use to
+// reach a listener, replacing wildcard addresses with loopback.
+func scrapeAddress(network string, addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		// Wildcard listeners on "tcp" are dual-stack.
+		if network == "tcp6" {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
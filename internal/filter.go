@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// validateTags checks the tags of an entry or context, which the -only and
+// -exclude flags list separated by commas.
+func validateTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.ContainsAny(tag, ", \t") {
+			return fmt.Errorf("invalid tag %q (expected no commas or whitespace)", tag)
+		}
+	}
+	return nil
+}
+
+// ParseList splits the comma separated values of the -only, -exclude,
+// -context and -namespace flags.
+func ParseList(list string) []string {
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// FilterTags removes the entries that have none of the tags in only, unless
+// only is empty, and those that have one of the tags in exclude. Entries
+// have the tags of their context besides their own.
+func (c *Config) FilterTags(only, exclude []string) {
+	if len(only) == 0 && len(exclude) == 0 {
+		return
+	}
+	c.filterEntries(func(ctx *Context, opts EntryOptions) bool {
+		return tagsMatch(append(slices.Clip(ctx.Tags), opts.Tags...), only, exclude)
+	})
+}
+
+// FilterScope removes the entries that aren't in one of contexts or one of
+// namespaces, unless they are empty. Contexts match by their name in the
+// config or in the kubeconfig, entries by the namespace they forward from.
+func (c *Config) FilterScope(contexts, namespaces []string) {
+	if len(contexts) == 0 && len(namespaces) == 0 {
+		return
+	}
+	c.filterEntries(func(ctx *Context, opts EntryOptions) bool {
+		if len(contexts) > 0 && !slices.Contains(contexts, ctx.displayName()) && !slices.Contains(contexts, ctx.Name) {
+			return false
+		}
+		namespace := opts.Namespace
+		if namespace == "" {
+			namespace = ctx.namespace(c)
+		}
+		return len(namespaces) == 0 || slices.Contains(namespaces, namespace)
+	})
+}
+
+// filterEntries removes the entries for which keep returns false. Contexts
+// left without entries are removed, so their clusters aren't connected to
+// at all. Services discovered by forward_all_services are kept if keep
+// accepts options without anything set.
+func (c *Config) filterEntries(keep func(ctx *Context, opts EntryOptions) bool) {
+	contexts := c.Contexts[:0]
+	for _, ctx := range c.Contexts {
+		drop := func(opts EntryOptions) bool { return !keep(&ctx, opts) }
+		ctx.Svc = slices.DeleteFunc(ctx.Svc, func(s Service) bool { return drop(s.EntryOptions) })
+		ctx.Pods = slices.DeleteFunc(ctx.Pods, func(p Pod) bool { return drop(p.EntryOptions) })
+		ctx.LabelSelectors = slices.DeleteFunc(ctx.LabelSelectors, func(s Selector) bool { return drop(s.EntryOptions) })
+		ctx.Deployments = slices.DeleteFunc(ctx.Deployments, func(w Workload) bool { return drop(w.EntryOptions) })
+		ctx.StatefulSets = slices.DeleteFunc(ctx.StatefulSets, func(w Workload) bool { return drop(w.EntryOptions) })
+		ctx.ReplicaSets = slices.DeleteFunc(ctx.ReplicaSets, func(w Workload) bool { return drop(w.EntryOptions) })
+		ctx.Remotes = slices.DeleteFunc(ctx.Remotes, func(r Remote) bool { return drop(r.EntryOptions) })
+		if ctx.ForwardAllServices && drop(EntryOptions{}) {
+			ctx.ForwardAllServices = false
+		}
+
+		if ctx.ForwardAllServices || len(ctx.Svc)+len(ctx.Pods)+len(ctx.LabelSelectors)+len(ctx.Deployments)+
+			len(ctx.StatefulSets)+len(ctx.ReplicaSets)+len(ctx.Remotes) > 0 {
+			contexts = append(contexts, ctx)
+		}
+	}
+	c.Contexts = contexts
+}
+
+// tagsMatch reports whether tags has one of only, if any, and none of
+// exclude.
+func tagsMatch(tags, only, exclude []string) bool {
+	for _, tag := range exclude {
+		if slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	if len(only) == 0 {
+		return true
+	}
+	for _, tag := range only {
+		if slices.Contains(tags, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,668 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// tunnelWaitTimeout bounds how long an accepted local connection waits for
+// the tunnel to be (re-)established before it is dropped.
+const tunnelWaitTimeout = 30 * time.Second
+
+// failoverWindow is how long a failed pod is passed over in favour of the
+// other pods matching an entry.
+const failoverWindow = time.Minute
+
+// forward owns the local listeners of a single entry and proxies every
+// accepted connection to the target pod. The listeners stay bound while the
+// tunnel behind them is re-established, so clients never see the local port
+// disappear during reconnects.
+type forward struct {
+	kube  *kubeClient
+	entry entry
+
+	mu        sync.Mutex
+	podName   string
+	tun       *tunnel
+	ready     chan struct{}
+	listeners []net.Listener
+
+	// noPods is set while the entry's selector matches no pods.
+	noPods bool
+
+	// downSince is when the tunnel was lost, while it is re-established.
+	downSince time.Time
+
+	// connectedAt is when the last tunnel was established.
+	connectedAt time.Time
+
+	// failures counts the consecutive failed attempts to establish a
+	// tunnel, see retry.
+	failures int
+
+	stats    forwardStats
+	throttle *throttle
+
+	// backends are the additional tunnels of a load-balanced forward,
+	// nextBackend counts the connections spread across them.
+	backends    []*backend
+	nextBackend int
+
+	// standbys are the tunnels kept open to take over from the main tunnel,
+	// if the entry asks for them.
+	standbys []*standby
+
+	// mirror receives a copy of the traffic of every connection, if the
+	// entry sets one.
+	mirror *mirror
+
+	// har records the HTTP exchanges of the forward, if the entry asks for
+	// it.
+	har *harRecorder
+
+	// failedPods maps the pods that failed within failoverWindow to when
+	// they failed, so pod selection fails over to the other pods first.
+	// reselected is set when a request failed on the pod, to select
+	// another one right away.
+	failedPods map[string]time.Time
+	reselected bool
+
+	// Connection tracking for scale-from-zero entries. scaledUp is set
+	// while the workload runs because k10ls scaled it up.
+	active     int
+	lastActive time.Time
+	scaledUp   bool
+}
+
+func newForward(kube *kubeClient, e entry) *forward {
+	return &forward{
+		kube:     kube,
+		entry:    e,
+		ready:    make(chan struct{}),
+		throttle: newThrottle(e),
+	}
+}
+
+// pod returns the name of the pod currently forwarded to.
+func (f *forward) pod() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.podName
+}
+
+// run binds the local listeners and keeps a tunnel to the pod open until
+// runCtx is cancelled. The pod is resolved again on every reconnect, so
+// service and label selector entries follow their pods. It only returns an
+// error for failures retrying can't fix.
+func (f *forward) run(runCtx context.Context) error {
+	var tlsConfig *tls.Config
+	if f.entry.TLS {
+		var err error
+		if tlsConfig, err = forwardTLSConfig(f.entry); err != nil {
+			return err
+		}
+	}
+
+	if f.entry.RecordHAR != "" {
+		f.har = newHARRecorder(f.entry.RecordHAR)
+	}
+	if f.entry.Mirror != "" {
+		f.mirror = newMirror(f.kube, f.entry)
+		defer f.mirror.close()
+	}
+
+	listeners := f.bind(runCtx)
+	if listeners == nil {
+		return nil
+	}
+	f.setListeners(listeners)
+	registerForward(f)
+	defer func() {
+		unregisterForward(f)
+		f.setListeners(nil)
+		for _, l := range listeners {
+			releaseListener(l)
+		}
+	}()
+
+	portArgs := make([]string, len(listeners))
+	for i, l := range listeners {
+		_, local, _ := net.SplitHostPort(l.Addr().String())
+		portArgs[i] = fmt.Sprintf("%s:%s", local, f.entry.Ports[i].Target)
+		served := l
+		if tlsConfig != nil {
+			served = tls.NewListener(l, tlsConfig)
+		}
+		go f.serve(runCtx, served, f.entry.Ports[i].Target)
+	}
+	if f.entry.ScaleFromZero != "" {
+		go f.scaleDownWhenIdle(runCtx)
+	}
+
+	if f.entry.Kind == kindRemote {
+		// The relay pod is deleted once no forward uses it anymore.
+		defer useHelper(helperRef{f.kube, f.entry.Namespace, relayPodName(f.entry)})()
+	}
+
+	pods := f.kube.podInformer(f.entry.Namespace)
+	defer pods.release()
+	if f.entry.LoadBalance > 1 {
+		go f.balance(runCtx, pods)
+	}
+	if f.entry.Standby > 0 {
+		go f.keepStandby(runCtx, pods)
+	}
+
+	for runCtx.Err() == nil {
+		core, cfg := f.kube.getCore()
+		failures := f.podFailures()
+		var podName string
+		var podUID types.UID
+		var tun *tunnel
+		var err error
+		if s := f.takeStandby(failures); s != nil {
+			// Take over the standby tunnel instead of dialing another pod.
+			podName, podUID, tun = s.pod, s.uid, s.tun
+			f.setPod(podName)
+			f.entry.log().Infof("Failing over to standby tunnel to pod %s", podName)
+		} else {
+			podName, err = resolvePod(runCtx, core, pods, f.entry, failures)
+			if errors.Is(err, errNoPods) {
+				// Keep the listeners bound, the service may be scaled back up.
+				f.waitingForPods(runCtx, err)
+				sleepContext(runCtx, f.entry.Reconnect.delay())
+				continue
+			}
+			var pod *corev1.Pod
+			if err == nil {
+				f.setPod(podName)
+				pod, err = core.getPod(runCtx, f.entry.Namespace, podName)
+			}
+			if apierrors.IsForbidden(err) {
+				// Retrying will not help until someone fixes the role bindings.
+				return fmt.Errorf("missing RBAC: %v", err)
+			}
+			if errors.Is(err, errNoSelector) {
+				return err
+			}
+			if err != nil {
+				f.failed("%v", err)
+				if err := f.retry(runCtx); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Respect the context's max_streams before opening another tunnel
+			// against its API server.
+			if !f.kube.acquireStream(runCtx) {
+				return nil
+			}
+			if !acquireReconnect(runCtx) {
+				f.kube.releaseStream()
+				return nil
+			}
+			tun, err = f.kube.dialTunnel(runCtx, core, cfg, f.entry, podName)
+			releaseReconnect()
+			if err != nil {
+				f.kube.releaseStream()
+				f.failed("%v", err)
+				f.podFailed(podName)
+				if _, retried := failures[podName]; !retried && f.entry.Kind != kindPod {
+					// Fail over to the next pod right away.
+					continue
+				}
+				if err := f.retry(runCtx); err != nil {
+					return err
+				}
+				continue
+			}
+			podUID = pod.UID
+		}
+		f.setTunnel(tun)
+		endpointChanged := f.kube.endpointChanged()
+
+		f.entry.log().Info(aurora.Green(aurora.Sprintf("Started port-forward for pod %s on %v via %s", aurora.Yellow(aurora.Bold(podName)), aurora.Cyan(aurora.Bold(portArgs)), tun.transport)))
+		for _, equiv := range f.kubectlCommands(podName, portArgs) {
+			f.entry.log().Info(aurora.Yellow(aurora.Sprintf("Equivalent kubectl command: %s", aurora.Cyan(equiv))))
+		}
+		if f.entry.CopyURL && f.stats.tunnels.Load() == 1 {
+			go f.copyURL()
+		}
+
+		// Tear the tunnel down as soon as the pod is deleted, evicted or
+		// replaced by a new pod with the same name (e.g. StatefulSets), so a
+		// new pod is picked right away instead of forwarding over a
+		// connection bound to the old pod.
+		gone, stopWatching := watchPod(core, pods, f.entry.Namespace, podName, podUID)
+		stopProbing := make(chan struct{})
+		if f.entry.HealthProbe != nil {
+			go f.probeTunnel(tun, stopProbing)
+		}
+		recreated := false
+		select {
+		case <-runCtx.Done():
+		case <-tun.Done():
+		case <-gone:
+			recreated = true
+		case <-endpointChanged:
+			// The kubeconfig now points elsewhere; reconnect right away
+			// instead of forwarding against the stale endpoint.
+			recreated = true
+		}
+		stopWatching()
+		close(stopProbing)
+		f.setTunnel(nil)
+		tun.Close()
+		f.kube.releaseStream()
+
+		if runCtx.Err() != nil {
+			return nil
+		}
+		if f.reselecting() {
+			continue
+		}
+		if recreated {
+			f.entry.log().Warnf("re-establishing port-forward for pod %s", podName)
+			continue
+		}
+		f.failed("lost connection to pod")
+		f.podFailed(podName)
+		if f.hasStandby() {
+			continue
+		}
+		if err := f.retry(runCtx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// kubectlCommands returns the kubectl commands equivalent to forwarding
+// portArgs to podName: one per local address, as kubectl port-forward
+// listens on the same addresses for all ports.
+func (f *forward) kubectlCommands(podName string, portArgs []string) []string {
+	kubectl := "kubectl"
+	if f.entry.KubeContext != "" {
+		kubectl += " --context " + f.entry.KubeContext
+	}
+	var addresses []string
+	ports := map[string][]string{}
+	for i, arg := range portArgs {
+		address := f.entry.portAddress(f.entry.Ports[i])
+		if _, ok := ports[address]; !ok {
+			addresses = append(addresses, address)
+		}
+		ports[address] = append(ports[address], arg)
+	}
+	commands := make([]string, len(addresses))
+	for i, address := range addresses {
+		commands[i] = fmt.Sprintf("%s -n %s port-forward pod/%s %s --address %s", kubectl, f.entry.Namespace, podName, strings.Join(ports[address], " "), address)
+	}
+	return commands
+}
+
+// retry waits before the next attempt to establish a tunnel after a failed
+// one, backing off according to the reconnect policy of the entry. It
+// returns an error once max_retries consecutive attempts have failed.
+func (f *forward) retry(runCtx context.Context) error {
+	f.mu.Lock()
+	f.failures++
+	n := f.failures
+	f.mu.Unlock()
+
+	if max := f.entry.Reconnect.maxRetries(); max > 0 && n > max {
+		return fmt.Errorf("giving up after %d failed attempts (max_retries = %d)", n, max)
+	}
+	d := f.entry.Reconnect.backoff(n)
+	if n > 1 {
+		f.entry.log().Debugf("reconnecting in %s after %d failed attempts", d.Round(time.Millisecond), n)
+	}
+	sleepContext(runCtx, d)
+	return nil
+}
+
+// setPod records the pod currently forwarded to.
+func (f *forward) setPod(podName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.podName = podName
+	f.noPods = false
+}
+
+// reselect drops tun, if it is still the current tunnel, so that another
+// pod is selected right away.
+func (f *forward) reselect(tun *tunnel) {
+	f.mu.Lock()
+	if tun == nil || f.tun != tun {
+		f.mu.Unlock()
+		return
+	}
+	f.markPodFailed(f.podName)
+	f.reselected = true
+	f.tun = nil
+	f.ready = make(chan struct{})
+	f.downSince = time.Now()
+	f.mu.Unlock()
+	tun.Close()
+}
+
+// reselecting reports whether the tunnel was dropped by reselect.
+func (f *forward) reselecting() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reselected
+}
+
+// podFailed records that the pod named name failed.
+func (f *forward) podFailed(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.markPodFailed(name)
+}
+
+// markPodFailed records that the pod named name failed. The caller must
+// hold f.mu.
+func (f *forward) markPodFailed(name string) {
+	if f.failedPods == nil {
+		f.failedPods = map[string]time.Time{}
+	}
+	f.failedPods[name] = time.Now()
+}
+
+// podFailures returns the pods that failed within failoverWindow for the
+// next pod selection, forgetting older failures.
+func (f *forward) podFailures() map[string]time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reselected = false
+	failures := map[string]time.Time{}
+	for name, t := range f.failedPods {
+		if time.Since(t) > failoverWindow {
+			delete(f.failedPods, name)
+			continue
+		}
+		failures[name] = t
+	}
+	return failures
+}
+
+// waitingForPods reports that the entry's selector matches no pods. The
+// first time this happens it is logged as a warning and the entry's
+// zero_pods_hook is run.
+func (f *forward) waitingForPods(runCtx context.Context, err error) {
+	f.mu.Lock()
+	first := !f.noPods
+	f.noPods = true
+	f.mu.Unlock()
+
+	if !first {
+		f.entry.log().Debugf("%v, retrying", err)
+		return
+	}
+	f.entry.log().Warnf("%v, waiting for pods to appear", err)
+	recordDiagnostic(f.entry, err.Error())
+	if f.entry.ZeroPodsHook != "" {
+		go runHook(runCtx, f.entry, f.entry.ZeroPodsHook)
+	}
+}
+
+// bind opens one local listener per port mapping, retrying until it succeeds
+// or runCtx is cancelled.
+func (f *forward) bind(runCtx context.Context) []net.Listener {
+	for runCtx.Err() == nil {
+		listeners := make([]net.Listener, 0, len(f.entry.Ports))
+		var err error
+		var address string
+		for _, p := range f.entry.Ports {
+			var l net.Listener
+			address = f.entry.portAddress(p)
+			l, err = listen(f.entry.Network, address, p.Source)
+			if err != nil && portUnavailable(err) && f.entry.PortRemap != "" && f.entry.PortRemap != portRemapOff {
+				l, err = f.remap(address, p.Source, err)
+			}
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		if err == nil {
+			return listeners
+		}
+
+		for _, l := range listeners {
+			releaseListener(l)
+		}
+		if errors.Is(err, errHandedOff) {
+			return nil
+		}
+		f.failed("unable to listen on %s: %v", address, err)
+		sleepContext(runCtx, f.entry.Reconnect.delay())
+	}
+	return nil
+}
+
+// remap listens on another port of address in place of the unavailable
+// port source according to the port_remap policy of the entry, reporting
+// the substitution. It returns cause if no other port is free either.
+func (f *forward) remap(address, source string, cause error) (net.Listener, error) {
+	l, err := listenRemapped(f.entry.Network, address, source, f.entry.PortRemap)
+	if err != nil {
+		f.entry.log().Debugf("failed to remap port %s: %v", source, err)
+		return nil, cause
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	msg := fmt.Sprintf("port %s is unavailable (%v), listening on port %s instead", source, cause, port)
+	f.entry.log().Warnf("%s: %s", f.entry.describe(), msg)
+	recordDiagnostic(f.entry, msg)
+	return l, nil
+}
+
+// serve accepts local connections on l and proxies them to the given port
+// of the pod. It returns once l is closed.
+func (f *forward) serve(runCtx context.Context, l net.Listener, port string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.Debugf("failed to accept connection on %s: %v", l.Addr(), err)
+			sleepContext(runCtx, 100*time.Millisecond)
+			continue
+		}
+
+		activeConns.Add(1)
+		go func() {
+			defer activeConns.Done()
+			defer conn.Close()
+			defer recoverPanic("connection to " + f.entry.Key)
+
+			f.connected(runCtx)
+			defer f.disconnected()
+
+			start := time.Now()
+			f.stats.connections.Add(1)
+			cc := &countingConn{Conn: conn, stats: &f.stats}
+			client := clientIP(conn.RemoteAddr())
+			err := f.throttle.acquire(runCtx, client)
+			if err == nil {
+				f.logConnection("Connection from %s to port %s of pod %s opened", conn.RemoteAddr(), port, f.pod())
+				err = f.handle(runCtx, f.throttle.wrap(runCtx, cc, client), port)
+				f.throttle.release(client)
+			}
+			if err != nil {
+				f.logConnection("Connection from %s to port %s failed after %v: %v", conn.RemoteAddr(), port, time.Since(start).Round(time.Millisecond), err)
+			} else {
+				f.logConnection("Connection from %s to port %s closed after %v, %d bytes sent, %d received", conn.RemoteAddr(), port, time.Since(start).Round(time.Millisecond), cc.read.Load(), cc.written.Load())
+			}
+
+			rec := AuditRecord{
+				Time:          start,
+				Client:        conn.RemoteAddr().String(),
+				Local:         conn.LocalAddr().String(),
+				Context:       f.entry.Context,
+				Namespace:     f.entry.Namespace,
+				ID:            f.entry.ID,
+				Entry:         f.entry.Resource(),
+				Pod:           f.pod(),
+				Port:          port,
+				BytesSent:     cc.read.Load(),
+				BytesReceived: cc.written.Load(),
+				Duration:      time.Since(start).Seconds(),
+				Labels:        f.entry.Labels,
+			}
+			if err != nil {
+				rec.Error = Redact(err.Error())
+			}
+			writeAudit(rec)
+		}()
+	}
+}
+
+// logConnection logs an event of a local connection, at info level if the
+// entry sets log_connections.
+func (f *forward) logConnection(format string, args ...interface{}) {
+	if f.entry.LogConnections {
+		f.entry.log().Infof(format, args...)
+	} else {
+		f.entry.log().Debugf(format, args...)
+	}
+}
+
+// handle proxies a single local connection through the current tunnel.
+func (f *forward) handle(runCtx context.Context, conn net.Conn, port string) error {
+	tun, err := f.waitTunnel(runCtx)
+	if err != nil {
+		f.entry.log().Debugf("dropping connection from %s to %s: %v", conn.RemoteAddr(), f.pod(), err)
+		return err
+	}
+	if f.mirror != nil {
+		mc := f.mirror.wrap(runCtx, conn, port)
+		defer mc.finish()
+		conn = mc
+	}
+	switch {
+	case f.entry.Protocol == protocolHTTP && (f.entry.RewriteURLs || f.entry.ReadOnly || f.entry.Retries > 0 || f.har != nil):
+		return f.handleHTTP(runCtx, tun, conn, port)
+	case f.entry.Protocol == protocolRedis && f.entry.ReadOnly:
+		return f.handleProxied(tun, conn, port, proxyRedisReadOnly)
+	case f.entry.Protocol == protocolPostgres && f.entry.ReadOnly:
+		return f.handleProxied(tun, conn, port, proxyPostgresReadOnly)
+	}
+	if err := tun.proxy(conn, port); err != nil {
+		f.failed("%v", err)
+		return err
+	}
+	return nil
+}
+
+// handleProxied proxies a local connection through tun with a protocol
+// aware proxy, e.g. to rewrite URLs or block writes.
+func (f *forward) handleProxied(tun *tunnel, conn net.Conn, port string, proxy func(client, upstream net.Conn) error) error {
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tun.proxy(remote, port)
+		remote.Close()
+	}()
+
+	err := proxy(conn, local)
+	local.Close()
+	if tunErr := <-errc; tunErr != nil {
+		err = tunErr
+	}
+	if err != nil {
+		f.failed("%v", err)
+	}
+	return err
+}
+
+// handleHTTP proxies a local connection with proxyHTTP through tun, the
+// tunnel handle picked, connecting to the pod again as needed so that
+// failed requests can be retried.
+func (f *forward) handleHTTP(runCtx context.Context, tun *tunnel, conn net.Conn, port string) error {
+	upstream := &httpUpstream{f: f, runCtx: runCtx, port: port, retries: f.entry.Retries, next: tun}
+	err := proxyHTTP(conn, upstream, f.entry.RewriteURLs, f.entry.ReadOnly, f.har)
+	if tunErr := upstream.close(); tunErr != nil {
+		err = tunErr
+	}
+	if err != nil {
+		f.failed("%v", err)
+	}
+	return err
+}
+
+// setTunnel publishes tun as the tunnel new connections are proxied
+// through. Passing nil makes new connections wait for the next tunnel.
+func (f *forward) setTunnel(tun *tunnel) {
+	f.mu.Lock()
+	var outage time.Duration
+	switch {
+	case tun != nil && !f.downSince.IsZero():
+		outage = time.Since(f.downSince)
+		f.downSince = time.Time{}
+	case tun == nil && f.tun != nil:
+		f.downSince = time.Now()
+	}
+	switch {
+	case tun != nil:
+		f.stats.tunnels.Add(1)
+		f.connectedAt = time.Now()
+		f.failures = 0
+		close(f.ready)
+	case f.tun != nil:
+		f.ready = make(chan struct{})
+	}
+	f.tun = tun
+	f.mu.Unlock()
+
+	if outage > 0 {
+		recordDowntime(f.entry, outage)
+	}
+	updateEndpoints()
+}
+
+// waitTunnel returns the current tunnel, waiting for it to be established
+// if a reconnect is in progress.
+func (f *forward) waitTunnel(runCtx context.Context) (*tunnel, error) {
+	wait := tunnelWaitTimeout
+	if f.entry.ScaleFromZero != "" {
+		// Give the workload time to start.
+		wait = scaleWaitTimeout
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+
+	for {
+		f.mu.Lock()
+		tun, ready := f.tun, f.ready
+		if tun != nil {
+			tun = f.nextTunnel(tun)
+		}
+		f.mu.Unlock()
+		if tun != nil {
+			return tun, nil
+		}
+
+		select {
+		case <-ready:
+		case <-runCtx.Done():
+			return nil, runCtx.Err()
+		case <-timeout.C:
+			return nil, fmt.Errorf("timed out waiting for tunnel")
+		}
+	}
+}
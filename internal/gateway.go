@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/yaml"
+)
+
+// serviceAccountNamespace holds the namespace of the pod k10ls runs in when
+// deployed in-cluster.
+const serviceAccountNamespace = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Gateway configures in-cluster gateway mode: forwards bind the pod IP
+// instead of every interface, and a Service exposing them to the rest of
+// the cluster is generated.
+type Gateway struct {
+	Enabled   bool              `toml:"enabled"`
+	Service   string            `toml:"service,omitempty"`
+	Namespace string            `toml:"namespace,omitempty"`
+	Type      string            `toml:"type,omitempty"`
+	Selector  map[string]string `toml:"selector,omitempty"`
+	Apply     bool              `toml:"apply,omitempty"`
+}
+
+// ApplyGateway binds forwards without an explicit address to the pod IP
+// when gateway mode is enabled.
+func (c *Config) ApplyGateway() error {
+	if c.Gateway == nil || !c.Gateway.Enabled || c.DefaultAddress != "" {
+		return nil
+	}
+	ip, err := podIP()
+	if err != nil {
+		return fmt.Errorf("gateway: %v", err)
+	}
+	c.DefaultAddress = ip
+	return nil
+}
+
+// podIP returns the IP of the pod k10ls runs in, preferring the POD_IP
+// variable set through the downward API.
+func podIP() (string, error) {
+	if ip := os.Getenv("POD_IP"); ip != "" {
+		return ip, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine pod IP: %v", err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && !n.IP.IsLoopback() && n.IP.To4() != nil {
+			return n.IP.String(), nil
+		}
+	}
+	return "", fmt.Errorf("failed to determine pod IP: set POD_IP or default_address")
+}
+
+// GatewayService builds the Service exposing every fixed local port of
+// config to the cluster.
+func GatewayService(config *Config) (*corev1.Service, error) {
+	gw := config.Gateway
+	if gw == nil {
+		gw = &Gateway{}
+	}
+
+	name := gw.Service
+	if name == "" {
+		name = "k10ls-gateway"
+	}
+	namespace := gw.Namespace
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		if data, err := os.ReadFile(serviceAccountNamespace); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	serviceType := corev1.ServiceTypeClusterIP
+	switch gw.Type {
+	case "", "ClusterIP":
+	case "NodePort":
+		serviceType = corev1.ServiceTypeNodePort
+	default:
+		return nil, fmt.Errorf("gateway: unsupported service type %q", gw.Type)
+	}
+	selector := gw.Selector
+	if len(selector) == 0 {
+		selector = map[string]string{"app": "k10ls"}
+	}
+
+	desired, err := desiredEntries(config)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int]bool{}
+	var ports []corev1.ServicePort
+	for _, d := range desired {
+		for _, p := range d.entry.Ports {
+			port, err := strconv.Atoi(p.Source)
+			if err != nil || port == 0 || seen[port] {
+				// randomly assigned ports can't be exposed
+				continue
+			}
+			seen[port] = true
+			ports = append(ports, corev1.ServicePort{
+				Name:       fmt.Sprintf("p%d", port),
+				Protocol:   corev1.ProtocolTCP,
+				Port:       int32(port),
+				TargetPort: intstr.FromInt32(int32(port)),
+			})
+		}
+	}
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("gateway: no entry has a fixed local port to expose")
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    map[string]string{"app.kubernetes.io/managed-by": "k10ls"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:     serviceType,
+			Selector: selector,
+			Ports:    ports,
+		},
+	}, nil
+}
+
+// GatewayManifest renders the gateway Service as YAML.
+func GatewayManifest(config *Config) ([]byte, error) {
+	svc, err := GatewayService(config)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(svc)
+}
+
+// ApplyGatewayService creates or updates the gateway Service using the
+// in-cluster service account. It fails when not running in a cluster rather
+// than applying the Service with a local kubeconfig.
+func ApplyGatewayService(ctx context.Context, config *Config) error {
+	svc, err := GatewayService(config)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+
+	restConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return fmt.Errorf("gateway: applying the service needs to run in a cluster: %v", err)
+	}
+	clientset, _, err := newClientset(restConfig)
+	if err != nil {
+		return fmt.Errorf("gateway: %v", err)
+	}
+	force := true
+	_, err = clientset.CoreV1().Services(svc.Namespace).Patch(ctx, svc.Name, types.ApplyPatchType, data,
+		metav1.PatchOptions{FieldManager: "k10ls", Force: &force})
+	if err != nil {
+		return fmt.Errorf("failed to apply gateway service %s/%s: %v", svc.Namespace, svc.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limits of HAR recordings. Bodies beyond maxHARBody are truncated, and
+// only the last maxHAREntries exchanges are kept.
+const (
+	maxHARBody    = 1 << 20
+	maxHAREntries = 1000
+)
+
+// harFile is an HTTP Archive (HAR 1.2) document.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	Cookies     []harNameValue `json:"cookies"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Headers     []harNameValue `json:"headers"`
+	Cookies     []harNameValue `json:"cookies"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harRecorder records the exchanges of a forward to a HAR file, which is
+// rewritten after every exchange.
+type harRecorder struct {
+	path string
+
+	mu      sync.Mutex
+	entries []harEntry
+}
+
+// newHARRecorder returns a recorder writing to path.
+func newHARRecorder(path string) *harRecorder {
+	return &harRecorder{path: path}
+}
+
+// bodyCapture keeps the first maxHARBody bytes read through it while
+// counting all of them.
+type bodyCapture struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	size int64
+}
+
+func (b *bodyCapture) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	if room := maxHARBody - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(n, room)])
+	}
+	return n, err
+}
+
+// captureBody replaces *body with a reader capturing what is read from it.
+func captureBody(body *io.ReadCloser) *bodyCapture {
+	if *body == nil || *body == http.NoBody {
+		return nil
+	}
+	c := &bodyCapture{ReadCloser: *body}
+	*body = c
+	return c
+}
+
+// record adds an exchange to the recording. reqBody and respBody hold what
+// was captured of the bodies, if any.
+func (r *harRecorder) record(start, answered time.Time, req *http.Request, reqBody *bodyCapture, resp *http.Response, respBody *bodyCapture) {
+	u := url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: req.URL.RawQuery}
+	e := harEntry{
+		StartedDateTime: start,
+		Time:            millis(time.Since(start)),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			Cookies:     []harNameValue{},
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprint(resp.StatusCode))),
+			HTTPVersion: resp.Proto,
+			Headers:     harHeaders(resp.Header),
+			Cookies:     []harNameValue{},
+			Content:     harContent{MimeType: resp.Header.Get("Content-Type")},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+		},
+		Timings: harTimings{
+			Wait:    millis(answered.Sub(start)),
+			Receive: millis(time.Since(answered)),
+		},
+	}
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	if reqBody != nil {
+		e.Request.BodySize = reqBody.size
+		text, encoding := harText(reqBody.buf.Bytes())
+		e.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: text, Encoding: encoding}
+	}
+	if respBody != nil {
+		e.Response.BodySize = respBody.size
+		e.Response.Content.Size = respBody.size
+		e.Response.Content.Text, e.Response.Content.Encoding = harText(respBody.buf.Bytes())
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, e)
+	if len(r.entries) > maxHAREntries {
+		r.entries = r.entries[len(r.entries)-maxHAREntries:]
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "k10ls", Version: "1"},
+		Entries: r.entries,
+	}}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(r.path, append(data, '\n'))
+	}
+	if err != nil {
+		logrus.Errorf("failed to write HAR recording: %v", err)
+	}
+}
+
+// harHeaders converts h to HAR name/value pairs.
+func harHeaders(h http.Header) []harNameValue {
+	out := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			out = append(out, harNameValue{Name: k, Value: v})
+		}
+	}
+	return out
+}
+
+// harText returns body as HAR text, base64 encoded unless it is UTF-8.
+func harText(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// millis returns d in milliseconds.
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// hopHeaders are not replayed, as they describe the recorded connection.
+var hopHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Te":                true,
+	"Trailer":           true,
+}
+
+// ReplayHAR sends every request recorded in the HAR file at path to
+// target, e.g. "http://localhost:8081", and writes the recorded and the
+// new status of each to out. Only requests whose URL contains filter are
+// sent.
+func ReplayHAR(path, target, filter string, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	base, err := url.Parse(target)
+	if err != nil || base.Host == "" {
+		return fmt.Errorf("invalid target %q (expected e.g. http://localhost:8081)", target)
+	}
+	client := &http.Client{
+		Timeout: time.Minute,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var failed int
+	for _, e := range har.Log.Entries {
+		if filter != "" && !strings.Contains(e.Request.URL, filter) {
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return fmt.Errorf("invalid recorded URL %q: %v", e.Request.URL, err)
+		}
+		u.Scheme, u.Host = base.Scheme, base.Host
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+
+		var body io.Reader
+		if pd := e.Request.PostData; pd != nil {
+			b := []byte(pd.Text)
+			if pd.Encoding == "base64" {
+				if b, err = base64.StdEncoding.DecodeString(pd.Text); err != nil {
+					return fmt.Errorf("invalid recorded body of %s: %v", e.Request.URL, err)
+				}
+			}
+			body = bytes.NewReader(b)
+		}
+		req, err := http.NewRequest(e.Request.Method, u.String(), body)
+		if err != nil {
+			return err
+		}
+		for _, h := range e.Request.Headers {
+			if !hopHeaders[http.CanonicalHeaderKey(h.Name)] {
+				req.Header.Add(h.Name, h.Value)
+			}
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "%s %s\t%d → error: %v\n", req.Method, u.RequestURI(), e.Response.Status, err)
+			continue
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		mark := ""
+		if resp.StatusCode != e.Response.Status {
+			failed++
+			mark = "\t(differs)"
+		}
+		fmt.Fprintf(out, "%s %s\t%d → %d%s\n", req.Method, u.RequestURI(), e.Response.Status, resp.StatusCode, mark)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d replayed requests failed or got a different status", failed)
+	}
+	return nil
+}
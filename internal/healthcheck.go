@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Defaults of health probes that leave out a setting.
+const (
+	defaultProbeInterval = 30 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+	defaultProbeFailures = 3
+)
+
+// HealthProbe periodically checks that the tunnel of a forward still
+// reaches every forwarded port of the pod. Without Path the probe opens a
+// TCP connection to the port, with Path it sends an HTTP GET request and
+// expects a 2xx or 3xx response. After Failures consecutive failed probes
+// the tunnel is torn down and re-established.
+type HealthProbe struct {
+	Interval time.Duration `toml:"interval,omitempty"`
+	Timeout  time.Duration `toml:"timeout,omitempty"`
+	Failures int           `toml:"failures,omitempty"`
+	Path     string        `toml:"path,omitempty"`
+}
+
+// validate checks the settings of the probe.
+func (p *HealthProbe) validate() error {
+	switch {
+	case p == nil:
+		return nil
+	case p.Interval < 0 || p.Timeout < 0:
+		return fmt.Errorf("health_probe: interval and timeout must not be negative")
+	case p.Failures < 0:
+		return fmt.Errorf("health_probe: failures must not be negative")
+	case p.Path != "" && !strings.HasPrefix(p.Path, "/"):
+		return fmt.Errorf("health_probe: path must start with /")
+	}
+	return nil
+}
+
+func (p *HealthProbe) interval() time.Duration {
+	if p.Interval == 0 {
+		return defaultProbeInterval
+	}
+	return p.Interval
+}
+
+func (p *HealthProbe) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return defaultProbeTimeout
+	}
+	return p.Timeout
+}
+
+func (p *HealthProbe) failures() int {
+	if p.Failures == 0 {
+		return defaultProbeFailures
+	}
+	return p.Failures
+}
+
+// probeTunnel probes every forwarded port through tun until stop is closed,
+// closing tun once the probes failed too often in a row.
+func (f *forward) probeTunnel(tun *tunnel, stop <-chan struct{}) {
+	p := f.entry.HealthProbe
+	ticker := time.NewTicker(p.interval())
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tun.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		for _, port := range f.entry.Ports {
+			if err = tun.probe(port.Target, p.Path, p.timeout()); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		f.entry.log().Warnf("health probe of %s failed (%d of %d): %v", f.entry.describe(), failures, p.failures(), err)
+		if failures >= p.failures() {
+			msg := fmt.Sprintf("%d health probes failed in a row, re-establishing tunnel", failures)
+			f.entry.log().Warn(msg)
+			recordDiagnostic(f.entry, msg)
+			tun.Close()
+			return
+		}
+	}
+}
+
+// probe checks within timeout that port of the pod is reachable through
+// the tunnel: that the API server still opens streams on it, that the pod
+// doesn't refuse the connection and, with an HTTP path, that the port
+// answers a GET request for it successfully.
+func (t *tunnel) probe(port, path string, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() { result <- t.probeStreams(port, path, timeout/2) }()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err
+	case <-timer.C:
+		// A stale tunnel never answers. probeStreams returns once the
+		// tunnel gives up on the streams or is closed.
+		return fmt.Errorf("port %s: no answer within %s", port, timeout)
+	}
+}
+
+// probeStreams opens a connection to port through the tunnel. The pod
+// reports a refused connection on the error stream right away, so a TCP
+// probe succeeds once grace passes without one.
+func (t *tunnel) probeStreams(port, path string, grace time.Duration) error {
+	requestID := t.requestID.Add(1)
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, port)
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+	errorStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("port %s: %v", port, err)
+	}
+	errorStream.Close()
+	defer t.conn.RemoveStreams(errorStream)
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("port %s: %v", port, err)
+	}
+	defer t.conn.RemoveStreams(dataStream)
+	defer dataStream.Reset()
+
+	refused := make(chan string, 1)
+	go func() {
+		message, _ := io.ReadAll(errorStream)
+		refused <- string(message)
+	}()
+	wait := time.NewTimer(grace)
+	defer wait.Stop()
+
+	if path != "" {
+		err := probeHTTP(dataStream, path)
+		if err == nil {
+			return nil
+		}
+		select {
+		case message := <-refused:
+			if message != "" {
+				return fmt.Errorf("port %s: %s", port, message)
+			}
+		case <-wait.C:
+		}
+		return fmt.Errorf("port %s: %v", port, err)
+	}
+
+	select {
+	case message := <-refused:
+		if message != "" {
+			return fmt.Errorf("port %s: %s", port, message)
+		}
+	case <-wait.C:
+	}
+	return nil
+}
+
+// probeHTTP sends a GET request for path over conn and checks the status
+// of the response.
+func probeHTTP(conn io.ReadWriter, path string) error {
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nUser-Agent: k10ls-probe\r\nConnection: close\r\n\r\n", path); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Labels and annotations of the helper pods k10ls creates in clusters,
+// such as relay and echo pods. The session label and owner annotations tell
+// which k10ls process created a helper, so leaked helpers can be told apart
+// from those still in use.
+const (
+	managedByLabel      = "app.kubernetes.io/managed-by"
+	componentLabel      = "app.kubernetes.io/component"
+	sessionLabel        = "k10ls.io/session"
+	ownerHostAnnotation = "k10ls.io/owner-host"
+	ownerPIDAnnotation  = "k10ls.io/owner-pid"
+	managedByK10ls      = "k10ls"
+)
+
+// helperDeleteTimeout bounds deleting a helper pod, which also happens
+// while shutting down.
+const helperDeleteTimeout = 30 * time.Second
+
+// session identifies this k10ls process on the helpers it creates.
+var session = newSessionID()
+
+func newSessionID() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// helperMeta returns the metadata of a helper pod of this process.
+func helperMeta(component string) metav1.ObjectMeta {
+	host, _ := os.Hostname()
+	return metav1.ObjectMeta{
+		Labels: map[string]string{
+			managedByLabel: managedByK10ls,
+			componentLabel: component,
+			sessionLabel:   session,
+		},
+		Annotations: map[string]string{
+			ownerHostAnnotation: host,
+			ownerPIDAnnotation:  strconv.Itoa(os.Getpid()),
+		},
+	}
+}
+
+// helperRef identifies a helper pod in the cluster of a context.
+type helperRef struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+}
+
+// helperRefs counts the forwards using each helper pod.
+var helperRefs struct {
+	sync.Mutex
+	refs map[helperRef]int
+}
+
+// useHelper records that a forward uses the helper pod ref, which may not
+// exist yet. The pod is deleted once the last forward using it calls the
+// returned release function, at the latest when k10ls shuts down.
+func useHelper(ref helperRef) (release func()) {
+	helperRefs.Lock()
+	if helperRefs.refs == nil {
+		helperRefs.refs = map[helperRef]int{}
+	}
+	helperRefs.refs[ref]++
+	helperRefs.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			helperRefs.Lock()
+			helperRefs.refs[ref]--
+			last := helperRefs.refs[ref] == 0
+			if last {
+				delete(helperRefs.refs, ref)
+			}
+			helperRefs.Unlock()
+			if last {
+				deleteHelper(ref)
+			}
+		})
+	}
+}
+
+// deleteHelper deletes the helper pod ref, logging the outcome.
+func deleteHelper(ref helperRef) {
+	// Clean up even while shutting down.
+	ctx, cancel := context.WithTimeout(context.Background(), helperDeleteTimeout)
+	defer cancel()
+	core, _ := ref.kube.getCore()
+	err := core.deletePod(ctx, ref.namespace, ref.name)
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		logrus.Errorf("Failed to delete helper pod %s/%s, remove it with k10ls gc: %v", ref.namespace, ref.name, err)
+	default:
+		logrus.Infof("Deleted helper pod %s/%s", ref.namespace, ref.name)
+	}
+}
+
+// HelperPod is a helper pod found by CollectGarbage.
+type HelperPod struct {
+	Context   string
+	Namespace string
+	Name      string
+	Component string
+	// Owner is the host and PID of the k10ls process that created the pod.
+	Owner   string
+	Created time.Time
+	// Leaked is set when the process that created the pod is gone. Pods
+	// created on other hosts, which have OtherHost set, are never
+	// considered leaked.
+	Leaked    bool
+	OtherHost bool
+	// Deleted is set once the pod was deleted, Error if that failed.
+	Deleted bool
+	Error   string
+}
+
+// CollectGarbage lists the helper pods in the clusters of every context of
+// config and deletes the leaked ones, or every one of them with all. With
+// dryRun nothing is deleted.
+func CollectGarbage(ctx context.Context, config *Config, all, dryRun bool) ([]HelperPod, error) {
+	host, _ := os.Hostname()
+	seen := map[string]bool{}
+	var helpers []HelperPod
+	for i := range config.Contexts {
+		c := &config.Contexts[i]
+		kube, err := newContextClient(ctx, c, config)
+		if err != nil {
+			return helpers, fmt.Errorf("context %s: %v", c.displayName(), err)
+		}
+		core, cfg := kube.getCore()
+		pods, err := listHelpers(ctx, core, c, config)
+		if err != nil {
+			return helpers, fmt.Errorf("context %s: %v", c.displayName(), err)
+		}
+		for _, pod := range pods {
+			// Contexts of the same cluster find the same pods.
+			id := cfg.Host + "/" + pod.Namespace + "/" + pod.Name
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			h := HelperPod{
+				Context:   c.displayName(),
+				Namespace: pod.Namespace,
+				Name:      pod.Name,
+				Component: pod.Labels[componentLabel],
+				Owner:     pod.Annotations[ownerHostAnnotation] + ":" + pod.Annotations[ownerPIDAnnotation],
+				Created:   pod.CreationTimestamp.Time,
+				Leaked:    helperLeaked(pod, host),
+			}
+			if owner, ok := pod.Annotations[ownerHostAnnotation]; ok && owner != host {
+				h.OtherHost = true
+			}
+			if (all || h.Leaked) && !dryRun {
+				err := core.deletePod(ctx, pod.Namespace, pod.Name)
+				if err != nil && !apierrors.IsNotFound(err) {
+					h.Error = err.Error()
+				} else {
+					h.Deleted = true
+				}
+			}
+			helpers = append(helpers, h)
+		}
+	}
+	return helpers, nil
+}
+
+// listHelpers returns the helper pods in every namespace of the cluster of
+// c, or only in the namespaces c forwards from if pods can't be listed
+// cluster-wide.
+func listHelpers(ctx context.Context, core coreClient, c *Context, config *Config) ([]corev1.Pod, error) {
+	opts := metav1.ListOptions{LabelSelector: labels.Set{managedByLabel: managedByK10ls}.String()}
+	pods, err := core.listPods(ctx, metav1.NamespaceAll, opts)
+	if err == nil {
+		return pods.Items, nil
+	}
+	if !apierrors.IsForbidden(err) {
+		return nil, err
+	}
+
+	namespaces := map[string]bool{c.namespace(config): true}
+	entries, err := c.entries(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		namespaces[e.Namespace] = true
+	}
+	var names []string
+	for ns := range namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	var items []corev1.Pod
+	for _, ns := range names {
+		pods, err := core.listPods(ctx, ns, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, pods.Items...)
+	}
+	return items, nil
+}
+
+// helperLeaked reports whether the helper pod was created on host by a
+// k10ls process that is gone. Helpers without owner annotations predate
+// them and are leaked too.
+func helperLeaked(pod corev1.Pod, host string) bool {
+	owner, ok := pod.Annotations[ownerHostAnnotation]
+	if !ok {
+		return true
+	}
+	if owner != host {
+		return false
+	}
+	pid, err := strconv.Atoi(pod.Annotations[ownerPIDAnnotation])
+	return err != nil || !processAlive(pid)
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// runHook runs the shell command hook on behalf of e. Its output goes to the
+// log.
+func runHook(ctx context.Context, e entry, hook string) {
+	cmd := hookCommand(ctx, e, hook)
+	out, err := cmd.CombinedOutput()
+	log := e.log()
+	if len(out) > 0 {
+		log.Infof("Hook output: %s", Redact(string(out)))
+	}
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("Hook %q failed: %v", hook, err)
+	}
+}
+
+// hookCommand returns the shell command hook, describing e in K10LS_*
+// environment variables.
+func hookCommand(ctx context.Context, e entry, hook string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", hook)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"K10LS_ENTRY="+e.Key,
+		"K10LS_ENTRY_ID="+e.ID,
+		"K10LS_CONTEXT="+e.KubeContext,
+		"K10LS_NAMESPACE="+e.Namespace,
+		"K10LS_KIND="+e.Kind,
+		"K10LS_NAME="+e.Name,
+	)
+	cmd.Env = append(cmd.Env, labelEnv(e)...)
+	return cmd
+}
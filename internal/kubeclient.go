@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// defaultKubeConfigRefresh is how often kubeconfigs kept in a secret store
+// are fetched again when no refresh interval is configured.
+const defaultKubeConfigRefresh = 15 * time.Minute
+
+// kubeClient holds the clients and REST config of a context. They are
+// swapped when the kubeconfig changes, so every new tunnel picks up the
+// current endpoint and credentials.
+type kubeClient struct {
+	mu   sync.RWMutex
+	core coreClient
+	cfg  *rest.Config
+
+	// lightweight serves the API with plain REST calls instead of a full
+	// clientset.
+	lightweight bool
+
+	// streams limits the number of tunnels open against the API server at
+	// once. It is nil when the context sets no max_streams.
+	streams chan struct{}
+
+	// changed is closed when the API server endpoint changes, so tunnels
+	// still open against the old endpoint can be re-established.
+	changed chan struct{}
+
+	// pins are the certificate fingerprints the API server must present,
+	// nil when the context doesn't pin any.
+	pins certPins
+
+	// protocol is the port-forward protocol of tunnels, see
+	// negotiateTunnel. spdyFallback is set once the API server accepted
+	// SPDY but not WebSocket tunnels, proxyFallback once it accepted
+	// neither.
+	protocol      string
+	spdyFallback  atomic.Bool
+	proxyFallback atomic.Bool
+
+	// informers are the running pod informers by namespace.
+	informersMu sync.Mutex
+	informers   map[string]*podInformer
+}
+
+// acquireStream blocks until a tunnel may be opened or ctx is cancelled.
+// It reports whether a slot was acquired.
+func (k *kubeClient) acquireStream(ctx context.Context) bool {
+	if k.streams == nil {
+		return true
+	}
+	select {
+	case k.streams <- struct{}{}:
+		return true
+	default:
+	}
+
+	logrus.Debugf("max_streams reached, queuing tunnel")
+	select {
+	case k.streams <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseStream frees a slot taken by acquireStream.
+func (k *kubeClient) releaseStream() {
+	if k.streams != nil {
+		<-k.streams
+	}
+}
+
+// getCore returns the client of the core API and the REST config.
+func (k *kubeClient) getCore() (coreClient, *rest.Config) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.core, k.cfg
+}
+
+// set builds the clients for cfg and switches to them.
+func (k *kubeClient) set(cfg *rest.Config) error {
+	registerConfigSecrets(cfg)
+	var core coreClient
+	if k.lightweight {
+		rc, err := newRESTCore(cfg)
+		if err != nil {
+			return err
+		}
+		core = rc
+	} else {
+		clientset, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create clientset: %v", err)
+		}
+		core = clientsetCore{clientset}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.cfg != nil && k.cfg.Host != cfg.Host {
+		logrus.Warnf("API server endpoint changed from %s to %s", k.cfg.Host, cfg.Host)
+		close(k.changed)
+		k.changed = make(chan struct{})
+		k.spdyFallback.Store(false)
+		k.proxyFallback.Store(false)
+	}
+	k.core, k.cfg = core, cfg
+	return nil
+}
+
+// endpointChanged returns a channel closed once the API server endpoint of
+// the client changes.
+func (k *kubeClient) endpointChanged() <-chan struct{} {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.changed
+}
+
+// newContextClient builds the client for ctx. Kubeconfig files are watched
+// and reloaded when they change. Kubeconfigs kept in a secret store are
+// fetched into memory only and refreshed periodically until runCtx is
+// cancelled.
+func newContextClient(runCtx context.Context, ctx *Context, config *Config) (*kubeClient, error) {
+	pins, err := parsePins(ctx.PinSHA256)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := contextProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	kube := &kubeClient{lightweight: config.LightweightClient, streams: streamLimit(ctx), changed: make(chan struct{}), pins: pins, protocol: ctx.TunnelProtocol}
+
+	if ctx.KubeConfigVault == "" && ctx.KubeConfigSecret == "" {
+		load := func() error {
+			cfg, err := loadRESTConfig(ctx.kubeContext(), ctx.KubeConfigPath, config.GlobalKubeConfig)
+			if err != nil {
+				return err
+			}
+			return kube.set(tuneConfig(cfg, proxy, pins))
+		}
+		if err := load(); err != nil {
+			return nil, err
+		}
+
+		path := ctx.KubeConfigPath
+		if path == "" {
+			path = config.GlobalKubeConfig
+		}
+		reload := func() {
+			if err := load(); err != nil {
+				contextLog(ctx).Errorf("Failed to reload kubeconfig for context %s: %v", ctx.displayName(), err)
+				return
+			}
+			contextLog(ctx).Infof("Reloaded kubeconfig for context %s", ctx.displayName())
+		}
+		for _, p := range filepath.SplitList(path) {
+			go watchKubeConfig(runCtx, p, reload)
+		}
+		return kube, nil
+	}
+
+	load := func() error {
+		data, err := fetchKubeConfig(runCtx, ctx)
+		if err != nil {
+			return err
+		}
+		cfg, err := restConfigFromBytes(ctx.kubeContext(), data)
+		if err != nil {
+			return err
+		}
+		return kube.set(tuneConfig(cfg, proxy, pins))
+	}
+	if err := load(); err != nil {
+		return nil, err
+	}
+
+	refresh := ctx.KubeConfigRefresh
+	if refresh <= 0 {
+		refresh = defaultKubeConfigRefresh
+	}
+	go func() {
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case <-ticker.C:
+				if err := load(); err != nil {
+					contextLog(ctx).Errorf("Failed to refresh kubeconfig for context %s: %v", ctx.displayName(), err)
+					continue
+				}
+				contextLog(ctx).Debugf("refreshed kubeconfig for context %s", ctx.displayName())
+			}
+		}
+	}()
+	return kube, nil
+}
+
+// tuneConfig changes cfg to connect through proxy, if set, and to only
+// accept an API server presenting one of pins, if any. In chaos mode
+// requests fail at random.
+func tuneConfig(cfg *rest.Config, proxy func(*http.Request) (*url.URL, error), pins certPins) *rest.Config {
+	if proxy != nil {
+		cfg = rest.CopyConfig(cfg)
+		cfg.Proxy = proxy
+	}
+	if pins != nil {
+		cfg = pinConfig(cfg, pins)
+	}
+	return chaos.wrapConfig(cfg)
+}
+
+// streamLimit returns the semaphore enforcing the max_streams of ctx.
+func streamLimit(ctx *Context) chan struct{} {
+	if ctx.MaxStreams <= 0 {
+		return nil
+	}
+	return make(chan struct{}, ctx.MaxStreams)
+}
+
+// restConfigFromBytes loads the REST config of contextName from an
+// in-memory kubeconfig.
+func restConfigFromBytes(contextName string, data []byte) (*rest.Config, error) {
+	apiConfig, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %v", err)
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+	config, err := clientcmd.NewNonInteractiveClientConfig(*apiConfig, contextName, overrides, nil).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+	return config, nil
+}
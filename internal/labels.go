@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+)
+
+// labelName matches the label names accepted by Prometheus, so entry labels
+// can be exported as metric labels as they are.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// builtinLabels are the labels k10ls sets itself on metrics and file_sd
+// targets, which entry labels can't override.
+var builtinLabels = map[string]bool{
+	"id": true, "entry": true, "context": true, "namespace": true,
+	"resource": true, "pod": true, "service": true,
+}
+
+// validateLabels checks the names of entry labels.
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		switch {
+		case !labelName.MatchString(name) || strings.HasPrefix(name, "__"):
+			return fmt.Errorf("invalid label name %q (expected letters, digits and underscores, not starting with a digit or __)", name)
+		case builtinLabels[name]:
+			return fmt.Errorf("label %q is set by k10ls", name)
+		}
+	}
+	return nil
+}
+
+// labelNames returns the names of labels, sorted.
+func labelNames(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FilterForwards returns the forwards whose labels match the label
+// selector, e.g. "team=payments,tier!=db".
+func FilterForwards(metrics []ForwardMetrics, selector string) ([]ForwardMetrics, error) {
+	sel, err := k8slabels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %q: %v", selector, err)
+	}
+	var out []ForwardMetrics
+	for _, m := range metrics {
+		if sel.Matches(k8slabels.Set(m.Labels)) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// labelEnv returns the labels of e as hook environment variables:
+// K10LS_LABELS lists them as name=value pairs separated by commas, and
+// each is also set as K10LS_LABEL_<NAME>.
+func labelEnv(e entry) []string {
+	names := labelNames(e.Labels)
+	pairs := make([]string, len(names))
+	env := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs[i] = name + "=" + e.Labels[name]
+		env = append(env, "K10LS_LABEL_"+strings.ToUpper(name)+"="+e.Labels[name])
+	}
+	return append(env, "K10LS_LABELS="+strings.Join(pairs, ","))
+}
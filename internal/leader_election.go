@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderElection configures Lease-based leader election so that only one of
+// several k10ls replicas owns the local listeners at any time.
+type LeaderElection struct {
+	Enabled        bool          `toml:"enabled"`
+	LeaseName      string        `toml:"lease_name,omitempty"`
+	Namespace      string        `toml:"namespace,omitempty"`
+	Identity       string        `toml:"identity,omitempty"`
+	Context        string        `toml:"context,omitempty"`
+	KubeConfigPath string        `toml:"kubeconfig,omitempty"`
+	LeaseDuration  time.Duration `toml:"lease_duration,omitempty"`
+	RenewDeadline  time.Duration `toml:"renew_deadline,omitempty"`
+	RetryPeriod    time.Duration `toml:"retry_period,omitempty"`
+}
+
+// RunWithLeaderElection calls run whenever this process holds the lease and
+// cancels the context passed to run as soon as leadership is lost. It keeps
+// competing for the lease until ctx is cancelled.
+func RunWithLeaderElection(ctx context.Context, config *Config, run func(context.Context)) error {
+	le := config.LeaderElection
+
+	leaseName := le.LeaseName
+	if leaseName == "" {
+		leaseName = "k10ls"
+	}
+	namespace := le.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	identity := le.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to determine leader election identity: %v", err)
+		}
+		identity = hostname
+	}
+	leaseDuration := le.LeaseDuration
+	if leaseDuration == 0 {
+		leaseDuration = 15 * time.Second
+	}
+	renewDeadline := le.RenewDeadline
+	if renewDeadline == 0 {
+		renewDeadline = 10 * time.Second
+	}
+	retryPeriod := le.RetryPeriod
+	if retryPeriod == 0 {
+		retryPeriod = 2 * time.Second
+	}
+
+	clientset, _, err := getKubeClient(le.Context, le.KubeConfigPath, config.GlobalKubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to load KubeClient for leader election: %v", err)
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: leaseName, Namespace: namespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            leaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				logrus.Infof("%s: %s", aurora.Green("Acquired leadership"), aurora.Bold(aurora.Cyan(identity)))
+				run(leaderCtx)
+			},
+			OnStoppedLeading: func() {
+				logrus.Warnf("%s: %s", aurora.Yellow("Lost leadership"), aurora.Bold(aurora.Cyan(identity)))
+			},
+			OnNewLeader: func(current string) {
+				if current != identity {
+					logrus.Infof("Current leader: %s", aurora.Cyan(current))
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create leader elector: %v", err)
+	}
+
+	// Run returns whenever leadership is lost; keep competing until we are
+	// asked to shut down.
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// productionContext matches the names and aliases of contexts that look
+// like production clusters.
+var productionContext = regexp.MustCompile(`(?i)prod`)
+
+// Generated pod names: pods of a ReplicaSet end in the pod template hash
+// and a random suffix, pods of DaemonSets and Jobs in a random suffix. Both
+// use the alphabet of the names Kubernetes generates, which has no vowels.
+var (
+	replicaSetPodName = regexp.MustCompile(`^(.+)-[bcdfghjklmnpqrstvwxz2456789]{6,10}-[bcdfghjklmnpqrstvwxz2456789]{5}$`)
+	generatedPodName  = regexp.MustCompile(`^(.+)-[bcdfghjklmnpqrstvwxz2456789]{5}$`)
+)
+
+// inheritsWildcard reports whether a port of e listens on all interfaces
+// because e does.
+func inheritsWildcard(e entry) bool {
+	for _, p := range e.Ports {
+		if p.Address == "" && isWildcard(e.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// lintEntry warns about the entry e of ctx, defined at path in f, if it
+// works but is likely a mistake:
+//   - it listens on all interfaces in a context that looks like production,
+//     exposing the cluster to the network;
+//   - neither it, its context nor the defaults set a namespace, so it
+//     silently forwards from that of the kubeconfig context or "default";
+//   - it forwards to a pod by a generated name, which goes away with the
+//     next rollout;
+//   - another entry already forwards to the same port of the same target;
+//   - it is tagged production but its context has no approval hook, so it
+//     is forwarded without approval.
+func (c *configChecker) lintEntry(f checkedFile, ctx *Context, ce checkedEntry, path string, e entry, where string, merged *Config) {
+	prefix := fmt.Sprintf("context %s: %s: ", ctx.displayName(), e.Resource())
+	warn := func(loc Location, format string, args ...interface{}) {
+		c.addProblem(Problem{File: f.path, Location: loc, Message: prefix + fmt.Sprintf(format, args...), Warning: true})
+	}
+	ctxPath, _, _ := strings.Cut(path, ".")
+
+	if productionContext.MatchString(ctx.displayName()) || productionContext.MatchString(e.KubeContext) {
+		const advice = "set address = \"127.0.0.1\" unless other hosts need it"
+		if inheritsWildcard(e) {
+			// Point at wherever the address was set.
+			loc := f.locateKey(path, "address")
+			if _, ok := f.locate(joinPath(path, "address")); !ok {
+				if l, ok := f.locate(ctxPath + ".address"); ok {
+					loc = l
+				} else if l, ok := f.locate("default_address"); ok {
+					loc = l
+				}
+			}
+			warn(loc, "listens on all interfaces (%s) in a production context, %s", e.Address, advice)
+		}
+		for i, p := range e.Ports {
+			if p.Address != "" && isWildcard(p.Address) {
+				warn(f.locateKey(path, fmt.Sprintf("ports[%d].address", i)), "port %s listens on all interfaces (%s) in a production context, %s", p.Source, p.Address, advice)
+			}
+		}
+	}
+
+	if e.Kind != kindRemote && ce.opts.Namespace == "" && ctx.Namespace == "" && ctx.Defaults.merge(merged.Defaults).Namespace == "" {
+		warn(f.locateKey(path, ""), "no namespace set, forwarding from the namespace of the kubeconfig context or \"default\"")
+	}
+
+	if e.Kind == kindPod {
+		if m := replicaSetPodName.FindStringSubmatch(e.Name); m != nil {
+			warn(f.locateKey(path, "name"), "%q looks like a generated pod name that changes with every rollout, forward deploy/%s instead", e.Name, m[1])
+		} else if m := generatedPodName.FindStringSubmatch(e.Name); m != nil {
+			warn(f.locateKey(path, "name"), "%q looks like a generated pod name that changes when the pod is replaced, forward its workload or a label selector instead", e.Name)
+		}
+	}
+
+	if ctx.Approval == nil && (slices.Contains(ctx.Tags, productionTag) || slices.Contains(ce.opts.Tags, productionTag)) {
+		warn(f.locateKey(path, "tags"), "tagged %s but its context has no [context.approval] hook, so it is forwarded without approval", productionTag)
+	}
+
+	target := e.KubeContext
+	if target == "" {
+		target = e.Context
+	}
+	for i, p := range e.Ports {
+		key := fmt.Sprintf("%s/%s/%s:%s", target, e.Namespace, e.Resource(), p.Target)
+		if other, ok := c.targets[key]; ok && other != where {
+			warn(f.locateKey(path, fmt.Sprintf("ports[%d]", i)), "port %s is also forwarded by the entry at %s", p.Target, other)
+			continue
+		}
+		c.targets[key] = where
+	}
+}
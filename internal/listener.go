@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errHandedOff is returned when a listener is requested after this process
+// handed its sockets over to another k10ls process.
+var errHandedOff = errors.New("listeners have been handed over to another process")
+
+// The listener registry tracks every local socket bound by this process,
+// keyed by "address:port", so it can be handed over to a new process during
+// an upgrade. Listeners received from a previous process are parked in
+// inherited until an entry claims them.
+var (
+	listenersMu sync.Mutex
+	listeners   = map[string]net.Listener{}
+	inherited   = map[string]net.Listener{}
+	handedOff   bool
+
+	// reservedPorts are the local ports configured for entries, which
+	// remapped ports stay clear of.
+	reservedPorts = map[string]bool{}
+
+	activeConns sync.WaitGroup
+)
+
+// listen returns a listener on the given TCP network for address:port,
+// reusing an inherited socket when one is available.
+func listen(network, address, port string) (net.Listener, error) {
+	if port == "" {
+		port = "0"
+	}
+	key := net.JoinHostPort(address, port)
+
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	if handedOff {
+		return nil, errHandedOff
+	}
+	if k, l, ok := claimInherited(address, port); ok {
+		listeners[k] = l
+		return l, nil
+	}
+
+	l, err := net.Listen(network, key)
+	if err != nil {
+		return nil, err
+	}
+	if port == "0" {
+		key = l.Addr().String()
+	}
+	listeners[key] = l
+	return l, nil
+}
+
+// Policies for local ports that are taken or privileged, see
+// Defaults.PortRemap. Without one the entry keeps retrying its port.
+const (
+	portRemapOff    = "off"
+	portRemapNext   = "next"
+	portRemapRandom = "random"
+)
+
+// portRemapSpan is how many ports above the configured one the next policy
+// tries.
+const portRemapSpan = 100
+
+// listenRemapped listens on a port other than port for address, chosen by
+// policy: the first free one after port that no entry is configured with,
+// starting at port+8000 for privileged ports (80 becomes 8080), or any free
+// port.
+func listenRemapped(network, address, port, policy string) (net.Listener, error) {
+	if policy == portRemapRandom {
+		return listen(network, address, "0")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	start := n + 1
+	if n < 1024 {
+		start = n + 8000
+	}
+	for p := start; p < start+portRemapSpan && p <= 65535; p++ {
+		if portReserved(strconv.Itoa(p)) {
+			continue
+		}
+		l, err := listen(network, address, strconv.Itoa(p))
+		if err == nil || !portUnavailable(err) {
+			return l, err
+		}
+	}
+	return nil, fmt.Errorf("no free port in %d-%d", start, min(start+portRemapSpan-1, 65535))
+}
+
+// reservePorts records the local ports configured for the entries in
+// desired.
+func reservePorts(desired map[string]desiredEntry) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	reservedPorts = map[string]bool{}
+	for _, d := range desired {
+		for _, p := range d.entry.Ports {
+			reservedPorts[p.Source] = true
+		}
+	}
+}
+
+// portReserved reports whether an entry is configured with port.
+func portReserved(port string) bool {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	return reservedPorts[port]
+}
+
+// releaseListener closes l and removes it from the registry.
+func releaseListener(l net.Listener) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for key, cur := range listeners {
+		if cur == l {
+			delete(listeners, key)
+		}
+	}
+	l.Close()
+}
+
+// WaitForConnections blocks until every proxied connection has finished or
+// the timeout expires. It reports whether all connections finished.
+func WaitForConnections(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		activeConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// releaseInherited closes the inherited listeners that none of the local
+// addresses in wanted, given as "address:port", would claim, e.g. because
+// their entry was removed from the config during an upgrade.
+func releaseInherited(wanted []string) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	if len(inherited) == 0 {
+		return
+	}
+
+	kept := map[string]net.Listener{}
+	for _, w := range wanted {
+		address, port, err := net.SplitHostPort(w)
+		if err != nil {
+			continue
+		}
+		if key, l, ok := claimInherited(address, port); ok {
+			kept[key] = l
+		}
+	}
+	for key, l := range inherited {
+		logrus.Warnf("Closing inherited listener %s: no entry uses it", key)
+		l.Close()
+	}
+	inherited = kept
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// portUnavailable reports whether err means a port is taken by another
+// socket or needs privileges k10ls doesn't have.
+func portUnavailable(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.EACCES)
+}
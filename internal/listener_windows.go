@@ -0,0 +1,17 @@
+//go:build windows
+
+package internal
+
+import (
+	"errors"
+	"syscall"
+)
+
+// wsaeaddrinuse is the Winsock error for a port taken by another socket.
+const wsaeaddrinuse syscall.Errno = 10048
+
+// portUnavailable reports whether err means a port is taken by another
+// socket or reserved, e.g. by Hyper-V.
+func portUnavailable(err error) bool {
+	return errors.Is(err, wsaeaddrinuse) || errors.Is(err, syscall.WSAEACCES)
+}
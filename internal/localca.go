@@ -0,0 +1,213 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Lifetimes of the local CA and of the certificates it issues.
+const (
+	localCAValidity   = 10 * 365 * 24 * time.Hour
+	localLeafValidity = 365 * 24 * time.Hour
+)
+
+// localCA is the certificate authority k10ls issues the certificates of
+// TLS forwards with.
+type localCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+var (
+	localCAMu     sync.Mutex
+	localCACached *localCA
+)
+
+// LocalCADir returns the directory the local CA is kept in.
+func LocalCADir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "k10ls"), nil
+}
+
+// localCAPaths returns the paths of the certificate and key of the local
+// CA.
+func localCAPaths() (certPath, keyPath string, err error) {
+	dir, err := LocalCADir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), nil
+}
+
+// loadLocalCA returns the local CA, generating it on first use.
+func loadLocalCA() (*localCA, error) {
+	localCAMu.Lock()
+	defer localCAMu.Unlock()
+	if localCACached != nil {
+		return localCACached, nil
+	}
+
+	certPath, keyPath, err := localCAPaths()
+	if err != nil {
+		return nil, err
+	}
+	ca, err := readLocalCA(certPath, keyPath)
+	if os.IsNotExist(err) {
+		ca, err = createLocalCA(certPath, keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("local CA: %v", err)
+	}
+	localCACached = ca
+	return ca, nil
+}
+
+// readLocalCA reads the local CA from certPath and keyPath.
+func readLocalCA(certPath, keyPath string) (*localCA, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, fmt.Errorf("invalid PEM in %s or %s", certPath, keyPath)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &localCA{cert: cert, key: key}, nil
+}
+
+// createLocalCA generates a new CA and writes it to certPath and keyPath.
+func createLocalCA(certPath, keyPath string) (*localCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	name := "k10ls local CA"
+	if u, err := user.Current(); err == nil {
+		host, _ := os.Hostname()
+		name += " " + u.Username + "@" + host
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"k10ls"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(localCAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(certPath), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return nil, err
+	}
+	return &localCA{cert: cert, key: key}, nil
+}
+
+// issue returns a certificate for hosts, which may be DNS names or IPs,
+// signed by the CA.
+func (ca *localCA) issue(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: hosts[0], Organization: []string{"k10ls"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(localLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}, nil
+}
+
+// randomSerial returns a random 128 bit certificate serial number.
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// forwardTLSConfig returns the TLS config terminating TLS on the local
+// ports of e, with a certificate for localhost, the bind address and, for
+// services, the cluster DNS names of the service.
+func forwardTLSConfig(e entry) (*tls.Config, error) {
+	ca, err := loadLocalCA()
+	if err != nil {
+		return nil, err
+	}
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	for _, p := range e.Ports {
+		address := e.portAddress(p)
+		if ip := net.ParseIP(address); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() && !slices.Contains(hosts, address) {
+			hosts = append(hosts, address)
+		}
+	}
+	if e.Kind == kindService {
+		hosts = append(hosts, e.Name, e.Name+"."+e.Namespace, e.Name+"."+e.Namespace+".svc",
+			e.Name+"."+e.Namespace+".svc.cluster.local")
+	}
+	cert, err := ca.issue(hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
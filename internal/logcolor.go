@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// contextField is the log field naming the context a log line belongs to.
+const contextField = "context"
+
+// logColors maps the color names accepted in the config to ANSI codes.
+var logColors = map[string]string{
+	"red":            "31",
+	"green":          "32",
+	"yellow":         "33",
+	"blue":           "34",
+	"magenta":        "35",
+	"cyan":           "36",
+	"white":          "37",
+	"bright-red":     "91",
+	"bright-green":   "92",
+	"bright-yellow":  "93",
+	"bright-blue":    "94",
+	"bright-magenta": "95",
+	"bright-cyan":    "96",
+	"bright-white":   "97",
+}
+
+// defaultLogPalette is used when the config has no log_palette.
+var defaultLogPalette = []string{"cyan", "magenta", "blue", "green", "yellow", "bright-cyan", "bright-magenta", "bright-blue"}
+
+var (
+	logColorsMu sync.Mutex
+	logPalette  = defaultLogPalette
+	ctxColors   = map[string]string{}
+)
+
+// SetLogColors applies the log_palette and per-context colors of config.
+func SetLogColors(config *Config) {
+	logColorsMu.Lock()
+	defer logColorsMu.Unlock()
+
+	logPalette = defaultLogPalette
+	if len(config.LogPalette) > 0 {
+		logPalette = config.LogPalette
+	}
+	ctxColors = map[string]string{}
+	for i := range config.Contexts {
+		ctx := &config.Contexts[i]
+		if ctx.Color != "" {
+			ctxColors[ctx.displayName()] = ctx.Color
+		}
+	}
+}
+
+// contextColor returns the ANSI code of the context named name: its
+// configured color, or one picked from the palette by a hash of the name so
+// that it stays the same across runs.
+func contextColor(name string) string {
+	logColorsMu.Lock()
+	defer logColorsMu.Unlock()
+
+	if c, ok := ctxColors[name]; ok {
+		return logColors[c]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return logColors[logPalette[h.Sum32()%uint32(len(logPalette))]]
+}
+
+// validateColor checks that name is a known color.
+func validateColor(name string) error {
+	if _, ok := logColors[name]; !ok {
+		return fmt.Errorf("unknown color %q", name)
+	}
+	return nil
+}
+
+// log returns a logger tagging lines with the entry and its context.
+func (e entry) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"entry": e.Key, contextField: e.Context})
+}
+
+// contextLog returns a logger tagging lines with the context ctx.
+func contextLog(ctx *Context) *logrus.Entry {
+	return logrus.WithField(contextField, ctx.displayName())
+}
+
+// ContextColorFormatter wraps a logrus formatter and prefixes every line
+// logged for a context with the context name in that context's color.
+type ContextColorFormatter struct {
+	Formatter logrus.Formatter
+}
+
+// Format implements logrus.Formatter.
+func (f *ContextColorFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	name, ok := entry.Data[contextField].(string)
+	if !ok {
+		return f.Formatter.Format(entry)
+	}
+
+	// The prefix already names the context.
+	e := *entry
+	e.Data = logrus.Fields{}
+	for k, v := range entry.Data {
+		if k != contextField {
+			e.Data[k] = v
+		}
+	}
+	b, err := f.Formatter.Format(&e)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "\x1b[1;%sm▌%s\x1b[0m ", contextColor(name), name)
+	out.Write(b)
+	return out.Bytes(), nil
+}
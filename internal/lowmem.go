@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"runtime/debug"
+	"sync"
+)
+
+// lowMemory is set by EnableLowMemory.
+var lowMemory bool
+
+// copyBufferSize is the size of the buffers connections are proxied with.
+var copyBufferSize = 32 << 10
+
+// copyBuffers recycles the buffers of proxied connections.
+var copyBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, copyBufferSize)
+	return &buf
+}}
+
+// reconnects serializes opening tunnels in the low-memory profile. It is
+// nil otherwise.
+var reconnects chan struct{}
+
+// EnableLowMemory switches to the low-memory profile for small hosts such
+// as Raspberry Pi jump boxes: pods are looked up directly instead of being
+// cached by informers, connections are proxied with small buffers, fewer
+// diagnostics are kept, tunnels are opened one at a time and garbage is
+// collected more eagerly. It must be called before any forward starts.
+func EnableLowMemory() {
+	lowMemory = true
+	copyBufferSize = 4 << 10
+	mirrorQueue = 16
+	diagnosticsSize = 10
+	reconnects = make(chan struct{}, 1)
+	debug.SetGCPercent(50)
+}
+
+// copyConn copies src to dst with a pooled buffer.
+func copyConn(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// acquireReconnect blocks until a tunnel may be opened in the low-memory
+// profile, reporting false if ctx is cancelled first.
+func acquireReconnect(ctx context.Context) bool {
+	if reconnects == nil {
+		return true
+	}
+	select {
+	case reconnects <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseReconnect frees the slot taken by acquireReconnect.
+func releaseReconnect() {
+	if reconnects != nil {
+		<-reconnects
+	}
+}
@@ -0,0 +1,720 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+)
+
+// ConfigDiff lists the entries added, removed and changed by applying a new
+// configuration.
+type ConfigDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+	// Changes describes what changed about each changed entry.
+	Changes map[string][]string `json:"changes,omitempty"`
+}
+
+// Empty reports whether the diff contains no changes.
+func (d *ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func (d *ConfigDiff) String() string {
+	if d.Empty() {
+		return "no changes"
+	}
+	var b strings.Builder
+	for _, k := range d.Added {
+		fmt.Fprintf(&b, "+ %s\n", k)
+	}
+	for _, k := range d.Removed {
+		fmt.Fprintf(&b, "- %s\n", k)
+	}
+	for _, k := range d.Changed {
+		fmt.Fprintf(&b, "~ %s\n", k)
+		for _, c := range d.Changes[k] {
+			fmt.Fprintf(&b, "    %s\n", c)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// desiredEntry is an entry of the applied configuration together with the
+// context it belongs to.
+type desiredEntry struct {
+	entry     entry
+	ctx       *Context
+	clientSig string
+}
+
+// runningEntry is an entry whose forward is currently running.
+type runningEntry struct {
+	desired desiredEntry
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// clientRetry is an entry waiting to retry creating the client of its
+// context, or, once its timer is nil, one that gave up.
+type clientRetry struct {
+	failures int
+	timer    *time.Timer
+}
+
+// clientBuild is a client of a context being created. done is closed once
+// kube or err is set.
+type clientBuild struct {
+	sig  string
+	done chan struct{}
+	kube *kubeClient
+	err  error
+}
+
+// contextClient is the cached client of a context.
+type contextClient struct {
+	kube   *kubeClient
+	sig    string
+	cancel context.CancelFunc
+}
+
+// Manager starts and stops forwards as configurations are applied. While
+// running, applying a new configuration only touches the entries that were
+// added, removed or changed.
+type Manager struct {
+	mu      sync.Mutex
+	config  *Config
+	desired map[string]desiredEntry
+	runCtx  context.Context
+	clients map[string]*contextClient
+	running map[string]*runningEntry
+
+	// stopped holds the entries stopped over the control socket. They stay
+	// stopped across reloads until restarted.
+	stopped map[string]bool
+
+	// retrying holds the entries whose forward couldn't start because the
+	// client of their context couldn't be created.
+	retrying map[string]*clientRetry
+
+	// Clients are created without holding mu, as that may take long, e.g.
+	// to fetch a kubeconfig from Vault. building holds the clients being
+	// created by context name, starting the entries waiting for one.
+	building map[string]*clientBuild
+	starting map[string]*clientBuild
+
+	// static holds the entries of the configuration, discovered the
+	// entries found by forward_all_services, by context name. Discovery
+	// loops report with the generation they were started in, so reports of
+	// loops stopped by a later Apply are ignored.
+	static          map[string]desiredEntry
+	discovered      map[string]map[string]desiredEntry
+	discoveryGen    int
+	discoveryCancel context.CancelFunc
+	assigned        map[string]int
+}
+
+// NewManager returns a manager without any configuration applied.
+func NewManager() *Manager {
+	return &Manager{
+		desired:    map[string]desiredEntry{},
+		clients:    map[string]*contextClient{},
+		running:    map[string]*runningEntry{},
+		stopped:    map[string]bool{},
+		retrying:   map[string]*clientRetry{},
+		building:   map[string]*clientBuild{},
+		starting:   map[string]*clientBuild{},
+		static:     map[string]desiredEntry{},
+		discovered: map[string]map[string]desiredEntry{},
+		assigned:   map[string]int{},
+	}
+}
+
+// Apply makes config the desired configuration and, if the manager is
+// running, reconciles the running forwards with it.
+func (m *Manager) Apply(config *Config) (*ConfigDiff, error) {
+	static, err := desiredEntries(config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.config = config
+	m.static = static
+	for name := range m.discovered {
+		if c := config.context(name); c == nil || !c.ForwardAllServices {
+			delete(m.discovered, name)
+		}
+	}
+	if m.runCtx != nil {
+		m.startDiscovery()
+	}
+	diff := m.reconcile()
+	m.releaseInherited()
+	return diff, nil
+}
+
+// reconcile makes the static and discovered entries the desired entries
+// and, if the manager is running, starts and stops forwards accordingly.
+// The caller must hold m.mu.
+func (m *Manager) reconcile() *ConfigDiff {
+	desired := map[string]desiredEntry{}
+	for _, entries := range m.discovered {
+		for key, d := range entries {
+			desired[key] = d
+		}
+	}
+	for key, d := range m.static {
+		desired[key] = d
+	}
+
+	diff := diffEntries(m.desired, desired)
+	for _, key := range diff.Removed {
+		delete(m.stopped, key)
+	}
+	m.desired = desired
+	reservePorts(desired)
+
+	if m.runCtx != nil {
+		for _, key := range append(append([]string{}, diff.Removed...), diff.Changed...) {
+			m.stop(key)
+		}
+		for _, key := range append(append([]string{}, diff.Added...), diff.Changed...) {
+			m.start(key)
+		}
+	}
+	return diff
+}
+
+// Plan returns how applying config would change the desired entries,
+// without applying it. Services discovered for contexts that keep
+// forward_all_services are assumed to stay the same.
+func (m *Manager) Plan(config *Config) (*ConfigDiff, error) {
+	static, err := desiredEntries(config)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	desired := map[string]desiredEntry{}
+	for name, entries := range m.discovered {
+		if c := config.context(name); c == nil || !c.ForwardAllServices {
+			continue
+		}
+		for key, d := range entries {
+			desired[key] = d
+		}
+	}
+	for key, d := range static {
+		desired[key] = d
+	}
+	return diffEntries(m.desired, desired), nil
+}
+
+// diffEntries compares the desired entries old and desired.
+func diffEntries(old, desired map[string]desiredEntry) *ConfigDiff {
+	diff := &ConfigDiff{}
+	for key, d := range desired {
+		prev, ok := old[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+			continue
+		}
+		var changes []string
+		if prev.clientSig != d.clientSig {
+			changes = append(changes, "kubernetes client settings of the context")
+		}
+		changes = append(changes, entryChanges(prev.entry, d.entry)...)
+		if len(changes) > 0 {
+			diff.Changed = append(diff.Changed, key)
+			if diff.Changes == nil {
+				diff.Changes = map[string][]string{}
+			}
+			diff.Changes[key] = changes
+		}
+	}
+	for key := range old {
+		if _, ok := desired[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// entryChanges describes the fields that differ between old and e, e.g.
+// "Address: 127.0.0.1 -> 0.0.0.0". The ID is left out as it follows from
+// the other fields.
+func entryChanges(old, e entry) []string {
+	var changes []string
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(e)
+	for i := 0; i < ov.NumField(); i++ {
+		of, nf := ov.Field(i), nv.Field(i)
+		if ov.Type().Field(i).Name == "ID" || reflect.DeepEqual(of.Interface(), nf.Interface()) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", ov.Type().Field(i).Name, describeValue(of), describeValue(nf)))
+	}
+	return changes
+}
+
+// describeValue formats v for entryChanges, following pointers.
+func describeValue(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "unset"
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.String && v.String() == "" {
+		return `""`
+	}
+	if ports, ok := v.Interface().([]PortMap); ok {
+		s := make([]string, len(ports))
+		for i, p := range ports {
+			s[i] = p.Source + ":" + p.Target
+		}
+		return "[" + strings.Join(s, " ") + "]"
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
+
+// startDiscovery (re)starts service discovery for every context with
+// forward_all_services. The caller must hold m.mu.
+func (m *Manager) startDiscovery() {
+	if m.discoveryCancel != nil {
+		m.discoveryCancel()
+	}
+	m.discoveryGen++
+	discCtx, cancel := context.WithCancel(m.runCtx)
+	m.discoveryCancel = cancel
+
+	for i := range m.config.Contexts {
+		ctx := &m.config.Contexts[i]
+		if !ctx.ForwardAllServices {
+			continue
+		}
+		d := desiredEntry{ctx: ctx, clientSig: clientSignature(ctx, m.config)}
+		go m.discover(discCtx, m.discoveryGen, ctx, m.config, d)
+	}
+}
+
+// setDiscovered replaces the discovered services of ctx and reconciles the
+// running forwards.
+func (m *Manager) setDiscovered(gen int, ctx *Context, config *Config, clientSig string, svcs []Service) {
+	c := *ctx
+	c.Svc, c.Pods, c.LabelSelectors = svcs, nil, nil
+	c.Deployments, c.StatefulSets, c.ReplicaSets, c.Remotes = nil, nil, nil, nil
+	entries, err := c.entries(config)
+	if err != nil {
+		contextLog(ctx).Errorf("Discovered services of context %s: %v", ctx.displayName(), err)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if gen != m.discoveryGen {
+		return
+	}
+
+	discovered := map[string]desiredEntry{}
+	for _, e := range entries {
+		e.Key = fmt.Sprintf("%s/%s/%s", e.Context, e.Namespace, e.Resource())
+		e.ID = forwardID(e)
+		if _, ok := m.static[e.Key]; ok {
+			continue
+		}
+		discovered[e.Key] = desiredEntry{entry: e, ctx: ctx, clientSig: clientSig}
+	}
+	m.discovered[ctx.Name] = discovered
+	if diff := m.reconcile(); !diff.Empty() {
+		contextLog(ctx).Infof("Discovered services of context %s changed:\n%s", ctx.displayName(), diff)
+	}
+	m.releaseInherited()
+}
+
+// releaseInherited closes the listeners inherited from a previous process
+// or systemd that no desired entry listens on. Entries that bind late, e.g.
+// while waiting for their namespace or an approval, keep theirs. Until every
+// forward_all_services context has reported its services, nothing is
+// released, as the discovered services may claim some. The caller must
+// hold m.mu.
+func (m *Manager) releaseInherited() {
+	for i := range m.config.Contexts {
+		ctx := &m.config.Contexts[i]
+		if _, ok := m.discovered[ctx.Name]; ctx.ForwardAllServices && !ok {
+			return
+		}
+	}
+	var wanted []string
+	for _, d := range m.desired {
+		for _, p := range d.entry.Ports {
+			wanted = append(wanted, net.JoinHostPort(d.entry.portAddress(p), p.Source))
+		}
+	}
+	releaseInherited(wanted)
+}
+
+// Run starts every desired entry and keeps the forwards running until
+// runCtx is cancelled, at which point all of them are stopped, dependents
+// first.
+func (m *Manager) Run(runCtx context.Context) {
+	m.mu.Lock()
+	m.runCtx = runCtx
+	m.startDiscovery()
+	keys := make([]string, 0, len(m.desired))
+	for key := range m.desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.start(key)
+	}
+	m.mu.Unlock()
+
+	<-runCtx.Done()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.discoveryCancel()
+	m.discoveryCancel = nil
+	m.stopAll()
+	for key := range m.retrying {
+		m.forgetRetry(key)
+	}
+	clear(m.starting)
+	clear(m.building)
+	for name, c := range m.clients {
+		c.cancel()
+		delete(m.clients, name)
+	}
+	m.runCtx = nil
+}
+
+// start launches the forward of the desired entry key, unless it was
+// stopped over the control socket. The caller must hold m.mu.
+func (m *Manager) start(key string) {
+	if m.stopped[key] {
+		return
+	}
+	d := m.desired[key]
+	kube, b := m.client(d)
+	if kube == nil {
+		m.starting[key] = b
+		go func() {
+			<-b.done
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if m.starting[key] != b || m.runCtx == nil {
+				return
+			}
+			delete(m.starting, key)
+			if b.err != nil {
+				m.retryClient(key, b.err)
+				return
+			}
+			m.start(key)
+		}()
+		return
+	}
+	m.forgetRetry(key)
+
+	// Forwards outlive runCtx so Run can stop them in dependency order.
+	entryCtx, cancel := context.WithCancel(context.WithoutCancel(m.runCtx))
+	r := &runningEntry{desired: d, cancel: cancel, done: make(chan struct{})}
+	m.running[key] = r
+
+	go func() {
+		defer close(r.done)
+		defer func() {
+			if p := recover(); p != nil {
+				msg := reportPanic("forward "+d.entry.Key, p)
+				d.entry.log().Error(msg)
+				recordDiagnostic(d.entry, msg)
+			}
+		}()
+		if err := startEntry(entryCtx, kube, d.entry); err != nil && entryCtx.Err() == nil {
+			d.entry.log().Errorf("Error forwarding %s: %v", d.entry.describe(), err)
+			recordDiagnostic(d.entry, err.Error())
+		}
+	}()
+}
+
+// retryClient schedules another start of entry key after the client of its
+// context failed with err, backing off according to the reconnect policy of
+// the entry until max_retries attempts have failed. The caller must hold
+// m.mu.
+func (m *Manager) retryClient(key string, err error) {
+	d := m.desired[key]
+	r, ok := m.retrying[key]
+	if !ok {
+		r = &clientRetry{}
+		m.retrying[key] = r
+	}
+	r.failures++
+	r.timer = nil
+
+	msg := fmt.Sprintf("Failed to load KubeClient for context %s: %v", d.ctx.displayName(), err)
+	if max := d.entry.Reconnect.maxRetries(); max > 0 && r.failures > max {
+		msg = fmt.Sprintf("%s, giving up after %d failed attempts (max_retries = %d)", msg, r.failures, max)
+		contextLog(d.ctx).Error(msg)
+		recordDiagnostic(d.entry, msg)
+		return
+	}
+	delay := d.entry.Reconnect.backoff(r.failures)
+	contextLog(d.ctx).Errorf("%s, retrying %s in %s", msg, d.entry.describe(), delay.Round(time.Millisecond))
+	recordDiagnostic(d.entry, msg)
+
+	r.timer = time.AfterFunc(delay, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.retrying[key] != r || m.runCtx == nil {
+			return
+		}
+		if _, ok := m.running[key]; ok {
+			return
+		}
+		if _, ok := m.starting[key]; ok {
+			return
+		}
+		m.start(key)
+	})
+}
+
+// forgetRetry cancels the pending client retry of entry key, if any. The
+// caller must hold m.mu.
+func (m *Manager) forgetRetry(key string) {
+	if r, ok := m.retrying[key]; ok {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		delete(m.retrying, key)
+	}
+}
+
+// stop cancels the forward of entry key and waits for its listeners to be
+// released. The caller must hold m.mu.
+func (m *Manager) stop(key string) {
+	m.forgetRetry(key)
+	delete(m.starting, key)
+	r, ok := m.running[key]
+	if !ok {
+		return
+	}
+	r.cancel()
+	<-r.done
+	delete(m.running, key)
+	forgetDiagnostics(key)
+	forgetDowntime(key)
+}
+
+// client returns the client for the context of d if it was created
+// already for its current kubeconfig settings. Otherwise it returns the
+// creation of the client, started unless in progress, whose result is
+// cached once done unless the settings changed meanwhile. The caller must
+// hold m.mu.
+func (m *Manager) client(d desiredEntry) (*kubeClient, *clientBuild) {
+	name := d.ctx.Name
+	if c, ok := m.clients[name]; ok && c.sig == d.clientSig {
+		return c.kube, nil
+	}
+	if b, ok := m.building[name]; ok && b.sig == d.clientSig {
+		return nil, b
+	}
+
+	b := &clientBuild{sig: d.clientSig, done: make(chan struct{})}
+	m.building[name] = b
+	ctx, config := d.ctx, m.config
+	clientCtx, cancel := context.WithCancel(context.WithoutCancel(m.runCtx))
+	go func() {
+		contextLog(ctx).Infof("%s: %s", aurora.Yellow("Processing context"), aurora.Bold(aurora.Cyan(ctx.displayName())))
+		kube, err := newContextClient(clientCtx, ctx, config)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch {
+		case err != nil:
+			cancel()
+		case m.building[name] != b || m.runCtx == nil:
+			// Superseded or shut down; entries waiting for it start over.
+			cancel()
+			err = fmt.Errorf("client of context %s was discarded", ctx.displayName())
+			kube = nil
+		default:
+			if old, ok := m.clients[name]; ok {
+				old.cancel()
+			}
+			m.clients[name] = &contextClient{kube: kube, sig: b.sig, cancel: cancel}
+		}
+		if m.building[name] == b {
+			delete(m.building, name)
+		}
+		b.kube, b.err = kube, err
+		close(b.done)
+	}()
+	return nil, b
+}
+
+// desiredEntries flattens every context of config into entries keyed by
+// context/namespace/kind/name. Entries for the same resource are told apart
+// by their ID, e.g. context/namespace/svc/api#3f2a9c0d81b4, so keys don't
+// depend on the order of the configuration either.
+func desiredEntries(config *Config) (map[string]desiredEntry, error) {
+	var all []desiredEntry
+	resources := map[string]int{}
+	for i := range config.Contexts {
+		ctx := &config.Contexts[i]
+		entries, err := ctx.entries(config)
+		if err != nil {
+			return nil, fmt.Errorf("context %s: %v", ctx.displayName(), err)
+		}
+
+		sig := clientSignature(ctx, config)
+		for _, e := range entries {
+			e.ID = forwardID(e)
+			e.Key = fmt.Sprintf("%s/%s/%s", e.Context, e.Namespace, e.Resource())
+			resources[e.Key]++
+			all = append(all, desiredEntry{entry: e, ctx: ctx, clientSig: sig})
+		}
+	}
+
+	desired := map[string]desiredEntry{}
+	for _, d := range all {
+		if resources[d.entry.Key] > 1 {
+			// Identical entries share their ID, so fall back to a counter.
+			key := d.entry.Key + "#" + d.entry.ID
+			for n := 2; ; n++ {
+				if _, dup := desired[key]; !dup {
+					break
+				}
+				key = fmt.Sprintf("%s#%s-%d", d.entry.Key, d.entry.ID, n)
+			}
+			d.entry.Key = key
+		}
+		desired[d.entry.Key] = d
+	}
+	return desired, nil
+}
+
+// clientSignature identifies the client settings of ctx, so the client is
+// rebuilt when they change.
+func clientSignature(ctx *Context, config *Config) string {
+	return fmt.Sprintf("%s|%t|%s|%s|%s|%s|%s|%s|%d|%s|%s|%s|%s|%t", ctx.Name, ctx.UseCurrentContext, ctx.KubeConfigPath, config.GlobalKubeConfig,
+		ctx.KubeConfigVault, ctx.KubeConfigVaultKey, ctx.KubeConfigSecret, ctx.KubeConfigRefresh, ctx.MaxStreams,
+		strings.Join(ctx.PinSHA256, ","), ctx.Proxy, ctx.NoProxy, ctx.TunnelProtocol, config.LightweightClient)
+}
+
+// context returns the context of c named name, or nil.
+func (c *Config) context(name string) *Context {
+	for i := range c.Contexts {
+		if c.Contexts[i].Name == name {
+			return &c.Contexts[i]
+		}
+	}
+	return nil
+}
+
+// Restart restarts the forwards of the entries matched by refs, given as
+// ID, kind/name or context/namespace/kind/name, including stopped ones. It
+// returns the keys of the restarted entries.
+func (m *Manager) Restart(refs []string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no entries given")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys, err := m.matchEntries(refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		delete(m.stopped, key)
+		if m.runCtx != nil {
+			m.stop(key)
+			m.start(key)
+		}
+		m.desired[key].entry.log().Info("Forward restarted over the control socket")
+	}
+	return keys, nil
+}
+
+// Stop stops the forwards of the entries matched by refs until they are
+// restarted, and returns their keys.
+func (m *Manager) Stop(refs []string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no entries given")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys, err := m.matchEntries(refs)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		m.stopped[key] = true
+		m.stop(key)
+		m.desired[key].entry.log().Info("Forward stopped over the control socket")
+	}
+	return keys, nil
+}
+
+// Status returns the state and counters of every running forward, plus the
+// entries stopped over the control socket and those whose client is being
+// created or couldn't be, still connecting while retrying and failed once
+// they gave up.
+func (m *Manager) Status() []ForwardMetrics {
+	metrics := forwardMetrics()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.stopped {
+		metrics = append(metrics, idleMetrics(m.desired[key].entry, stateStopped))
+	}
+	for key, r := range m.retrying {
+		state := stateConnecting
+		if r.timer == nil {
+			state = stateFailed
+		}
+		metrics = append(metrics, idleMetrics(m.desired[key].entry, state))
+	}
+	for key := range m.starting {
+		if _, ok := m.retrying[key]; !ok {
+			metrics = append(metrics, idleMetrics(m.desired[key].entry, stateConnecting))
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Entry < metrics[j].Entry
+	})
+	return metrics
+}
+
+// idleMetrics returns the metrics of entry e, which has no forward running,
+// in the given state.
+func idleMetrics(e entry, state string) ForwardMetrics {
+	return ForwardMetrics{
+		ID:        e.ID,
+		Entry:     e.Key,
+		Context:   e.Context,
+		Namespace: e.Namespace,
+		Resource:  e.Resource(),
+		Listen:    []string{},
+		State:     state,
+		Labels:    e.Labels,
+	}
+}
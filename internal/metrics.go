@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// labelEscaper escapes label values for the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// forwardMetric is a metric exported for every forward.
+type forwardMetric struct {
+	name, kind, help string
+	// value returns the sample of a forward, ok being false if the forward
+	// has none.
+	value func(m ForwardMetrics, now time.Time) (v float64, ok bool)
+}
+
+var forwardMetricDefs = []forwardMetric{
+	{"k10ls_forward_up", "gauge", "Whether the tunnel of the forward is established.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) {
+			if m.State == stateReady {
+				return 1, true
+			}
+			return 0, true
+		}},
+	{"k10ls_forward_restarts_total", "counter", "Tunnels opened after the first one.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) { return float64(m.Restarts), true }},
+	{"k10ls_forward_seconds_since_connected", "gauge", "Seconds since the last tunnel was established.",
+		func(m ForwardMetrics, now time.Time) (float64, bool) {
+			if m.LastConnected == nil {
+				return 0, false
+			}
+			return now.Sub(*m.LastConnected).Seconds(), true
+		}},
+	{"k10ls_forward_connections_total", "counter", "Local connections accepted.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) { return float64(m.Connections), true }},
+	{"k10ls_forward_active_connections", "gauge", "Local connections currently open.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) { return float64(m.ActiveConnections), true }},
+	{"k10ls_forward_sent_bytes_total", "counter", "Bytes proxied from local clients to the pod.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) { return float64(m.BytesSent), true }},
+	{"k10ls_forward_received_bytes_total", "counter", "Bytes proxied from the pod to local clients.",
+		func(m ForwardMetrics, _ time.Time) (float64, bool) { return float64(m.BytesReceived), true }},
+}
+
+// ServeMetrics serves the metrics returned by status in the Prometheus text
+// format on addr under /metrics until ctx is cancelled.
+func ServeMetrics(ctx context.Context, addr string, status func() []ForwardMetrics) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, status(), time.Now())
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("metrics server failed: %v", err)
+		}
+	}()
+	logrus.Infof("Serving metrics on http://%s/metrics", l.Addr())
+	return nil
+}
+
+// entryLabelPairs formats the entry labels of a forward as additional
+// label pairs.
+func entryLabelPairs(labels map[string]string) string {
+	var b strings.Builder
+	for _, name := range labelNames(labels) {
+		fmt.Fprintf(&b, ",%s=\"%s\"", name, labelEscaper.Replace(labels[name]))
+	}
+	return b.String()
+}
+
+// writeMetrics writes the samples of every forward in metrics to w.
+func writeMetrics(w io.Writer, metrics []ForwardMetrics, now time.Time) {
+	for _, def := range forwardMetricDefs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", def.name, def.help, def.name, def.kind)
+		for _, m := range metrics {
+			v, ok := def.value(m, now)
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(w, "%s{id=\"%s\",entry=\"%s\",context=\"%s\",namespace=\"%s\",resource=\"%s\"%s} %g\n",
+				def.name,
+				labelEscaper.Replace(m.ID),
+				labelEscaper.Replace(m.Entry),
+				labelEscaper.Replace(m.Context),
+				labelEscaper.Replace(m.Namespace),
+				labelEscaper.Replace(m.Resource),
+				entryLabelPairs(m.Labels),
+				v)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// mirrorQueue bounds the reads of a connection buffered for its mirror.
+// When the mirror falls behind it is dropped rather than slowing down the
+// connection.
+var mirrorQueue = 256
+
+// parseMirrorTarget splits a mirror reference such as "svc/canary" into
+// its kind and name.
+func parseMirrorTarget(ref string) (string, string, error) {
+	kind, name, ok := strings.Cut(ref, "/")
+	if ok && name != "" {
+		switch kind {
+		case kindService, "service":
+			return kindService, name, nil
+		case kindPod, kindLabel:
+			return kind, name, nil
+		}
+		if kind, ok := workloadKind(kind); ok {
+			return kind, name, nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid mirror %q (expected svc/<name>, pod/<name>, label/<selector>, deploy/<name>, sts/<name> or rs/<name>)", ref)
+}
+
+// mirror keeps a tunnel to the pod the traffic of a forward is mirrored
+// to. Its responses are discarded.
+type mirror struct {
+	kube  *kubeClient
+	entry entry
+	pods  *podInformer
+
+	mu  sync.Mutex
+	tun *tunnel
+}
+
+// newMirror returns the mirror of e, which must set Mirror.
+func newMirror(kube *kubeClient, e entry) *mirror {
+	kind, name, _ := parseMirrorTarget(e.Mirror)
+	target := e
+	target.Kind, target.Name = kind, name
+	return &mirror{kube: kube, entry: target, pods: kube.podInformer(target.Namespace)}
+}
+
+// tunnel returns the tunnel to the mirror pod, opening a new one if there
+// is none or it was closed.
+func (m *mirror) tunnel(ctx context.Context) (*tunnel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tun != nil {
+		select {
+		case <-m.tun.Done():
+			m.tun = nil
+		default:
+			return m.tun, nil
+		}
+	}
+
+	core, cfg := m.kube.getCore()
+	podName, err := resolvePod(ctx, core, m.pods, m.entry, nil)
+	if err != nil {
+		return nil, err
+	}
+	tun, err := m.kube.dialTunnel(ctx, core, cfg, m.entry, podName)
+	if err != nil {
+		return nil, err
+	}
+	m.entry.log().Infof("Mirroring traffic to pod %s via %s", podName, tun.transport)
+	m.tun = tun
+	return tun, nil
+}
+
+// close closes the tunnel to the mirror pod.
+func (m *mirror) close() {
+	m.pods.release()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tun != nil {
+		m.tun.Close()
+		m.tun = nil
+	}
+}
+
+// mirrorConn copies everything read from a local connection to a
+// connection to the mirror pod, without ever blocking the reader.
+type mirrorConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	queue  chan []byte
+	closed bool
+}
+
+// wrap wraps conn so that the data the client sends is also sent to
+// the given port of the mirror pod.
+func (m *mirror) wrap(ctx context.Context, conn net.Conn, port string) *mirrorConn {
+	mc := &mirrorConn{Conn: conn, queue: make(chan []byte, mirrorQueue)}
+	go m.relay(ctx, mc.queue, port)
+	return mc
+}
+
+func (c *mirrorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.send(append([]byte(nil), b[:n]...))
+	}
+	if err != nil {
+		c.finish()
+	}
+	return n, err
+}
+
+// send queues data for the mirror, dropping the mirror if it fell behind.
+func (c *mirrorConn) send(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.queue <- data:
+	default:
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+// finish ends the mirrored connection once the client is done.
+func (c *mirrorConn) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+}
+
+// relay writes the queued data to a new connection to the mirror pod,
+// discarding its responses. Failures only affect the mirror.
+func (m *mirror) relay(ctx context.Context, queue <-chan []byte, port string) {
+	defer func() {
+		for range queue {
+		}
+	}()
+
+	tun, err := m.tunnel(ctx)
+	if err != nil {
+		m.entry.log().Debugf("not mirroring connection: %v", err)
+		return
+	}
+	local, remote := net.Pipe()
+	defer local.Close()
+	go func() {
+		if err := tun.proxy(remote, port); err != nil {
+			m.entry.log().Debugf("mirror connection failed: %v", err)
+		}
+		remote.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, local)
+	}()
+
+	for data := range queue {
+		if _, err := local.Write(data); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// waitForNamespace blocks until namespace exists, e.g. once a preview
+// environment has been created. It returns false if ctx is cancelled first.
+// Unless the API server says the namespace doesn't exist, it is assumed to
+// exist.
+func waitForNamespace(ctx context.Context, core coreClient, namespace string) bool {
+	logged := false
+	for ctx.Err() == nil {
+		_, err := core.getNamespace(ctx, namespace)
+		if !apierrors.IsNotFound(err) {
+			// Either it exists, or we can't tell; the forward itself
+			// retries until the API server is reachable.
+			return true
+		}
+
+		if !logged {
+			logrus.Warnf("Namespace %s does not exist yet, waiting for it to be created", namespace)
+			logged = true
+		}
+		opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", namespace).String()}
+		w, err := core.watchNamespaces(ctx, opts)
+		if err != nil {
+			logrus.Debugf("failed to watch namespace %s: %v", namespace, err)
+			sleepContext(ctx, 2*time.Second)
+			continue
+		}
+		waitEvent(ctx, w, func(ev watch.Event, ns *corev1.Namespace) bool {
+			return ev.Type == watch.Added
+		})
+	}
+	return false
+}
+
+// watchNamespaceDeletion blocks until namespace is deleted, returning true.
+// It returns false once ctx is cancelled or namespaces can't be watched.
+func watchNamespaceDeletion(ctx context.Context, core coreClient, namespace string) bool {
+	opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", namespace).String()}
+	for ctx.Err() == nil {
+		w, err := core.watchNamespaces(ctx, opts)
+		if apierrors.IsForbidden(err) {
+			return false
+		}
+		if err != nil {
+			logrus.Debugf("failed to watch namespace %s: %v", namespace, err)
+			sleepContext(ctx, 2*time.Second)
+			continue
+		}
+		deleted := waitEvent(ctx, w, func(ev watch.Event, ns *corev1.Namespace) bool {
+			// A terminating namespace can't run new pods, treat it as gone.
+			return ev.Type == watch.Deleted || ns.Status.Phase == corev1.NamespaceTerminating
+		})
+		if deleted {
+			return true
+		}
+	}
+	return false
+}
+
+// waitEvent reads namespace events from w until match returns true, the
+// watch ends or ctx is cancelled. It reports whether match returned true.
+func waitEvent(ctx context.Context, w watch.Interface, match func(watch.Event, *corev1.Namespace) bool) bool {
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case ev, ok := <-w.ResultChan():
+			if !ok {
+				return false
+			}
+			ns, ok := ev.Object.(*corev1.Namespace)
+			if ok && match(ev, ns) {
+				return true
+			}
+		}
+	}
+}
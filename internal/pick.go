@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pickTimeout bounds the API requests listing what k10ls pick offers.
+const pickTimeout = 10 * time.Second
+
+// pickShown is how many matches the built-in picker lists at a time.
+const pickShown = 20
+
+// ErrNothingPicked is returned by Pick when the user cancels.
+var ErrNothingPicked = errors.New("nothing picked")
+
+// PickCandidate is a service or pod offered by k10ls pick, with the ports
+// forwarded unless others are chosen.
+type PickCandidate struct {
+	// Resource is "svc/<name>" or "pod/<name>".
+	Resource string
+	Ports    []PortMap
+}
+
+// String formats c for the picker, like "svc/web  80:8080 443:8443".
+func (c PickCandidate) String() string {
+	return c.Resource + "  " + FormatPorts(c.Ports, " ")
+}
+
+// FormatPorts formats ports as local:remote pairs separated by sep.
+func FormatPorts(ports []PortMap, sep string) string {
+	s := make([]string, len(ports))
+	for i, p := range ports {
+		s[i] = p.Source + ":" + p.Target
+	}
+	return strings.Join(s, sep)
+}
+
+// PickCandidates lists the services and running pods in namespace of the
+// kubeconfig context kubeContext, or the current context if empty. Services
+// forward their TCP ports locally to the container ports behind them, like
+// those of forward_all_services; pods their TCP container ports. Services
+// without a selector, which have no pods to forward to, are left out.
+func PickCandidates(kubeConfig, kubeContext, namespace string) ([]PickCandidate, error) {
+	clientset, err := listingClient(kubeConfig, kubeContext, pickTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pickTimeout)
+	defer cancel()
+
+	var candidates []PickCandidate
+	services, err := clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %v", err)
+	}
+	for _, svc := range services.Items {
+		if len(svc.Spec.Selector) == 0 {
+			continue
+		}
+		c := PickCandidate{Resource: kindService + "/" + svc.Name}
+		for _, p := range svc.Spec.Ports {
+			if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP {
+				continue
+			}
+			target, err := targetPort(ctx, clientsetCore{clientset}, svc, p)
+			if err != nil {
+				continue
+			}
+			c.Ports = append(c.Ports, PortMap{Source: strconv.Itoa(int(p.Port)), Target: strconv.Itoa(target)})
+		}
+		candidates = append(candidates, c)
+	}
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != corev1.PodRunning || pod.DeletionTimestamp != nil {
+			continue
+		}
+		c := PickCandidate{Resource: kindPod + "/" + pod.Name}
+		for _, container := range pod.Spec.Containers {
+			for _, p := range container.Ports {
+				if p.Protocol != "" && p.Protocol != corev1.ProtocolTCP {
+					continue
+				}
+				port := strconv.Itoa(int(p.ContainerPort))
+				c.Ports = append(c.Ports, PortMap{Source: port, Target: port})
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, nil
+}
+
+// Pick asks the user to choose one of items and returns its index. It runs
+// fzf if installed and stdin is a terminal, otherwise it lists the items on
+// out and reads a filter or the number of an item from in.
+func Pick(in *bufio.Reader, out io.Writer, prompt string, items []string) (int, error) {
+	if len(items) == 0 {
+		return 0, fmt.Errorf("nothing to pick from")
+	}
+	if fzf, err := exec.LookPath("fzf"); err == nil && isTerminal(os.Stdin) {
+		return pickFzf(fzf, prompt, items)
+	}
+	return pickPrompt(in, out, prompt, items)
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// pickFzf lets the user choose one of items with fzf, which reads the keys
+// from the terminal itself.
+func pickFzf(fzf, prompt string, items []string) (int, error) {
+	cmd := exec.Command(fzf, "--prompt", prompt+"> ", "--height", "40%", "--reverse")
+	cmd.Stdin = strings.NewReader(strings.Join(items, "\n"))
+	cmd.Stderr = os.Stderr
+	choice, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// 1: no match, 130: cancelled.
+		return 0, ErrNothingPicked
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i, item := range items {
+		if item == strings.TrimRight(string(choice), "\n") {
+			return i, nil
+		}
+	}
+	return 0, ErrNothingPicked
+}
+
+// pickPrompt lets the user choose one of items by narrowing them down with
+// fuzzy filters until picking one by its number.
+func pickPrompt(in *bufio.Reader, out io.Writer, prompt string, items []string) (int, error) {
+	matches := fuzzyFilter(items, "")
+	for {
+		for i, m := range matches {
+			if i == pickShown {
+				fmt.Fprintf(out, "     ... and %d more, type to narrow them down\n", len(matches)-pickShown)
+				break
+			}
+			fmt.Fprintf(out, "%4d) %s\n", i+1, items[m])
+		}
+		fmt.Fprintf(out, "%s (number, or text to filter by): ", prompt)
+		line, err := in.ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(out)
+			return 0, ErrNothingPicked
+		}
+		line = strings.TrimSpace(line)
+
+		if n, err := strconv.Atoi(line); err == nil && n >= 1 && n <= min(len(matches), pickShown) {
+			return matches[n-1], nil
+		}
+		if line == "" && len(matches) == 1 {
+			return matches[0], nil
+		}
+		if filtered := fuzzyFilter(items, line); len(filtered) > 0 {
+			matches = filtered
+		} else {
+			fmt.Fprintf(out, "Nothing matches %q\n", line)
+		}
+	}
+}
+
+// fuzzyFilter returns the indexes of the items matching query like fzf
+// does, its characters appearing in order, ignoring case. Items containing
+// query as is come first.
+func fuzzyFilter(items []string, query string) []int {
+	query = strings.ToLower(query)
+	var exact, fuzzy []int
+	for i, item := range items {
+		item = strings.ToLower(item)
+		switch {
+		case strings.Contains(item, query):
+			exact = append(exact, i)
+		case isSubsequence(query, item):
+			fuzzy = append(fuzzy, i)
+		}
+	}
+	return append(exact, fuzzy...)
+}
+
+// isSubsequence reports whether the characters of sub appear in s in
+// order.
+func isSubsequence(sub, s string) bool {
+	for _, r := range sub {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(string(r)):]
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"k8s.io/client-go/rest"
+)
+
+// certPins is a set of SHA-256 certificate fingerprints, hex encoded in
+// lower case without separators.
+type certPins map[string]bool
+
+// parsePins parses fingerprints given as hex, optionally separated by
+// colons.
+func parsePins(fingerprints []string) (certPins, error) {
+	if len(fingerprints) == 0 {
+		return nil, nil
+	}
+	pins := certPins{}
+	for _, fp := range fingerprints {
+		norm := strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+		if b, err := hex.DecodeString(norm); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid SHA-256 fingerprint %q", fp)
+		}
+		pins[norm] = true
+	}
+	return pins, nil
+}
+
+// fingerprint returns the SHA-256 fingerprint of cert.
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// verify checks that one of the certificates the server presented, or of
+// the chains they were verified against, is pinned. Pinning a CA thus
+// accepts any server certificate it issued.
+func (p certPins) verify(cs tls.ConnectionState) error {
+	seen := map[string]bool{}
+	var presented []string
+	check := func(cert *x509.Certificate) bool {
+		fp := fingerprint(cert)
+		if !seen[fp] {
+			seen[fp] = true
+			presented = append(presented, fp)
+		}
+		return p[fp]
+	}
+	for _, cert := range cs.PeerCertificates {
+		if check(cert) {
+			return nil
+		}
+	}
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if check(cert) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("API server certificate does not match the pinned fingerprints (got %s)", strings.Join(presented, ", "))
+}
+
+// pinnedRoundTripper fails every response that didn't come over a
+// connection with a pinned certificate.
+type pinnedRoundTripper struct {
+	rt   http.RoundTripper
+	pins certPins
+}
+
+func (p *pinnedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := p.rt.RoundTrip(req)
+	if err != nil || resp.TLS == nil {
+		return resp, err
+	}
+	if err := p.pins.verify(*resp.TLS); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// pinConfig returns a copy of cfg that only accepts responses from an API
+// server presenting a pinned certificate. The pins aren't checked up front:
+// every API request and tunnel handshake checks them.
+func pinConfig(cfg *rest.Config, pins certPins) *rest.Config {
+	pinned := rest.CopyConfig(cfg)
+	wrap := cfg.WrapTransport
+	pinned.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrap != nil {
+			rt = wrap(rt)
+		}
+		return &pinnedRoundTripper{rt: rt, pins: pins}
+	}
+	return pinned
+}
+
+// pinnedTLSConfig returns the TLS config of cfg, refusing handshakes with
+// servers that don't present a pinned certificate.
+func pinnedTLSConfig(cfg *rest.Config, pins certPins) (*tls.Config, error) {
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.VerifyConnection = pins.verify
+	return tlsConfig, nil
+}
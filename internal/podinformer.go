@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podInformer caches the pods of a namespace. It is shared by every
+// forward of a context in that namespace and stopped once the last of them
+// releases it.
+type podInformer struct {
+	informer cache.SharedIndexInformer
+	cancel   context.CancelFunc
+
+	// failed is set while the pods can't be listed or watched, e.g. for
+	// lack of RBAC permissions, so lookups fall back to the API.
+	failed atomic.Bool
+
+	kube      *kubeClient
+	namespace string
+	refs      int
+}
+
+// podInformer returns the pod informer of namespace, starting it if no
+// forward uses it yet. Callers must release it when done. In the
+// low-memory profile there are no informers and it returns nil.
+func (k *kubeClient) podInformer(namespace string) *podInformer {
+	if lowMemory {
+		return nil
+	}
+	k.informersMu.Lock()
+	defer k.informersMu.Unlock()
+	if p, ok := k.informers[namespace]; ok {
+		p.refs++
+		return p
+	}
+
+	p := &podInformer{kube: k, namespace: namespace, refs: 1}
+	// The client is looked up on every call so a reloaded kubeconfig is
+	// picked up when the informer lists or watches again.
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			core, _ := k.getCore()
+			pods, err := core.listPods(context.Background(), namespace, opts)
+			if err == nil {
+				p.failed.Store(false)
+			}
+			return pods, err
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			core, _ := k.getCore()
+			return core.watchPods(context.Background(), namespace, opts)
+		},
+	}
+	p.informer = cache.NewSharedIndexInformer(lw, &corev1.Pod{}, 0, cache.Indexers{})
+	// Forwards only look at labels, nodes and status; don't keep the
+	// managed fields of every pod in memory.
+	_ = p.informer.SetTransform(func(obj interface{}) (interface{}, error) {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			pod.ManagedFields = nil
+		}
+		return obj, nil
+	})
+	_ = p.informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		p.failed.Store(true)
+		logrus.Debugf("failed to watch pods in namespace %s: %v", namespace, err)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	go p.informer.Run(ctx.Done())
+	if k.informers == nil {
+		k.informers = map[string]*podInformer{}
+	}
+	k.informers[namespace] = p
+	return p
+}
+
+// release drops a reference to p, stopping it when it was the last one.
+func (p *podInformer) release() {
+	if p == nil {
+		return
+	}
+	k := p.kube
+	k.informersMu.Lock()
+	defer k.informersMu.Unlock()
+	p.refs--
+	if p.refs == 0 {
+		p.cancel()
+		delete(k.informers, p.namespace)
+	}
+}
+
+// ready waits until the cache of p is filled. It returns false if the pods
+// can't be listed or ctx is cancelled first.
+func (p *podInformer) ready(ctx context.Context) bool {
+	for ctx.Err() == nil {
+		if p.failed.Load() {
+			return false
+		}
+		if p.informer.HasSynced() {
+			return true
+		}
+		sleepContext(ctx, 50*time.Millisecond)
+	}
+	return false
+}
+
+// list returns the cached pods matching selector.
+func (p *podInformer) list(selector labels.Selector) []corev1.Pod {
+	var pods []corev1.Pod
+	for _, obj := range p.informer.GetStore().List() {
+		if pod, ok := obj.(*corev1.Pod); ok && selector.Matches(labels.Set(pod.Labels)) {
+			pods = append(pods, *pod)
+		}
+	}
+	return pods
+}
+
+// watchPod returns a channel closed as soon as the pod named name with uid
+// is gone: deleted, being deleted, evicted or otherwise terminated, or
+// replaced by a new pod with the same name (e.g. StatefulSets). The pod is
+// followed through pods, or watched on its own if pods is nil. stop must be
+// called once the channel isn't needed anymore.
+func watchPod(core coreClient, pods *podInformer, namespace, name string, uid types.UID) (gone <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	var once sync.Once
+	signal := func() { once.Do(func() { close(ch) }) }
+
+	if pods == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			if watchPodGone(ctx, core, namespace, name, uid) {
+				signal()
+			}
+		}()
+		return ch, cancel
+	}
+
+	check := func(obj interface{}, deleted bool) {
+		if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj, deleted = d.Obj, true
+		}
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Name != name {
+			return
+		}
+		if pod.UID != uid || deleted || podTerminated(pod) {
+			signal()
+		}
+	}
+	reg, err := pods.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { check(obj, false) },
+		UpdateFunc: func(_, obj interface{}) { check(obj, false) },
+		DeleteFunc: func(obj interface{}) { check(obj, true) },
+	})
+	if err != nil {
+		return ch, func() {}
+	}
+	return ch, func() { _ = pods.informer.RemoveEventHandler(reg) }
+}
+
+// watchPodGone watches the pod named name with uid until it is gone like
+// for watchPod, returning true. It returns false once ctx is cancelled.
+func watchPodGone(ctx context.Context, core coreClient, namespace, name string, uid types.UID) bool {
+	opts := metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()}
+	for ctx.Err() == nil {
+		w, err := core.watchPods(ctx, namespace, opts)
+		if err != nil {
+			logrus.Debugf("failed to watch pod %s: %v", name, err)
+			sleepContext(ctx, 2*time.Second)
+			continue
+		}
+
+	events:
+		for {
+			select {
+			case <-ctx.Done():
+				w.Stop()
+				return false
+			case ev, ok := <-w.ResultChan():
+				if !ok {
+					break events
+				}
+				pod, ok := ev.Object.(*corev1.Pod)
+				if !ok {
+					continue
+				}
+				if pod.UID != uid || ev.Type == watch.Deleted || podTerminated(pod) {
+					w.Stop()
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// podTerminated reports whether pod is being deleted or won't run anymore,
+// e.g. after an eviction.
+func podTerminated(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// listPods lists the pods in the namespace of e matching labelSelector,
+// keeping only those on the node e is pinned to, if any. Pods are read from
+// the cache of informer, or from the API without one or while it can't be
+// filled.
+func listPods(ctx context.Context, core coreClient, informer *podInformer, e entry, labelSelector string) ([]corev1.Pod, error) {
+	var items []corev1.Pod
+	if informer != nil && informer.ready(ctx) {
+		selector, err := labels.Parse(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range informer.list(selector) {
+			if e.Node == "" || p.Spec.NodeName == e.Node {
+				items = append(items, p)
+			}
+		}
+	} else {
+		opts := metav1.ListOptions{LabelSelector: labelSelector}
+		if e.Node != "" {
+			opts.FieldSelector = fields.OneTermEqualSelector("spec.nodeName", e.Node).String()
+		}
+		pods, err := core.listPods(ctx, e.Namespace, opts)
+		if err != nil {
+			return nil, err
+		}
+		items = pods.Items
+	}
+	if len(e.NodeSelector) == 0 {
+		return items, nil
+	}
+
+	nodes, err := core.listNodes(ctx, metav1.ListOptions{LabelSelector: labels.Set(e.NodeSelector).String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	names := map[string]bool{}
+	for _, n := range nodes.Items {
+		names[n.Name] = true
+	}
+	var pinned []corev1.Pod
+	for _, p := range items {
+		if names[p.Spec.NodeName] {
+			pinned = append(pinned, p)
+		}
+	}
+	return pinned, nil
+}
+
+// nodeSuffix describes the node pinning of e for error messages.
+func (e entry) nodeSuffix() string {
+	switch {
+	case e.Node != "":
+		return " on node " + e.Node
+	case len(e.NodeSelector) > 0:
+		return " on nodes " + labels.Set(e.NodeSelector).String()
+	}
+	return ""
+}
+
+// topologyTiers maps the nodes matching the topology_preference of e to the
+// index of the first node labels they match. The preference is only a hint:
+// if the nodes can't be listed, it is ignored.
+func topologyTiers(ctx context.Context, core coreClient, e entry) map[string]int {
+	if len(e.TopologyPreference) == 0 {
+		return nil
+	}
+	tiers := map[string]int{}
+	for i, selector := range e.TopologyPreference {
+		nodes, err := core.listNodes(ctx, metav1.ListOptions{LabelSelector: labels.Set(selector).String()})
+		if err != nil {
+			e.log().Debugf("ignoring topology_preference, failed to list nodes: %v", err)
+			return nil
+		}
+		for _, n := range nodes.Items {
+			if _, ok := tiers[n.Name]; !ok {
+				tiers[n.Name] = i
+			}
+		}
+	}
+	return tiers
+}
+
+// pickPod chooses the pod to forward to among the pods matched by e. Only
+// running and ready pods that aren't being deleted are considered. Pods
+// younger than min_age or restarted more than max_restarts times come after
+// the others; within each group, pods on nodes earlier in the
+// topology_preference, as mapped by tiers, come first, then the pod with
+// the fewest restarts, then the oldest, wins. Pods in failed, which maps the
+// pods that failed recently to the time they failed, are skipped for the
+// next candidate; once every candidate failed, the one that failed longest
+// ago is tried again.
+func pickPod(pods []corev1.Pod, e entry, failed map[string]time.Time, tiers map[string]int) (string, error) {
+	candidates := rankPods(pods, e, tiers)
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("%w ready for %s%s", errNoPods, e.describe(), e.nodeSuffix())
+	}
+
+	pick := candidates[0]
+	for i, p := range candidates {
+		if _, ok := failed[p.Name]; !ok {
+			e.log().Debugf("picked pod %s of %d ready pods, skipping %d that failed recently", p.Name, len(candidates), i)
+			return p.Name, nil
+		}
+		if failed[p.Name].Before(failed[pick.Name]) {
+			pick = p
+		}
+	}
+	e.log().Debugf("all %d ready pods failed recently, retrying pod %s, which failed first", len(candidates), pick.Name)
+	return pick.Name, nil
+}
+
+// rankPods returns the pods pickPod considers, best first.
+func rankPods(pods []corev1.Pod, e entry, tiers map[string]int) []corev1.Pod {
+	var preferred, others []corev1.Pod
+	for _, p := range pods {
+		if p.DeletionTimestamp != nil || p.Status.Phase != corev1.PodRunning || !podReady(p) {
+			continue
+		}
+		if (e.MinAge > 0 && time.Since(p.CreationTimestamp.Time) < e.MinAge) ||
+			(e.MaxRestarts != nil && restartCount(p) > *e.MaxRestarts) {
+			others = append(others, p)
+			continue
+		}
+		preferred = append(preferred, p)
+	}
+
+	tier := func(p corev1.Pod) int {
+		if t, ok := tiers[p.Spec.NodeName]; ok {
+			return t
+		}
+		return len(e.TopologyPreference)
+	}
+	byHealth := func(candidates []corev1.Pod) {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if ti, tj := tier(candidates[i]), tier(candidates[j]); ti != tj {
+				return ti < tj
+			}
+			ri, rj := restartCount(candidates[i]), restartCount(candidates[j])
+			if ri != rj {
+				return ri < rj
+			}
+			return candidates[i].CreationTimestamp.Before(&candidates[j].CreationTimestamp)
+		})
+	}
+	byHealth(preferred)
+	byHealth(others)
+	return append(preferred, others...)
+}
+
+// podReady reports whether the Ready condition of p is true.
+func podReady(p corev1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// restartCount returns the total number of container restarts of p.
+func restartCount(p corev1.Pod) int {
+	n := 0
+	for _, s := range p.Status.ContainerStatuses {
+		n += int(s.RestartCount)
+	}
+	return n
+}
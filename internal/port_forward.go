@@ -2,70 +2,188 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
 	"net/url"
-	"strings"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
-	"github.com/logrusorgru/aurora/v4"
-	"github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"k8s.io/client-go/tools/portforward"
-	"k8s.io/client-go/transport/spdy"
 )
 
 // Config holds the main structure of the TOML configuration
 type Config struct {
-	GlobalKubeConfig string    `toml:"global_kubeconfig,omitempty"`
-	DefaultAddress   string    `toml:"default_address,omitempty"`
-	Contexts         []Context `toml:"context"`
+	GlobalKubeConfig  string                `toml:"global_kubeconfig,omitempty"`
+	DefaultAddress    string                `toml:"default_address,omitempty"`
+	ControlSocket     string                `toml:"control_socket,omitempty"`
+	AuditLog          string                `toml:"audit_log,omitempty"`
+	FileSD            string                `toml:"file_sd,omitempty"`
+	EndpointsFile     *EndpointsFile        `toml:"endpoints_file,omitempty"`
+	MetricsSnapshot   *MetricsSnapshot      `toml:"metrics_snapshot,omitempty"`
+	MetricsAddress    string                `toml:"metrics_address,omitempty"`
+	CrashReports      *CrashReports         `toml:"crash_reports,omitempty"`
+	LightweightClient bool                  `toml:"lightweight_client,omitempty"`
+	Defaults          *Defaults             `toml:"defaults,omitempty"`
+	PortSets          map[string]PortSet    `toml:"portsets,omitempty"`
+	Envs              map[string]EnvOverlay `toml:"env,omitempty"`
+	LeaderElection    *LeaderElection       `toml:"leader_election,omitempty"`
+	Gateway           *Gateway              `toml:"gateway,omitempty"`
+	LogPalette        []string              `toml:"log_palette,omitempty"`
+	Include           []string              `toml:"include,omitempty"`
+	Contexts          []Context             `toml:"context"`
 }
 
 // Context holds Kubernetes context settings
 type Context struct {
-	Name           string     `toml:"name"`
-	Address        string     `toml:"address"`
-	Namespace      string     `toml:"namespace"`
-	KubeConfigPath string     `toml:"kubeconfig,omitempty"`
-	Svc            []Service  `toml:"svc"`
-	Pods           []Pod      `toml:"pods"`
-	LabelSelectors []Selector `toml:"label-selectors"`
+	Name               string        `toml:"name"`
+	UseCurrentContext  bool          `toml:"use_current_context,omitempty"`
+	Alias              string        `toml:"alias,omitempty"`
+	Color              string        `toml:"color,omitempty"`
+	Tags               []string      `toml:"tags,omitempty"`
+	Address            string        `toml:"address"`
+	Namespace          string        `toml:"namespace"`
+	KubeConfigPath     string        `toml:"kubeconfig,omitempty"`
+	KubeConfigVault    string        `toml:"kubeconfig_vault,omitempty"`
+	KubeConfigVaultKey string        `toml:"kubeconfig_vault_key,omitempty"`
+	KubeConfigSecret   string        `toml:"kubeconfig_secret,omitempty"`
+	KubeConfigRefresh  time.Duration `toml:"kubeconfig_refresh,omitempty"`
+	MaxStreams         int           `toml:"max_streams,omitempty"`
+	PinSHA256          []string      `toml:"pin_sha256,omitempty"`
+	Proxy              string        `toml:"proxy,omitempty"`
+	NoProxy            string        `toml:"no_proxy,omitempty"`
+	TunnelProtocol     string        `toml:"tunnel_protocol,omitempty"`
+	PortOffset         int           `toml:"port_offset,omitempty"`
+	ForwardAllServices bool          `toml:"forward_all_services,omitempty"`
+	Include            []string      `toml:"include,omitempty"`
+	Exclude            []string      `toml:"exclude,omitempty"`
+	Approval           *Approval     `toml:"approval,omitempty"`
+	Defaults           *Defaults     `toml:"defaults,omitempty"`
+	Svc                []Service     `toml:"svc"`
+	Pods               []Pod         `toml:"pods"`
+	LabelSelectors     []Selector    `toml:"label-selectors"`
+	Deployments        []Workload    `toml:"deploy,omitempty"`
+	StatefulSets       []Workload    `toml:"sts,omitempty"`
+	ReplicaSets        []Workload    `toml:"rs,omitempty"`
+	Remotes            []Remote      `toml:"remote,omitempty"`
+}
+
+// displayName returns the alias of the context, falling back to its name
+// in the kubeconfig.
+func (ctx *Context) displayName() string {
+	if ctx.Alias != "" {
+		return ctx.Alias
+	}
+	if ctx.Name != "" {
+		return ctx.Name
+	}
+	return currentContextName
+}
+
+// kubeContext returns the name of ctx in the kubeconfig, or "" to use the
+// kubeconfig's current context.
+func (ctx *Context) kubeContext() string {
+	if ctx.UseCurrentContext {
+		return ""
+	}
+	return ctx.Name
+}
+
+// currentContextName is the display name of contexts following the current
+// context of their kubeconfig that set neither name nor alias.
+const currentContextName = "current-context"
+
+// EntryOptions holds the settings shared by services, pods, label
+// selectors, workloads and remote hosts
+type EntryOptions struct {
+	Ports         []PortMap         `toml:"ports"`
+	PortSet       string            `toml:"portset,omitempty"`
+	Namespace     string            `toml:"namespace,omitempty"`
+	Address       string            `toml:"address,omitempty"`
+	Protocol      string            `toml:"protocol,omitempty"`
+	RewriteURLs   bool              `toml:"rewrite_urls,omitempty"`
+	ReadOnly      bool              `toml:"read_only,omitempty"`
+	ZeroPodsHook  string            `toml:"zero_pods_hook,omitempty"`
+	ScaleFromZero string            `toml:"scale_from_zero,omitempty"`
+	IdleTimeout   time.Duration     `toml:"idle_timeout,omitempty"`
+	MinAge        time.Duration     `toml:"min_age,omitempty"`
+	MaxRestarts   *int              `toml:"max_restarts,omitempty"`
+	Node          string            `toml:"node,omitempty"`
+	NodeSelector  map[string]string `toml:"node_selector,omitempty"`
+	Retries       int               `toml:"retries,omitempty"`
+	TLS           bool              `toml:"tls,omitempty"`
+	Mirror        string            `toml:"mirror,omitempty"`
+	RecordHAR     string            `toml:"record_har,omitempty"`
+	DependsOn     []string          `toml:"depends_on,omitempty"`
+	Labels        map[string]string `toml:"labels,omitempty"`
+	Tags          []string          `toml:"tags,omitempty"`
+	LoadBalance   int               `toml:"load_balance,omitempty"`
+	Standby       int               `toml:"standby,omitempty"`
+	Reconnect     *ReconnectPolicy  `toml:"reconnect,omitempty"`
+	HealthProbe   *HealthProbe      `toml:"health_probe,omitempty"`
+
+	MaxConnections          int    `toml:"max_connections,omitempty"`
+	Bandwidth               string `toml:"bandwidth,omitempty"`
+	MaxConnectionsPerClient int    `toml:"max_connections_per_client,omitempty"`
+	BandwidthPerClient      string `toml:"bandwidth_per_client,omitempty"`
+	LogConnections          bool   `toml:"log_connections,omitempty"`
+	CopyURL                 bool   `toml:"copy_url,omitempty"`
+
+	DialTimeout         time.Duration `toml:"dial_timeout,omitempty"`
+	TLSHandshakeTimeout time.Duration `toml:"tls_handshake_timeout,omitempty"`
+	Keepalive           time.Duration `toml:"keepalive,omitempty"`
+
+	TopologyPreference []map[string]string `toml:"topology_preference,omitempty"`
 }
 
 // Service represents a Kubernetes service to be forwarded
 type Service struct {
-	Name      string    `toml:"name"`
-	Ports     []PortMap `toml:"ports"`
-	Namespace string    `toml:"namespace,omitempty"`
-	Address   string    `toml:"address,omitempty"`
+	Name string `toml:"name"`
+	EntryOptions
 }
 
 // Pod represents a Kubernetes pod to be forwarded
 type Pod struct {
-	Name      string    `toml:"name"`
-	Ports     []PortMap `toml:"ports"`
-	Namespace string    `toml:"namespace,omitempty"`
-	Address   string    `toml:"address,omitempty"`
+	Name string `toml:"name"`
+	EntryOptions
 }
 
 // Selector represents a label selector for forwarding
 type Selector struct {
-	Label     string    `toml:"label"`
-	Ports     []PortMap `toml:"ports"`
-	Namespace string    `toml:"namespace,omitempty"`
-	Address   string    `toml:"address,omitempty"`
+	Label string `toml:"label"`
+	EntryOptions
+}
+
+// Workload represents a Deployment, StatefulSet or ReplicaSet forwarded to
+// one of its pods, like kubectl port-forward deploy/<name>
+type Workload struct {
+	Name string `toml:"name"`
+	EntryOptions
 }
 
-// PortMap represents a port-forward mapping (source -> target)
+// Remote represents a host outside the cluster, e.g. a managed database
+// only reachable from the cluster network, forwarded to through a relay pod
+type Remote struct {
+	Host  string `toml:"host"`
+	Image string `toml:"image,omitempty"`
+	EntryOptions
+}
+
+// PortSet is a named list of port mappings shared by several entries
+type PortSet struct {
+	Ports []PortMap `toml:"ports"`
+}
+
+// PortMap represents a port-forward mapping (source -> target), listening
+// on Address instead of the address of its entry if set
 type PortMap struct {
-	Source string `toml:"source"`
-	Target string `toml:"target"`
+	Source  string `toml:"source"`
+	Target  string `toml:"target"`
+	Address string `toml:"address,omitempty"`
 }
 
 func computeAddress(entryAddr, ctxAddr, globalAddr string) string {
@@ -81,81 +199,77 @@ func computeAddress(entryAddr, ctxAddr, globalAddr string) string {
 	return "0.0.0.0"
 }
 
-func Portforward(ctx *Context, config *Config) {
-	logrus.Infof("%s: %s", aurora.Yellow("Processing context"), aurora.Bold(aurora.Cyan(ctx.Name)))
-
-	if ctx.Namespace == "" {
-		ctx.Namespace = "default"
-	}
-
-	clientset, cfg, err := getKubeClient(ctx.Name, ctx.KubeConfigPath, config.GlobalKubeConfig)
+// getKubeClient initializes a Kubernetes client
+func getKubeClient(contextName, contextKubeConfig, globalKubeConfig string) (*kubernetes.Clientset, *rest.Config, error) {
+	config, err := loadRESTConfig(contextName, contextKubeConfig, globalKubeConfig)
 	if err != nil {
-		logrus.Fatalf("Failed to load KubeClient: %v", err)
-	}
-
-	for _, svc := range ctx.Svc {
-		go func(service Service) {
-			namespace := service.Namespace
-			if namespace == "" {
-				namespace = ctx.Namespace
-			}
-			addr := computeAddress(service.Address, ctx.Address, config.DefaultAddress)
-			err := portForwardResource(clientset, cfg, ctx.Name, namespace, "svc/"+service.Name, service.Ports, addr)
-			if err != nil {
-				logrus.Errorf("Error forwarding service %s: %v", service.Name, err)
-			}
-		}(svc)
-	}
-
-	for _, pod := range ctx.Pods {
-		go func(pod Pod) {
-			namespace := pod.Namespace
-			if namespace == "" {
-				namespace = ctx.Namespace
-			}
-			addr := computeAddress(pod.Address, ctx.Address, config.DefaultAddress)
-			err := portForwardResource(clientset, cfg, ctx.Name, namespace, "pod/"+pod.Name, pod.Ports, addr)
-			if err != nil {
-				logrus.Errorf("Error forwarding pod %s: %v", pod.Name, err)
-			}
-		}(pod)
-	}
-
-	for _, selector := range ctx.LabelSelectors {
-		go func(sel Selector) {
-			namespace := sel.Namespace
-			if namespace == "" {
-				namespace = ctx.Namespace
-			}
-			addr := computeAddress(sel.Address, ctx.Address, config.DefaultAddress)
-			err := portForwardLabel(clientset, cfg, ctx.Name, namespace, sel.Label, sel.Ports, addr)
-			if err != nil {
-				logrus.Errorf("Error forwarding label selector %s: %v", sel.Label, err)
-			}
-		}(selector)
+		return nil, nil, err
 	}
+	return newClientset(config)
 }
 
-// getKubeClient initializes a Kubernetes client
-func getKubeClient(contextName, contextKubeConfig, globalKubeConfig string) (*kubernetes.Clientset, *rest.Config, error) {
+// loadRESTConfig loads the REST config of contextName from the kubeconfig
+// of the context, the global kubeconfig or, without either, the in-cluster
+// config.
+func loadRESTConfig(contextName, contextKubeConfig, globalKubeConfig string) (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
 	if contextKubeConfig != "" {
-		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: contextKubeConfig}
 		overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
-		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(contextKubeConfig), overrides).ClientConfig()
 	} else if globalKubeConfig != "" {
-		loadingRules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: globalKubeConfig}
 		overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
-		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(globalKubeConfig), overrides).ClientConfig()
 	} else {
 		config, err = rest.InClusterConfig()
 	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
 	}
+	return config, nil
+}
 
+// kubeConfigNamespace returns the namespace set on the kubeconfig context
+// contextName, or the current context if empty, like kubens sets it. It
+// returns "" if the context sets none or the kubeconfig can't be read.
+func kubeConfigNamespace(contextName, contextKubeConfig, globalKubeConfig string) string {
+	path := contextKubeConfig
+	if path == "" {
+		path = globalKubeConfig
+	}
+	if path == "" {
+		return ""
+	}
+	raw, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules(path), &clientcmd.ConfigOverrides{}).RawConfig()
+	if err != nil {
+		return ""
+	}
+	if contextName == "" {
+		contextName = raw.CurrentContext
+	}
+	if kubeCtx, ok := raw.Contexts[contextName]; ok {
+		return kubeCtx.Namespace
+	}
+	return ""
+}
+
+// loadingRules returns the rules loading the kubeconfig at path. Like
+// KUBECONFIG for kubectl, path may list several files separated by the OS
+// path list separator (":" or ";" on Windows). They are merged, the first
+// file setting a value winning, and files that don't exist are skipped.
+func loadingRules(path string) *clientcmd.ClientConfigLoadingRules {
+	paths := filepath.SplitList(path)
+	if len(paths) == 1 {
+		return &clientcmd.ClientConfigLoadingRules{ExplicitPath: path}
+	}
+	return &clientcmd.ClientConfigLoadingRules{Precedence: paths}
+}
+
+// newClientset builds a clientset for config, registering its credentials
+// for redaction from log output.
+func newClientset(config *rest.Config) (*kubernetes.Clientset, *rest.Config, error) {
+	registerConfigSecrets(config)
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create clientset: %v", err)
@@ -163,84 +277,131 @@ func getKubeClient(contextName, contextKubeConfig, globalKubeConfig string) (*ku
 	return clientset, config, nil
 }
 
-func portForwardResource(clientset *kubernetes.Clientset, cfg *rest.Config, contextName, namespace, resource string, ports []PortMap, address string) error {
-	var podName string
-	if strings.HasPrefix(resource, "svc/") {
-		name := strings.TrimPrefix(resource, "svc/")
-		svc, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+// registerConfigSecrets registers the credentials of config for redaction
+// from log output.
+func registerConfigSecrets(config *rest.Config) {
+	RegisterSecret(config.BearerToken)
+	RegisterSecret(config.Password)
+	if u, err := url.Parse(config.Host); err == nil && u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			RegisterSecret(p)
+		}
+	}
+}
+
+// startEntry forwards e until runCtx is cancelled. If the namespace of e
+// doesn't exist yet, the forward starts once it is created, and it is torn
+// down again when the namespace is deleted.
+func startEntry(runCtx context.Context, kube *kubeClient, e entry) error {
+	if e.Approval != nil {
+		expires, err := requestApproval(runCtx, e)
 		if err != nil {
-			return fmt.Errorf("failed to get service %s: %v", name, err)
+			return err
 		}
-		if len(svc.Spec.Selector) == 0 {
-			return fmt.Errorf("service %s has no selector", name)
+		parent := runCtx
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithDeadline(parent, expires)
+		defer cancel()
+		defer func() {
+			if parent.Err() == nil && runCtx.Err() != nil {
+				e.log().Warnf("Approval to forward %s expired, stopped it. Restart k10ls to request access again", e.describe())
+			}
+		}()
+	}
+
+	for runCtx.Err() == nil {
+		core, _ := kube.getCore()
+		if !waitForNamespace(runCtx, core, e.Namespace) {
+			return nil
 		}
-		selector := labels.Set(svc.Spec.Selector).String()
-		pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
-		if err != nil {
-			return fmt.Errorf("failed to list pods for service %s: %v", name, err)
+
+		nsCtx, cancel := context.WithCancel(runCtx)
+		var deleted atomic.Bool
+		go func() {
+			if watchNamespaceDeletion(nsCtx, core, e.Namespace) {
+				deleted.Store(true)
+				cancel()
+			}
+		}()
+		err := forwardEntry(nsCtx, kube, e)
+		cancel()
+
+		if err != nil && runCtx.Err() == nil && !deleted.Load() {
+			// The forward may have failed because the namespace went away
+			// before the deletion was observed.
+			_, nsErr := core.getNamespace(runCtx, e.Namespace)
+			deleted.Store(apierrors.IsNotFound(nsErr))
 		}
-		if len(pods.Items) == 0 {
-			return fmt.Errorf("no pods found for service %s", name)
+		if !deleted.Load() {
+			return err
 		}
-		podName = pods.Items[0].Name
-	} else {
-		podName = strings.TrimPrefix(resource, "pod/")
+		e.log().Warnf("Namespace %s was deleted, stopping %s", e.Namespace, e.describe())
 	}
-
-	go maintainPortForward(cfg, contextName, namespace, podName, ports, address)
 	return nil
 }
 
-func portForwardLabel(clientset *kubernetes.Clientset, cfg *rest.Config, contextName, namespace, label string, ports []PortMap, address string) error {
-	pods, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: label})
-	if err != nil {
-		return fmt.Errorf("failed to list pods: %v", err)
-	}
-	if len(pods.Items) == 0 {
-		return fmt.Errorf("no pods found with label: %s", label)
+// Errors returned by resolvePod.
+var (
+	errNoPods     = errors.New("no pods found")
+	errNoSelector = errors.New("service has no selector")
+)
+
+// forwardEntry forwards e until runCtx is cancelled.
+func forwardEntry(runCtx context.Context, kube *kubeClient, e entry) error {
+	core, _ := kube.getCore()
+	if err := preflightRBAC(runCtx, core, e); err != nil {
+		return err
 	}
-	podName := pods.Items[0].Name
-	return portForwardResource(clientset, cfg, contextName, namespace, "pod/"+podName, ports, address)
+	return newForward(kube, e).run(runCtx)
 }
 
-func maintainPortForward(cfg *rest.Config, contextName, namespace, podName string, ports []PortMap, address string) {
-	portArgs := make([]string, len(ports))
-	for i, p := range ports {
-		portArgs[i] = fmt.Sprintf("%s:%s", p.Source, p.Target)
-	}
-	for {
-		if err := startPortForward(cfg, contextName, namespace, podName, address, portArgs); err != nil {
-			logrus.Errorf("port-forward failed for %s: %v", podName, err)
+// resolvePod returns the name of the pod backing e, failing over from the
+// pods in failed like pickPod. Pods are looked up in informer, the pod
+// informer of the namespace of e.
+func resolvePod(ctx context.Context, core coreClient, informer *podInformer, e entry, failed map[string]time.Time) (string, error) {
+	switch e.Kind {
+	case kindService:
+		svc, err := core.getService(ctx, e.Namespace, e.Name)
+		if err != nil {
+			return "", fmt.Errorf("failed to get service %s: %w", e.Name, err)
+		}
+		if len(svc.Spec.Selector) == 0 {
+			return "", fmt.Errorf("%w: %s", errNoSelector, e.Name)
+		}
+		selector := labels.Set(svc.Spec.Selector).String()
+		pods, err := listPods(ctx, core, informer, e, selector)
+		if err != nil {
+			return "", fmt.Errorf("failed to list pods for service %s: %w", e.Name, err)
+		}
+		if len(pods) == 0 {
+			return "", fmt.Errorf("%w for service %s%s", errNoPods, e.Name, e.nodeSuffix())
 		}
-		time.Sleep(2 * time.Second)
+		return pickPod(pods, e, failed, topologyTiers(ctx, core, e))
+	case kindLabel:
+		pods, err := listPods(ctx, core, informer, e, e.Name)
+		if err != nil {
+			return "", fmt.Errorf("failed to list pods: %w", err)
+		}
+		if len(pods) == 0 {
+			return "", fmt.Errorf("%w with label: %s%s", errNoPods, e.Name, e.nodeSuffix())
+		}
+		return pickPod(pods, e, failed, topologyTiers(ctx, core, e))
+	case kindDeployment, kindStatefulSet, kindReplicaSet:
+		return resolveWorkloadPod(ctx, core, informer, e, failed)
+	case kindRemote:
+		return ensureRelayPod(ctx, core, e)
+	default:
+		return e.Name, nil
 	}
 }
 
-func startPortForward(cfg *rest.Config, contextName, namespace, podName, address string, ports []string) error {
-	path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/portforward", namespace, podName)
-	hostIP := strings.TrimPrefix(cfg.Host, "https://")
-	transport, upgrader, err := spdy.RoundTripperFor(cfg)
-	if err != nil {
-		return err
+// sleepContext waits for d to elapse or ctx to be cancelled, whichever
+// happens first.
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
 	}
-	url := &url.URL{Scheme: "https", Path: path, Host: hostIP}
-	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
-
-	stopCh := make(chan struct{})
-	readyCh := make(chan struct{})
-	pf, err := portforward.NewOnAddresses(dialer, []string{address}, ports, stopCh, readyCh, io.Discard, io.Discard)
-	if err != nil {
-		return err
-	}
-
-	go func() {
-		<-readyCh
-		logrus.Info(aurora.Green(aurora.Sprintf("Started port-forward for pod %s on %v", aurora.Yellow(aurora.Bold(podName)), aurora.Cyan(aurora.Bold(ports)))))
-		equiv := fmt.Sprintf("kubectl --context %s -n %s port-forward pod/%s %s --address %s", contextName, namespace, podName, strings.Join(ports, " "), address)
-		logrus.Info(aurora.Yellow(aurora.Sprintf("Equivalent kubectl command: %s", aurora.Cyan(equiv))))
-	}()
-
-	err = pf.ForwardPorts()
-	close(stopCh)
-	return err
 }
@@ -0,0 +1,294 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Startup request codes of the PostgreSQL protocol.
+const (
+	pgProtocolV3    = 196608
+	pgCancelRequest = 80877102
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+)
+
+// maxPostgresMessage bounds the size of a single message buffered by a
+// read-only PostgreSQL forward.
+const maxPostgresMessage = 64 << 20
+
+// pgReadOnlyStatements are the statements read-only forwards let through,
+// by their first keyword. The session additionally runs with
+// default_transaction_read_only, which catches writes hidden in e.g. CTEs.
+var pgReadOnlyStatements = toSet(
+	"SELECT", "WITH", "VALUES", "TABLE", "SHOW", "EXPLAIN",
+	"DECLARE", "FETCH", "MOVE", "CLOSE",
+	"BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE",
+	"SET", "RESET", "DISCARD", "DEALLOCATE", "LISTEN", "UNLISTEN",
+)
+
+// pgReadWrite matches statements that would turn read-only transactions off.
+var pgReadWrite = regexp.MustCompile(`(?i)read\s+write|read_only`)
+
+// proxyPostgresReadOnly relays the PostgreSQL protocol between the local
+// client and upstream, starting the session with
+// default_transaction_read_only and replacing statements that may modify
+// data with one that fails with SQLSTATE 25006 (read_only_sql_transaction).
+//
+// TLS requests are declined so that queries can be inspected; the tunnel to
+// the API server is encrypted regardless.
+func proxyPostgresReadOnly(client, upstream net.Conn) error {
+	r := bufio.NewReader(client)
+
+	// Startup phase: messages without a type byte.
+	for {
+		msg, err := readPostgresMessage(r, false)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(msg) < 8 {
+			return fmt.Errorf("invalid postgres startup message")
+		}
+		switch code := binary.BigEndian.Uint32(msg[4:8]); code {
+		case pgSSLRequest, pgGSSENCRequest:
+			if _, err := client.Write([]byte{'N'}); err != nil {
+				return err
+			}
+			continue
+		case pgProtocolV3:
+			msg = pgReadOnlyStartup(msg)
+		case pgCancelRequest:
+		default:
+			return fmt.Errorf("unsupported postgres protocol version %d", code)
+		}
+		if _, err := upstream.Write(msg); err != nil {
+			return err
+		}
+		break
+	}
+
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		client.Close()
+	}()
+
+	for {
+		msg, err := readPostgresMessage(r, true)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch msg[0] {
+		case 'Q':
+			// Query: cstring
+			if query := cstring(msg[5:]); !pgReadOnlySQL(query) {
+				msg = pgMessage('Q', append([]byte(pgBlockedSQL(query)), 0))
+			}
+		case 'P':
+			// Parse: name cstring, query cstring, parameter types
+			name := cstring(msg[5:])
+			rest := msg[5+len(name)+1:]
+			if query := cstring(rest); !pgReadOnlySQL(query) {
+				body := append([]byte(name), 0)
+				body = append(append(body, pgBlockedSQL(query)...), 0)
+				body = append(body, 0, 0) // no parameter types
+				msg = pgMessage('P', body)
+			}
+		}
+		if _, err := upstream.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// readPostgresMessage reads one message, with a leading type byte if typed
+// is set.
+func readPostgresMessage(r *bufio.Reader, typed bool) ([]byte, error) {
+	headerLen := 4
+	if typed {
+		headerLen = 5
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[headerLen-4:]))
+	if size < 4 || size > maxPostgresMessage {
+		return nil, fmt.Errorf("invalid postgres message length %d", size)
+	}
+	msg := make([]byte, headerLen+size-4)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[headerLen:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// pgMessage builds a typed message.
+func pgMessage(typ byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = typ
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// pgReadOnlyStartup returns the startup message msg with
+// default_transaction_read_only turned on.
+func pgReadOnlyStartup(msg []byte) []byte {
+	var body bytes.Buffer
+	body.Write(msg[4:8])
+	params := msg[8:]
+	for len(params) > 1 {
+		key := cstring(params)
+		value := cstring(params[len(key)+1:])
+		params = params[len(key)+len(value)+2:]
+		if key != "default_transaction_read_only" {
+			body.WriteString(key + "\x00" + value + "\x00")
+		}
+	}
+	body.WriteString("default_transaction_read_only\x00on\x00\x00")
+
+	out := make([]byte, 4, 4+body.Len())
+	binary.BigEndian.PutUint32(out, uint32(4+body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// pgReadOnlySQL reports whether every statement of query is allowed on a
+// read-only forward.
+func pgReadOnlySQL(query string) bool {
+	for _, stmt := range splitSQL(query) {
+		word := strings.ToUpper(firstWord(stmt))
+		if word == "" {
+			continue
+		}
+		if !pgReadOnlyStatements[word] {
+			return false
+		}
+		switch word {
+		case "SET", "BEGIN", "START":
+			if pgReadWrite.MatchString(stmt) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// pgBlockedSQL returns a statement failing with read_only_sql_transaction
+// in place of query.
+func pgBlockedSQL(query string) string {
+	word := "statement"
+	for _, stmt := range splitSQL(query) {
+		if w := strings.ToUpper(firstWord(stmt)); w != "" && !pgReadOnlyStatements[w] {
+			word = w
+			break
+		}
+	}
+	return fmt.Sprintf("DO $k10ls$ BEGIN RAISE EXCEPTION USING ERRCODE = 'read_only_sql_transaction', "+
+		"MESSAGE = 'k10ls: %s is blocked on this read-only forward'; END $k10ls$", word)
+}
+
+// splitSQL splits query into statements at semicolons outside of quotes,
+// dollar-quoted strings and comments. Comments are dropped.
+func splitSQL(query string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ';':
+			stmts = append(stmts, cur.String())
+			cur.Reset()
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end
+			}
+			cur.WriteByte(' ')
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			cur.WriteByte(' ')
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(query[i+1:], c)
+			if end < 0 {
+				cur.WriteString(query[i:])
+				i = len(query)
+			} else {
+				cur.WriteString(query[i : i+end+2])
+				i += end + 1
+			}
+		case c == '$':
+			tag := dollarTag(query[i:])
+			if tag == "" {
+				cur.WriteByte(c)
+				break
+			}
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				cur.WriteString(query[i:])
+				i = len(query)
+			} else {
+				cur.WriteString(query[i : i+2*len(tag)+end])
+				i += 2*len(tag) + end - 1
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	return append(stmts, cur.String())
+}
+
+// dollarTag returns the opening tag of a dollar-quoted string at the start
+// of s, e.g. "$$" or "$body$", or "" if there is none.
+func dollarTag(s string) string {
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '$':
+			return s[:i+1]
+		case c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 1 && c >= '0' && c <= '9'):
+		default:
+			return ""
+		}
+	}
+	return ""
+}
+
+// firstWord returns the first keyword of stmt, skipping leading
+// whitespace and parentheses.
+func firstWord(stmt string) string {
+	stmt = strings.TrimLeft(stmt, " \t\r\n(")
+	end := strings.IndexFunc(stmt, func(r rune) bool {
+		return !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+	})
+	if end < 0 {
+		return stmt
+	}
+	return stmt[:end]
+}
+
+// cstring returns the NUL terminated string at the start of b.
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b)
+}
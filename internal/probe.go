@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/version"
+)
+
+// ContextProbe is the result of probing the API server of a context.
+type ContextProbe struct {
+	Context string
+	Server  string
+	Version string
+	// Latency is the round trip time of the version request.
+	Latency time.Duration
+	// Auth describes whether the credentials are accepted and allow port
+	// forwarding in the namespace of the context.
+	Auth string
+	// Error is set when the API server couldn't be reached or the
+	// credentials were rejected.
+	Error string
+}
+
+// OK reports whether the context is usable for forwarding.
+func (p ContextProbe) OK() bool {
+	return p.Error == "" && p.Auth == "ok"
+}
+
+// ProbeContexts probes every context of config in parallel, giving each
+// up to timeout, and returns the results in the order of the config.
+func ProbeContexts(ctx context.Context, config *Config, timeout time.Duration) []ContextProbe {
+	probes := make([]ContextProbe, len(config.Contexts))
+	var wg sync.WaitGroup
+	for i := range config.Contexts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			probes[i] = probeContext(ctx, &config.Contexts[i], config, timeout)
+		}(i)
+	}
+	wg.Wait()
+	return probes
+}
+
+// probeContext fetches the version of the API server of c and checks that
+// its credentials may forward ports.
+func probeContext(ctx context.Context, c *Context, config *Config, timeout time.Duration) ContextProbe {
+	probe := ContextProbe{Context: c.displayName(), Auth: "-"}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	kube, err := newContextClient(ctx, c, config)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	core, cfg := kube.getCore()
+	probe.Server = cfg.Host
+
+	start := time.Now()
+	body, err := core.serverVersion(ctx)
+	probe.Latency = time.Since(start)
+	if err != nil && !apierrors.IsUnauthorized(err) && !apierrors.IsForbidden(err) {
+		probe.Error = fmt.Sprintf("unreachable: %v", err)
+		return probe
+	}
+	var info version.Info
+	if err == nil && json.Unmarshal(body, &info) == nil {
+		probe.Version = info.GitVersion
+	}
+
+	namespace := c.namespace(config)
+	review, err := core.reviewAccess(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: "portforward",
+			},
+		},
+	})
+	switch {
+	case apierrors.IsUnauthorized(err):
+		probe.Auth = "rejected"
+		probe.Error = "credentials rejected"
+	case err != nil:
+		probe.Auth = fmt.Sprintf("unknown (%v)", err)
+	case !review.Status.Allowed:
+		probe.Auth = "no port-forward in " + namespace
+	default:
+		probe.Auth = "ok"
+	}
+	return probe
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package internal
+
+import "os"
+
+// processAlive reports whether a process with pid runs on this host.
+// FindProcess opens the process on Windows and fails if there is none.
+func processAlive(pid int) bool {
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	proc.Release()
+	return true
+}
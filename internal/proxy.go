@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+	"k8s.io/client-go/rest"
+)
+
+// proxyDirect as the proxy of a context connects to its API server
+// directly, ignoring the environment.
+const proxyDirect = "direct"
+
+// contextProxy returns the proxy function for the API server of ctx, or nil
+// if ctx doesn't override the proxy-url of its kubeconfig or the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+func contextProxy(ctx *Context) (func(*http.Request) (*url.URL, error), error) {
+	var pc *httpproxy.Config
+	switch ctx.Proxy {
+	case "":
+		if ctx.NoProxy == "" {
+			return nil, nil
+		}
+		pc = httpproxy.FromEnvironment()
+		pc.NoProxy = strings.Trim(pc.NoProxy+","+ctx.NoProxy, ",")
+	case proxyDirect:
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	default:
+		u, err := url.Parse(ctx.Proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", ctx.Proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy %q: unsupported scheme %q (expected http, https or socks5)", ctx.Proxy, u.Scheme)
+		}
+		pc = &httpproxy.Config{HTTPProxy: ctx.Proxy, HTTPSProxy: ctx.Proxy, NoProxy: ctx.NoProxy}
+	}
+
+	proxyFunc := pc.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyFunc(req.URL)
+	}, nil
+}
+
+// dialAPIServer opens a TCP connection to addr, the host:port of the API
+// server of cfg, with dialer through the proxy cfg uses for it. Like the
+// Kubernetes client, it falls back to the environment when cfg sets no
+// proxy. Cancelling ctx aborts the dial.
+func dialAPIServer(ctx context.Context, cfg *rest.Config, addr string, dialer *net.Dialer) (net.Conn, error) {
+	proxyFunc := cfg.Proxy
+	if proxyFunc == nil {
+		proxyFunc = http.ProxyFromEnvironment
+	}
+	proxyURL, err := proxyFunc(&http.Request{URL: &url.URL{Scheme: "https", Host: addr}})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	if proxyURL.Scheme == "socks5" {
+		d, err := proxy.FromURL(proxyURL, dialer)
+		if err != nil {
+			return nil, err
+		}
+		if cd, ok := d.(proxy.ContextDialer); ok {
+			return cd.DialContext(ctx, "tcp", addr)
+		}
+		return d.Dial("tcp", addr)
+	}
+	return dialConnect(ctx, proxyURL, addr, dialer)
+}
+
+// dialConnect opens a tunnel to addr through the HTTP(S) proxy proxyURL
+// with a CONNECT request.
+func dialConnect(ctx context.Context, proxyURL *url.URL, addr string, dialer *net.Dialer) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "80"
+		if proxyURL.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: proxyURL.Hostname()}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", proxyAddr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", proxyAddr, err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	// Abort the exchange with the proxy once ctx is cancelled.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	return conn, nil
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// permission is a single RBAC permission an entry depends on.
+type permission struct {
+	Group       string
+	Verb        string
+	Resource    string
+	Subresource string
+	// ClusterScoped is set for permissions on cluster-scoped resources,
+	// like nodes, which are reviewed without a namespace.
+	ClusterScoped bool
+}
+
+func (p permission) String() string {
+	resource := p.Resource
+	if p.Subresource != "" {
+		resource += "/" + p.Subresource
+	}
+	if p.ClusterScoped {
+		resource += " (cluster-wide)"
+	}
+	return p.Verb + " " + resource
+}
+
+// requiredPermissions lists the permissions needed to resolve and forward e.
+func requiredPermissions(e entry) []permission {
+	perms := []permission{
+		{Verb: "get", Resource: "pods"},
+		{Verb: "create", Resource: "pods", Subresource: "portforward"},
+	}
+	if e.TunnelProtocol == tunnelPodProxy {
+		perms[1] = permission{Verb: "get", Resource: "pods", Subresource: "proxy"}
+	}
+	switch e.Kind {
+	case kindService:
+		perms = append(perms,
+			permission{Verb: "get", Resource: "services"},
+			permission{Verb: "list", Resource: "pods"},
+			permission{Verb: "watch", Resource: "pods"},
+		)
+	case kindLabel:
+		perms = append(perms,
+			permission{Verb: "list", Resource: "pods"},
+			permission{Verb: "watch", Resource: "pods"},
+		)
+	case kindDeployment:
+		perms = append(perms,
+			permission{Group: "apps", Verb: "get", Resource: "deployments"},
+			permission{Group: "apps", Verb: "list", Resource: "replicasets"},
+			permission{Verb: "list", Resource: "pods"},
+			permission{Verb: "watch", Resource: "pods"},
+		)
+	case kindStatefulSet:
+		perms = append(perms,
+			permission{Group: "apps", Verb: "get", Resource: "statefulsets"},
+			permission{Verb: "list", Resource: "pods"},
+			permission{Verb: "watch", Resource: "pods"},
+		)
+	case kindReplicaSet:
+		perms = append(perms,
+			permission{Group: "apps", Verb: "get", Resource: "replicasets"},
+			permission{Verb: "list", Resource: "pods"},
+			permission{Verb: "watch", Resource: "pods"},
+		)
+	case kindRemote:
+		perms = append(perms,
+			permission{Verb: "create", Resource: "pods"},
+			permission{Verb: "delete", Resource: "pods"},
+		)
+	}
+	if len(e.NodeSelector) > 0 || len(e.TopologyPreference) > 0 {
+		perms = append(perms, permission{Verb: "list", Resource: "nodes", ClusterScoped: true})
+	}
+	if e.ScaleFromZero != "" {
+		if kind, _, err := parseScaleTarget(e.ScaleFromZero); err == nil {
+			perms = append(perms,
+				permission{Group: "apps", Verb: "get", Resource: kind + "s", Subresource: "scale"},
+				permission{Group: "apps", Verb: "update", Resource: kind + "s", Subresource: "scale"},
+			)
+		}
+	}
+	return perms
+}
+
+// preflightRBAC verifies with SelfSubjectAccessReviews that the current
+// identity holds every permission e needs. If the reviews themselves cannot
+// be performed the check is skipped rather than blocking the entry.
+func preflightRBAC(ctx context.Context, core coreClient, e entry) error {
+	var missing []string
+	for _, p := range requiredPermissions(e) {
+		namespace := e.Namespace
+		if p.ClusterScoped {
+			namespace = ""
+		}
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Group:       p.Group,
+					Verb:        p.Verb,
+					Resource:    p.Resource,
+					Subresource: p.Subresource,
+				},
+			},
+		}
+		resp, err := core.reviewAccess(ctx, review)
+		if err != nil {
+			logrus.Debugf("skipping RBAC preflight for %s: %v", e.Resource(), err)
+			return nil
+		}
+		if !resp.Status.Allowed {
+			missing = append(missing, p.String())
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing RBAC: cannot %s in namespace %s", strings.Join(missing, ", "), e.Namespace)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// readOnlyMethods are the HTTP methods read-only forwards let through.
+var readOnlyMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// readOnlyRequest reports whether req may be forwarded by a read-only
+// forward. Upgrades are refused because the upgraded stream can't be
+// inspected.
+func readOnlyRequest(req *http.Request) bool {
+	return readOnlyMethods[req.Method] && req.Header.Get("Upgrade") == ""
+}
+
+// rejectRequest answers req with 403 Forbidden.
+func rejectRequest(client net.Conn, req *http.Request) error {
+	// Drain the body so the next request on the connection can be read.
+	_, _ = io.Copy(io.Discard, req.Body)
+	req.Body.Close()
+
+	what := req.Method
+	if req.Header.Get("Upgrade") != "" {
+		what = "upgrade to " + req.Header.Get("Upgrade")
+	}
+	body := fmt.Sprintf("k10ls: %s is blocked on this read-only forward\n", what)
+	resp := &http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req.Close,
+	}
+	if err := resp.Write(client); err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+	return nil
+}
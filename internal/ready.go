@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// readyEntries reports, by entry key, whether the tunnel of every running
+// forward is established.
+func readyEntries() map[string]bool {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	ready := map[string]bool{}
+	for f := range forwards {
+		f.mu.Lock()
+		ready[f.entry.Key] = f.tun != nil
+		f.mu.Unlock()
+	}
+	return ready
+}
+
+// WaitReady blocks until the forwards selected by waitFor are ready to
+// accept connections. waitFor is "all", "any", or a comma separated list of
+// entries given as ID, kind/name or context/namespace/kind/name. It fails
+// once timeout expires or ctx is cancelled.
+func (m *Manager) WaitReady(ctx context.Context, waitFor string, timeout time.Duration) error {
+	keys, err := m.selectEntries(waitFor)
+	if err != nil {
+		return err
+	}
+	anyReady := waitFor == "any"
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		ready := readyEntries()
+		var pending []string
+		for _, key := range keys {
+			if !ready[key] {
+				pending = append(pending, key)
+			}
+		}
+		if len(pending) == 0 || (anyReady && len(pending) < len(keys)) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("forwards not ready after %s: %s", timeout, strings.Join(pending, ", "))
+		case <-tick.C:
+		}
+	}
+}
+
+// selectEntries returns the keys of the desired entries matched by waitFor.
+func (m *Manager) selectEntries(waitFor string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch waitFor {
+	case "", "all", "any":
+		return m.matchEntries(nil)
+	}
+	refs := strings.Split(waitFor, ",")
+	for i := range refs {
+		refs[i] = strings.TrimSpace(refs[i])
+	}
+	return m.matchEntries(refs)
+}
+
+// matchEntries returns the sorted keys of the desired entries matched by
+// refs, or of every desired entry if refs is empty. It fails if a ref
+// matches nothing. The caller must hold m.mu.
+func (m *Manager) matchEntries(refs []string) ([]string, error) {
+	matched := map[string]bool{}
+	for key, d := range m.desired {
+		if len(refs) == 0 {
+			matched[key] = true
+		}
+		for _, ref := range refs {
+			if d.entry.matches(ref) {
+				matched[key] = true
+			}
+		}
+	}
+	for _, ref := range refs {
+		found := false
+		for key := range matched {
+			found = found || m.desired[key].entry.matches(ref)
+		}
+		if !found {
+			return nil, fmt.Errorf("no entry matches %q", ref)
+		}
+	}
+
+	keys := make([]string, 0, len(matched))
+	for key := range matched {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
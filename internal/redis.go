@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxRedisCommand bounds the size of a single command buffered by a
+// read-only Redis forward.
+const maxRedisCommand = 64 << 20
+
+// redisBlockedCommand replaces commands blocked by read-only forwards. Redis
+// answers it with an "unknown command" error naming the blocked command,
+// which keeps the replies of pipelined commands in order.
+const redisBlockedCommand = "K10LS_READ_ONLY_FORWARD_BLOCKED"
+
+// redisReadOnlyCommands are the Redis commands read-only forwards let
+// through.
+var redisReadOnlyCommands = toSet(
+	// keys and strings
+	"GET", "MGET", "GETRANGE", "STRLEN", "EXISTS", "KEYS", "SCAN", "TYPE", "TTL", "PTTL",
+	"EXPIRETIME", "PEXPIRETIME", "RANDOMKEY", "DBSIZE", "DUMP", "OBJECT", "LCS", "SORT_RO",
+	"GETBIT", "BITCOUNT", "BITPOS", "BITFIELD_RO",
+	// hashes, lists, sets and sorted sets
+	"HGET", "HMGET", "HGETALL", "HKEYS", "HVALS", "HLEN", "HEXISTS", "HSTRLEN", "HSCAN", "HRANDFIELD",
+	"LRANGE", "LLEN", "LINDEX", "LPOS",
+	"SMEMBERS", "SISMEMBER", "SMISMEMBER", "SCARD", "SRANDMEMBER", "SSCAN", "SINTER", "SINTERCARD", "SUNION", "SDIFF",
+	"ZRANGE", "ZRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGE", "ZREVRANGEBYSCORE", "ZREVRANGEBYLEX",
+	"ZSCORE", "ZMSCORE", "ZCARD", "ZCOUNT", "ZLEXCOUNT", "ZRANK", "ZREVRANK", "ZSCAN", "ZRANDMEMBER",
+	"ZINTER", "ZINTERCARD", "ZUNION", "ZDIFF",
+	// streams, geo and hyperloglog
+	"XRANGE", "XREVRANGE", "XLEN", "XREAD", "XINFO", "XPENDING",
+	"GEOPOS", "GEODIST", "GEOHASH", "GEOSEARCH", "GEORADIUS_RO", "GEORADIUSBYMEMBER_RO",
+	"PFCOUNT",
+	// scripting without writes
+	"EVAL_RO", "EVALSHA_RO", "FCALL_RO",
+	// connection, transactions and pub/sub
+	"AUTH", "HELLO", "PING", "ECHO", "SELECT", "QUIT", "RESET", "READONLY",
+	"MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH",
+	"SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE",
+	// server introspection
+	"INFO", "TIME", "LASTSAVE", "ROLE", "COMMAND", "MEMORY",
+)
+
+// redisReadOnlyClientCommands are the CLIENT subcommands read-only forwards
+// let through.
+var redisReadOnlyClientCommands = toSet(
+	"SETNAME", "GETNAME", "SETINFO", "ID", "INFO", "TRACKING", "TRACKINGINFO", "CACHING", "NO-EVICT", "NO-TOUCH",
+)
+
+func toSet(items ...string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
+	}
+	return set
+}
+
+// proxyRedisReadOnly relays the Redis protocol between the local client and
+// upstream, replacing commands that may modify data.
+func proxyRedisReadOnly(client, upstream net.Conn) error {
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		client.Close()
+	}()
+
+	r := bufio.NewReader(client)
+	for {
+		raw, args, err := readRedisCommand(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(args) > 0 && !redisReadOnly(args) {
+			raw = redisArray(redisBlockedCommand, strings.ToUpper(args[0]))
+		}
+		if _, err := upstream.Write(raw); err != nil {
+			return err
+		}
+	}
+}
+
+// redisReadOnly reports whether the command args only reads data.
+func redisReadOnly(args []string) bool {
+	name := strings.ToUpper(args[0])
+	if name == "CLIENT" {
+		return len(args) > 1 && redisReadOnlyClientCommands[strings.ToUpper(args[1])]
+	}
+	return redisReadOnlyCommands[name]
+}
+
+// readRedisCommand reads one command in RESP or inline form, returning its
+// raw bytes and its first two arguments.
+func readRedisCommand(r *bufio.Reader) ([]byte, []string, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		if len(line) == 0 {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, err
+	}
+	if line[0] != '*' {
+		// Inline command, e.g. typed in telnet.
+		return line, strings.Fields(string(line)), nil
+	}
+
+	n, err := strconv.Atoi(string(bytes.TrimSpace(line[1:])))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid redis command: %q", line)
+	}
+	raw := append([]byte{}, line...)
+	var args []string
+	for i := 0; i < n; i++ {
+		header, err := r.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(header) < 2 || header[0] != '$' {
+			return nil, nil, fmt.Errorf("invalid redis command: %q", header)
+		}
+		size, err := strconv.Atoi(string(bytes.TrimSpace(header[1:])))
+		if err != nil || size < 0 || len(raw)+size > maxRedisCommand {
+			return nil, nil, fmt.Errorf("invalid redis bulk string: %q", header)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, nil, err
+		}
+		raw = append(append(raw, header...), arg...)
+		if i < 2 {
+			args = append(args, string(arg[:size]))
+		}
+	}
+	return raw, args, nil
+}
+
+// redisArray encodes args as a RESP array of bulk strings.
+func redisArray(args ...string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// defaultRelayImage is the image of relay pods and echo pods, which only
+// need socat.
+const defaultRelayImage = "alpine/socat"
+
+// relayStartTimeout bounds how long a forward waits for a new relay pod to
+// become ready.
+const relayStartTimeout = 2 * time.Minute
+
+// remoteAnnotation records the remote host on relay pods.
+const remoteAnnotation = "k10ls.io/remote"
+
+// validateRemoteHost checks the host of a remote entry, which must be a
+// bare host name or IP address.
+func validateRemoteHost(host string) error {
+	if host == "" {
+		return fmt.Errorf("host is required")
+	}
+	if strings.ContainsAny(host, "/ \t") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+		return fmt.Errorf("invalid host %q (expected a host name or IP address without port)", host)
+	}
+	return nil
+}
+
+// relayImage returns the image of the relay pod of e.
+func (e entry) relayImage() string {
+	if e.RelayImage == "" {
+		return defaultRelayImage
+	}
+	return e.RelayImage
+}
+
+// relayPorts returns the distinct remote ports of e, in order.
+func (e entry) relayPorts() []string {
+	seen := map[string]bool{}
+	var ports []string
+	for _, p := range e.Ports {
+		if !seen[p.Target] {
+			seen[p.Target] = true
+			ports = append(ports, p.Target)
+		}
+	}
+	sort.Strings(ports)
+	return ports
+}
+
+// relayPodName returns the name of the relay pod of e. It depends on the
+// remote host, ports and image and on the session, so every entry of this
+// process relaying to the same host and ports shares the pod.
+func relayPodName(e entry) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{e.Name, strings.Join(e.relayPorts(), ","), e.relayImage()}, "\x00")))
+	return "k10ls-relay-" + session + "-" + hex.EncodeToString(sum[:5])
+}
+
+// relayPod builds the relay pod of e: one socat container per remote port,
+// listening on that port in the pod and connecting to the same port of the
+// remote host.
+func relayPod(e entry, name string) *corev1.Pod {
+	host := e.Name
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	noToken := false
+	pod := &corev1.Pod{
+		ObjectMeta: helperMeta("relay"),
+		Spec: corev1.PodSpec{
+			AutomountServiceAccountToken: &noToken,
+		},
+	}
+	pod.Name = name
+	pod.Annotations[remoteAnnotation] = e.Name
+	for _, port := range e.relayPorts() {
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  "relay-" + port,
+			Image: e.relayImage(),
+			Args:  []string{"TCP-LISTEN:" + port + ",fork,reuseaddr", "TCP:" + host + ":" + port},
+		})
+	}
+	return pod
+}
+
+// ensureRelayPod returns the name of the relay pod of e once it is ready,
+// creating it if it doesn't exist yet. A relay pod that terminated is
+// deleted so the next attempt creates a new one.
+func ensureRelayPod(ctx context.Context, core coreClient, e entry) (string, error) {
+	name := relayPodName(e)
+	pod, err := core.getPod(ctx, e.Namespace, name)
+	switch {
+	case apierrors.IsNotFound(err):
+		pod, err = core.createPod(ctx, e.Namespace, relayPod(e, name))
+		if apierrors.IsAlreadyExists(err) {
+			// Another entry created it meanwhile.
+			pod, err = core.getPod(ctx, e.Namespace, name)
+		} else if err == nil {
+			e.log().Infof("Created relay pod %s for %s", name, e.Name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create relay pod for %s: %w", e.Name, err)
+		}
+	case err != nil:
+		return "", fmt.Errorf("failed to get relay pod %s: %w", name, err)
+	}
+	if podTerminated(pod) {
+		if err := core.deletePod(ctx, e.Namespace, name); err != nil && !apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("failed to delete terminated relay pod %s: %w", name, err)
+		}
+		return "", fmt.Errorf("relay pod %s terminated, recreating it", name)
+	}
+	if pod.Status.Phase == corev1.PodRunning && podReady(*pod) {
+		return name, nil
+	}
+
+	err = wait.PollUntilContextTimeout(ctx, time.Second, relayStartTimeout, false, func(ctx context.Context) (bool, error) {
+		pod, err := core.getPod(ctx, e.Namespace, name)
+		if err != nil {
+			return false, err
+		}
+		if podTerminated(pod) {
+			return false, fmt.Errorf("relay pod exited (%s)", pod.Status.Phase)
+		}
+		return pod.Status.Phase == corev1.PodRunning && podReady(*pod), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("relay pod %s did not start: %w", name, err)
+	}
+	return name, nil
+}
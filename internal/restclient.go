@@ -0,0 +1,332 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// coreClient is the part of the Kubernetes API forwards use: following
+// namespaces, resolving services and workloads to pods, checking RBAC and
+// opening tunnels, and for forward_all_services, scale_from_zero and
+// k10ls contexts, discovering services, scaling workloads and probing the
+// API server.
+type coreClient interface {
+	getNamespace(ctx context.Context, name string) (*corev1.Namespace, error)
+	watchNamespaces(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+	getService(ctx context.Context, namespace, name string) (*corev1.Service, error)
+	listServices(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.ServiceList, error)
+	watchServices(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error)
+	getPod(ctx context.Context, namespace, name string) (*corev1.Pod, error)
+	createPod(ctx context.Context, namespace string, pod *corev1.Pod) (*corev1.Pod, error)
+	deletePod(ctx context.Context, namespace, name string) error
+	listPods(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.PodList, error)
+	watchPods(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error)
+	listNodes(ctx context.Context, opts metav1.ListOptions) (*corev1.NodeList, error)
+	getDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error)
+	getStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error)
+	getReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error)
+	listReplicaSets(ctx context.Context, namespace string, opts metav1.ListOptions) (*appsv1.ReplicaSetList, error)
+	reviewAccess(ctx context.Context, review *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error)
+	// getScale and updateScale read and write the scale subresource of
+	// resource, "deployments" or "statefulsets".
+	getScale(ctx context.Context, namespace, resource, name string) (*autoscalingv1.Scale, error)
+	updateScale(ctx context.Context, namespace, resource, name string, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error)
+	// serverVersion returns the raw response of the /version endpoint.
+	serverVersion(ctx context.Context) ([]byte, error)
+	// portForwardURL returns the URL of the portforward subresource of a
+	// pod. It keeps the scheme, port and path prefix of the API server URL,
+	// e.g. for clusters behind Rancher or kubectl proxy.
+	portForwardURL(namespace, pod string) *url.URL
+}
+
+// clientsetCore serves the core API through a full clientset.
+type clientsetCore struct {
+	clientset kubernetes.Interface
+}
+
+func (c clientsetCore) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	return c.clientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) watchNamespaces(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.clientset.CoreV1().Namespaces().Watch(ctx, opts)
+}
+
+func (c clientsetCore) getService(ctx context.Context, namespace, name string) (*corev1.Service, error) {
+	return c.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) listServices(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.ServiceList, error) {
+	return c.clientset.CoreV1().Services(namespace).List(ctx, opts)
+}
+
+func (c clientsetCore) watchServices(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.clientset.CoreV1().Services(namespace).Watch(ctx, opts)
+}
+
+func (c clientsetCore) getPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	return c.clientset.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) createPod(ctx context.Context, namespace string, pod *corev1.Pod) (*corev1.Pod, error) {
+	return c.clientset.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{})
+}
+
+func (c clientsetCore) deletePod(ctx context.Context, namespace, name string) error {
+	return c.clientset.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (c clientsetCore) listPods(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.PodList, error) {
+	return c.clientset.CoreV1().Pods(namespace).List(ctx, opts)
+}
+
+func (c clientsetCore) watchPods(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.clientset.CoreV1().Pods(namespace).Watch(ctx, opts)
+}
+
+func (c clientsetCore) listNodes(ctx context.Context, opts metav1.ListOptions) (*corev1.NodeList, error) {
+	return c.clientset.CoreV1().Nodes().List(ctx, opts)
+}
+
+func (c clientsetCore) getDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	return c.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) getStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	return c.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) getReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	return c.clientset.AppsV1().ReplicaSets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) listReplicaSets(ctx context.Context, namespace string, opts metav1.ListOptions) (*appsv1.ReplicaSetList, error) {
+	return c.clientset.AppsV1().ReplicaSets(namespace).List(ctx, opts)
+}
+
+func (c clientsetCore) reviewAccess(ctx context.Context, review *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error) {
+	return c.clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+}
+
+func (c clientsetCore) getScale(ctx context.Context, namespace, resource, name string) (*autoscalingv1.Scale, error) {
+	if resource == "statefulsets" {
+		return c.clientset.AppsV1().StatefulSets(namespace).GetScale(ctx, name, metav1.GetOptions{})
+	}
+	return c.clientset.AppsV1().Deployments(namespace).GetScale(ctx, name, metav1.GetOptions{})
+}
+
+func (c clientsetCore) updateScale(ctx context.Context, namespace, resource, name string, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error) {
+	if resource == "statefulsets" {
+		return c.clientset.AppsV1().StatefulSets(namespace).UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+	}
+	return c.clientset.AppsV1().Deployments(namespace).UpdateScale(ctx, name, scale, metav1.UpdateOptions{})
+}
+
+func (c clientsetCore) serverVersion(ctx context.Context) ([]byte, error) {
+	return c.clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+}
+
+func (c clientsetCore) portForwardURL(namespace, pod string) *url.URL {
+	return c.clientset.CoreV1().RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("portforward").
+		URL()
+}
+
+// restScheme only knows the types restCore reads and writes, so the
+// lightweight client doesn't depend on the scheme of every API group.
+var (
+	restScheme         = runtime.NewScheme()
+	restCodecs         = serializer.NewCodecFactory(restScheme)
+	restParameterCodec = runtime.NewParameterCodec(restScheme)
+)
+
+func init() {
+	restScheme.AddKnownTypes(corev1.SchemeGroupVersion,
+		&corev1.Namespace{}, &corev1.NamespaceList{},
+		&corev1.Service{}, &corev1.ServiceList{},
+		&corev1.Pod{}, &corev1.PodList{},
+		&corev1.NodeList{},
+	)
+	metav1.AddToGroupVersion(restScheme, corev1.SchemeGroupVersion)
+	restScheme.AddKnownTypes(appsv1.SchemeGroupVersion,
+		&appsv1.Deployment{},
+		&appsv1.StatefulSet{},
+		&appsv1.ReplicaSet{}, &appsv1.ReplicaSetList{},
+	)
+	metav1.AddToGroupVersion(restScheme, appsv1.SchemeGroupVersion)
+	// The scale subresource of apps/v1 workloads is an autoscaling/v1 Scale.
+	restScheme.AddKnownTypes(autoscalingv1.SchemeGroupVersion, &autoscalingv1.Scale{})
+	metav1.AddToGroupVersion(restScheme, autoscalingv1.SchemeGroupVersion)
+	restScheme.AddKnownTypes(authorizationv1.SchemeGroupVersion, &authorizationv1.SelfSubjectAccessReview{})
+	metav1.AddToGroupVersion(restScheme, authorizationv1.SchemeGroupVersion)
+}
+
+// restCore serves the core API with plain REST calls, for the lightweight
+// client mode.
+type restCore struct {
+	core, apps, authorization *rest.RESTClient
+}
+
+// newRESTCore builds the REST clients of the lightweight client mode for
+// cfg. They share one HTTP client.
+func newRESTCore(cfg *rest.Config) (*restCore, error) {
+	httpClient, err := rest.HTTPClientFor(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client: %v", err)
+	}
+	client := func(apiPath string, gv schema.GroupVersion) (*rest.RESTClient, error) {
+		c := rest.CopyConfig(cfg)
+		c.APIPath = apiPath
+		c.GroupVersion = &gv
+		c.NegotiatedSerializer = restCodecs.WithoutConversion()
+		if c.UserAgent == "" {
+			c.UserAgent = rest.DefaultKubernetesUserAgent()
+		}
+		return rest.RESTClientForConfigAndClient(c, httpClient)
+	}
+	core, err := client("/api", corev1.SchemeGroupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client: %v", err)
+	}
+	apps, err := client("/apis", appsv1.SchemeGroupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client: %v", err)
+	}
+	authorization, err := client("/apis", authorizationv1.SchemeGroupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client: %v", err)
+	}
+	return &restCore{core: core, apps: apps, authorization: authorization}, nil
+}
+
+func (c *restCore) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	ns := &corev1.Namespace{}
+	err := c.core.Get().Resource("namespaces").Name(name).Do(ctx).Into(ns)
+	return ns, err
+}
+
+func (c *restCore) watchNamespaces(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.core.Get().Resource("namespaces").VersionedParams(&opts, restParameterCodec).Watch(ctx)
+}
+
+func (c *restCore) getService(ctx context.Context, namespace, name string) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	err := c.core.Get().Namespace(namespace).Resource("services").Name(name).Do(ctx).Into(svc)
+	return svc, err
+}
+
+func (c *restCore) listServices(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.ServiceList, error) {
+	svcs := &corev1.ServiceList{}
+	err := c.core.Get().Namespace(namespace).Resource("services").VersionedParams(&opts, restParameterCodec).Do(ctx).Into(svcs)
+	return svcs, err
+}
+
+func (c *restCore) watchServices(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.core.Get().Namespace(namespace).Resource("services").VersionedParams(&opts, restParameterCodec).Watch(ctx)
+}
+
+func (c *restCore) getPod(ctx context.Context, namespace, name string) (*corev1.Pod, error) {
+	pod := &corev1.Pod{}
+	err := c.core.Get().Namespace(namespace).Resource("pods").Name(name).Do(ctx).Into(pod)
+	return pod, err
+}
+
+func (c *restCore) createPod(ctx context.Context, namespace string, pod *corev1.Pod) (*corev1.Pod, error) {
+	result := &corev1.Pod{}
+	err := c.core.Post().Namespace(namespace).Resource("pods").Body(pod).Do(ctx).Into(result)
+	return result, err
+}
+
+func (c *restCore) deletePod(ctx context.Context, namespace, name string) error {
+	return c.core.Delete().Namespace(namespace).Resource("pods").Name(name).Do(ctx).Error()
+}
+
+func (c *restCore) listPods(ctx context.Context, namespace string, opts metav1.ListOptions) (*corev1.PodList, error) {
+	pods := &corev1.PodList{}
+	err := c.core.Get().Namespace(namespace).Resource("pods").VersionedParams(&opts, restParameterCodec).Do(ctx).Into(pods)
+	return pods, err
+}
+
+func (c *restCore) watchPods(ctx context.Context, namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+	opts.Watch = true
+	return c.core.Get().Namespace(namespace).Resource("pods").VersionedParams(&opts, restParameterCodec).Watch(ctx)
+}
+
+func (c *restCore) listNodes(ctx context.Context, opts metav1.ListOptions) (*corev1.NodeList, error) {
+	nodes := &corev1.NodeList{}
+	err := c.core.Get().Resource("nodes").VersionedParams(&opts, restParameterCodec).Do(ctx).Into(nodes)
+	return nodes, err
+}
+
+func (c *restCore) getDeployment(ctx context.Context, namespace, name string) (*appsv1.Deployment, error) {
+	deploy := &appsv1.Deployment{}
+	err := c.apps.Get().Namespace(namespace).Resource("deployments").Name(name).Do(ctx).Into(deploy)
+	return deploy, err
+}
+
+func (c *restCore) getStatefulSet(ctx context.Context, namespace, name string) (*appsv1.StatefulSet, error) {
+	sts := &appsv1.StatefulSet{}
+	err := c.apps.Get().Namespace(namespace).Resource("statefulsets").Name(name).Do(ctx).Into(sts)
+	return sts, err
+}
+
+func (c *restCore) getReplicaSet(ctx context.Context, namespace, name string) (*appsv1.ReplicaSet, error) {
+	rs := &appsv1.ReplicaSet{}
+	err := c.apps.Get().Namespace(namespace).Resource("replicasets").Name(name).Do(ctx).Into(rs)
+	return rs, err
+}
+
+func (c *restCore) listReplicaSets(ctx context.Context, namespace string, opts metav1.ListOptions) (*appsv1.ReplicaSetList, error) {
+	rss := &appsv1.ReplicaSetList{}
+	err := c.apps.Get().Namespace(namespace).Resource("replicasets").VersionedParams(&opts, restParameterCodec).Do(ctx).Into(rss)
+	return rss, err
+}
+
+func (c *restCore) reviewAccess(ctx context.Context, review *authorizationv1.SelfSubjectAccessReview) (*authorizationv1.SelfSubjectAccessReview, error) {
+	result := &authorizationv1.SelfSubjectAccessReview{}
+	err := c.authorization.Post().Resource("selfsubjectaccessreviews").Body(review).Do(ctx).Into(result)
+	return result, err
+}
+
+func (c *restCore) getScale(ctx context.Context, namespace, resource, name string) (*autoscalingv1.Scale, error) {
+	scale := &autoscalingv1.Scale{}
+	err := c.apps.Get().Namespace(namespace).Resource(resource).Name(name).SubResource("scale").Do(ctx).Into(scale)
+	return scale, err
+}
+
+func (c *restCore) updateScale(ctx context.Context, namespace, resource, name string, scale *autoscalingv1.Scale) (*autoscalingv1.Scale, error) {
+	result := &autoscalingv1.Scale{}
+	err := c.apps.Put().Namespace(namespace).Resource(resource).Name(name).SubResource("scale").Body(scale).Do(ctx).Into(result)
+	return result, err
+}
+
+func (c *restCore) serverVersion(ctx context.Context) ([]byte, error) {
+	return c.core.Get().AbsPath("/version").Do(ctx).Raw()
+}
+
+func (c *restCore) portForwardURL(namespace, pod string) *url.URL {
+	return c.core.Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("portforward").
+		URL()
+}
@@ -0,0 +1,34 @@
+package internal
+
+import (
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestPortForwardURL(t *testing.T) {
+	for _, host := range []string{
+		"https://host:6443/k8s/clusters/c-1",
+		"http://host:8001/k8s/clusters/c-1",
+	} {
+		want := host + "/api/v1/namespaces/apps/pods/web-0/portforward"
+		cfg := &rest.Config{Host: host}
+
+		clientset, err := kubernetes.NewForConfig(cfg)
+		if err != nil {
+			t.Fatalf("%s: clientset: %v", host, err)
+		}
+		if got := (clientsetCore{clientset}).portForwardURL("apps", "web-0").String(); got != want {
+			t.Errorf("clientsetCore.portForwardURL with %s = %s, want %s", host, got, want)
+		}
+
+		rc, err := newRESTCore(cfg)
+		if err != nil {
+			t.Fatalf("%s: REST core: %v", host, err)
+		}
+		if got := rc.portForwardURL("apps", "web-0").String(); got != want {
+			t.Errorf("restCore.portForwardURL with %s = %s, want %s", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// maxRetryBody bounds the size of request bodies buffered so that the
+// request can be retried. Requests with larger bodies are not retried.
+const maxRetryBody = 1 << 20
+
+// httpUpstream is the connection of an HTTP-aware forward to its pod. It is
+// opened on demand, so that a request that failed can be retried on a new
+// connection after the pod was selected again.
+type httpUpstream struct {
+	f       *forward
+	runCtx  context.Context
+	port    string
+	retries int
+
+	// next is the tunnel picked for the connection by handle, used for the
+	// first attempt so that it counts once towards load balancing.
+	next *tunnel
+
+	tun    *tunnel
+	conn   net.Conn
+	reader *bufio.Reader
+	errc   chan error
+}
+
+// open connects to the pod through the tunnel picked by handle, or the
+// current tunnel after the pod was selected again, unless already
+// connected.
+func (u *httpUpstream) open() error {
+	if u.conn != nil {
+		return nil
+	}
+	tun := u.next
+	u.next = nil
+	if tun == nil {
+		var err error
+		if tun, err = u.f.waitTunnel(u.runCtx); err != nil {
+			return err
+		}
+	}
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tun.proxy(remote, u.port)
+		remote.Close()
+	}()
+	u.tun, u.conn, u.reader, u.errc = tun, local, bufio.NewReader(local), errc
+	return nil
+}
+
+// close closes the connection to the pod, returning the error of the
+// tunnel stream behind it.
+func (u *httpUpstream) close() error {
+	if u.conn == nil {
+		return nil
+	}
+	u.conn.Close()
+	err := <-u.errc
+	u.conn, u.reader = nil, nil
+	return err
+}
+
+// roundTrip forwards req to the pod and reads the response. If the pod
+// couldn't be reached, or the request was safe to run twice and no response
+// arrived, the request is retried up to u.retries times, each time on a new
+// connection to a freshly selected pod, as long as its body is small enough
+// to be sent again. Other requests may already have been processed by the
+// pod, so they aren't retried once written.
+func (u *httpUpstream) roundTrip(req *http.Request) (*http.Response, error) {
+	replayable := u.retries > 0 && req.Header.Get("Upgrade") == ""
+	var body []byte
+	if replayable && req.Body != nil && req.Body != http.NoBody {
+		b, err := io.ReadAll(io.LimitReader(req.Body, maxRetryBody+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %v", err)
+		}
+		if len(b) > maxRetryBody {
+			replayable = false
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(b), req.Body), req.Body}
+		} else {
+			body = b
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		if err := u.open(); err != nil {
+			return nil, err
+		}
+		resp, written, err := u.send(req)
+		if err == nil {
+			return resp, nil
+		}
+		if tunErr := u.close(); tunErr != nil {
+			err = tunErr
+		}
+		retryable := written == 0 || safeMethods[req.Method]
+		if !replayable || !retryable || attempt > u.retries || u.runCtx.Err() != nil {
+			return nil, err
+		}
+		u.f.entry.log().Warnf("%s %s failed (%v), retrying on a freshly selected pod (%d/%d)", req.Method, req.URL, err, attempt, u.retries)
+		u.f.reselect(u.tun)
+	}
+}
+
+// safeMethods are the HTTP methods without side effects, which may be sent
+// to the pod again even if it received them already.
+var safeMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// send writes req to the pod and reads the response. It also returns how
+// many bytes of the request were written.
+func (u *httpUpstream) send(req *http.Request) (*http.Response, int64, error) {
+	w := &countingWriter{w: u.conn}
+	if err := req.Write(w); err != nil {
+		return nil, w.n, fmt.Errorf("failed to forward request: %v", err)
+	}
+	resp, err := http.ReadResponse(u.reader, req)
+	if err != nil {
+		return nil, w.n, fmt.Errorf("failed to read response: %v", err)
+	}
+	return resp, w.n, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// badGateway answers req with 502 Bad Gateway and closes the connection,
+// as the rest of the request body may not have been read.
+func badGateway(client net.Conn, req *http.Request, cause error) {
+	body := fmt.Sprintf("k10ls: %s\n", Redact(cause.Error()))
+	resp := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	_ = resp.Write(client)
+}
@@ -0,0 +1,207 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRewriteBody bounds the size of response bodies buffered for URL
+// rewriting. Larger bodies are passed through unchanged.
+const maxRewriteBody = 8 << 20
+
+// rewriteHeaders are the response headers that may carry absolute URLs.
+var rewriteHeaders = []string{"Location", "Content-Location", "Refresh", "Link"}
+
+// urlRewriter rewrites absolute URLs pointing at in-cluster service
+// hostnames to the local address of the forward of that service.
+type urlRewriter struct {
+	re      *regexp.Regexp
+	targets map[string]string
+}
+
+// newURLRewriter builds a rewriter for every running service forward.
+func newURLRewriter() *urlRewriter {
+	targets := map[string]string{}
+
+	forwardsMu.Lock()
+	for f := range forwards {
+		if f.entry.Kind != kindService {
+			continue
+		}
+		name, ns := f.entry.Name, f.entry.Namespace
+		hosts := []string{name, name + "." + ns, name + "." + ns + ".svc", name + "." + ns + ".svc.cluster.local"}
+		f.mu.Lock()
+		for i, l := range f.listeners {
+			local := scrapeAddress(f.entry.Network, l.Addr())
+			for _, h := range hosts {
+				targets[h+":"+f.entry.Ports[i].Target] = local
+			}
+		}
+		f.mu.Unlock()
+	}
+	forwardsMu.Unlock()
+
+	if len(targets) == 0 {
+		return &urlRewriter{}
+	}
+	seen := map[string]bool{}
+	var hosts []string
+	for key := range targets {
+		h, _, _ := net.SplitHostPort(key)
+		if !seen[h] {
+			seen[h] = true
+			hosts = append(hosts, regexp.QuoteMeta(h))
+		}
+	}
+	// Longest first, so "api.apps" wins over "api".
+	sort.Slice(hosts, func(i, j int) bool { return len(hosts[i]) > len(hosts[j]) })
+	re := regexp.MustCompile(`//(` + strings.Join(hosts, "|") + `)(?::(\d+))?([^\w.:-]|$)`)
+	return &urlRewriter{re: re, targets: targets}
+}
+
+// rewrite replaces every in-cluster URL in s that has a local forward.
+func (r *urlRewriter) rewrite(s string) string {
+	if r.re == nil {
+		return s
+	}
+	return r.re.ReplaceAllStringFunc(s, func(m string) string {
+		sub := r.re.FindStringSubmatch(m)
+		port := sub[2]
+		if port == "" {
+			port = "80"
+		}
+		local, ok := r.targets[sub[1]+":"+port]
+		if !ok {
+			return m
+		}
+		return "//" + local + sub[3]
+	})
+}
+
+// rewritable reports whether a response body of the given content type may
+// contain URLs worth rewriting.
+func rewritable(contentType string) bool {
+	if strings.Contains(contentType, "event-stream") {
+		// streamed, never complete
+		return false
+	}
+	for _, t := range []string{"text/", "json", "javascript", "xml"} {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyHTTP relays HTTP/1.x exchanges between the local client and
+// upstream. With rewriteURLs, in-cluster URLs in the responses are
+// rewritten; upgraded connections (e.g. WebSockets) are relayed unchanged
+// after the handshake. With readOnly, requests that may modify state are
+// answered with 403 Forbidden instead of being forwarded. Requests the pod
+// doesn't answer are retried as configured, then answered with 502 Bad
+// Gateway. If rec is set, every exchange is recorded to it.
+func proxyHTTP(client net.Conn, upstream *httpUpstream, rewriteURLs, readOnly bool, rec *harRecorder) error {
+	clientReader := bufio.NewReader(client)
+
+	for {
+		req, err := http.ReadRequest(clientReader)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("failed to read request: %v", err)
+		}
+		if readOnly && !readOnlyRequest(req) {
+			if err := rejectRequest(client, req); err != nil {
+				return err
+			}
+			if req.Close {
+				return nil
+			}
+			continue
+		}
+		if rewriteURLs {
+			// Ask for an uncompressed body so it can be rewritten.
+			req.Header.Del("Accept-Encoding")
+		}
+		start := time.Now()
+		var reqBody *bodyCapture
+		if rec != nil {
+			reqBody = captureBody(&req.Body)
+		}
+		resp, err := upstream.roundTrip(req)
+		if err != nil {
+			badGateway(client, req, err)
+			return err
+		}
+		if rewriteURLs {
+			if err := rewriteResponse(resp); err != nil {
+				return err
+			}
+		}
+
+		answered := time.Now()
+		var respBody *bodyCapture
+		if rec != nil {
+			respBody = captureBody(&resp.Body)
+		}
+		if err := resp.Write(client); err != nil {
+			return fmt.Errorf("failed to write response: %v", err)
+		}
+		if rec != nil {
+			rec.record(start, answered, req, reqBody, resp, respBody)
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			go func() {
+				_, _ = io.Copy(upstream.conn, clientReader)
+			}()
+			_, err := io.Copy(client, upstream.reader)
+			return err
+		}
+		if resp.Close || req.Close {
+			return nil
+		}
+	}
+}
+
+// rewriteResponse rewrites in-cluster URLs in the headers and, if it is
+// small enough and uncompressed text, the body of resp.
+func rewriteResponse(resp *http.Response) error {
+	rw := newURLRewriter()
+	for _, h := range rewriteHeaders {
+		if vs := resp.Header.Values(h); len(vs) > 0 {
+			resp.Header.Del(h)
+			for _, v := range vs {
+				resp.Header.Add(h, rw.rewrite(v))
+			}
+		}
+	}
+	if resp.Header.Get("Content-Encoding") == "" && rewritable(resp.Header.Get("Content-Type")) &&
+		resp.ContentLength <= maxRewriteBody {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBody+1))
+		if err != nil {
+			return fmt.Errorf("failed to read response body: %v", err)
+		}
+		if len(body) > maxRewriteBody {
+			// Too large to buffer, pass it through as is.
+			resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), resp.Body))
+		} else {
+			resp.Body.Close()
+			body = []byte(rw.rewrite(string(body)))
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			resp.ContentLength = int64(len(body))
+			resp.TransferEncoding = nil
+			resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+	return nil
+}
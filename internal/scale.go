@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultIdleTimeout is how long a workload scaled up by k10ls may go
+// without connections before it is scaled back to zero.
+const defaultIdleTimeout = 15 * time.Minute
+
+// scaleWaitTimeout bounds how long a connection waits for a workload
+// scaled up from zero to become reachable.
+const scaleWaitTimeout = 3 * time.Minute
+
+// parseScaleTarget splits a workload reference such as "deploy/web" into
+// its kind and name.
+func parseScaleTarget(ref string) (string, string, error) {
+	kind, name, ok := strings.Cut(ref, "/")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid workload %q (expected deployment/<name> or statefulset/<name>)", ref)
+	}
+	switch kind {
+	case "deployment", "deploy":
+		return "deployment", name, nil
+	case "statefulset", "sts":
+		return "statefulset", name, nil
+	}
+	return "", "", fmt.Errorf("invalid workload %q (expected deployment/<name> or statefulset/<name>)", ref)
+}
+
+// scaleWorkload sets the replicas of a deployment or statefulset if it
+// currently runs from replicas, reporting whether it changed anything.
+func scaleWorkload(ctx context.Context, core coreClient, namespace, ref string, from, to int32) (bool, error) {
+	kind, name, err := parseScaleTarget(ref)
+	if err != nil {
+		return false, err
+	}
+
+	scale, err := core.getScale(ctx, namespace, kind+"s", name)
+	if err != nil {
+		return false, fmt.Errorf("failed to get scale of %s: %v", ref, err)
+	}
+	if scale.Spec.Replicas != from {
+		return false, nil
+	}
+
+	scale.Spec.Replicas = to
+	if _, err := core.updateScale(ctx, namespace, kind+"s", name, scale); err != nil {
+		return false, fmt.Errorf("failed to scale %s to %d: %v", ref, to, err)
+	}
+	return true, nil
+}
+
+// connected records a new client connection and, for scale-from-zero
+// entries, scales the workload up if it has no replicas.
+func (f *forward) connected(runCtx context.Context) {
+	f.mu.Lock()
+	f.active++
+	f.lastActive = time.Now()
+	needScale := f.entry.ScaleFromZero != "" && f.tun == nil && !f.scaledUp
+	if needScale {
+		f.scaledUp = true
+	}
+	f.mu.Unlock()
+
+	if !needScale {
+		return
+	}
+	core, _ := f.kube.getCore()
+	changed, err := scaleWorkload(runCtx, core, f.entry.Namespace, f.entry.ScaleFromZero, 0, 1)
+	if err != nil {
+		f.failed("%v", err)
+	}
+	if changed {
+		f.entry.log().Infof("Scaled %s up from zero", f.entry.ScaleFromZero)
+	}
+	if err != nil || !changed {
+		// Not ours to scale back down.
+		f.mu.Lock()
+		f.scaledUp = false
+		f.mu.Unlock()
+	}
+}
+
+// disconnected records that a client connection closed.
+func (f *forward) disconnected() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.active--
+	f.lastActive = time.Now()
+}
+
+// scaleDownWhenIdle scales the workload of a scale-from-zero entry back to
+// zero once it has had no connections for the idle timeout, as long as it
+// was k10ls that scaled it up.
+func (f *forward) scaleDownWhenIdle(runCtx context.Context) {
+	idle := f.entry.IdleTimeout
+	if idle <= 0 {
+		idle = defaultIdleTimeout
+	}
+	interval := idle / 4
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-runCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		f.mu.Lock()
+		due := f.scaledUp && f.active == 0 && time.Since(f.lastActive) >= idle
+		f.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		core, _ := f.kube.getCore()
+		if _, err := scaleWorkload(runCtx, core, f.entry.Namespace, f.entry.ScaleFromZero, 1, 0); err != nil {
+			f.failed("%v", err)
+			continue
+		}
+		f.mu.Lock()
+		f.scaledUp = false
+		f.mu.Unlock()
+		f.entry.log().Infof("Scaled %s down to zero after %s idle", f.entry.ScaleFromZero, idle)
+	}
+}
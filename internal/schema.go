@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// durationPattern matches durations as time.ParseDuration parses them, like
+// "1m30s".
+const durationPattern = `^[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|ms|s|m|h))+)$`
+
+// requiredKeys are the keys the config types can't do without, by type
+// name.
+var requiredKeys = map[string][]string{
+	"Service":  {"name"},
+	"Pod":      {"name"},
+	"Selector": {"label"},
+	"Workload": {"name"},
+	"Remote":   {"host"},
+	"PortMap":  {"target"},
+}
+
+// ConfigSchema returns a JSON Schema of the config format, for editors to
+// complete and check config files with. It is derived from the TOML keys of
+// Config and the types it holds, each struct type a definition of its own,
+// so the schema can't fall behind the keys k10ls accepts. Unknown keys are
+// invalid, like in k10ls validate.
+func ConfigSchema() map[string]interface{} {
+	s := &schemaBuilder{defs: map[string]interface{}{}}
+	root := s.schema(reflect.TypeOf(Config{}))
+	// JSON configs may name their schema, see decodeJSONConfig.
+	config := s.defs["Config"].(map[string]interface{})
+	config["properties"].(map[string]interface{})["$schema"] = map[string]interface{}{"type": "string"}
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "k10ls config",
+		"$ref":    root["$ref"],
+		"$defs":   s.defs,
+	}
+}
+
+// schemaBuilder collects the definitions of the struct types of a schema.
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+// schema returns the schema of values of type t in the config.
+func (s *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Duration(0)) {
+		// Durations are strings like "30s" or nanoseconds.
+		return map[string]interface{}{"type": []string{"string", "integer"}, "pattern": durationPattern}
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if t.Name() == "" {
+			return map[string]interface{}{"type": "object", "additionalProperties": false, "properties": s.properties(t)}
+		}
+		if _, ok := s.defs[t.Name()]; !ok {
+			def := map[string]interface{}{"type": "object", "additionalProperties": false}
+			// Registered before its fields, in case a type holds itself.
+			s.defs[t.Name()] = def
+			def["properties"] = s.properties(t)
+			if keys := requiredKeys[t.Name()]; keys != nil {
+				def["required"] = keys
+			}
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// properties returns the schemas of the keys of struct type t, including
+// those of embedded structs, which TOML flattens into t.
+func (s *schemaBuilder) properties(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			for key, prop := range s.properties(f.Type) {
+				props[key] = prop
+			}
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		props[tag] = s.schema(f.Type)
+	}
+	return props
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// fetchKubeConfig retrieves the kubeconfig of c from HashiCorp Vault
+// (kubeconfig_vault) or a cloud secret manager (kubeconfig_secret). The
+// result is only ever kept in memory.
+func fetchKubeConfig(ctx context.Context, c *Context) ([]byte, error) {
+	var value string
+	var err error
+	switch {
+	case c.KubeConfigVault != "":
+		key := c.KubeConfigVaultKey
+		if key == "" {
+			key = "kubeconfig"
+		}
+		value, err = readVaultSecret(ctx, c.KubeConfigVault, key)
+	case strings.HasPrefix(c.KubeConfigSecret, "aws-sm://"):
+		id := strings.TrimPrefix(c.KubeConfigSecret, "aws-sm://")
+		value, err = runSecretCommand(ctx, "aws", "secretsmanager", "get-secret-value", "--secret-id", id, "--query", "SecretString", "--output", "text")
+	case strings.HasPrefix(c.KubeConfigSecret, "gcp-sm://"):
+		name := strings.TrimPrefix(c.KubeConfigSecret, "gcp-sm://")
+		value, err = runSecretCommand(ctx, "gcloud", "secrets", "versions", "access", "latest", "--secret", name)
+	default:
+		return nil, fmt.Errorf("unsupported kubeconfig_secret %q (expected aws-sm://<id> or gcp-sm://<name>)", c.KubeConfigSecret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeKubeConfigValue(value), nil
+}
+
+// decodeKubeConfigValue accepts both plain and base64-encoded kubeconfigs.
+func decodeKubeConfigValue(value string) []byte {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "\n") && !strings.Contains(value, ":") {
+		if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+			return b
+		}
+	}
+	return []byte(value)
+}
+
+// readVaultSecret reads key from the Vault secret at path, trying the KV
+// version 2 API first and falling back to version 1. The Vault address and
+// token are taken from VAULT_ADDR and VAULT_TOKEN (or ~/.vault-token).
+func readVaultSecret(ctx context.Context, path, key string) (string, error) {
+	addr := strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if b, err := os.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				token = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("no Vault token found (set VAULT_TOKEN or run vault login)")
+	}
+	RegisterSecret(token)
+
+	path = strings.Trim(path, "/")
+	mount, rest, _ := strings.Cut(path, "/")
+	candidates := []string{
+		fmt.Sprintf("%s/v1/%s/data/%s", addr, mount, rest),
+		fmt.Sprintf("%s/v1/%s", addr, path),
+	}
+
+	var lastErr error
+	for _, u := range candidates {
+		data, err := vaultGet(ctx, u, token)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		// KV v2 nests the secret under data.data
+		if inner, ok := data["data"].(map[string]interface{}); ok {
+			data = inner
+		}
+		value, ok := data[key].(string)
+		if !ok {
+			return "", fmt.Errorf("vault secret %s has no key %q", path, key)
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("failed to read vault secret %s: %v", path, lastErr)
+}
+
+func vaultGet(ctx context.Context, u, token string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid vault response: %v", err)
+	}
+	return body.Data, nil
+}
+
+// runSecretCommand fetches a secret through a cloud provider CLI, which
+// takes care of the provider's authentication chain.
+func runSecretCommand(ctx context.Context, name string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
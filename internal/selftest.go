@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// selfTestPort is the port the echo pod listens on.
+const selfTestPort = "7"
+
+// SelfTestOptions configures SelfTest.
+type SelfTestOptions struct {
+	Context        string
+	KubeConfigPath string
+	Namespace      string
+	// Pod is an existing pod echoing everything sent to Port. When empty, a
+	// temporary echo pod is created from Image.
+	Pod   string
+	Port  string
+	Image string
+}
+
+// SelfTest validates connectivity end to end: it forwards to an echo pod,
+// sends random bytes through the tunnel and checks they come back. Progress
+// is written to out.
+func SelfTest(ctx context.Context, opts SelfTestOptions, out io.Writer) error {
+	step := func(format string, args ...interface{}) {
+		fmt.Fprintf(out, "✓ "+format+"\n", args...)
+	}
+
+	if opts.Namespace == "" {
+		opts.Namespace = "default"
+	}
+	if opts.Image == "" {
+		opts.Image = defaultRelayImage
+	}
+
+	clientset, cfg, err := getKubeClient(opts.Context, opts.KubeConfigPath, "")
+	if err != nil {
+		return err
+	}
+	step("loaded kubeconfig, API server %s", cfg.Host)
+
+	port := opts.Port
+	podName := opts.Pod
+	if podName == "" {
+		port = selfTestPort
+		meta := helperMeta("selftest")
+		meta.GenerateName = "k10ls-selftest-"
+		pod, err := clientset.CoreV1().Pods(opts.Namespace).Create(ctx, &corev1.Pod{
+			ObjectMeta: meta,
+			Spec: corev1.PodSpec{
+				RestartPolicy: corev1.RestartPolicyNever,
+				Containers: []corev1.Container{{
+					Name:  "echo",
+					Image: opts.Image,
+					Args:  []string{"TCP-LISTEN:" + selfTestPort + ",fork,reuseaddr", "EXEC:cat"},
+				}},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create echo pod: %v", err)
+		}
+		podName = pod.Name
+		defer func() {
+			// Clean up even if ctx was cancelled.
+			delCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := clientset.CoreV1().Pods(opts.Namespace).Delete(delCtx, podName, metav1.DeleteOptions{}); err != nil {
+				fmt.Fprintf(out, "✗ failed to delete echo pod %s: %v\n", podName, err)
+				return
+			}
+			step("deleted echo pod %s", podName)
+		}()
+		step("created echo pod %s/%s", opts.Namespace, podName)
+
+		err = wait.PollUntilContextTimeout(ctx, time.Second, 2*time.Minute, true, func(ctx context.Context) (bool, error) {
+			pod, err := clientset.CoreV1().Pods(opts.Namespace).Get(ctx, podName, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			switch pod.Status.Phase {
+			case corev1.PodRunning:
+				return true, nil
+			case corev1.PodFailed, corev1.PodSucceeded:
+				return false, fmt.Errorf("echo pod exited (%s)", pod.Status.Phase)
+			}
+			return false, nil
+		})
+		if err != nil {
+			return fmt.Errorf("echo pod %s did not start: %v", podName, err)
+		}
+		step("echo pod is running")
+	} else if port == "" {
+		return fmt.Errorf("a port is required when testing against an existing pod")
+	}
+
+	e := entry{
+		Context:     opts.Context,
+		KubeContext: opts.Context,
+		Namespace:   opts.Namespace,
+		Kind:        kindPod,
+		Name:        podName,
+		Ports:       []PortMap{{Source: "0", Target: port}},
+		Address:     "127.0.0.1",
+		Network:     "tcp",
+	}
+	if err := preflightRBAC(ctx, clientsetCore{clientset}, e); err != nil {
+		return err
+	}
+	step("RBAC allows port-forwarding to %s", podName)
+
+	fwdCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f := newForward(&kubeClient{core: clientsetCore{clientset}, cfg: cfg, changed: make(chan struct{})}, e)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.run(fwdCtx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if _, err := f.waitTunnel(fwdCtx); err != nil {
+		return fmt.Errorf("tunnel to %s was not established: %v", podName, err)
+	}
+	status := f.portStatus()
+	if len(status) == 0 {
+		return fmt.Errorf("local listener was not bound")
+	}
+	step("tunnel established, listening on %s", status[0].Local)
+
+	conn, err := net.DialTimeout("tcp", status[0].Local, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to local port: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	payload := make([]byte, 64*1024)
+	if _, err := rand.Read(payload); err != nil {
+		return err
+	}
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		return fmt.Errorf("failed to read echoed data: %v", err)
+	}
+	if !bytes.Equal(payload, echoed) {
+		return fmt.Errorf("echoed data does not match what was sent")
+	}
+	step("sent and received %d bytes through the tunnel", len(payload))
+	return nil
+}
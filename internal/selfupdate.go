@@ -0,0 +1,270 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	utilversion "k8s.io/apimachinery/pkg/util/version"
+)
+
+// releasesURL is the GitHub API endpoint describing the latest release.
+const releasesURL = "https://api.github.com/repos/besrabasant/k10ls/releases/latest"
+
+// checksumsAsset is the release asset listing the SHA-256 of every binary,
+// signatureAsset its Ed25519 signature by the release workflow.
+const (
+	checksumsAsset = "checksums.txt"
+	signatureAsset = "checksums.txt.sig"
+)
+
+// releaseKey is the base64 encoded Ed25519 public key releases are signed
+// with. The private key is the RELEASE_SIGNING_KEY secret of the release
+// workflow.
+const releaseKey = "W9i8TBcwpMIz6XGdG9c97H/cQ3zKFSQYCPHpV6SbSvo="
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// UpdateOptions controls SelfUpdate.
+type UpdateOptions struct {
+	// CheckOnly only reports the latest version.
+	CheckOnly bool
+	// AllowDowngrade installs the latest release even if it is older than
+	// the running version.
+	AllowDowngrade bool
+}
+
+// UpdateResult describes the outcome of SelfUpdate. Newer is set if Latest
+// is newer than Current.
+type UpdateResult struct {
+	Current string
+	Latest  string
+	Newer   bool
+	Updated bool
+}
+
+// SelfUpdate replaces the running binary with the latest GitHub release if
+// it is newer than current, or older with opts.AllowDowngrade. The release's
+// checksums file must carry a valid signature by releaseKey, and the
+// download must match it, before anything is replaced.
+func SelfUpdate(ctx context.Context, current string, opts UpdateOptions) (*UpdateResult, error) {
+	release, err := latestRelease(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmp, err := compareVersions(release.TagName, current)
+	if err != nil {
+		return nil, err
+	}
+	result := &UpdateResult{Current: current, Latest: release.TagName, Newer: cmp > 0}
+	if opts.CheckOnly || cmp == 0 {
+		return result, nil
+	}
+	if cmp < 0 && !opts.AllowDowngrade {
+		return nil, fmt.Errorf("latest release %s is older than %s, pass -allow-downgrade to install it anyway", release.TagName, current)
+	}
+
+	name := releaseAssetName(release.TagName)
+	assets := map[string]string{}
+	for _, a := range release.Assets {
+		assets[a.Name] = a.URL
+	}
+	binURL, ok := assets[name]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no binary for %s/%s (expected %s)", release.TagName, runtime.GOOS, runtime.GOARCH, name)
+	}
+	sumsURL, ok := assets[checksumsAsset]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s, refusing to install an unverified binary", release.TagName, checksumsAsset)
+	}
+
+	sigURL, ok := assets[signatureAsset]
+	if !ok {
+		return nil, fmt.Errorf("release %s has no %s, refusing to install an unverified binary", release.TagName, signatureAsset)
+	}
+
+	sums, err := download(ctx, sumsURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download checksums: %v", err)
+	}
+	sig, err := download(ctx, sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download checksums signature: %v", err)
+	}
+	if err := verifySignature(sums, sig); err != nil {
+		return nil, fmt.Errorf("release %s: %v", release.TagName, err)
+	}
+	want, err := findChecksum(sums, name)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Downloading %s", name)
+	bin, err := download(ctx, binURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %v", name, err)
+	}
+	sum := sha256.Sum256(bin)
+	if got := hex.EncodeToString(sum[:]); got != want {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", name, want, got)
+	}
+
+	if err := replaceExecutable(bin); err != nil {
+		return nil, err
+	}
+	result.Updated = true
+	return result, nil
+}
+
+// compareVersions returns -1, 0 or 1 as the release tagged tag is older
+// than, the same as or newer than current, comparing semantic versions.
+// Builds that aren't of a release, such as dev, are older than any.
+func compareVersions(tag, current string) (int, error) {
+	latest, err := utilversion.ParseSemantic(tag)
+	if err != nil {
+		return 0, fmt.Errorf("latest release %s: %v", tag, err)
+	}
+	running, err := utilversion.ParseSemantic(current)
+	if err != nil {
+		return 1, nil
+	}
+	switch {
+	case latest.LessThan(running):
+		return -1, nil
+	case running.LessThan(latest):
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// verifySignature checks that sig is the Ed25519 signature of sums by
+// releaseKey.
+func verifySignature(sums, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(releaseKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release key")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), sums, sig) {
+		return fmt.Errorf("invalid signature of %s, refusing to install an unverified binary", checksumsAsset)
+	}
+	return nil
+}
+
+// releaseAssetName returns the binary name published by the release
+// workflow for the current platform.
+func releaseAssetName(tag string) string {
+	goos := runtime.GOOS
+	if goos == "darwin" {
+		goos = "macos"
+	}
+	name := fmt.Sprintf("k10ls-%s-%s-%s", tag, goos, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+func latestRelease(ctx context.Context) (*githubRelease, error) {
+	b, err := download(ctx, releasesURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query latest release: %v", err)
+	}
+	var release githubRelease
+	if err := json.Unmarshal(b, &release); err != nil {
+		return nil, fmt.Errorf("invalid release metadata: %v", err)
+	}
+	return &release, nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// findChecksum looks up name in a sha256sum-formatted checksums file.
+func findChecksum(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(string(sums)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum published for %s", name)
+}
+
+// replaceExecutable atomically swaps the running binary for bin. The new
+// file is written next to the old one so the final rename stays on the same
+// filesystem.
+func replaceExecutable(bin []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate running binary: %v", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return fmt.Errorf("failed to resolve running binary: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".k10ls-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write update: %v", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return fmt.Errorf("failed to make update executable: %v", err)
+	}
+
+	// Windows refuses to overwrite a running executable but allows renaming
+	// it out of the way.
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return fmt.Errorf("failed to move old binary: %v", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", exe, err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SessionEvent is a log line of a recorded session: lifecycle events of the
+// forwards, the pods they resolved to, reconnects and errors, including
+// those only logged at debug level.
+type SessionEvent struct {
+	Time    time.Time         `json:"time"`
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+var (
+	recordingMu   sync.Mutex
+	recordingFile *os.File
+	// printLevel is the level of the lines printed while recording, the
+	// logger itself logs at debug level then.
+	printLevel logrus.Level
+)
+
+// RecordSession records every log line, whatever the log level, to a new
+// file at path, one SessionEvent per line, until the process exits. The
+// lines printed stay at the log level set before; see SetLogLevel.
+func RecordSession(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open session recording %s: %v", path, err)
+	}
+
+	recordingMu.Lock()
+	recordingFile = f
+	printLevel = logrus.GetLevel()
+	recordingMu.Unlock()
+
+	logger := logrus.StandardLogger()
+	logger.SetFormatter(&levelFormatter{Formatter: logger.Formatter})
+	logger.AddHook(sessionHook{})
+	logger.SetLevel(logrus.DebugLevel)
+	return nil
+}
+
+// LogLevel returns the level of the log lines printed.
+func LogLevel() logrus.Level {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if recordingFile != nil {
+		return printLevel
+	}
+	return logrus.GetLevel()
+}
+
+// SetLogLevel sets the level of the log lines printed. While recording a
+// session, lines below it are still recorded.
+func SetLogLevel(level logrus.Level) {
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	if recordingFile != nil {
+		printLevel = level
+		return
+	}
+	logrus.SetLevel(level)
+}
+
+// levelFormatter wraps a logrus formatter and drops the lines below the log
+// level while recording a session.
+type levelFormatter struct {
+	Formatter logrus.Formatter
+}
+
+// Format implements logrus.Formatter.
+func (f *levelFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > LogLevel() {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// ansiEscape matches the color codes of log messages, left out of session
+// recordings.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// sessionHook appends every log line to the session recording.
+type sessionHook struct{}
+
+func (sessionHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (sessionHook) Fire(entry *logrus.Entry) error {
+	ev := SessionEvent{Time: entry.Time, Level: entry.Level.String(), Message: Redact(ansiEscape.ReplaceAllString(entry.Message, ""))}
+	if len(entry.Data) > 0 {
+		ev.Fields = make(map[string]string, len(entry.Data))
+		for k, v := range entry.Data {
+			ev.Fields[k] = Redact(fmt.Sprint(v))
+		}
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	recordingMu.Lock()
+	defer recordingMu.Unlock()
+	_, err = recordingFile.Write(append(b, '\n'))
+	return err
+}
+
+// ReplaySession prints the events of the session recording at path at or
+// above level to w, formatted like the log lines k10ls prints.
+func ReplaySession(path, level string, w io.Writer) error {
+	minLevel, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	formatter := logrus.StandardLogger().Formatter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var ev SessionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		evLevel, err := logrus.ParseLevel(ev.Level)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if evLevel > minLevel {
+			continue
+		}
+
+		entry := logrus.NewEntry(logrus.StandardLogger())
+		entry.Time, entry.Level, entry.Message = ev.Time, evLevel, ev.Message
+		for k, v := range ev.Fields {
+			entry.Data[k] = v
+		}
+		b, err := formatter.Format(entry)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Shells ShellEnv can format variables for.
+const (
+	shellBash       = "bash"
+	shellFish       = "fish"
+	shellPowerShell = "powershell"
+)
+
+// PortEnv returns an environment variable for every ready port in ports,
+// as "K10LS_<NAMESPACE>_<NAME>_<PORT>=host:port" like the env format of the
+// endpoints file. Wildcard addresses are replaced with the loopback address
+// so the values can be connected to.
+func PortEnv(ports []PortStatus) []string {
+	var env []string
+	for _, p := range ports {
+		if !p.Ready {
+			continue
+		}
+		_, name, _ := strings.Cut(p.Entry, "/")
+		env = append(env, envName("K10LS", p.Namespace, name, p.Port)+"="+connectAddress(p.Local))
+	}
+	sort.Strings(env)
+	return env
+}
+
+// connectAddress returns the address local clients connect to for a
+// listener bound to local.
+func connectAddress(local string) string {
+	host, port, err := net.SplitHostPort(local)
+	if err != nil {
+		return local
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ip.To4() != nil {
+			host = "127.0.0.1"
+		} else {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// ShellEnv renders env, as returned by PortEnv, as commands setting the
+// variables in the given shell: bash (which covers sh and zsh), fish or
+// powershell.
+func ShellEnv(shell string, env []string) (string, error) {
+	if _, err := ShellCommand(shell); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, kv := range env {
+		name, value, _ := strings.Cut(kv, "=")
+		switch shell {
+		case shellBash:
+			fmt.Fprintf(&b, "export %s=%q\n", name, value)
+		case shellFish:
+			fmt.Fprintf(&b, "set -gx %s %q;\n", name, value)
+		case shellPowerShell:
+			fmt.Fprintf(&b, "$Env:%s = %q\n", name, value)
+		}
+	}
+	return b.String(), nil
+}
+
+// ShellCommand returns the executable of shell, for spawning a subshell.
+// PowerShell 7 (pwsh) is preferred over Windows PowerShell.
+func ShellCommand(shell string) (string, error) {
+	switch shell {
+	case shellBash, shellFish:
+		return shell, nil
+	case shellPowerShell:
+		if _, err := exec.LookPath("pwsh"); err != nil {
+			return "powershell", nil
+		}
+		return "pwsh", nil
+	default:
+		return "", fmt.Errorf("unknown shell %q (expected bash, fish or powershell)", shell)
+	}
+}
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// matches reports whether e is referred to by ref, given as its ID, as
+// kind/name or as context/namespace/kind/name like -wait-for.
+func (e entry) matches(ref string) bool {
+	return e.Key == ref || e.ID == ref || strings.HasSuffix(e.Key, "/"+ref)
+}
+
+// dependencies resolves the depends_on references of every entry in
+// entries to entry keys, leaving out references that match nothing.
+func dependencies(entries map[string]entry) map[string][]string {
+	deps := map[string][]string{}
+	for key, e := range entries {
+		for _, ref := range e.DependsOn {
+			for other, o := range entries {
+				if other != key && o.matches(ref) {
+					deps[key] = append(deps[key], other)
+				}
+			}
+		}
+	}
+	return deps
+}
+
+// shutdownWaves groups keys into waves that can be stopped together, every
+// entry coming before the entries it depends on according to deps. The
+// entries of a dependency cycle are stopped together and also returned as
+// cyclic.
+func shutdownWaves(keys []string, deps map[string][]string) (waves [][]string, cyclic []string) {
+	remaining := map[string]bool{}
+	for _, key := range keys {
+		remaining[key] = true
+	}
+	for len(remaining) > 0 {
+		needed := map[string]bool{}
+		for key := range remaining {
+			for _, dep := range deps[key] {
+				needed[dep] = true
+			}
+		}
+		var wave []string
+		for key := range remaining {
+			if !needed[key] {
+				wave = append(wave, key)
+			}
+		}
+		if len(wave) == 0 {
+			wave = cycle(remaining, deps)
+			cyclic = append(cyclic, wave...)
+		}
+		sort.Strings(wave)
+		for _, key := range wave {
+			delete(remaining, key)
+		}
+		waves = append(waves, wave)
+	}
+	sort.Strings(cyclic)
+	return waves, cyclic
+}
+
+// cycle returns the entries of remaining that are part of a dependency
+// cycle, leaving out the entries the cycle merely depends on.
+func cycle(remaining map[string]bool, deps map[string][]string) []string {
+	members := map[string]bool{}
+	for key := range remaining {
+		members[key] = true
+	}
+	for pruned := true; pruned; {
+		pruned = false
+		for key := range members {
+			dependsOnMember := false
+			for _, dep := range deps[key] {
+				dependsOnMember = dependsOnMember || members[dep]
+			}
+			if !dependsOnMember {
+				delete(members, key)
+				pruned = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// stopAll stops every running forward. Forwards are stopped before the
+// forwards they depend on, each wave being stopped together. The caller
+// must hold m.mu.
+func (m *Manager) stopAll() {
+	entries := map[string]entry{}
+	keys := make([]string, 0, len(m.running))
+	for key, r := range m.running {
+		entries[key] = r.desired.entry
+		keys = append(keys, key)
+	}
+	waves, _ := shutdownWaves(keys, dependencies(entries))
+
+	for _, wave := range waves {
+		if len(waves) > 1 {
+			logrus.Infof("Stopping %s", strings.Join(wave, ", "))
+		}
+		for _, key := range wave {
+			m.running[key].cancel()
+		}
+		for _, key := range wave {
+			m.stop(key)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// parseSignal fails on Windows, where processes can't be sent signals.
+func parseSignal(name string) (os.Signal, error) {
+	return nil, errors.New("signals are not supported on windows")
+}
@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultSnapshotInterval is how often the metrics snapshot is written when
+// no interval is configured.
+const defaultSnapshotInterval = 10 * time.Second
+
+// Forward states reported in metrics snapshots and by k10ls status.
+const (
+	stateReady       = "ready"
+	stateConnecting  = "connecting"
+	stateWaitingPods = "waiting_for_pods"
+	stateStopped     = "stopped"
+	stateFailed      = "failed"
+)
+
+// MetricsSnapshot configures a JSON file the metrics of every forward are
+// periodically written to.
+type MetricsSnapshot struct {
+	Path     string        `toml:"path"`
+	Interval time.Duration `toml:"interval,omitempty"`
+}
+
+// forwardStats counts the tunnels, connections and traffic of a forward.
+type forwardStats struct {
+	tunnels       atomic.Int64
+	connections   atomic.Int64
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+}
+
+// snapshot is the content of the metrics snapshot file.
+type snapshot struct {
+	Time     time.Time        `json:"time"`
+	Forwards []ForwardMetrics `json:"forwards"`
+}
+
+// ForwardMetrics is the state and traffic of one running forward.
+type ForwardMetrics struct {
+	ID        string `json:"id"`
+	Entry     string `json:"entry"`
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Resource  string `json:"resource"`
+	Pod       string `json:"pod"`
+	// Backends lists the other pods a load-balanced forward spreads
+	// connections across.
+	Backends []string `json:"backends,omitempty"`
+	// Standby lists the pods the forward keeps standby tunnels to.
+	Standby []string `json:"standby,omitempty"`
+	// Listen lists the local addresses of the forward.
+	Listen []string `json:"listen"`
+	State  string   `json:"state"`
+	// LastConnected is when the last tunnel was established.
+	LastConnected *time.Time `json:"last_connected,omitempty"`
+	// Restarts counts the tunnels opened after the first one.
+	Restarts          int64 `json:"restarts"`
+	Connections       int64 `json:"connections"`
+	ActiveConnections int   `json:"active_connections"`
+	// BytesSent is the traffic from local clients to the pod, BytesReceived
+	// from the pod to local clients.
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// validate checks the path and interval of the snapshot.
+func (c *MetricsSnapshot) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("metrics_snapshot: path is required")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("metrics_snapshot: interval must be positive")
+	}
+	return nil
+}
+
+// WriteMetricsSnapshots writes the metrics of every forward to the file
+// described by c every interval until ctx is cancelled.
+func WriteMetricsSnapshots(ctx context.Context, c *MetricsSnapshot) {
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := writeSnapshot(c.Path); err != nil {
+			logrus.Errorf("failed to write metrics snapshot: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeSnapshot replaces the snapshot file at path with the current
+// metrics.
+func writeSnapshot(path string) error {
+	s := snapshot{Time: time.Now().UTC(), Forwards: forwardMetrics()}
+	if s.Forwards == nil {
+		s.Forwards = []ForwardMetrics{}
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Status bars may read the file at any time, so replace it atomically.
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// forwardMetrics returns the metrics of every running forward, sorted by
+// entry key.
+func forwardMetrics() []ForwardMetrics {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	var metrics []ForwardMetrics
+	for f := range forwards {
+		metrics = append(metrics, f.metrics())
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Entry < metrics[j].Entry
+	})
+	return metrics
+}
+
+// metrics returns the state and counters of f.
+func (f *forward) metrics() ForwardMetrics {
+	f.mu.Lock()
+	state := stateConnecting
+	switch {
+	case f.tun != nil:
+		state = stateReady
+	case f.noPods:
+		state = stateWaitingPods
+	}
+	m := ForwardMetrics{
+		ID:                f.entry.ID,
+		Entry:             f.entry.Key,
+		Context:           f.entry.Context,
+		Namespace:         f.entry.Namespace,
+		Resource:          f.entry.Resource(),
+		Pod:               f.podName,
+		State:             state,
+		ActiveConnections: f.active,
+		Listen:            []string{},
+		Labels:            f.entry.Labels,
+	}
+	for _, l := range f.listeners {
+		m.Listen = append(m.Listen, l.Addr().String())
+	}
+	for _, b := range f.backends {
+		m.Backends = append(m.Backends, b.pod)
+	}
+	for _, s := range f.standbys {
+		m.Standby = append(m.Standby, s.pod)
+	}
+	if !f.connectedAt.IsZero() {
+		connected := f.connectedAt
+		m.LastConnected = &connected
+	}
+	f.mu.Unlock()
+
+	if n := f.stats.tunnels.Load(); n > 1 {
+		m.Restarts = n - 1
+	}
+	m.Connections = f.stats.connections.Load()
+	m.BytesSent = f.stats.bytesSent.Load()
+	m.BytesReceived = f.stats.bytesReceived.Load()
+	return m
+}
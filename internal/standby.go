@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// standby is a pre-established tunnel to another pod than the main tunnel,
+// taken over by the forward once the main tunnel is lost.
+type standby struct {
+	pod string
+	uid types.UID
+	tun *tunnel
+	// promoted is closed once the forward took over the tunnel.
+	promoted chan struct{}
+}
+
+// keepStandby keeps tunnels to up to standby pods besides the pods the
+// forward uses open until runCtx is cancelled, so that losing the main
+// tunnel fails over without resolving and dialing another pod first. The
+// first standby tunnel is opened after the reconnect delay, once the main
+// tunnel picked its pod.
+func (f *forward) keepStandby(runCtx context.Context, pods *podInformer) {
+	for runCtx.Err() == nil {
+		sleepContext(runCtx, f.entry.Reconnect.delay())
+		f.addStandbys(runCtx, pods)
+	}
+}
+
+// addStandbys opens standby tunnels to ready pods the forward doesn't use
+// yet until it has standby of them or no other pod is left.
+func (f *forward) addStandbys(runCtx context.Context, pods *podInformer) {
+	missing, used := f.standbySlots()
+	if missing <= 0 {
+		return
+	}
+	core, cfg := f.kube.getCore()
+	candidates, err := backendPods(runCtx, core, pods, f.entry)
+	if err != nil {
+		f.entry.log().Debugf("failed to list pods to keep on standby: %v", err)
+		return
+	}
+	for _, pod := range candidates {
+		if missing == 0 || runCtx.Err() != nil {
+			return
+		}
+		if used[pod.Name] || f.recentlyFailed(pod.Name) {
+			continue
+		}
+		if !f.kube.acquireStream(runCtx) {
+			return
+		}
+		endpointChanged := f.kube.endpointChanged()
+		tun, err := f.kube.dialTunnel(runCtx, core, cfg, f.entry, pod.Name)
+		if err != nil {
+			f.kube.releaseStream()
+			f.podFailed(pod.Name)
+			f.entry.log().Debugf("failed to open standby tunnel to pod %s: %v", pod.Name, err)
+			continue
+		}
+		s := &standby{pod: pod.Name, uid: pod.UID, tun: tun, promoted: make(chan struct{})}
+		f.mu.Lock()
+		f.standbys = append(f.standbys, s)
+		f.mu.Unlock()
+		f.entry.log().Infof("Keeping standby tunnel to pod %s via %s", pod.Name, tun.transport)
+		go f.watchStandby(runCtx, core, pods, s, endpointChanged)
+		missing--
+	}
+}
+
+// watchStandby drops s once its tunnel breaks, its pod is gone, the API
+// server endpoint changes or runCtx is cancelled, unless the forward took
+// it over before.
+func (f *forward) watchStandby(runCtx context.Context, core coreClient, pods *podInformer, s *standby, endpointChanged <-chan struct{}) {
+	gone, stopWatching := watchPod(core, pods, f.entry.Namespace, s.pod, s.uid)
+	select {
+	case <-runCtx.Done():
+	case <-s.tun.Done():
+	case <-gone:
+	case <-endpointChanged:
+	case <-s.promoted:
+	}
+	stopWatching()
+
+	f.mu.Lock()
+	dropped := f.removeStandby(s)
+	f.mu.Unlock()
+	if dropped {
+		s.tun.Close()
+		f.kube.releaseStream()
+	}
+}
+
+// removeStandby removes s from the standby tunnels of f, reporting whether
+// it was still one of them. f.mu must be held.
+func (f *forward) removeStandby(s *standby) bool {
+	for i, other := range f.standbys {
+		if other == s {
+			f.standbys = append(f.standbys[:i], f.standbys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// standbySlots returns how many more standby tunnels the forward should
+// open and the pods it already forwards to. A standby tunnel to the pod the
+// main tunnel moved to is closed, to be replaced by one to another pod.
+func (f *forward) standbySlots() (int, map[string]bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	used := map[string]bool{f.podName: true}
+	for _, b := range f.backends {
+		used[b.pod] = true
+	}
+	missing := f.entry.Standby
+	for _, s := range f.standbys {
+		if s.pod == f.podName {
+			s.tun.Close()
+			continue
+		}
+		used[s.pod] = true
+		missing--
+	}
+	return missing, used
+}
+
+// takeStandby hands over the first usable standby tunnel to the forward,
+// skipping pods that failed within failoverWindow, or returns nil if there
+// is none. The stream it holds is released with the main tunnel.
+func (f *forward) takeStandby(failures map[string]time.Time) *standby {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.standbys {
+		if _, failed := failures[s.pod]; failed {
+			continue
+		}
+		select {
+		case <-s.tun.Done():
+			continue
+		default:
+		}
+		f.removeStandby(s)
+		close(s.promoted)
+		return s
+	}
+	return nil
+}
+
+// hasStandby reports whether a standby tunnel is ready to take over.
+func (f *forward) hasStandby() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, s := range f.standbys {
+		select {
+		case <-s.tun.Done():
+		default:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PortStatus describes one local port bound by a running forward.
+type PortStatus struct {
+	ID        string `json:"id"`
+	Local     string `json:"local"`
+	Context   string `json:"context"`
+	Namespace string `json:"namespace"`
+	Entry     string `json:"entry"`
+	Pod       string `json:"pod"`
+	Port      string `json:"port"`
+	Offset    int    `json:"offset,omitempty"`
+	Ready     bool   `json:"ready"`
+}
+
+// The forward registry tracks every running forward of this process so its
+// state can be reported over the control socket.
+var (
+	forwardsMu sync.Mutex
+	forwards   = map[*forward]struct{}{}
+)
+
+func registerForward(f *forward) {
+	forwardsMu.Lock()
+	forwards[f] = struct{}{}
+	forwardsMu.Unlock()
+	updateFileSD()
+}
+
+func unregisterForward(f *forward) {
+	forwardsMu.Lock()
+	delete(forwards, f)
+	forwardsMu.Unlock()
+	updateFileSD()
+	updateEndpoints()
+}
+
+// boundPorts returns the local ports of all running forwards, sorted by
+// local address.
+func boundPorts() []PortStatus {
+	forwardsMu.Lock()
+	defer forwardsMu.Unlock()
+
+	var ports []PortStatus
+	for f := range forwards {
+		ports = append(ports, f.portStatus()...)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Local < ports[j].Local
+	})
+	return ports
+}
+
+// portStatus reports the local ports f has bound.
+func (f *forward) portStatus() []PortStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ports := make([]PortStatus, 0, len(f.listeners))
+	for i, l := range f.listeners {
+		ports = append(ports, PortStatus{
+			ID:        f.entry.ID,
+			Local:     l.Addr().String(),
+			Context:   f.entry.Context,
+			Namespace: f.entry.Namespace,
+			Entry:     f.entry.Resource(),
+			Pod:       f.podName,
+			Port:      f.entry.Ports[i].Target,
+			Offset:    f.entry.PortOffset,
+			Ready:     f.tun != nil,
+		})
+	}
+	return ports
+}
+
+// LogStatus logs a table of every running forward with its state, local
+// addresses, restarts and traffic.
+func LogStatus() {
+	metrics := forwardMetrics()
+	var buf bytes.Buffer
+	_ = WriteStatus(&buf, metrics)
+
+	logrus.Infof("Status of %d forwards:", len(metrics))
+	for _, line := range strings.Split(strings.TrimRight(buf.String(), "\n"), "\n") {
+		logrus.Info(line)
+	}
+}
+
+// ConfiguredForward describes an entry of a configuration, whether or not
+// it is running.
+type ConfiguredForward struct {
+	ID        string
+	Key       string
+	Context   string
+	Namespace string
+	Resource  string
+	Address   string
+	Ports     []PortMap
+}
+
+// Forwards returns every entry of c, sorted by key. Services found by
+// forward_all_services are only known to a running instance and are left
+// out.
+func (c *Config) Forwards() ([]ConfiguredForward, error) {
+	desired, err := desiredEntries(c)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ConfiguredForward, 0, len(desired))
+	for _, d := range desired {
+		e := d.entry
+		out = append(out, ConfiguredForward{
+			ID:        e.ID,
+			Key:       e.Key,
+			Context:   e.Context,
+			Namespace: e.Namespace,
+			Resource:  e.Resource(),
+			Address:   e.Address,
+			Ports:     e.Ports,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, nil
+}
+
+// WriteStatus writes metrics to w as a table.
+func WriteStatus(w io.Writer, metrics []ForwardMetrics) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tENTRY\tSTATE\tPOD\tLISTEN\tRESTARTS\tCONNECTIONS\tACTIVE\tSENT\tRECEIVED")
+	for _, m := range metrics {
+		pod := m.Pod
+		if len(m.Backends) > 0 {
+			pod += fmt.Sprintf(" (+%d)", len(m.Backends))
+		}
+		if len(m.Standby) > 0 {
+			pod += fmt.Sprintf(" (%d standby)", len(m.Standby))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n", m.ID, m.Entry, m.State, pod, strings.Join(m.Listen, ","),
+			m.Restarts, m.Connections, m.ActiveConnections, m.BytesSent, m.BytesReceived)
+	}
+	return tw.Flush()
+}
+
+// setListeners records the listeners f currently serves on.
+func (f *forward) setListeners(listeners []net.Listener) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listeners = listeners
+}
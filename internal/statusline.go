@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Output formats of k10ls status. The starship and tmux formats print a
+// one-line summary for shell prompts and status bars.
+const (
+	StatusFormatTable    = "table"
+	StatusFormatStarship = "starship"
+	StatusFormatTmux     = "tmux"
+)
+
+// ReadSnapshot returns the forwards in the metrics snapshot file of c. A
+// snapshot that wasn't replaced for three intervals is stale, most likely
+// left behind by an instance that is gone, and an error.
+func ReadSnapshot(c *MetricsSnapshot) ([]ForwardMetrics, error) {
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", c.Path, err)
+	}
+	interval := c.Interval
+	if interval <= 0 {
+		interval = defaultSnapshotInterval
+	}
+	if age := time.Since(s.Time); age > 3*interval {
+		return nil, fmt.Errorf("%s: snapshot is %s old", c.Path, age.Round(time.Second))
+	}
+	return s.Forwards, nil
+}
+
+// StatusLine returns the one-line summary of metrics in format, like
+// "k10ls 12/14 up": how many of the forwards not stopped on purpose are
+// ready. The tmux format colors it green when all of them are, yellow when
+// some are and red when none is.
+func StatusLine(metrics []ForwardMetrics, format string) string {
+	up, total := 0, 0
+	for _, m := range metrics {
+		switch m.State {
+		case stateStopped:
+			continue
+		case stateReady:
+			up++
+		}
+		total++
+	}
+	line := fmt.Sprintf("k10ls %d/%d up", up, total)
+	if format != StatusFormatTmux {
+		return line
+	}
+	color := "yellow"
+	switch up {
+	case total:
+		color = "green"
+	case 0:
+		color = "red"
+	}
+	return fmt.Sprintf("#[fg=%s]%s#[default]", color, line)
+}
@@ -0,0 +1,138 @@
+//go:build !windows
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handOff passes every local listener to the process on the other end of
+// conn using SCM_RIGHTS, one socket per message, followed by a final
+// ControlResponse. This process stops accepting connections afterwards.
+func (s *ControlServer) handOff(conn *net.UnixConn) error {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	if handedOff {
+		return errHandedOff
+	}
+
+	files := make(map[string]*os.File, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for key, l := range listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener %s: %v", key, err)
+		}
+		files[key] = f
+	}
+
+	for key, f := range files {
+		rights := syscall.UnixRights(int(f.Fd()))
+		if _, _, err := conn.WriteMsgUnix([]byte(key+"\n"), rights, nil); err != nil {
+			return fmt.Errorf("failed to send listener %s: %v", key, err)
+		}
+		logrus.Debugf("handed over listener %s", key)
+	}
+
+	// The receiving process now owns the sockets; stop accepting on our
+	// copies and release the control socket path so it can bind it.
+	handedOff = true
+	for _, l := range listeners {
+		l.Close()
+	}
+	s.Close()
+
+	if err := json.NewEncoder(conn).Encode(ControlResponse{}); err != nil {
+		return err
+	}
+	if s.OnHandOff != nil {
+		go s.OnHandOff()
+	}
+	return nil
+}
+
+// TakeOver asks the k10ls instance listening on the control socket at path
+// to hand over its local listeners. The received sockets are reused by
+// entries binding the same address and port.
+func TakeOver(path string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket %s: %v", path, err)
+	}
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+
+	if err := json.NewEncoder(uc).Encode(ControlRequest{Command: "takeover"}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for {
+		n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+		if err != nil {
+			return fmt.Errorf("failed to receive listeners: %v", err)
+		}
+
+		fds, err := parseRights(oob[:oobn])
+		if err != nil {
+			return err
+		}
+		if len(fds) == 0 {
+			var resp ControlResponse
+			if err := json.Unmarshal(buf[:n], &resp); err != nil {
+				return fmt.Errorf("invalid takeover response: %v", err)
+			}
+			if resp.Error != "" {
+				return errors.New(resp.Error)
+			}
+			return nil
+		}
+
+		key := strings.TrimSpace(string(buf[:n]))
+		f := os.NewFile(uintptr(fds[0]), key)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to adopt listener %s: %v", key, err)
+		}
+
+		listenersMu.Lock()
+		inherited[key] = l
+		listenersMu.Unlock()
+		logrus.Infof("Took over listener %s", key)
+	}
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse control message: %v", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse unix rights: %v", err)
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+var errTakeoverUnsupported = errors.New("socket takeover is not supported on windows")
+
+func (s *ControlServer) handOff(conn *net.UnixConn) error {
+	return errTakeoverUnsupported
+}
+
+// TakeOver is not supported on Windows, which lacks SCM_RIGHTS.
+func TakeOver(path string) error {
+	return errTakeoverUnsupported
+}
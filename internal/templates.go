@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// entryTemplates are the built-in entry templates of `k10ls add`. min_age
+// keeps k10ls off pods that only just started and may not accept
+// connections yet.
+var entryTemplates = map[string]EntryOptions{
+	"postgres": {
+		Ports:    []PortMap{{Source: "5432", Target: "5432"}},
+		Protocol: protocolPostgres,
+		MinAge:   30 * time.Second,
+	},
+	"redis": {
+		Ports:    []PortMap{{Source: "6379", Target: "6379"}},
+		Protocol: protocolRedis,
+		MinAge:   10 * time.Second,
+	},
+	"kafka": {
+		Ports:  []PortMap{{Source: "9092", Target: "9092"}},
+		MinAge: time.Minute,
+	},
+	"grafana": {
+		Ports:    []PortMap{{Source: "3000", Target: "3000"}},
+		Protocol: protocolHTTP,
+		MinAge:   30 * time.Second,
+		Retries:  2,
+	},
+}
+
+// contextHeader matches the header of a context table.
+var contextHeader = regexp.MustCompile(`(?m)^[ \t]*\[\[[ \t]*context[ \t]*\]\]`)
+
+// TemplateNames returns the names of the built-in entry templates.
+func TemplateNames() []string {
+	names := make([]string, 0, len(entryTemplates))
+	for name := range entryTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEntry describes an entry added with `k10ls add` or forwarded with
+// `k10ls forward`.
+type NewEntry struct {
+	// Resource is the entry as a kind/name reference, e.g. "svc/orders-db".
+	Resource  string
+	Template  string
+	Namespace string
+	Ports     []PortMap
+}
+
+// options returns the options of the entry, starting from its template.
+func (n NewEntry) options() (EntryOptions, error) {
+	var opts EntryOptions
+	if n.Template != "" {
+		t, ok := entryTemplates[n.Template]
+		if !ok {
+			return opts, fmt.Errorf("unknown template %q (expected %s)", n.Template, strings.Join(TemplateNames(), ", "))
+		}
+		opts = t
+	}
+	if len(n.Ports) > 0 {
+		opts.Ports = n.Ports
+	}
+	if len(opts.Ports) == 0 {
+		return opts, fmt.Errorf("%s: no ports given and no template to take them from", n.Resource)
+	}
+	opts.Namespace = n.Namespace
+	return opts, nil
+}
+
+// invalidResource is the error for a resource reference of an unknown
+// form.
+func invalidResource(resource string) error {
+	return fmt.Errorf("invalid resource %q (expected svc/<name>, pod/<name>, label/<selector>, deploy/<name>, sts/<name>, rs/<name> or remote/<host>)", resource)
+}
+
+// toml renders the entry as a table of the last context in a config file.
+func (n NewEntry) toml() (string, error) {
+	kind, name, ok := strings.Cut(n.Resource, "/")
+	if !ok || name == "" {
+		return "", invalidResource(n.Resource)
+	}
+	opts, err := n.options()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	switch kind {
+	case kindService, "service":
+		fmt.Fprintf(&b, "[[context.svc]]\nname = %q\n", name)
+	case kindPod:
+		fmt.Fprintf(&b, "[[context.pods]]\nname = %q\n", name)
+	case kindLabel:
+		fmt.Fprintf(&b, "[[context.label-selectors]]\nlabel = %q\n", name)
+	case kindRemote:
+		fmt.Fprintf(&b, "[[context.remote]]\nhost = %q\n", name)
+	default:
+		workload, ok := workloadKind(kind)
+		if !ok {
+			return "", invalidResource(n.Resource)
+		}
+		fmt.Fprintf(&b, "[[context.%s]]\nname = %q\n", workload, name)
+	}
+	if opts.Namespace != "" {
+		fmt.Fprintf(&b, "namespace = %q\n", opts.Namespace)
+	}
+	if opts.Protocol != "" {
+		fmt.Fprintf(&b, "protocol = %q\n", opts.Protocol)
+	}
+	if opts.Retries > 0 {
+		fmt.Fprintf(&b, "retries = %d\n", opts.Retries)
+	}
+	if opts.MinAge > 0 {
+		fmt.Fprintf(&b, "min_age = %q\n", opts.MinAge)
+	}
+	ports := make([]string, len(opts.Ports))
+	for i, p := range opts.Ports {
+		ports[i] = fmt.Sprintf("{source = %q, target = %q}", p.Source, p.Target)
+	}
+	fmt.Fprintf(&b, "ports = [%s]\n", strings.Join(ports, ", "))
+	return b.String(), nil
+}
+
+// AddEntry inserts n into the context named contextName (or its alias) of
+// the config file data, keeping the rest of the file, including comments,
+// as it is. contextName may be empty if the file has a single context.
+func AddEntry(data []byte, contextName string, n NewEntry) ([]byte, error) {
+	table, err := n.toml()
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return nil, err
+	}
+
+	index := -1
+	for i := range config.Contexts {
+		ctx := &config.Contexts[i]
+		if contextName == "" || ctx.Name == contextName || ctx.Alias == contextName {
+			if index >= 0 {
+				return nil, fmt.Errorf("several contexts match, choose one with --context")
+			}
+			index = i
+		}
+	}
+	if index < 0 {
+		if contextName == "" {
+			return nil, fmt.Errorf("the config file has no context")
+		}
+		return nil, fmt.Errorf("no context %q in the config file", contextName)
+	}
+
+	// A [[context.svc]] table belongs to the last [[context]] before it, so
+	// insert the entry right before the header of the next context.
+	headers := contextHeader.FindAllIndex(data, -1)
+	if len(headers) != len(config.Contexts) {
+		return nil, fmt.Errorf("unable to locate the contexts in the config file, add the entry by hand:\n%s", table)
+	}
+	at := len(data)
+	if index+1 < len(headers) {
+		at = headers[index+1][0]
+	}
+
+	var out bytes.Buffer
+	out.Write(data[:at])
+	if at > 0 && !bytes.HasSuffix(data[:at], []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	if at > 0 && !bytes.HasSuffix(data[:at], []byte("\n\n")) {
+		out.WriteByte('\n')
+	}
+	out.WriteString(table)
+	if at < len(data) {
+		out.WriteByte('\n')
+	}
+	out.Write(data[at:])
+
+	var updated Config
+	if _, err := toml.Decode(out.String(), &updated); err != nil {
+		return nil, err
+	}
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// AddKubeContextEntry inserts n into the context of the config file data
+// that uses the kubeconfig context kubeContext, appending one if there is
+// none, like AddEntry.
+func AddKubeContextEntry(data []byte, kubeContext string, n NewEntry) ([]byte, error) {
+	var config Config
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return nil, err
+	}
+	for _, ctx := range config.Contexts {
+		if ctx.Name == kubeContext {
+			return AddEntry(data, kubeContext, n)
+		}
+	}
+
+	table, err := n.toml()
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	out.Write(data)
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n\n")) {
+		out.WriteByte('\n')
+	}
+	fmt.Fprintf(&out, "[[context]]\nname = %q\n\n%s", kubeContext, table)
+
+	var updated Config
+	if _, err := toml.Decode(out.String(), &updated); err != nil {
+		return nil, err
+	}
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// throttle limits the concurrent connections and the bandwidth of a
+// forward, overall and per client IP.
+type throttle struct {
+	// slots holds a token per open connection. It is nil when the entry
+	// sets no max_connections.
+	slots chan struct{}
+
+	// limiter is shared by both directions of every connection. It is nil
+	// when the entry sets no bandwidth.
+	limiter *rate.Limiter
+
+	// clients holds the quota of every client IP with open connections. It
+	// is nil when the entry sets neither max_connections_per_client nor
+	// bandwidth_per_client.
+	mu              sync.Mutex
+	clients         map[string]*clientQuota
+	maxPerClient    int
+	clientBandwidth int64
+}
+
+// clientQuota limits the connections of one client IP on a forward. It is
+// kept while the client has connections open or waiting.
+type clientQuota struct {
+	refs    int
+	slots   chan struct{}
+	limiter *rate.Limiter
+}
+
+// parseBandwidth parses a bandwidth in bytes per second such as "1Mi" or
+// "500k".
+func parseBandwidth(s string) (int64, error) {
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q (expected bytes per second, e.g. 1Mi or 500k)", s)
+	}
+	if q.Value() <= 0 {
+		return 0, fmt.Errorf("bandwidth must be positive")
+	}
+	return q.Value(), nil
+}
+
+func newThrottle(e entry) *throttle {
+	t := &throttle{}
+	if e.MaxConnections > 0 {
+		t.slots = make(chan struct{}, e.MaxConnections)
+	}
+	if e.Bandwidth > 0 {
+		t.limiter = newBandwidthLimiter(e.Bandwidth)
+	}
+	if e.MaxConnectionsPerClient > 0 || e.BandwidthPerClient > 0 {
+		t.clients = map[string]*clientQuota{}
+		t.maxPerClient = e.MaxConnectionsPerClient
+		t.clientBandwidth = e.BandwidthPerClient
+	}
+	return t
+}
+
+// newBandwidthLimiter returns a limiter to bandwidth bytes per second.
+func newBandwidthLimiter(bandwidth int64) *rate.Limiter {
+	// Allow bursts of one copy buffer so reads are never split below it,
+	// or of a second's worth of traffic on fast links.
+	burst := max(copyBufferSize, int(min(bandwidth, int64(1<<30))))
+	return rate.NewLimiter(rate.Limit(bandwidth), burst)
+}
+
+// clientIP returns the IP of the client at addr, or addr itself if it has
+// none, e.g. for unix sockets.
+func clientIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire waits for a connection slot of client and of the forward, for up
+// to tunnelWaitTimeout in total.
+func (t *throttle) acquire(ctx context.Context, client string) (err error) {
+	q := t.quota(client)
+	if q == nil && t.slots == nil {
+		return nil
+	}
+	heldClientSlot := false
+	defer func() {
+		if err != nil {
+			t.releaseQuota(client, heldClientSlot)
+		}
+	}()
+
+	timer := time.NewTimer(tunnelWaitTimeout)
+	defer timer.Stop()
+	if q != nil && q.slots != nil {
+		select {
+		case q.slots <- struct{}{}:
+			heldClientSlot = true
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("too many connections from %s (max_connections_per_client = %d)", client, cap(q.slots))
+		}
+	}
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return fmt.Errorf("too many connections (max_connections = %d)", cap(t.slots))
+		}
+	}
+	return nil
+}
+
+// release frees the slots taken by acquire.
+func (t *throttle) release(client string) {
+	if t.slots != nil {
+		<-t.slots
+	}
+	t.releaseQuota(client, true)
+}
+
+// quota returns the quota of client, creating it if it has no connections
+// yet, and counts a reference to it. It returns nil without per-client
+// limits.
+func (t *throttle) quota(client string) *clientQuota {
+	if t.clients == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.clients[client]
+	if !ok {
+		q = &clientQuota{}
+		if t.maxPerClient > 0 {
+			q.slots = make(chan struct{}, t.maxPerClient)
+		}
+		if t.clientBandwidth > 0 {
+			q.limiter = newBandwidthLimiter(t.clientBandwidth)
+		}
+		t.clients[client] = q
+	}
+	q.refs++
+	return q
+}
+
+// releaseQuota drops a reference to the quota of client, freeing its
+// connection slot if slot is set, and forgets the client once it has no
+// connections left.
+func (t *throttle) releaseQuota(client string, slot bool) {
+	if t.clients == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q := t.clients[client]
+	if slot && q.slots != nil {
+		<-q.slots
+	}
+	q.refs--
+	if q.refs == 0 {
+		delete(t.clients, client)
+	}
+}
+
+// wrap returns conn of client limited to the bandwidth of t and of the
+// client until ctx is cancelled.
+func (t *throttle) wrap(ctx context.Context, conn net.Conn, client string) net.Conn {
+	var limiters []*rate.Limiter
+	if t.limiter != nil {
+		limiters = append(limiters, t.limiter)
+	}
+	if t.clients != nil {
+		t.mu.Lock()
+		if q := t.clients[client]; q != nil && q.limiter != nil {
+			limiters = append(limiters, q.limiter)
+		}
+		t.mu.Unlock()
+	}
+	if len(limiters) == 0 {
+		return conn
+	}
+	burst := limiters[0].Burst()
+	for _, l := range limiters[1:] {
+		burst = min(burst, l.Burst())
+	}
+	return &throttledConn{Conn: conn, ctx: ctx, limiters: limiters, burst: burst}
+}
+
+// throttledConn waits for every limiter before passing on data in either
+// direction.
+type throttledConn struct {
+	net.Conn
+	ctx      context.Context
+	limiters []*rate.Limiter
+	// burst is the smallest burst of the limiters.
+	burst int
+}
+
+// wait waits until every limiter allows n bytes.
+func (c *throttledConn) wait(n int) error {
+	for _, l := range c.limiters {
+		if err := l.WaitN(c.ctx, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(b) > c.burst {
+		b = b[:c.burst]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if werr := c.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), c.burst)]
+		if err := c.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
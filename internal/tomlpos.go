@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Location is a position in a config file, counting lines and columns from
+// one.
+type Location struct {
+	Line   int
+	Column int
+}
+
+// tomlLocator records where the keys, tables and array elements of a TOML
+// document are defined. Paths are dotted keys with the index of array
+// elements, like context[0].svc[1].ports[0].source. The document must be
+// valid TOML; the locator doesn't report syntax errors.
+type tomlLocator struct {
+	src  string
+	pos  int
+	keys map[string]int
+	// order lists the paths in the order they appear in the document.
+	order []string
+	// arrays counts the tables of each array of tables.
+	arrays     map[string]int
+	lineStarts []int
+}
+
+// locateTOML scans the TOML document src.
+func locateTOML(src string) *tomlLocator {
+	l := &tomlLocator{src: src, keys: map[string]int{}, arrays: map[string]int{}, lineStarts: []int{0}}
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			l.lineStarts = append(l.lineStarts, i+1)
+		}
+	}
+
+	table := ""
+	for {
+		l.skipSpace(true)
+		if l.pos >= len(src) {
+			break
+		}
+		start := l.pos
+		switch {
+		case strings.HasPrefix(src[l.pos:], "[["):
+			l.pos += 2
+			table = l.tablePath(l.keyPath(), true)
+			l.record(table, start)
+		case src[l.pos] == '[':
+			l.pos++
+			table = l.tablePath(l.keyPath(), false)
+			l.record(table, start)
+		default:
+			segs := l.keyPath()
+			path := joinPath(table, strings.Join(segs, "."))
+			l.record(path, start)
+			l.skipSpace(false)
+			if l.pos < len(src) && src[l.pos] == '=' {
+				l.pos++
+				l.value(path)
+			}
+		}
+		l.skipLine()
+	}
+	return l
+}
+
+// locate returns where path is defined and whether it is.
+func (l *tomlLocator) locate(path string) (Location, bool) {
+	offset, ok := l.keys[path]
+	if !ok {
+		return Location{}, false
+	}
+	return l.location(offset), true
+}
+
+// location converts a byte offset into a line and column.
+func (l *tomlLocator) location(offset int) Location {
+	if offset > len(l.src) {
+		offset = len(l.src)
+	}
+	line := sort.Search(len(l.lineStarts), func(i int) bool { return l.lineStarts[i] > offset }) - 1
+	return Location{Line: line + 1, Column: len([]rune(l.src[l.lineStarts[line]:offset])) + 1}
+}
+
+// lineKey returns the location of the key named key on line, or the start
+// of the line if it isn't found there.
+func (l *tomlLocator) lineKey(line int, key string) Location {
+	if line < 1 || line > len(l.lineStarts) {
+		return Location{Line: line, Column: 1}
+	}
+	start := l.lineStarts[line-1]
+	end := len(l.src)
+	if line < len(l.lineStarts) {
+		end = l.lineStarts[line]
+	}
+	if i := strings.Index(l.src[start:end], key); i >= 0 && key != "" {
+		return l.location(start + i)
+	}
+	return Location{Line: line, Column: 1}
+}
+
+func (l *tomlLocator) record(path string, offset int) {
+	if _, ok := l.keys[path]; !ok {
+		l.order = append(l.order, path)
+	}
+	l.keys[path] = offset
+}
+
+// tablePath resolves the key of a table header to its path. Keys naming an
+// array of tables refer to its last table; a new array table is appended
+// to its array.
+func (l *tomlLocator) tablePath(segs []string, array bool) string {
+	path := ""
+	for i, seg := range segs {
+		path = joinPath(path, seg)
+		n, isArray := l.arrays[path]
+		if i == len(segs)-1 && array {
+			l.arrays[path] = n + 1
+			return fmt.Sprintf("%s[%d]", path, n)
+		}
+		if isArray {
+			path = fmt.Sprintf("%s[%d]", path, n-1)
+		}
+	}
+	return path
+}
+
+// keyPath reads a dotted key of bare and quoted keys.
+func (l *tomlLocator) keyPath() []string {
+	var segs []string
+	for l.pos < len(l.src) {
+		l.skipSpace(false)
+		if l.pos >= len(l.src) {
+			break
+		}
+		switch c := l.src[l.pos]; c {
+		case '"', '\'':
+			segs = append(segs, l.quotedKey(c))
+		default:
+			start := l.pos
+			for l.pos < len(l.src) && isBareKeyChar(l.src[l.pos]) {
+				l.pos++
+			}
+			segs = append(segs, l.src[start:l.pos])
+		}
+		l.skipSpace(false)
+		if l.pos < len(l.src) && l.src[l.pos] == '.' {
+			l.pos++
+			continue
+		}
+		break
+	}
+	return segs
+}
+
+func (l *tomlLocator) quotedKey(quote byte) string {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) && l.src[l.pos] != quote {
+		if quote == '"' && l.src[l.pos] == '\\' && l.pos+1 < len(l.src) {
+			l.pos++
+		}
+		b.WriteByte(l.src[l.pos])
+		l.pos++
+	}
+	l.pos++
+	return b.String()
+}
+
+// value skips the value of path, recording the keys of inline tables and
+// the elements of arrays in it.
+func (l *tomlLocator) value(path string) {
+	l.skipSpace(false)
+	if l.pos >= len(l.src) {
+		return
+	}
+	switch c := l.src[l.pos]; {
+	case c == '{':
+		l.pos++
+		for {
+			l.skipSpace(true)
+			if l.pos >= len(l.src) || l.src[l.pos] == '}' {
+				l.pos++
+				return
+			}
+			if l.src[l.pos] == ',' {
+				l.pos++
+				continue
+			}
+			start := l.pos
+			key := joinPath(path, strings.Join(l.keyPath(), "."))
+			if l.pos == start {
+				// Not a key, the document is invalid.
+				l.pos++
+				continue
+			}
+			l.record(key, start)
+			l.skipSpace(false)
+			if l.pos < len(l.src) && l.src[l.pos] == '=' {
+				l.pos++
+				l.value(key)
+			}
+		}
+	case c == '[':
+		l.pos++
+		for i := 0; ; {
+			l.skipSpace(true)
+			if l.pos >= len(l.src) || l.src[l.pos] == ']' {
+				l.pos++
+				return
+			}
+			if l.src[l.pos] == ',' {
+				l.pos++
+				continue
+			}
+			start := l.pos
+			elem := fmt.Sprintf("%s[%d]", path, i)
+			l.record(elem, start)
+			l.value(elem)
+			if l.pos == start {
+				l.pos++
+			}
+			i++
+		}
+	case c == '"' || c == '\'':
+		l.skipString(c)
+	default:
+		for l.pos < len(l.src) && !strings.ContainsRune(",]}\n#", rune(l.src[l.pos])) {
+			l.pos++
+		}
+	}
+}
+
+// skipString skips a basic or literal, single or multi-line string.
+func (l *tomlLocator) skipString(quote byte) {
+	delim := string(quote)
+	if strings.HasPrefix(l.src[l.pos:], strings.Repeat(delim, 3)) {
+		delim = strings.Repeat(delim, 3)
+	}
+	l.pos += len(delim)
+	for l.pos < len(l.src) {
+		if quote == '"' && l.src[l.pos] == '\\' {
+			l.pos += 2
+			continue
+		}
+		if strings.HasPrefix(l.src[l.pos:], delim) {
+			l.pos += len(delim)
+			// Multi-line strings may end in up to two more quotes.
+			for len(delim) == 3 && l.pos < len(l.src) && l.src[l.pos] == quote {
+				l.pos++
+			}
+			return
+		}
+		l.pos++
+	}
+}
+
+// skipSpace skips whitespace and, with newlines, line breaks and comments.
+func (l *tomlLocator) skipSpace(newlines bool) {
+	for l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case ' ', '\t':
+		case '\r', '\n':
+			if !newlines {
+				return
+			}
+		case '#':
+			if !newlines {
+				return
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		default:
+			return
+		}
+		l.pos++
+	}
+}
+
+// skipLine skips the rest of the line, like closing brackets of table
+// headers and comments.
+func (l *tomlLocator) skipLine() {
+	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+		l.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func joinPath(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// trustNickname names the local CA in NSS databases.
+const trustNickname = "k10ls local CA"
+
+// linuxTrustStores are the anchor directories of the Linux system trust
+// stores and the commands that rebuild them.
+var linuxTrustStores = []struct {
+	dir    string
+	update []string
+}{
+	{"/usr/local/share/ca-certificates", []string{"update-ca-certificates"}},
+	{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+	{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+	{"/usr/share/pki/trust/anchors", []string{"update-ca-certificates"}},
+}
+
+// TrustInstall generates the local CA if needed and adds it to the system
+// trust store and to the NSS databases of Firefox and Chromium, writing
+// progress to stdout.
+func TrustInstall() error {
+	if _, err := loadLocalCA(); err != nil {
+		return err
+	}
+	certPath, _, err := localCAPaths()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Local CA: %s\n", certPath)
+
+	switch runtime.GOOS {
+	case "darwin":
+		err = runPrivileged("security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain", certPath)
+	case "windows":
+		err = runPrivileged("certutil", "-addstore", "-f", "ROOT", certPath)
+	case "linux":
+		err = linuxTrust(certPath, true)
+	default:
+		err = fmt.Errorf("installing into the system trust store is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Installed the local CA in the system trust store")
+	nssTrust(certPath, true)
+	return nil
+}
+
+// TrustUninstall removes the local CA from the trust stores TrustInstall
+// added it to. The CA itself is kept, so installing it again doesn't
+// invalidate certificates clients may have pinned.
+func TrustUninstall() error {
+	certPath, _, err := localCAPaths()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(certPath); err != nil {
+		return fmt.Errorf("no local CA at %s", certPath)
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		err = runPrivileged("security", "remove-trusted-cert", "-d", certPath)
+	case "windows":
+		ca, caErr := loadLocalCA()
+		if caErr != nil {
+			return caErr
+		}
+		err = runPrivileged("certutil", "-delstore", "ROOT", ca.cert.SerialNumber.Text(16))
+	case "linux":
+		err = linuxTrust(certPath, false)
+	default:
+		err = fmt.Errorf("removing from the system trust store is not supported on %s", runtime.GOOS)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Removed the local CA from the system trust store")
+	nssTrust(certPath, false)
+	return nil
+}
+
+// linuxTrust adds the CA to, or removes it from, the first system trust
+// store found.
+func linuxTrust(certPath string, install bool) error {
+	for _, store := range linuxTrustStores {
+		if _, err := os.Stat(store.dir); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(store.update[0]); err != nil {
+			continue
+		}
+		anchor := filepath.Join(store.dir, "k10ls-local-ca.crt")
+		if install {
+			if err := runPrivileged("cp", certPath, anchor); err != nil {
+				return err
+			}
+		} else if err := runPrivileged("rm", "-f", anchor); err != nil {
+			return err
+		}
+		return runPrivileged(store.update[0], store.update[1:]...)
+	}
+	return fmt.Errorf("no supported system trust store found")
+}
+
+// nssTrust adds the CA to, or removes it from, the NSS databases of
+// Firefox profiles and Chromium, if certutil from the NSS tools is
+// installed. Failures are reported but not fatal.
+func nssTrust(certPath string, install bool) {
+	dbs := nssDatabases()
+	if len(dbs) == 0 {
+		return
+	}
+	certutil, err := exec.LookPath("certutil")
+	if err != nil || runtime.GOOS == "windows" {
+		fmt.Println("Install certutil from the NSS tools to trust the local CA in Firefox and Chromium as well")
+		return
+	}
+	for _, db := range dbs {
+		args := []string{"-d", "sql:" + db, "-D", "-n", trustNickname}
+		if install {
+			args = []string{"-d", "sql:" + db, "-A", "-t", "C,,", "-n", trustNickname, "-i", certPath}
+		}
+		if out, err := exec.Command(certutil, args...).CombinedOutput(); err != nil {
+			fmt.Printf("Skipped %s: %s\n", db, strings.TrimSpace(string(out)))
+			continue
+		}
+		fmt.Printf("Updated %s\n", db)
+	}
+}
+
+// nssDatabases returns the NSS databases of the current user.
+func nssDatabases() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	patterns := []string{
+		filepath.Join(home, ".pki", "nssdb"),
+		filepath.Join(home, ".mozilla", "firefox", "*"),
+		filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"),
+		filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles", "*"),
+	}
+	var dbs []string
+	for _, p := range patterns {
+		matches, _ := filepath.Glob(filepath.Join(p, "cert9.db"))
+		for _, m := range matches {
+			dbs = append(dbs, filepath.Dir(m))
+		}
+	}
+	return dbs
+}
+
+// runPrivileged runs a command changing the system trust store, through
+// sudo unless already running as root.
+func runPrivileged(name string, args ...string) error {
+	if runtime.GOOS != "windows" && os.Geteuid() != 0 {
+		if _, err := exec.LookPath("sudo"); err == nil {
+			args = append([]string{"--prompt=k10ls needs your password to update the trust store: ", name}, args...)
+			name = "sudo"
+		}
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v", filepath.Base(cmd.Args[0]), err)
+	}
+	return nil
+}
@@ -0,0 +1,460 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	spdystream "k8s.io/apimachinery/pkg/util/httpstream/spdy"
+	portforwardconst "k8s.io/apimachinery/pkg/util/portforward"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"k8s.io/client-go/transport/websocket"
+)
+
+// defaultKeepalive is how often idle tunnels are kept alive unless an entry
+// sets keepalive. It matches the ping period of kubectl port-forward.
+const defaultKeepalive = 5 * time.Second
+
+// keepaliveProbes is how many TCP keepalive probes may go unanswered before
+// the connection of a tunnel is considered dead.
+const keepaliveProbes = 3
+
+// tunnel is an established port-forward connection to a single pod. Local
+// connections are proxied through it as pairs of data/error streams.
+type tunnel struct {
+	conn      httpstream.Connection
+	requestID atomic.Int64
+	// transport is the protocol the tunnel was opened with.
+	transport string
+}
+
+// Port-forward protocols of tunnels, see Context.TunnelProtocol. Without
+// one, WebSocket is tried first and SPDY used if the API server or a proxy
+// in front of it refuses the upgrade. If SPDY is refused too, entries with
+// protocol = "http" forward through the proxy subresource of the pod.
+const (
+	tunnelWebSocket = "websocket"
+	tunnelSPDY      = "spdy"
+	tunnelPodProxy  = "proxy"
+)
+
+// dialTunnel opens a port-forward connection to the given pod for e. If
+// the context pins certificates, the connection is refused unless the API
+// server presents one of them. The dial timeout of e bounds connecting to
+// the API server and upgrading the connection, its TLS handshake timeout
+// the TLS handshake in between. The idle connection is kept alive every
+// keepalive of e. In chaos mode dials fail and tunnels are dropped at
+// random.
+func (k *kubeClient) dialTunnel(ctx context.Context, core coreClient, cfg *rest.Config, e entry, podName string) (*tunnel, error) {
+	target := core.portForwardURL(e.Namespace, podName)
+	var deadlines *dialDeadlines
+	if e.DialTimeout > 0 || e.TLSHandshakeTimeout > 0 {
+		ctx, deadlines = withDialDeadlines(ctx, e.DialTimeout, e.TLSHandshakeTimeout)
+		defer deadlines.stop()
+	}
+
+	if chaos.failAPI() {
+		return nil, fmt.Errorf("error upgrading connection: chaos: simulated API error")
+	}
+	conn, transport, err := k.negotiateTunnel(ctx, target, cfg, e.keepalive(), e.Protocol == protocolHTTP)
+	if cause := deadlines.exceeded(); cause != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, fmt.Errorf("error upgrading connection: %v", cause)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error upgrading connection: %v", err)
+	}
+	tun := &tunnel{conn: conn, transport: transport}
+	chaos.dropLater(tun, e, podName)
+	return tun, nil
+}
+
+// dialDeadlines bounds the phases of opening a tunnel: connecting to the API
+// server and upgrading the connection share the dial timeout, while the TLS
+// handshake in between gets the handshake timeout of its own. It follows
+// the phases through the httptrace hooks of the dial and, once a phase
+// overruns, cancels the dial and closes its connection, as the SPDY upgrade
+// doesn't watch the context. A zero timeout doesn't limit its phases.
+type dialDeadlines struct {
+	cancel    context.CancelCauseFunc
+	dial      time.Duration
+	handshake time.Duration
+
+	mu sync.Mutex
+	// left is what is left of the dial timeout as of since, unless in the
+	// TLS handshake.
+	left        time.Duration
+	since       time.Time
+	inHandshake bool
+	timer       *time.Timer
+	conn        net.Conn
+	cause       error
+	done        bool
+}
+
+// withDialDeadlines returns ctx with the phases of dials made with it
+// bounded by dial and handshake, and the deadlines to stop once done.
+func withDialDeadlines(ctx context.Context, dial, handshake time.Duration) (context.Context, *dialDeadlines) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	d := &dialDeadlines{cancel: cancel, dial: dial, handshake: handshake, left: dial, since: time.Now()}
+	d.mu.Lock()
+	d.enter(false)
+	d.mu.Unlock()
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.conn = info.Conn
+		},
+		TLSHandshakeStart: func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.enter(true)
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.enter(false)
+		},
+	}), d
+}
+
+// enter starts the TLS handshake or, if not handshake, goes back to
+// connecting or upgrading, failing the dial once its limit is up. The
+// caller must hold d.mu.
+func (d *dialDeadlines) enter(handshake bool) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if !d.inHandshake {
+		d.left -= time.Since(d.since)
+	}
+	d.inHandshake, d.since = handshake, time.Now()
+
+	limit, cause := d.left, fmt.Errorf("timed out after %v", d.dial)
+	if handshake {
+		limit, cause = d.handshake, fmt.Errorf("TLS handshake timed out after %v", d.handshake)
+	}
+	if d.done || (handshake && d.handshake <= 0) || (!handshake && d.dial <= 0) {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(max(limit, 0), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.done || d.timer != timer {
+			return
+		}
+		d.done, d.cause = true, cause
+		d.cancel(cause)
+		if d.conn != nil {
+			d.conn.Close()
+		}
+	})
+	d.timer = timer
+}
+
+// exceeded returns why the dial was cancelled if a phase overran, or nil.
+func (d *dialDeadlines) exceeded() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cause
+}
+
+// stop ends the deadlines once the dial returned, leaving its connection
+// open.
+func (d *dialDeadlines) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done = true
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	d.cancel(context.Canceled)
+}
+
+// negotiateTunnel upgrades a connection to the portforward URL target with
+// the tunnel protocol of k and returns it with the protocol used. Once a
+// WebSocket upgrade was refused and SPDY worked, later tunnels use SPDY
+// right away until the endpoint changes. Once both were refused, tunnels
+// for HTTP forwards go through the proxy subresource of the pod right away.
+func (k *kubeClient) negotiateTunnel(ctx context.Context, target *url.URL, cfg *rest.Config, keepalive time.Duration, http bool) (httpstream.Connection, string, error) {
+	if k.protocol == tunnelPodProxy || (http && k.proxyFallback.Load()) {
+		conn, err := podProxyTunnel(ctx, target, cfg)
+		return conn, tunnelPodProxy, err
+	}
+	if k.protocol == tunnelSPDY || k.spdyFallback.Load() {
+		conn, err := spdyTunnel(ctx, target, cfg, k.pins, keepalive)
+		if err == nil || k.protocol == tunnelSPDY || !http || !upgradeRefused(err) {
+			return conn, tunnelSPDY, err
+		}
+		return k.podProxyFallback(ctx, target, cfg, err)
+	}
+	conn, err := webSocketTunnel(ctx, target, cfg, k.pins, keepalive)
+	if err == nil || k.protocol == tunnelWebSocket || !upgradeRefused(err) {
+		return conn, tunnelWebSocket, err
+	}
+	logrus.Debugf("WebSocket tunnel to %s refused, falling back to SPDY: %v", cfg.Host, err)
+	conn, err = spdyTunnel(ctx, target, cfg, k.pins, keepalive)
+	if err == nil && !k.spdyFallback.Swap(true) {
+		logrus.Infof("API server %s doesn't accept WebSocket tunnels, using SPDY", cfg.Host)
+	}
+	if err != nil && http && upgradeRefused(err) {
+		return k.podProxyFallback(ctx, target, cfg, err)
+	}
+	return conn, tunnelSPDY, err
+}
+
+// podProxyFallback opens a tunnel through the proxy subresource of the pod
+// after the SPDY upgrade failed with upgradeErr.
+func (k *kubeClient) podProxyFallback(ctx context.Context, target *url.URL, cfg *rest.Config, upgradeErr error) (httpstream.Connection, string, error) {
+	logrus.Debugf("SPDY tunnel to %s refused, falling back to the pod proxy: %v", cfg.Host, upgradeErr)
+	conn, err := podProxyTunnel(ctx, target, cfg)
+	if err != nil {
+		return nil, tunnelPodProxy, fmt.Errorf("%v (pod proxy fallback: %v)", upgradeErr, err)
+	}
+	if !k.proxyFallback.Swap(true) {
+		logrus.Infof("API server %s doesn't accept WebSocket or SPDY tunnels, forwarding HTTP through its pod proxy", cfg.Host)
+	}
+	return conn, tunnelPodProxy, nil
+}
+
+// upgradeRefused reports whether err means the API server or a proxy in
+// front of it refused to upgrade the connection. The SPDY round tripper
+// doesn't wrap the response that refused the upgrade in an
+// UpgradeFailureError.
+func upgradeRefused(err error) bool {
+	return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err) ||
+		strings.Contains(err.Error(), "unable to upgrade connection")
+}
+
+// webSocketTunnel opens a tunnel with the WebSocket port-forward protocol
+// of Kubernetes 1.30 and later, which carries the SPDY streams over a
+// WebSocket connection so it passes proxies that only allow WebSockets.
+func webSocketTunnel(ctx context.Context, target *url.URL, cfg *rest.Config, pins certPins, keepalive time.Duration) (httpstream.Connection, error) {
+	tlsConfig, proxy, err := tunnelTLS(cfg, pins)
+	if err != nil {
+		return nil, err
+	}
+	upgrader := &websocket.RoundTripper{TLSConfig: tlsConfig, Proxier: proxy}
+	transport, err := rest.HTTPWrappersForConfig(cfg, upgrader)
+	if err != nil {
+		return nil, err
+	}
+	// WebSocket upgrades are GET requests (RFC 6455).
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.Negotiate(transport, upgrader, req, portforwardconst.WebsocketsSPDYTunnelingPortForwardV1)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := spdystream.NewClientConnectionWithPings(portforward.NewTunnelingConnection("client", ws), keepalive)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// spdyTunnel opens a tunnel with the SPDY port-forward protocol.
+func spdyTunnel(ctx context.Context, target *url.URL, cfg *rest.Config, pins certPins, keepalive time.Duration) (httpstream.Connection, error) {
+	transport, upgrader, err := tunnelRoundTripper(ctx, target, cfg, pins, keepalive)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	conn, _, err := spdy.Negotiate(upgrader, &http.Client{Transport: transport}, req, portforward.PortForwardProtocolV1Name)
+	return conn, err
+}
+
+// tunnelTLS returns the TLS config of tunnels to the API server of cfg,
+// verifying pins if any, and the proxy to reach it through.
+func tunnelTLS(cfg *rest.Config, pins certPins) (*tls.Config, func(*http.Request) (*url.URL, error), error) {
+	tlsConfig, err := rest.TLSConfigFor(cfg)
+	if pins != nil {
+		tlsConfig, err = pinnedTLSConfig(cfg, pins)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != nil {
+		proxy = cfg.Proxy
+	}
+	return tlsConfig, proxy, nil
+}
+
+// tunnelRoundTripper is spdy.RoundTripperFor, verifying the pins of the API
+// server during the TLS handshake and keeping the connection alive: the
+// SPDY connection is pinged and TCP keepalive probes are sent every
+// keepalive, so NAT gateways and VPNs don't drop idle tunnels and a dead
+// peer closes the tunnel instead of failing the next connection. It dials
+// target itself, reporting the connection and TLS handshake to the
+// httptrace hooks of ctx like the WebSocket dialer does.
+func tunnelRoundTripper(ctx context.Context, target *url.URL, cfg *rest.Config, pins certPins, keepalive time.Duration) (http.RoundTripper, spdy.Upgrader, error) {
+	tlsConfig, _, err := tunnelTLS(cfg, pins)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Without a TLS config the upgrade would skip verifying the server.
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		tlsConfig = tlsConfig.Clone()
+		verify := tlsConfig.VerifyConnection
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			trace.TLSHandshakeDone(cs, nil)
+			return nil
+		}
+	}
+
+	dialer := &net.Dialer{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     keepalive,
+			Interval: keepalive,
+			Count:    keepaliveProbes,
+		},
+	}
+	dial := func(ctx context.Context, _, addr string) (net.Conn, error) {
+		conn, err := dialAPIServer(ctx, cfg, addr, dialer)
+		if err != nil || trace == nil {
+			return conn, err
+		}
+		if trace.GotConn != nil {
+			trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+		}
+		if target.Scheme == "https" && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+		return conn, nil
+	}
+	upgrader, err := spdystream.NewRoundTripperWithConfig(spdystream.RoundTripperConfig{
+		UpgradeTransport: &http.Transport{TLSClientConfig: tlsConfig, DialContext: dial},
+		PingPeriod:       keepalive,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapper, err := rest.HTTPWrappersForConfig(cfg, upgrader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return wrapper, upgrader, nil
+}
+
+// Close tears down the underlying connection and every stream on it.
+func (t *tunnel) Close() error {
+	return t.conn.Close()
+}
+
+// Done is closed once the underlying connection has been closed.
+func (t *tunnel) Done() <-chan bool {
+	return t.conn.CloseChan()
+}
+
+// proxy copies data between conn and the given port of the pod until either
+// side closes the connection.
+func (t *tunnel) proxy(conn net.Conn, port string) error {
+	requestID := t.requestID.Add(1)
+
+	headers := http.Header{}
+	headers.Set(corev1.StreamType, corev1.StreamTypeError)
+	headers.Set(corev1.PortHeader, port)
+	headers.Set(corev1.PortForwardRequestIDHeader, strconv.FormatInt(requestID, 10))
+	errorStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("error creating error stream for port %s: %v", port, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+	defer t.conn.RemoveStreams(errorStream)
+
+	errorChan := make(chan error)
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			errorChan <- fmt.Errorf("error reading from error stream for port %s: %v", port, err)
+		case len(message) > 0:
+			errorChan <- fmt.Errorf("an error occurred forwarding port %s: %v", port, string(message))
+		}
+		close(errorChan)
+	}()
+
+	headers.Set(corev1.StreamType, corev1.StreamTypeData)
+	dataStream, err := t.conn.CreateStream(headers)
+	if err != nil {
+		return fmt.Errorf("error creating forwarding stream for port %s: %v", port, err)
+	}
+	defer t.conn.RemoveStreams(dataStream)
+
+	localError := make(chan struct{})
+	remoteDone := make(chan struct{})
+
+	go func() {
+		// Copy from the remote side to the local port.
+		_, _ = copyConn(conn, dataStream)
+		close(remoteDone)
+	}()
+
+	go func() {
+		// inform the server we're not sending any more data after copy unblocks
+		defer dataStream.Close()
+
+		// Copy from the local port to the remote side.
+		if _, err := copyConn(dataStream, conn); err != nil && !isClosedErr(err) {
+			close(localError)
+		}
+	}()
+
+	select {
+	case <-remoteDone:
+	case <-localError:
+	}
+
+	// Reset the data stream before waiting on the error stream, otherwise
+	// unsent data may keep the error stream from ever completing.
+	_ = dataStream.Reset()
+
+	return <-errorChan
+}
+
+// isClosedErr reports whether err is the result of using a closed network
+// connection, which is expected whenever either side hangs up.
+func isClosedErr(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "use of closed network connection")
+}
@@ -0,0 +1,253 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ValidationError lists every problem found in a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%d problem(s) found:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// configProblem is a problem Validate found, with the display name of the
+// context and the kind/name of the entry it is about, if any.
+type configProblem struct {
+	context  string
+	resource string
+	message  string
+}
+
+// binding is a local address:port claimed by an entry.
+type binding struct {
+	entry   string
+	address string
+	port    int
+}
+
+// Validate checks the configuration as a whole: port numbers must be in
+// range and no two entries may bind overlapping local addresses on the same
+// port. All problems are reported together.
+func (c *Config) Validate() error {
+	problems := c.validate()
+	if len(problems) == 0 {
+		return nil
+	}
+	err := &ValidationError{}
+	for _, p := range problems {
+		err.Problems = append(err.Problems, p.message)
+	}
+	return err
+}
+
+// validate returns the problems of the configuration, see Validate.
+func (c *Config) validate() []configProblem {
+	var problems []configProblem
+	var bindings []binding
+
+	for _, color := range c.LogPalette {
+		if err := validateColor(color); err != nil {
+			problems = append(problems, configProblem{message: fmt.Sprintf("log_palette: %v", err)})
+		}
+	}
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		if ctx.Color != "" {
+			if err := validateColor(ctx.Color); err != nil {
+				problems = append(problems, configProblem{message: fmt.Sprintf("context %s: color: %v", ctx.Name, err)})
+			}
+		}
+		if _, err := parsePins(ctx.PinSHA256); err != nil {
+			problems = append(problems, configProblem{message: fmt.Sprintf("context %s: pin_sha256: %v", ctx.Name, err)})
+		}
+		if _, err := contextProxy(ctx); err != nil {
+			problems = append(problems, configProblem{message: fmt.Sprintf("context %s: %v", ctx.Name, err)})
+		}
+		switch ctx.TunnelProtocol {
+		case "", tunnelWebSocket, tunnelSPDY, tunnelPodProxy:
+		default:
+			problems = append(problems, configProblem{message: fmt.Sprintf("context %s: tunnel_protocol must be %q, %q or %q", ctx.Name, tunnelWebSocket, tunnelSPDY, tunnelPodProxy)})
+		}
+		if ctx.Approval != nil {
+			if err := ctx.Approval.validate(); err != nil {
+				problems = append(problems, configProblem{message: fmt.Sprintf("context %s: %v", ctx.Name, err)})
+			}
+		}
+	}
+
+	if c.MetricsSnapshot != nil {
+		if err := c.MetricsSnapshot.validate(); err != nil {
+			problems = append(problems, configProblem{message: err.Error()})
+		}
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			problems = append(problems, configProblem{message: fmt.Sprintf("metrics_address: %v", err)})
+		}
+	}
+	if c.CrashReports != nil {
+		if err := c.CrashReports.validate(); err != nil {
+			problems = append(problems, configProblem{message: err.Error()})
+		}
+	}
+	if c.EndpointsFile != nil {
+		if err := c.EndpointsFile.validate(); err != nil {
+			problems = append(problems, configProblem{message: err.Error()})
+		}
+	}
+
+	names := map[string]string{}
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		if ctx.Alias != "" {
+			if other, ok := names[ctx.Alias]; ok {
+				problems = append(problems, configProblem{message: fmt.Sprintf("context %s: alias %q is already used by context %s", ctx.Name, ctx.Alias, other)})
+			}
+			names[ctx.Alias] = ctx.Name
+		}
+	}
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		if other, ok := names[ctx.Name]; ok && other != ctx.Name {
+			problems = append(problems, configProblem{message: fmt.Sprintf("context %s: name is already used as alias of context %s", ctx.Name, other)})
+		}
+	}
+
+	for i := range c.Contexts {
+		ctx := &c.Contexts[i]
+		// Invalid entries are reported while the others are still checked
+		// for collisions.
+		entries, invalid, err := ctx.collectEntries(c)
+		if err != nil {
+			problems = append(problems, configProblem{context: ctx.displayName(), message: fmt.Sprintf("context %s: %v", ctx.displayName(), err)})
+			continue
+		}
+		for _, inv := range invalid {
+			problems = append(problems, configProblem{ctx.displayName(), inv.resource, fmt.Sprintf("context %s: %v", ctx.displayName(), inv.err)})
+		}
+
+		for _, e := range entries {
+			name := fmt.Sprintf("%s/%s/%s", e.Context, e.Namespace, e.Resource())
+			problem := func(message string) configProblem {
+				return configProblem{e.Context, e.Resource(), message}
+			}
+			if len(e.Ports) == 0 {
+				problems = append(problems, problem(fmt.Sprintf("%s: no ports configured", name)))
+			}
+			for _, p := range e.Ports {
+				if _, err := parsePort(p.Target, false); err != nil {
+					problems = append(problems, problem(fmt.Sprintf("%s: target port: %v", name, err)))
+				}
+				source, err := parsePort(p.Source, true)
+				if err != nil {
+					problems = append(problems, problem(fmt.Sprintf("%s: source port: %v", name, err)))
+					continue
+				}
+				if source == 0 {
+					// randomly assigned, can't collide
+					continue
+				}
+
+				b := binding{entry: name, address: e.portAddress(p), port: source}
+				for _, other := range bindings {
+					if other.port == b.port && addressesOverlap(other.address, b.address) {
+						problems = append(problems, problem(fmt.Sprintf("%s: %s conflicts with %s (%s)",
+							name, net.JoinHostPort(b.address, p.Source), other.entry, net.JoinHostPort(other.address, strconv.Itoa(other.port)))))
+					}
+				}
+				bindings = append(bindings, b)
+			}
+		}
+	}
+
+	if desired, err := desiredEntries(c); err == nil {
+		for _, p := range dependencyProblems(desired) {
+			problems = append(problems, configProblem{message: p})
+		}
+	}
+	return problems
+}
+
+// dependencyProblems reports depends_on references that match no entry
+// and dependency cycles.
+func dependencyProblems(desired map[string]desiredEntry) []string {
+	var problems []string
+	entries := map[string]entry{}
+	keys := make([]string, 0, len(desired))
+	for key, d := range desired {
+		entries[key] = d.entry
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, ref := range entries[key].DependsOn {
+			found := false
+			for other, o := range entries {
+				if other != key && o.matches(ref) {
+					found = true
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: depends_on: no entry matches %q", key, ref))
+			}
+		}
+	}
+	if _, cyclic := shutdownWaves(keys, dependencies(entries)); len(cyclic) > 0 {
+		problems = append(problems, fmt.Sprintf("depends_on: dependency cycle involving %s", strings.Join(cyclic, ", ")))
+	}
+	return problems
+}
+
+// parsePort parses a port number. An empty or zero port is accepted when
+// allowZero is set, meaning a random local port.
+func parsePort(s string, allowZero bool) (int, error) {
+	if s == "" && allowZero {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if n == 0 && allowZero {
+		return 0, nil
+	}
+	if n < 1 || n > 65535 {
+		return 0, fmt.Errorf("%d is out of range (1-65535)", n)
+	}
+	return n, nil
+}
+
+// addressesOverlap reports whether listeners on a and b would compete for
+// the same port: identical addresses, or either one being a wildcard.
+func addressesOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if isWildcard(a) || isWildcard(b) {
+		return true
+	}
+	ipA, ipB := resolveBindIP(a), resolveBindIP(b)
+	return ipA != nil && ipB != nil && ipA.Equal(ipB)
+}
+
+func isWildcard(address string) bool {
+	if address == "" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsUnspecified()
+}
+
+func resolveBindIP(address string) net.IP {
+	if address == "localhost" {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	return net.ParseIP(address)
+}
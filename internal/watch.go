@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// watchSettle is how long a watched file must stay unchanged before it is
+// reloaded. Editors and tools like `aws eks update-kubeconfig` write files
+// in several steps.
+const watchSettle = 500 * time.Millisecond
+
+// watchKubeConfig calls reload whenever the kubeconfig at path changes,
+// until ctx is cancelled.
+func watchKubeConfig(ctx context.Context, path string, reload func()) {
+	watchFile(ctx, "kubeconfig", path, reload)
+}
+
+// WatchConfig calls reload whenever the config file at path or one of the
+// files matching its include patterns changes, until ctx is cancelled. The
+// patterns are read again after every change, so added includes are
+// watched too. A config read from stdin never changes.
+func WatchConfig(ctx context.Context, path string, reload func()) {
+	if path == StdinConfig {
+		return
+	}
+	watchFiles(ctx, "config file", func() []string { return configWatchPatterns(path) }, reload)
+}
+
+// configWatchPatterns returns path and the include patterns of the config
+// file at path and of the files it includes, made absolute. Files that
+// can't be read or decoded just add no patterns.
+func configWatchPatterns(path string) []string {
+	patterns := []string{filepath.Clean(path)}
+	seen := map[string]bool{}
+	var add func(path string)
+	add = func(path string) {
+		abs, err := filepath.Abs(path)
+		if err != nil || seen[abs] {
+			return
+		}
+		seen[abs] = true
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return
+		}
+		config, _, err := decodeConfig(path, data)
+		if err != nil {
+			return
+		}
+		for _, pattern := range config.Include {
+			pattern = expandHome(pattern)
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			patterns = append(patterns, filepath.Clean(pattern))
+			matches, _ := filepath.Glob(pattern)
+			for _, match := range matches {
+				add(match)
+			}
+		}
+	}
+	add(path)
+	return patterns
+}
+
+// watchFile calls reload whenever the file at path, described by what in
+// log messages, changes until ctx is cancelled.
+func watchFile(ctx context.Context, what, path string, reload func()) {
+	path = filepath.Clean(path)
+	watchFiles(ctx, what, func() []string { return []string{path} }, reload)
+}
+
+// watchFiles calls reload whenever a file matching one of the glob
+// patterns returned by patterns, described by what in log messages,
+// changes until ctx is cancelled. Patterns are asked for again after every
+// reload. The parent directories are watched rather than the files
+// themselves, so files replaced by rename, and files added to a directory,
+// are still picked up.
+func watchFiles(ctx context.Context, what string, patterns func() []string, reload func()) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.Warnf("Not watching %s: %v", what, err)
+		return
+	}
+	defer w.Close()
+
+	current := patterns()
+	watched := map[string]bool{}
+	update := func() {
+		dirs := map[string]bool{}
+		for _, pattern := range current {
+			dir := filepath.Dir(pattern)
+			if !strings.ContainsAny(dir, "*?[") {
+				dirs[dir] = true
+				continue
+			}
+			matches, _ := filepath.Glob(dir)
+			for _, match := range matches {
+				dirs[match] = true
+			}
+		}
+		for dir := range watched {
+			if !dirs[dir] {
+				_ = w.Remove(dir)
+				delete(watched, dir)
+			}
+		}
+		for dir := range dirs {
+			if watched[dir] {
+				continue
+			}
+			if err := w.Add(dir); err != nil {
+				logrus.Warnf("Not watching %s directory %s: %v", what, dir, err)
+				continue
+			}
+			watched[dir] = true
+		}
+	}
+	update()
+	if len(watched) == 0 {
+		return
+	}
+
+	settle := time.NewTimer(watchSettle)
+	settle.Stop()
+	defer settle.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !matchesAny(current, filepath.Clean(ev.Name)) || !ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) {
+				continue
+			}
+			settle.Reset(watchSettle)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			logrus.Debugf("%s watch error: %v", what, err)
+		case <-settle.C:
+			reload()
+			current = patterns()
+			update()
+		}
+	}
+}
+
+// matchesAny reports whether path matches one of the glob patterns.
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok || pattern == path {
+			return true
+		}
+	}
+	return false
+}
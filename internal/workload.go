@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// workloadKind returns the entry kind of a workload kind as accepted by
+// kubectl, e.g. "deployment" or "deploy".
+func workloadKind(kind string) (string, bool) {
+	switch kind {
+	case kindDeployment, "deployment", "deployments":
+		return kindDeployment, true
+	case kindStatefulSet, "statefulset", "statefulsets":
+		return kindStatefulSet, true
+	case kindReplicaSet, "replicaset", "replicasets":
+		return kindReplicaSet, true
+	}
+	return "", false
+}
+
+// revisionAnnotation holds the rollout revision of Deployments and their
+// ReplicaSets.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
+// resolveWorkloadPod returns the name of the pod backing the workload e
+// like resolvePod, trying the selectors of workloadSelectors in turn.
+func resolveWorkloadPod(ctx context.Context, core coreClient, informer *podInformer, e entry, failed map[string]time.Time) (string, error) {
+	selectors, err := workloadSelectors(ctx, core, e)
+	if err != nil {
+		return "", err
+	}
+	tiers := topologyTiers(ctx, core, e)
+	var pods []corev1.Pod
+	for _, selector := range selectors {
+		if pods, err = listPods(ctx, core, informer, e, selector); err != nil {
+			return "", fmt.Errorf("failed to list pods for %s: %w", e.describe(), err)
+		}
+		if name, err := pickPod(pods, e, failed, tiers); err == nil {
+			return name, nil
+		}
+	}
+	if len(pods) == 0 {
+		return "", fmt.Errorf("%w for %s%s", errNoPods, e.describe(), e.nodeSuffix())
+	}
+	return pickPod(pods, e, failed, tiers)
+}
+
+// workloadSelectors returns the label selectors of the pods of the workload
+// e forwards to, most specific first. For a Deployment the pods of its
+// current ReplicaSet come first, then every pod of the Deployment, so a
+// rollout that hasn't produced a ready pod yet still reaches the old ones.
+func workloadSelectors(ctx context.Context, core coreClient, e entry) ([]string, error) {
+	var selector *metav1.LabelSelector
+	switch e.Kind {
+	case kindDeployment:
+		deploy, err := core.getDeployment(ctx, e.Namespace, e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get deployment %s: %w", e.Name, err)
+		}
+		all, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("deployment %s: %v", e.Name, err)
+		}
+		rss, err := core.listReplicaSets(ctx, e.Namespace, metav1.ListOptions{LabelSelector: all.String()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list replicasets of deployment %s: %w", e.Name, err)
+		}
+		for _, rs := range rss.Items {
+			if !metav1.IsControlledBy(&rs, deploy) || rs.Annotations[revisionAnnotation] != deploy.Annotations[revisionAnnotation] {
+				continue
+			}
+			if current, err := metav1.LabelSelectorAsSelector(rs.Spec.Selector); err == nil {
+				return []string{current.String(), all.String()}, nil
+			}
+		}
+		return []string{all.String()}, nil
+	case kindStatefulSet:
+		sts, err := core.getStatefulSet(ctx, e.Namespace, e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get statefulset %s: %w", e.Name, err)
+		}
+		selector = sts.Spec.Selector
+	case kindReplicaSet:
+		rs, err := core.getReplicaSet(ctx, e.Namespace, e.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get replicaset %s: %w", e.Name, err)
+		}
+		selector = rs.Spec.Selector
+	default:
+		return nil, fmt.Errorf("%s is not a workload", e.Resource())
+	}
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", e.describe(), err)
+	}
+	return []string{s.String()}, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/besrabasant/k10ls/internal"
+)
+
+// upCommand starts the forwards in the foreground, or in the background
+// with -d.
+func upCommand(args []string) error {
+	fs := flag.NewFlagSet("up", flag.ExitOnError)
+	detach := fs.Bool("d", false, "Run in the background")
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	logFile := fs.String("log-file", "", "Log file used with -d (default: next to the control socket)")
+	_ = fs.Parse(args)
+
+	daemonArgs := []string{"-config", *configFile}
+	if *env != "" {
+		daemonArgs = append(daemonArgs, "-env", *env)
+	}
+	if !*detach {
+		runDaemon(daemonArgs)
+		return nil
+	}
+
+	socket := controlSocketPath(*configFile)
+	if resp, err := internal.SendControl(socket, internal.ControlRequest{Command: "info"}); err == nil {
+		return fmt.Errorf("k10ls is already running (pid %d)", resp.Info.PID)
+	}
+
+	if *logFile == "" {
+		*logFile = strings.TrimSuffix(socket, filepath.Ext(socket)) + ".log"
+	}
+	dir, _ := os.Getwd()
+	pid, err := startDetached(dir, daemonArgs, *logFile)
+	if err != nil {
+		return err
+	}
+	if err := waitForDaemon(socket, func(info *internal.DaemonInfo) bool { return info.PID == pid }); err != nil {
+		return fmt.Errorf("%v, see %s", err, *logFile)
+	}
+	fmt.Printf("k10ls started in the background (pid %d), logging to %s\n", pid, *logFile)
+	return nil
+}
+
+// downCommand stops the running instance.
+func downCommand(args []string) error {
+	fs := flag.NewFlagSet("down", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	_ = fs.Parse(args)
+
+	socket := controlSocketPath(*configFile)
+	resp, err := internal.SendControl(socket, internal.ControlRequest{Command: "info"})
+	if err != nil {
+		return err
+	}
+	if _, err := internal.SendControl(socket, internal.ControlRequest{Command: "shutdown"}); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		if _, err := internal.SendControl(socket, internal.ControlRequest{Command: "info"}); err != nil {
+			fmt.Printf("k10ls stopped (pid %d)\n", resp.Info.PID)
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("k10ls (pid %d) did not stop within a minute", resp.Info.PID)
+}
+
+// restartCommand restarts the given entries of the running instance or,
+// without entries, the instance itself with the arguments it was started
+// with. Where supported, the new process takes over the listening sockets
+// so local ports never go away.
+func restartCommand(args []string) error {
+	fs := flag.NewFlagSet("restart", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	logFile := fs.String("log-file", "", "Log file of the new process (default: next to the control socket)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls restart [flags] [entry...]")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	socket := controlSocketPath(*configFile)
+	if fs.NArg() > 0 {
+		return entryCommand(socket, "restart", "Restarted", fs.Args())
+	}
+	resp, err := internal.SendControl(socket, internal.ControlRequest{Command: "info"})
+	if err != nil {
+		return err
+	}
+	old := resp.Info
+
+	if *logFile == "" {
+		*logFile = strings.TrimSuffix(socket, filepath.Ext(socket)) + ".log"
+	}
+
+	var daemonArgs []string
+	for _, a := range old.Args {
+		if a != "-takeover" && a != "--takeover" {
+			daemonArgs = append(daemonArgs, a)
+		}
+	}
+	if runtime.GOOS == "windows" {
+		if err := downCommand([]string{"-config", *configFile}); err != nil {
+			return err
+		}
+	} else {
+		daemonArgs = append(daemonArgs, "-takeover")
+	}
+
+	pid, err := startDetached(old.Dir, daemonArgs, *logFile)
+	if err != nil {
+		return err
+	}
+	if err := waitForDaemon(socket, func(info *internal.DaemonInfo) bool { return info.PID == pid }); err != nil {
+		return fmt.Errorf("%v, see %s", err, *logFile)
+	}
+	fmt.Printf("k10ls restarted (pid %d → %d)\n", old.PID, pid)
+	return nil
+}
+
+// stopCommand stops the given entries of the running instance until they
+// are restarted.
+func stopCommand(args []string) error {
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls stop [flags] entry...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return entryCommand(controlSocketPath(*configFile), "stop", "Stopped", fs.Args())
+}
+
+// entryCommand sends command for the entries refs to the instance on
+// socket and prints the entries it acted on.
+func entryCommand(socket, command, done string, refs []string) error {
+	resp, err := internal.SendControl(socket, internal.ControlRequest{Command: command, Args: refs})
+	if err != nil {
+		return err
+	}
+	for _, key := range resp.Entries {
+		fmt.Printf("%s %s\n", done, key)
+	}
+	return nil
+}
+
+// startDetached starts k10ls with args in the background, detached from
+// the terminal, and returns its pid.
+func startDetached(dir string, args []string, logFile string) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to locate k10ls binary: %v", err)
+	}
+	out, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = detachAttr()
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("failed to start k10ls: %v", err)
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+	return pid, nil
+}
+
+// waitForDaemon polls the control socket until ready reports true for the
+// instance answering on it.
+func waitForDaemon(socket string, ready func(*internal.DaemonInfo) bool) error {
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := internal.SendControl(socket, internal.ControlRequest{Command: "info"})
+		if err == nil && ready(resp.Info) {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("k10ls did not come up within 15s")
+}
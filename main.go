@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/BurntSushi/toml"
 	"github.com/besrabasant/k10ls/internal"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -15,10 +20,22 @@ import (
 	klog "k8s.io/klog/v2"
 )
 
+// levelBeforeDebug is the log level restored when debug logging is toggled
+// off again.
+var levelBeforeDebug = logrus.InfoLevel
+
+// version is set at build time with -ldflags "-X main.version=<tag>".
+var version = "dev"
+
 func init() {
-	logrus.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-		ForceColors:   true,
+	// Redact bearer tokens, passwords and URL userinfo from every log line.
+	logrus.SetFormatter(&internal.RedactingFormatter{
+		Formatter: &internal.ContextColorFormatter{
+			Formatter: &logrus.TextFormatter{
+				FullTimestamp: true,
+				ForceColors:   true,
+			},
+		},
 	})
 
 	// Silence verbose logs emitted by the Kubernetes libraries. By default
@@ -38,37 +55,376 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				logrus.Fatalf("%v", err)
+			}
+			return
+		}
+	}
+
+	runDaemon(os.Args[1:])
+}
+
+// runDaemon starts every configured forward and blocks until the process
+// is asked to shut down.
+func runDaemon(args []string) {
 	// Set up CLI and config file handling with Viper
-	configFile := flag.String("config", "config.toml", "Path to the config file")
-	flag.Parse()
+	flags := flag.NewFlagSet("k10ls", flag.ExitOnError)
+	configFile := flags.String("config", "config.toml", "Path to the config file, TOML or JSON, or - to read it from stdin")
+	env := flags.String("env", "", "Environment overlay from the config file to apply")
+	takeover := flags.Bool("takeover", false, "Take over the listening sockets of a running instance")
+	watch := flags.Bool("watch", true, "Reload the config file when it changes")
+	lowMemory := flags.Bool("low-memory", false, "Trade speed for memory on small hosts")
+	record := flags.String("record", "", "Record every log line, including debug ones, to this file for bug reports")
+	filters := addEntryFilters(flags, "forward")
+	chaos := flags.String("chaos", "", "Drop tunnels and fail API requests at random, e.g. drop=2,api_error=0.1")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage of k10ls:")
+		printDefaults(flags)
+	}
+	_ = flags.Parse(args)
 
-	viper.SetConfigFile(*configFile)
-	viper.AutomaticEnv()
-	if err := viper.ReadInConfig(); err != nil {
-		logrus.Fatalf("Error reading config file: %v", err)
+	if err := recordSession(*record); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+	if err := enableChaos(*chaos); err != nil {
+		logrus.Fatalf("%v", err)
 	}
 
-	var config internal.Config
-	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
-		logrus.Fatalf("Error parsing TOML config: %v", err)
+	if *lowMemory {
+		internal.EnableLowMemory()
 	}
 
-	if config.GlobalKubeConfig == "" {
-		homedir, err := os.UserHomeDir()
+	load := func() (*internal.Config, error) {
+		config, err := loadConfig(*configFile, *env)
+		if err != nil {
+			return nil, err
+		}
+		filters.apply(config)
+		return config, nil
+	}
+	config, err := load()
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+
+	internal.ConfigureCrashReports(config, version)
+
+	if err := internal.OpenAuditLog(config.AuditLog); err != nil {
+		logrus.Fatalf("%v", err)
+	}
+
+	if config.FileSD != "" {
+		if err := internal.EnableFileSD(config.FileSD); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	if config.EndpointsFile != nil {
+		if err := internal.EnableEndpointsFile(config.EndpointsFile); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+
+	if config.MetricsSnapshot != nil {
+		go internal.WriteMetricsSnapshots(ctx, config.MetricsSnapshot)
+	}
 
+	if config.ControlSocket == "" {
+		config.ControlSocket = internal.DefaultControlSocket()
+	}
+	// Inherited sockets no entry of the applied configuration listens on are
+	// closed by the manager.
+	if _, err := internal.InheritSystemdListeners(); err != nil {
+		logrus.Fatalf("Socket activation failed: %v", err)
+	}
+	if *takeover {
+		if err := internal.TakeOver(config.ControlSocket); err != nil {
+			logrus.Fatalf("Socket takeover failed: %v", err)
+		}
+	}
+
+	manager := internal.NewManager()
+	if _, err := manager.Apply(config); err != nil {
+		logrus.Fatalf("Invalid configuration: %v", err)
+	}
+	if config.MetricsAddress != "" {
+		if err := internal.ServeMetrics(ctx, config.MetricsAddress, manager.Status); err != nil {
+			logrus.Fatalf("%v", err)
+		}
+	}
+	// Reloads are triggered by SIGHUP, the control socket and the config
+	// watcher, so they are serialized.
+	var reloadMu sync.Mutex
+	reload := func() (*internal.ConfigDiff, error) {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		newConfig, err := load()
+		if err != nil {
+			return nil, err
+		}
+		newConfig.ControlSocket = config.ControlSocket
+		// A new audit log is opened first so a path that can't be opened
+		// rejects the reload.
+		if err := internal.OpenAuditLog(newConfig.AuditLog); err != nil {
+			return nil, err
+		}
+		diff, err := manager.Apply(newConfig)
 		if err != nil {
-			logrus.Fatal("error resolving user home directory.")
-			os.Exit(1)
+			_ = internal.OpenAuditLog(config.AuditLog)
+			return nil, err
 		}
+		config = newConfig
+		internal.ConfigureCrashReports(config, version)
+		if err := internal.EnableFileSD(config.FileSD); err != nil {
+			logrus.Errorf("%v", err)
+		}
+		if err := internal.EnableEndpointsFile(config.EndpointsFile); err != nil {
+			logrus.Errorf("%v", err)
+		}
+		logrus.Infof("Configuration reloaded:\n%s", diff)
+		applyGateway(ctx, config)
+		return diff, nil
+	}
 
-		config.GlobalKubeConfig = path.Join(homedir, ".kube", "config")
+	hup := make(chan os.Signal, 1)
+	notifyReload(hup)
+	go func() {
+		for range hup {
+			if _, err := reload(); err != nil {
+				logrus.Errorf("Reload failed: %v", err)
+			}
+		}
+	}()
+
+	if *watch {
+		go internal.WatchConfig(ctx, *configFile, func() {
+			if _, err := reload(); err != nil {
+				logrus.Errorf("Reload failed: %v", err)
+			}
+		})
+	}
+
+	status, debug := make(chan os.Signal, 1), make(chan os.Signal, 1)
+	notifyDiagnostics(status, debug)
+	go func() {
+		for {
+			select {
+			case <-status:
+				internal.LogStatus()
+			case <-debug:
+				toggleDebug()
+			}
+		}
+	}()
+
+	applyGateway(ctx, config)
+
+	control, err := internal.ListenControl(config.ControlSocket)
+	if err != nil {
+		logrus.Warnf("Control socket disabled: %v", err)
+	} else {
+		dir, _ := os.Getwd()
+		control.Info = internal.DaemonInfo{
+			PID:     os.Getpid(),
+			Version: version,
+			Args:    args,
+			Dir:     dir,
+			Config:  *configFile,
+			Started: time.Now(),
+		}
+		control.OnReload = reload
+		control.OnPlan = func() (*internal.ConfigDiff, error) {
+			newConfig, err := load()
+			if err != nil {
+				return nil, err
+			}
+			newConfig.ControlSocket = config.ControlSocket
+			return manager.Plan(newConfig)
+		}
+		control.OnStatus = manager.Status
+		control.OnRestart = manager.Restart
+		control.OnStop = manager.Stop
+		control.OnShutdown = func() {
+			logrus.Info("Shutdown requested over the control socket")
+			cancel()
+		}
+		control.OnHandOff = func() {
+			logrus.Info("Listeners handed over to a new process, draining active connections")
+			if !internal.WaitForConnections(30 * time.Second) {
+				logrus.Warn("Timed out draining connections")
+			}
+			cancel()
+		}
+		go control.Serve(ctx)
 	}
 
-	// Iterate over each context
-	for _, ctx := range config.Contexts {
-		go internal.Portforward(&ctx, &config)
+	if config.LeaderElection != nil && config.LeaderElection.Enabled {
+		if err := internal.RunWithLeaderElection(ctx, config, manager.Run); err != nil {
+			logrus.Fatalf("Leader election failed: %v", err)
+		}
+		return
 	}
 
 	// Keep the process alive
-	select {}
+	manager.Run(ctx)
+}
+
+// loadConfig reads and validates the config file, applying the environment
+// overlay env if set.
+func loadConfig(configFile, env string) (*internal.Config, error) {
+	if configFile != internal.StdinConfig {
+		viper.SetConfigFile(configFile)
+		viper.AutomaticEnv()
+		if err := viper.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("Error reading config file: %v", err)
+		}
+	}
+
+	config, err := internal.ReadConfig(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config: %v", err)
+	}
+
+	if env != "" {
+		if err := config.ApplyEnv(env); err != nil {
+			return nil, fmt.Errorf("Error applying environment: %v", err)
+		}
+	}
+
+	if err := config.ApplyGateway(); err != nil {
+		return nil, err
+	}
+
+	if config.GlobalKubeConfig == "" {
+		config.GlobalKubeConfig = defaultKubeConfig()
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	internal.SetLogColors(config)
+	return config, nil
+}
+
+// toggleDebug switches between debug logging and the previous log level.
+func toggleDebug() {
+	if internal.LogLevel() < logrus.DebugLevel {
+		levelBeforeDebug = internal.LogLevel()
+		internal.SetLogLevel(logrus.DebugLevel)
+	} else {
+		internal.SetLogLevel(levelBeforeDebug)
+	}
+	logrus.Warnf("Log level set to %s", internal.LogLevel())
+}
+
+// entryFilters are the flags restricting the entries of the config to
+// those of some contexts, namespaces or tags.
+type entryFilters struct {
+	context, namespace, only, exclude *string
+}
+
+// addEntryFilters adds the -context, -namespace, -only and -exclude flags
+// to fs, describing what is done with the entries selected as verb.
+func addEntryFilters(fs *flag.FlagSet, verb string) entryFilters {
+	return entryFilters{
+		context:   fs.String("context", "", "Only "+verb+" entries of these comma separated contexts"),
+		namespace: fs.String("namespace", "", "Only "+verb+" entries in these comma separated namespaces"),
+		only:      fs.String("only", "", "Only "+verb+" entries with one of these comma separated tags"),
+		exclude:   fs.String("exclude", "", "Don't "+verb+" entries with one of these comma separated tags"),
+	}
+}
+
+// apply removes the entries not selected by the flags from config.
+func (f entryFilters) apply(config *internal.Config) {
+	if *f.context == "" && *f.namespace == "" && *f.only == "" && *f.exclude == "" {
+		return
+	}
+	config.FilterScope(internal.ParseList(*f.context), internal.ParseList(*f.namespace))
+	config.FilterTags(internal.ParseList(*f.only), internal.ParseList(*f.exclude))
+	if len(config.Contexts) == 0 {
+		logrus.Warn("No entries match the -context, -namespace, -only and -exclude flags")
+	}
+}
+
+// enableChaos enables the failure injection of the -chaos flag, if set.
+func enableChaos(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	c, err := internal.ParseChaos(spec)
+	if err != nil {
+		return err
+	}
+	internal.EnableChaos(c)
+	return nil
+}
+
+// hiddenFlags are left out of the usage of commands: -chaos is meant for
+// testing k10ls and setups around it, not for everyday use.
+var hiddenFlags = map[string]bool{"chaos": true}
+
+// printDefaults prints the flags of fs like fs.PrintDefaults, except for
+// the hidden ones.
+func printDefaults(fs *flag.FlagSet) {
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(fs.Output())
+	fs.VisitAll(func(f *flag.Flag) {
+		if !hiddenFlags[f.Name] {
+			visible.Var(f.Value, f.Name, f.Usage)
+			visible.Lookup(f.Name).DefValue = f.DefValue
+		}
+	})
+	visible.PrintDefaults()
+}
+
+// recordSession starts recording the log to path, if set, beginning with
+// what is running where.
+func recordSession(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := internal.RecordSession(path); err != nil {
+		return err
+	}
+	logrus.Debugf("Recording session to %s: k10ls %s on %s/%s, arguments %q", path, version, runtime.GOOS, runtime.GOARCH, os.Args[1:])
+	return nil
+}
+
+// defaultKubeConfig returns $KUBECONFIG, which may list several files, or
+// ~/.kube/config. It returns an empty path when running inside a cluster
+// without a local kubeconfig so that the in-cluster config is used instead.
+func defaultKubeConfig() string {
+	if env := os.Getenv("KUBECONFIG"); env != "" {
+		return env
+	}
+	homedir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	kubeconfig := path.Join(homedir, ".kube", "config")
+	if _, err := os.Stat(kubeconfig); err == nil || os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return kubeconfig
+	}
+	return ""
+}
+
+// applyGateway publishes the gateway Service when gateway mode asks for it.
+func applyGateway(ctx context.Context, config *internal.Config) {
+	gw := config.Gateway
+	if gw == nil || !gw.Enabled || !gw.Apply {
+		return
+	}
+	if err := internal.ApplyGatewayService(ctx, config); err != nil {
+		logrus.Errorf("%v", err)
+		return
+	}
+	logrus.Info("Gateway service applied")
 }
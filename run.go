@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/besrabasant/k10ls/internal"
+	"github.com/sirupsen/logrus"
+)
+
+// runCommand starts the configured forwards, waits for them to be ready and
+// runs a command, stopping the forwards once it exits.
+func runCommand(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configFile := fs.String("config", "config.toml", "Path to the config file")
+	env := fs.String("env", "", "Environment overlay from the config file to apply")
+	waitFor := fs.String("wait-for", "all", "Forwards that must be ready before the command starts: all, any, or a comma separated list of entries")
+	waitTimeout := fs.Duration("wait-timeout", 30*time.Second, "How long to wait for the forwards to be ready")
+	filters := addEntryFilters(fs, "forward")
+	record := fs.String("record", "", "Record every log line, including debug ones, to this file for bug reports")
+	chaos := fs.String("chaos", "", "Drop tunnels and fail API requests at random, e.g. drop=2,api_error=0.1")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: k10ls run [flags] -- command [args...]")
+		printDefaults(fs)
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command given")
+	}
+	if err := recordSession(*record); err != nil {
+		return err
+	}
+	if err := enableChaos(*chaos); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(*configFile, *env)
+	if err != nil {
+		return err
+	}
+	filters.apply(config)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	runCtx, cancel := context.WithCancel(context.Background())
+
+	manager := internal.NewManager()
+	if _, err := manager.Apply(config); err != nil {
+		cancel()
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		manager.Run(runCtx)
+	}()
+	shutdown := func() {
+		cancel()
+		<-done
+	}
+
+	if err := manager.WaitReady(ctx, *waitFor, *waitTimeout); err != nil {
+		shutdown()
+		return fmt.Errorf("readiness barrier not met: %v", err)
+	}
+	logrus.Infof("Forwards ready, running %s", fs.Arg(0))
+
+	cmd := exec.Command(fs.Arg(0), fs.Args()[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	shutdown()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	return err
+}
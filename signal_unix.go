@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload delivers SIGHUP to ch, which reloads the configuration.
+func notifyReload(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGHUP)
+}
+
+// notifyDiagnostics delivers SIGUSR1, which logs the status of every
+// forward, to status and SIGUSR2, which toggles debug logging, to debug.
+func notifyDiagnostics(status, debug chan<- os.Signal) {
+	signal.Notify(status, syscall.SIGUSR1)
+	signal.Notify(debug, syscall.SIGUSR2)
+}
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// notifyReload is a no-op on Windows, which has no SIGHUP. Use
+// `k10ls reload` instead.
+func notifyReload(ch chan<- os.Signal) {}
+
+// notifyDiagnostics is a no-op on Windows, which has no SIGUSR1 or
+// SIGUSR2.
+func notifyDiagnostics(status, debug chan<- os.Signal) {}